@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -41,9 +42,10 @@ func init() {
 	// Define flags
 	rootCmd.Flags().StringP("config", "c", "", "the filepath for config file (json, yaml, toml)")
 	rootCmd.Flags().StringP("target", "t", "", "the remote server url, ex: http://localhost:8080/suo5.jsp")
-	rootCmd.Flags().StringP("listen", "l", defaultConfig.Listen, "listen address of socks5 server")
+	rootCmd.Flags().StringP("listen", "l", defaultConfig.Listen, "listen address of socks5, socks4 and http proxy server")
 	rootCmd.Flags().StringP("method", "m", defaultConfig.Method, "http request method")
 	rootCmd.Flags().StringP("redirect", "r", defaultConfig.RedirectURL, "redirect to the url if host not matched, used to bypass load balance")
+	rootCmd.Flags().StringArray("redirect-chain", nil, "further redirect urls after --redirect, the request is relayed through each of them in order, can be repeated")
 	rootCmd.Flags().Bool("no-auth", defaultConfig.NoAuth, "disable socks5 authentication")
 	rootCmd.Flags().String("auth", "", "socks5 creds, username:password, leave empty to auto generate")
 	rootCmd.Flags().String("mode", string(defaultConfig.Mode), "connection mode, choices are auto, full, half")
@@ -60,6 +62,44 @@ func init() {
 	rootCmd.Flags().StringSliceP("exclude-domain", "E", nil, "exclude certain domain name for proxy, ex -E 'portswigger.net'")
 	rootCmd.Flags().String("exclude-domain-file", "", "exclude certain domains for proxy in a file, one domain per line")
 	rootCmd.Flags().StringP("forward", "f", defaultConfig.ForwardTarget, "forward target address, enable forward mode when specified")
+	rootCmd.Flags().String("key", defaultConfig.Key, "pre-shared key to encrypt data frames, the server must be configured with the same key")
+	rootCmd.Flags().Bool("require-encryption", defaultConfig.RequireEncryption, "fail instead of falling back to xor when the server does not support encryption with --key")
+	rootCmd.Flags().String("cipher", defaultConfig.Cipher, "cipher used with --key, aes-gcm or chacha20-poly1305")
+	rootCmd.Flags().Bool("mux", defaultConfig.EnableMux, "multiplex all connections over one full duplex request")
+	rootCmd.Flags().String("http-listen", defaultConfig.HTTPListen, "extra listen address for the http proxy, the socks5 listen address also accepts http proxy requests")
+	rootCmd.Flags().Int("flush-window", defaultConfig.HalfFlushWindow, "milliseconds to coalesce writes into one request in half duplex mode, 0 to disable")
+	rootCmd.Flags().Int("batch-size", defaultConfig.HalfBatchSize, "max body size of a coalesced request in half duplex mode")
+	rootCmd.Flags().StringArray("rule", nil, "route rule in type,value,action format, ex --rule 'ip-cidr,10.0.0.0/8,tunnel', can be repeated")
+	rootCmd.Flags().String("default-route", defaultConfig.DefaultRoute, "action for connections matching no rule, tunnel, direct, reject or an upstream name")
+	rootCmd.Flags().StringArray("local-forward", nil, "forward a local address to a remote target, in listen->target format, ex --local-forward '127.0.0.1:3389->10.0.0.5:3389', can be repeated")
+	rootCmd.Flags().StringArray("reverse-forward", nil, "listen on the remote server and forward to a local target, in listen->target format, ex --reverse-forward '0.0.0.0:8000->127.0.0.1:80', can be repeated")
+	rootCmd.Flags().String("redir-listen", defaultConfig.RedirListen, "listen address of the transparent proxy for iptables REDIRECT, linux only")
+	rootCmd.Flags().String("dns-listen", defaultConfig.DNSListen, "listen address of the local dns server, udp and tcp")
+	rootCmd.Flags().String("dns-server", defaultConfig.DNSServer, "internal dns resolver reached through the tunnel, ex 10.0.0.2:53")
+	rootCmd.Flags().StringArray("dns-domain", nil, "domain suffix resolved through the tunnel, others use the system resolver, can be repeated")
+	rootCmd.Flags().String("metrics-listen", defaultConfig.MetricsListen, "listen address of the prometheus metrics endpoint, served at /metrics")
+	rootCmd.Flags().String("admin-listen", defaultConfig.AdminListen, "listen address of the admin api for listing and closing tunnel streams and reloading routing")
+	rootCmd.Flags().String("admin-token", defaultConfig.AdminToken, "bearer token required by the admin api")
+	rootCmd.Flags().String("profile", defaultConfig.Profile, "camouflage of the tunnel requests, raw, form, json, multipart, cookie or query, the server must use the same profile")
+	rootCmd.Flags().String("profile-field", defaultConfig.ProfileField, "name of the field carrying the data in the camouflaged requests")
+	rootCmd.Flags().String("padding", defaultConfig.Padding, "random padding size of each frame, uniform:MIN-MAX, normal:MEAN,STDDEV or exp:MEAN, ex uniform:0-256")
+	rootCmd.Flags().Int("jitter", defaultConfig.Jitter, "max random delay in milliseconds before each half duplex request, also randomizes the heartbeat interval")
+	rootCmd.Flags().Int("cover-interval", defaultConfig.CoverInterval, "milliseconds between cover requests sent while idle, 0 to disable")
+	rootCmd.Flags().String("tls-fingerprint", defaultConfig.TLSFingerprint, "tls client hello preset, randomized, chrome, firefox, safari, ios or edge")
+	rootCmd.Flags().String("tls-spec-file", defaultConfig.TLSSpecFile, "load a custom tls client hello spec from a json file, overrides --tls-fingerprint")
+	rootCmd.Flags().String("sni", defaultConfig.TLSServerName, "override the tls server name sent in the client hello")
+	rootCmd.Flags().StringSlice("alpn", nil, "tls alpn protocols, ex --alpn http/1.1")
+	rootCmd.Flags().StringArray("tls-pin", nil, "base64 sha256 of the server public key, the connection fails when no certificate in the chain matches, can be repeated")
+	rootCmd.Flags().String("tls-cert", defaultConfig.TLSCert, "client certificate file in pem format for mutual tls")
+	rootCmd.Flags().String("tls-key", defaultConfig.TLSKey, "client private key file in pem format for mutual tls")
+	rootCmd.Flags().String("connect-address", defaultConfig.ConnectAddress, "ip or front domain actually dialed instead of the target host, the port is optional")
+	rootCmd.Flags().String("host-header", defaultConfig.HostHeader, "override the http host header of the tunnel requests")
+	rootCmd.Flags().StringArray("targets", nil, "more server urls, new connections are spread across all available targets, can be repeated")
+	rootCmd.Flags().String("balance", defaultConfig.Balance, "how new connections are spread across the targets, round-robin or least-conn")
+	rootCmd.Flags().Int("health-interval", defaultConfig.HealthInterval, "seconds between health checks of the targets, 0 to only mark them down when requests fail")
+	rootCmd.Flags().String("transport", defaultConfig.Transport, "protocol of the full duplex requests, http1 or h2, h2 multiplexes them over one connection and falls back to http1 when unsupported")
+	rootCmd.Flags().Bool("websocket", defaultConfig.WebSocket, "carry the full duplex requests over websocket when the chunked requests are buffered, requires the go server")
+	rootCmd.Flags().Int("resume-timeout", defaultConfig.ResumeTimeout, "seconds to keep resuming a full duplex stream after the request drops, 0 to disable")
 }
 
 func initConfig() {
@@ -80,6 +120,7 @@ func initConfig() {
 	bindFlag("listen", "listen")
 	bindFlag("method", "method")
 	bindFlag("redirect_url", "redirect")
+	bindFlag("redirect_chain", "redirect-chain")
 	bindFlag("no_auth", "no-auth")
 	bindFlag("auth", "auth")
 	bindFlag("mode", "mode")
@@ -96,6 +137,44 @@ func initConfig() {
 	bindFlag("exclude_domain", "exclude-domain")
 	bindFlag("exclude_domain_file", "exclude-domain-file")
 	bindFlag("forward_target", "forward")
+	bindFlag("key", "key")
+	bindFlag("cipher", "cipher")
+	bindFlag("require_encryption", "require-encryption")
+	bindFlag("enable_mux", "mux")
+	bindFlag("http_listen", "http-listen")
+	bindFlag("half_flush_window", "flush-window")
+	bindFlag("half_batch_size", "batch-size")
+	bindFlag("resume_timeout", "resume-timeout")
+	bindFlag("rules", "rule")
+	bindFlag("default_route", "default-route")
+	bindFlag("forwards", "local-forward")
+	bindFlag("reverse_forwards", "reverse-forward")
+	bindFlag("redir_listen", "redir-listen")
+	bindFlag("dns_listen", "dns-listen")
+	bindFlag("dns_server", "dns-server")
+	bindFlag("dns_domains", "dns-domain")
+	bindFlag("metrics_listen", "metrics-listen")
+	bindFlag("admin_listen", "admin-listen")
+	bindFlag("admin_token", "admin-token")
+	bindFlag("profile", "profile")
+	bindFlag("profile_field", "profile-field")
+	bindFlag("padding", "padding")
+	bindFlag("jitter", "jitter")
+	bindFlag("cover_interval", "cover-interval")
+	bindFlag("tls_fingerprint", "tls-fingerprint")
+	bindFlag("tls_spec_file", "tls-spec-file")
+	bindFlag("tls_server_name", "sni")
+	bindFlag("tls_alpn", "alpn")
+	bindFlag("tls_pins", "tls-pin")
+	bindFlag("tls_cert", "tls-cert")
+	bindFlag("tls_key", "tls-key")
+	bindFlag("connect_address", "connect-address")
+	bindFlag("host_header", "host-header")
+	bindFlag("targets", "targets")
+	bindFlag("balance", "balance")
+	bindFlag("health_interval", "health-interval")
+	bindFlag("transport", "transport")
+	bindFlag("websocket", "websocket")
 }
 
 func run(_ *cobra.Command, _ []string) error {
@@ -110,6 +189,7 @@ func run(_ *cobra.Command, _ []string) error {
 	// any target from the config file.
 	if testExitURL := viper.GetString("test_exit"); testExitURL != "" {
 		cfg.Target = testExitURL
+		cfg.Targets = nil
 	}
 
 	// --- Configuration Validation and Finalization ---
@@ -147,19 +227,26 @@ func run(_ *cobra.Command, _ []string) error {
 	}
 
 	// Handle exclude-domain-file
-	if viper.GetString("exclude_domain_file") != "" {
-		excludeFile := viper.GetString("exclude_domain_file")
-		data, err := os.ReadFile(excludeFile)
-		if err != nil {
-			return fmt.Errorf("failed to read exclude-domain-file: %w", err)
-		}
-		lines := strings.Split(string(data), "\n")
-		for _, line := range lines {
-			line = strings.TrimSpace(line)
-			if line != "" {
-				cfg.ExcludeDomain = append(cfg.ExcludeDomain, line)
+	if err := readExcludeDomainFile(cfg); err != nil {
+		return err
+	}
+
+	// The admin api reloads routing from the config file when no rules are posted.
+	cfg.OnReload = func() (*core.Suo5Config, error) {
+		if err := viper.ReadInConfig(); err != nil {
+			var notFound viper.ConfigFileNotFoundError
+			if !errors.As(err, &notFound) {
+				return nil, fmt.Errorf("failed to read config file: %w", err)
 			}
 		}
+		reloaded := core.DefaultSuo5Config()
+		if err := viper.Unmarshal(reloaded); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal configuration: %w", err)
+		}
+		if err := readExcludeDomainFile(reloaded); err != nil {
+			return nil, err
+		}
+		return reloaded, nil
 	}
 
 	// --- Final Validation Checks ---
@@ -189,6 +276,30 @@ func run(_ *cobra.Command, _ []string) error {
 		return fmt.Errorf("buffer size must be between 512 and 1024000 bytes")
 	}
 
+	if cfg.HalfFlushWindow < 0 || cfg.HalfFlushWindow > 1000 {
+		return fmt.Errorf("flush window must be between 0 and 1000 milliseconds")
+	}
+
+	if cfg.HalfFlushWindow > 0 && (cfg.HalfBatchSize < 512 || cfg.HalfBatchSize > 1024*1024*8) {
+		return fmt.Errorf("batch size must be between 512 and 8388608 bytes")
+	}
+
+	if cfg.ResumeTimeout < 0 {
+		return fmt.Errorf("resume timeout must not be negative")
+	}
+
+	if cfg.Jitter < 0 || cfg.Jitter > 10000 {
+		return fmt.Errorf("jitter must be between 0 and 10000 milliseconds")
+	}
+
+	if cfg.CoverInterval != 0 && (cfg.CoverInterval < 100 || cfg.CoverInterval > 3600000) {
+		return fmt.Errorf("cover interval must be 0 or between 100 and 3600000 milliseconds")
+	}
+
+	if cfg.HealthInterval < 0 {
+		return fmt.Errorf("health interval must not be negative")
+	}
+
 	// Validate test-exit URL if provided
 	if testExitURL := viper.GetString("test_exit"); testExitURL != "" {
 		if _, err := url.Parse(testExitURL); err != nil {
@@ -203,6 +314,10 @@ func run(_ *cobra.Command, _ []string) error {
 		}
 	}
 
+	if cfg.DNSListen != "" && cfg.DNSServer == "" {
+		return fmt.Errorf("--dns-server is required when --dns-listen is specified")
+	}
+
 	// Validate auth conflicts
 	if cfg.NoAuth && viper.GetString("auth") != "" {
 		return fmt.Errorf("--no-auth and --auth flags are mutually exclusive")
@@ -216,6 +331,25 @@ func run(_ *cobra.Command, _ []string) error {
 	return ctrl.Run(ctx, cfg)
 }
 
+// readExcludeDomainFile appends the domains listed in exclude_domain_file, one per line.
+func readExcludeDomainFile(cfg *core.Suo5Config) error {
+	excludeFile := viper.GetString("exclude_domain_file")
+	if excludeFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(excludeFile)
+	if err != nil {
+		return fmt.Errorf("failed to read exclude-domain-file: %w", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			cfg.ExcludeDomain = append(cfg.ExcludeDomain, line)
+		}
+	}
+	return nil
+}
+
 func signalCtx() (context.Context, func()) {
 	ctx, cancel := context.WithCancel(context.Background())
 	ch := make(chan os.Signal, 1)
@@ -49,7 +49,9 @@ func (client *Client) Dial(ctx context.Context, network, address string) (conn n
 		return
 	}
 	if response.StatusCode != http.StatusOK {
-		err = conn.Close()
+		_ = conn.Close()
+		conn = nil
+		err = errors.New("proxy responded with " + response.Status)
 	}
 	return
 }
@@ -1,37 +1,64 @@
 package httpproxy
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net"
 	"net/http"
+	"sync"
+	"time"
 )
 
-var (
-	responseEstablished = http.Response{
-		StatusCode: 200,
-		Status:     "Connection Established",
-	}
-	responseUnauthorized = http.Response{
-		StatusCode: http.StatusUnauthorized,
-		Status:     http.StatusText(http.StatusUnauthorized),
-		Header:     http.Header{authenticate: []string{"Basic"}},
-	}
+// ErrForbidden 由 Dial 返回时响应 403，用于拒绝访问某些地址
+var ErrForbidden = errors.New("forbidden")
+
+const (
+	// idleConnTimeout 普通代理请求保留的空闲连接多久之后关闭
+	idleConnTimeout     = 90 * time.Second
+	maxIdleConns        = 64
+	maxIdleConnsPerHost = 4
 )
 
+var responseEstablished = []byte("HTTP/1.1 200 Connection Established\r\n\r\n")
+
+// hopHeaders 只对当前这一跳有效的请求头，转发前需要去掉
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	authorization,
+	authenticate,
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
 type Handler struct {
-	Auth        func(username, password string) bool
-	Dial        func(network, address string) (net.Conn, error)
+	Auth func(username, password string) bool
+	Dial func(network, address string) (net.Conn, error)
+	// DialContext 不为空时代替 Dial，ctx 来自客户端的请求
+	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
 	HandleError func(error, *http.Request)
-	client      *http.Client
+
+	once   sync.Once
+	client *http.Client
 }
 
 func Serve(listener net.Listener, dial func(network, address string) (net.Conn, error)) error {
-	return http.Serve(listener, Handler{Dial: dial})
+	h := &Handler{Dial: dial}
+	defer h.CloseIdleConnections()
+	return http.Serve(listener, h)
+}
+
+// CloseIdleConnections 关闭普通代理请求保留的空闲连接，监听停止后调用
+func (h *Handler) CloseIdleConnections() {
+	h.httpClient().CloseIdleConnections()
 }
 
-func (h Handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	if h.basicAuth(writer, request) {
+func (h *Handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if !h.basicAuth(writer, request) {
 		return
 	}
 	var err error
@@ -45,33 +72,54 @@ func (h Handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	}
 }
 
-func (h Handler) handleConnect(writer http.ResponseWriter, request *http.Request) error {
+func (h *Handler) handleConnect(writer http.ResponseWriter, request *http.Request) error {
 	hijacker, ok := writer.(http.Hijacker)
 	if !ok {
 		return errors.New("can't cast to Hijacker")
 	}
-	localConn, buffer, err := hijacker.Hijack()
+	// 先连接目标，失败时还能返回对应的状态码
+	remoteConn, err := h.dial(request.Context(), "tcp", urlToRemoteAddress(request.URL))
 	if err != nil {
+		writeError(writer, err)
 		return err
 	}
-	if err := responseEstablished.Write(buffer); err != nil {
-		return err
-	}
-	if err := buffer.Flush(); err != nil {
+	localConn, buffer, err := hijacker.Hijack()
+	if err != nil {
+		_ = remoteConn.Close()
 		return err
 	}
-	remoteConn, err := h.Dial("tcp", urlToRemoteAddress(request.URL))
-	if err != nil {
+	if _, err := localConn.Write(responseEstablished); err != nil {
+		_ = localConn.Close()
+		_ = remoteConn.Close()
 		return err
 	}
-	go func() { _, _ = io.Copy(localConn, remoteConn) }()
-	go func() { _, _ = io.Copy(remoteConn, localConn) }()
+
+	go func() {
+		defer remoteConn.Close()
+		// 客户端可能在收到响应前就发送了数据，这部分已经在 buffer 里
+		if n := buffer.Reader.Buffered(); n > 0 {
+			data, _ := buffer.Reader.Peek(n)
+			if _, err := remoteConn.Write(data); err != nil {
+				return
+			}
+		}
+		_, _ = io.Copy(remoteConn, localConn)
+	}()
+	go func() {
+		defer localConn.Close()
+		_, _ = io.Copy(localConn, remoteConn)
+	}()
 	return nil
 }
 
-func (h Handler) handleNormal(writer http.ResponseWriter, request *http.Request) error {
+func (h *Handler) handleNormal(writer http.ResponseWriter, request *http.Request) error {
+	if request.URL.Host == "" {
+		http.Error(writer, "this is a proxy server", http.StatusBadRequest)
+		return nil
+	}
 	response, err := h.request(request)
 	if err != nil {
+		writeError(writer, err)
 		return err
 	}
 	defer response.Body.Close()
@@ -79,32 +127,68 @@ func (h Handler) handleNormal(writer http.ResponseWriter, request *http.Request)
 	for name, values := range response.Header {
 		header[name] = values
 	}
+	removeHopHeaders(header)
+	writer.WriteHeader(response.StatusCode)
 	if _, err := io.Copy(writer, response.Body); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (h Handler) request(request *http.Request) (*http.Response, error) {
-	if h.client == nil {
+func (h *Handler) request(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	request.RequestURI = ""
+	removeHopHeaders(request.Header)
+	return h.httpClient().Do(request)
+}
+
+func (h *Handler) httpClient() *http.Client {
+	h.once.Do(func() {
 		h.client = &http.Client{
-			Transport:     &http.Transport{Dial: h.Dial},
-			CheckRedirect: func(_ *http.Request, _ []*http.Request) error { return nil },
+			Transport: &http.Transport{
+				DialContext:         h.dial,
+				DisableCompression:  true,
+				IdleConnTimeout:     idleConnTimeout,
+				MaxIdleConns:        maxIdleConns,
+				MaxIdleConnsPerHost: maxIdleConnsPerHost,
+			},
+			CheckRedirect: func(_ *http.Request, _ []*http.Request) error { return http.ErrUseLastResponse },
 		}
+	})
+	return h.client
+}
+
+func (h *Handler) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if h.DialContext != nil {
+		return h.DialContext(ctx, network, address)
 	}
-	request.RequestURI = ""
-	return h.client.Do(request)
+	return h.Dial(network, address)
 }
 
-func (h Handler) basicAuth(writer http.ResponseWriter, request *http.Request) bool {
+// basicAuth 校验 Proxy-Authorization，失败时返回 407 并返回 false
+func (h *Handler) basicAuth(writer http.ResponseWriter, request *http.Request) bool {
 	if h.Auth == nil {
-		return false
+		return true
 	}
-	auth := request.Header.Get(authorization)
-	username, password, ok := decodeBasicAuth(auth)
-	if !ok {
-		_ = responseUnauthorized.Write(writer)
-		return false
+	username, password, ok := decodeBasicAuth(request.Header.Get(authorization))
+	if ok && h.Auth(username, password) {
+		return true
+	}
+	writer.Header().Set(authenticate, `Basic realm="proxy"`)
+	writer.WriteHeader(http.StatusProxyAuthRequired)
+	return false
+}
+
+func writeError(writer http.ResponseWriter, err error) {
+	if errors.Is(err, ErrForbidden) {
+		http.Error(writer, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(writer, err.Error(), http.StatusBadGateway)
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, h := range hopHeaders {
+		header.Del(h)
 	}
-	return h.Auth(username, password)
 }
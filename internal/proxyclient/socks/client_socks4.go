@@ -1,10 +1,10 @@
 package socksproxy
 
 import (
-	"bufio"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/url"
 	"strings"
@@ -24,7 +24,7 @@ func (c *Socks4Client) Dial(ctx context.Context, network, address string) (remot
 		command: commandConnect,
 		port:    port,
 		ip:      []byte{0, 0, 0, 1},
-		userId:  []byte{},
+		userId:  c.userId(),
 		fqdn:    host,
 	}
 	if c.isSOCKS4() {
@@ -39,51 +39,55 @@ func (c *Socks4Client) Dial(ctx context.Context, network, address string) (remot
 		return
 	}
 	if _, err = remoteConn.Write(request.ToPacket()); err != nil {
-		return
+		_ = remoteConn.Close()
+		return nil, err
 	}
 
 	if request.command == commandConnect {
-		err = c.handleConnect(remoteConn)
+		if err = c.handleConnect(remoteConn); err != nil {
+			_ = remoteConn.Close()
+			return nil, err
+		}
 	}
 	return
 }
 
+// handleConnect 读取 8 字节的响应，不能预读，否则目标紧跟着发送的数据会丢失
 func (c *Socks4Client) handleConnect(remoteConn net.Conn) (err error) {
-	reader := bufio.NewReader(remoteConn)
-	version, err := reader.ReadByte()
-	if err != nil {
+	response := make([]byte, 8)
+	if _, err = io.ReadFull(remoteConn, response); err != nil {
 		return
 	}
-	if version != 0 {
+	if response[0] != 0 {
 		err = errVersionError
 		return
 	}
-	code, err := reader.ReadByte()
-	if err != nil {
-		return
-	}
-	if code != socks4StatusGranted {
+	if code := response[1]; code != socks4StatusGranted {
 		switch code {
 		case socks4StatusRejected:
 			err = errors.New("Socks connection request rejected or failed.")
-		case 92:
+		case socks4StatusIdentFailed:
 			err = errors.New("Socks connection request rejected becasue SOCKS server cannot connect to identd on the client.")
-		case 93:
+		case socks4StatusUserIdMismatch:
 			err = errors.New("Socks connection request rejected because the client program and identd report different user-ids.")
 		default:
 			err = errors.New("Socks connection request failed, unknown error.")
 		}
 		return
 	}
-	_, err = reader.Discard(2) // dst port
-	if err != nil {
-		return
+	return
+}
+
+// userId SOCKS4 没有密码认证，将 username:password 放在 user id 中
+func (c *Socks4Client) userId() []byte {
+	if c.proxy.User == nil {
+		return []byte{}
 	}
-	_, err = reader.Discard(4) // dst ip
-	if err != nil {
-		return
+	userId := c.proxy.User.Username()
+	if password, ok := c.proxy.User.Password(); ok {
+		userId += ":" + password
 	}
-	return
+	return []byte(userId)
 }
 
 func (c *Socks4Client) isSOCKS4() bool {
@@ -104,5 +108,6 @@ func (c *Socks4Client) lookupIP(host string) (ip net.IP, err error) {
 		err = errors.New("IPv6 is not supported by SOCKS4.")
 		return
 	}
+	ip = ip.To4()
 	return
 }
@@ -37,16 +37,22 @@ func IsSOCKS(r io.Reader) bool {
 }
 
 func handleConn(conn net.Conn, conf *SOCKSConf) {
-	var err error
-	buffer := make([]byte, 1)
-	if _, err = conn.Read(buffer); err != nil {
+	if err := ServeConn(conn, conf); err != nil {
 		conf.HandleError(err)
+	}
+}
+
+// ServeConn 根据版本号处理一个 SOCKS4/4a 或 SOCKS5 连接。
+// SOCKS4 没有密码认证，设置了 Auth 时 user id 需要是 username:password 的形式
+func ServeConn(conn net.Conn, conf *SOCKSConf) (err error) {
+	buffer := make([]byte, 1)
+	if _, err = io.ReadFull(conn, buffer); err != nil {
 		return
 	}
 	switch buffer[0] {
 	case socks4version:
-		if conf.Auth != nil || conf.TLSConfig != nil {
-			return
+		if conf.TLSConfig != nil {
+			return errVersionError
 		}
 		socksConn := &socks4Conn{conn, conf}
 		err = socksConn.Serve()
@@ -56,9 +62,8 @@ func handleConn(conn net.Conn, conf *SOCKSConf) {
 		}
 		socksConn := &socks5Conn{conn, conf}
 		err = socksConn.Serve()
+	default:
+		err = errVersionError
 	}
-	if err != nil {
-		conf.HandleError(err)
-		return
-	}
+	return
 }
@@ -4,6 +4,8 @@ import (
 	"context"
 	"io"
 	"net"
+	"strings"
+	"sync"
 )
 
 type socks4Conn struct {
@@ -14,33 +16,47 @@ type socks4Conn struct {
 func (c *socks4Conn) Serve() (err error) {
 	request, err := readSocks4Request(c.localConn)
 	if err != nil {
-		_ = c.sendReply(request, socks4StatusRejected)
 		return err
 	}
+	if c.conf.Auth != nil {
+		username, password, _ := strings.Cut(string(request.userId), ":")
+		if !c.conf.Auth(username, password) {
+			_ = c.sendReply(request, socks4StatusUserIdMismatch)
+			return errUserIdMismatch
+		}
+	}
 	switch request.command {
 	case commandConnect:
-		err = c.sendReply(request, socks4StatusGranted)
-		if err != nil {
-			return
-		}
-		err = c.handleConnect(request.Address())
+		return c.handleConnect(request)
 	default:
-		err = errCommandNotSupported
-	}
-	if err != nil {
 		_ = c.sendReply(request, socks4StatusRejected)
+		return errCommandNotSupported
 	}
-	return
 }
 
-func (c *socks4Conn) handleConnect(host string) (err error) {
-	remoteConn, err := c.conf.Dial(context.Background(), "tcp", host)
+// handleConnect 先连接目标再响应，连接失败时客户端能收到拒绝的状态码，之后一直转发到任意一端关闭
+func (c *socks4Conn) handleConnect(request *socks4Request) (err error) {
+	remoteConn, err := c.conf.Dial(context.Background(), "tcp", request.Address())
 	if err != nil {
+		_ = c.sendReply(request, socks4StatusRejected)
 		return err
 	}
-	go func() { _, _ = io.Copy(c.localConn, remoteConn) }()
-	go func() { _, _ = io.Copy(remoteConn, c.localConn) }()
-	return
+	defer remoteConn.Close()
+	if err = c.sendReply(request, socks4StatusGranted); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer remoteConn.Close()
+		_, _ = io.Copy(remoteConn, c.localConn)
+	}()
+	_, _ = io.Copy(c.localConn, remoteConn)
+	_ = c.localConn.Close()
+	wg.Wait()
+	return nil
 }
 
 func (c *socks4Conn) sendReply(request *socks4Request, status byte) error {
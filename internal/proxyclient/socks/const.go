@@ -9,8 +9,10 @@ const (
 	commandConnect      byte = 1
 	commandUDPAssociate byte = 3
 
-	socks4StatusGranted  byte = 90
-	socks4StatusRejected byte = 91
+	socks4StatusGranted        byte = 90
+	socks4StatusRejected       byte = 91
+	socks4StatusIdentFailed    byte = 92
+	socks4StatusUserIdMismatch byte = 93
 
 	socks5AddressTypeIPv4 byte = 1
 	socks5AddressTypeFQDN byte = 3
@@ -35,4 +37,5 @@ var (
 	errCommandNotSupported     = errors.New("command not supported")
 	errAddressTypeNotSupported = errors.New("address type not supported")
 	errAuthMethodNotSupported  = errors.New("authentication method not supported")
+	errUserIdMismatch          = errors.New("user id mismatch")
 )
@@ -3,6 +3,8 @@ package socksproxy
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
+	"io"
 	"net"
 	"strconv"
 )
@@ -57,32 +59,47 @@ func (response *socks4Response) ToPacket() []byte {
 	return packet
 }
 
+// readSocks4Request 读取版本号之后的请求，不能预读，否则客户端紧跟着发送的数据会丢失
 func readSocks4Request(conn net.Conn) (request *socks4Request, err error) {
-	reader := bufio.NewReader(conn)
-	request = &socks4Request{}
-	if request.command, err = reader.ReadByte(); err != nil {
-		return
-	}
-	request.port = make([]byte, 2)
-	if _, err = reader.Read(request.port); err != nil {
+	header := make([]byte, 7)
+	if _, err = io.ReadFull(conn, header); err != nil {
 		return
 	}
-	request.ip = make([]byte, 4)
-	if _, err = reader.Read(request.ip); err != nil {
-		return
+	request = &socks4Request{
+		command: header[0],
+		port:    header[1:3],
+		ip:      header[3:7],
 	}
-	if request.userId, err = reader.ReadBytes(0); err != nil {
+	if request.userId, err = readNullTerminated(conn); err != nil {
 		return
 	}
 	if !request.IsSOCKS4A() {
 		return
 	}
-	if request.fqdn, err = reader.ReadBytes(0); err != nil {
+	if request.fqdn, err = readNullTerminated(conn); err != nil {
 		return
 	}
 	return
 }
 
+// readNullTerminated 逐字节读取一个以 0 结尾的字段，返回的内容不包含结尾的 0
+func readNullTerminated(conn net.Conn) ([]byte, error) {
+	var field []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, err
+		}
+		if b[0] == 0 {
+			return field, nil
+		}
+		if len(field) >= 255 {
+			return nil, errors.New("socks4 field too long")
+		}
+		field = append(field, b[0])
+	}
+}
+
 // endregion
 
 // region SOCKS5
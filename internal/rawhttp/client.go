@@ -1,6 +1,7 @@
 package rawhttp
 
 import (
+	"errors"
 	"fmt"
 	"github.com/PurpleNewNew/bs5/internal/rawhttp/client"
 	"io"
@@ -9,6 +10,8 @@ import (
 	"net/http"
 	stdurl "net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -70,16 +73,17 @@ func (c *Client) DoRaw(method, url, uripath string, headers map[string][]string,
 		FollowRedirects: true,
 		MaxRedirects:    c.Options.MaxRedirects,
 	}
-	resp, _, err := c.do(method, url, uripath, headers, body, redirectstatus, c.Options)
+	resp, _, err := c.do(method, url, uripath, headers, body, redirectstatus, c.Options, false)
 	return resp, err
 }
 
+// DoRawHijack returns the underlying conn as well, which is never returned to the idle pool
 func (c *Client) DoRawHijack(method, url, uripath string, headers map[string][]string, body io.Reader) (*http.Response, net.Conn, error) {
 	redirectstatus := &RedirectStatus{
 		FollowRedirects: true,
 		MaxRedirects:    c.Options.MaxRedirects,
 	}
-	return c.do(method, url, uripath, headers, body, redirectstatus, c.Options)
+	return c.do(method, url, uripath, headers, body, redirectstatus, c.Options, true)
 }
 
 // DoRawWithOptions performs a raw request with additional options
@@ -88,10 +92,15 @@ func (c *Client) DoRawWithOptions(method, url, uripath string, headers map[strin
 		FollowRedirects: options.FollowRedirects,
 		MaxRedirects:    c.Options.MaxRedirects,
 	}
-	resp, _, err := c.do(method, url, uripath, headers, body, redirectstatus, options)
+	resp, _, err := c.do(method, url, uripath, headers, body, redirectstatus, options, false)
 	return resp, err
 }
 
+// PoolStats returns the keep-alive pool counters for debugging
+func (c *Client) PoolStats() PoolStats {
+	return c.dialer.Stats()
+}
+
 func (c *Client) getConn(protocol, host string, options *Options) (net.Conn, error) {
 	if options.Proxy != nil {
 		return c.dialer.DialWithProxy(protocol, host, c.Options.Proxy, c.Options.ProxyDialTimeout, options)
@@ -106,7 +115,7 @@ func (c *Client) getConn(protocol, host string, options *Options) (net.Conn, err
 	return conn, err
 }
 
-func (c *Client) do(method, url, uripath string, headers map[string][]string, body io.Reader, redirectstatus *RedirectStatus, options *Options) (*http.Response, net.Conn, error) {
+func (c *Client) do(method, url, uripath string, headers map[string][]string, body io.Reader, redirectstatus *RedirectStatus, options *Options, hijack bool) (*http.Response, net.Conn, error) {
 	protocol := "http"
 	if strings.HasPrefix(strings.ToLower(url), "https://") {
 		protocol = "https"
@@ -122,8 +131,12 @@ func (c *Client) do(method, url, uripath string, headers map[string][]string, bo
 
 	host := u.Host
 	if options.AutomaticHostHeader {
+		hostHeader := host
+		if options.HostHeader != "" {
+			hostHeader = options.HostHeader
+		}
 		// add automatic space
-		headers["Host"] = []string{fmt.Sprintf(" %s", host)}
+		headers["Host"] = []string{fmt.Sprintf(" %s", hostHeader)}
 	}
 
 	if !strings.Contains(host, ":") {
@@ -160,23 +173,39 @@ func (c *Client) do(method, url, uripath string, headers map[string][]string, bo
 	req.AutomaticContentLength = options.AutomaticContentLength
 	req.AutomaticHost = options.AutomaticHostHeader
 
-	// set timeout if any
+	// set timeout if any, a reused conn may still carry the deadline of its previous request
+	var deadline time.Time
 	if options.Timeout > 0 {
-		_ = conn.SetDeadline(time.Now().Add(options.Timeout))
+		deadline = time.Now().Add(options.Timeout)
 	}
+	_ = conn.SetDeadline(deadline)
 
 	connClient := client.NewConnClient(conn)
 
 	if err := connClient.WriteRequest(req); err != nil {
+		_ = conn.Close()
 		return nil, nil, err
 	}
 	resp, err := connClient.ReadResponse(options.ForceReadAllBody)
 	if err != nil {
+		_ = conn.Close()
 		return nil, nil, err
 	}
 
-	r, err := toHTTPResponse(conn, resp)
+	kb := &keepAliveBody{
+		r:          resp.Body,
+		reuse:      !hijack && !options.ForceReadAllBody && resp.KeepAlive(),
+		conn:       conn,
+		connClient: connClient,
+		release: func() {
+			c.release(protocol, host, options, conn, connClient.Written())
+		},
+	}
+	resp.Body = kb
+
+	r, err := toHTTPResponse(kb, resp)
 	if err != nil {
+		_ = conn.Close()
 		return nil, nil, err
 	}
 
@@ -191,7 +220,7 @@ func (c *Client) do(method, url, uripath string, headers map[string][]string, bo
 			loc = fmt.Sprintf("%s://%s%s", protocol, host, loc)
 		}
 		redirectstatus.Current++
-		return c.do(method, loc, uripath, headers, body, redirectstatus, options)
+		return c.do(method, loc, uripath, headers, body, redirectstatus, options, hijack)
 	}
 
 	return r, conn, err
@@ -203,3 +232,113 @@ type RedirectStatus struct {
 	MaxRedirects    int
 	Current         int
 }
+
+// requestWriteTimeout is how long a conn whose response has ended waits for its chunked request body to finish
+const requestWriteTimeout = 5 * time.Second
+
+// a body closed before its end is drained in the background within these limits, otherwise the conn is closed
+const (
+	drainTimeout  = time.Second
+	maxDrainBytes = 256 * 1024
+)
+
+var errBodyClosed = errors.New("rawhttp: read on closed response body")
+
+// release returns conn to the idle pool once the request has been written completely
+func (c *Client) release(protocol, host string, options *Options, conn net.Conn, written <-chan error) {
+	put := func(err error) {
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+		c.dialer.Release(protocol, host, options.Proxy != nil, conn, options)
+	}
+	select {
+	case err := <-written:
+		put(err)
+		return
+	default:
+	}
+	go func() {
+		select {
+		case err := <-written:
+			put(err)
+		case <-time.After(requestWriteTimeout):
+			_ = conn.Close()
+		}
+	}()
+}
+
+// keepAliveBody returns the conn to the pool on close once the body has been read to the end
+type keepAliveBody struct {
+	r          io.Reader
+	reuse      bool
+	conn       net.Conn
+	connClient client.ConnClient
+	release    func()
+
+	// mu serializes reads with the drain after close, eof is protected by mu
+	mu     sync.Mutex
+	eof    bool
+	closed atomic.Bool
+	once   sync.Once
+	err    error
+}
+
+func (b *keepAliveBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// the conn may already be drained and reused by another request
+	if b.closed.Load() {
+		return 0, errBodyClosed
+	}
+	if b.eof {
+		return 0, io.EOF
+	}
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *keepAliveBody) Close() error {
+	b.once.Do(func() {
+		b.closed.Store(true)
+		if !b.reuse {
+			b.err = b.conn.Close()
+			return
+		}
+		if b.mu.TryLock() {
+			eof := b.eof
+			b.mu.Unlock()
+			if eof {
+				b.finish(true)
+				return
+			}
+		}
+		go b.drain()
+	})
+	return b.err
+}
+
+// drain reads the rest of a body closed early, a pending read is woken up by the deadline at the latest
+func (b *keepAliveBody) drain() {
+	_ = b.conn.SetReadDeadline(time.Now().Add(drainTimeout))
+	b.mu.Lock()
+	if !b.eof {
+		n, err := io.Copy(io.Discard, io.LimitReader(b.r, maxDrainBytes+1))
+		b.eof = err == nil && n <= maxDrainBytes
+	}
+	eof := b.eof
+	b.mu.Unlock()
+	b.finish(eof)
+}
+
+func (b *keepAliveBody) finish(eof bool) {
+	if !eof || b.connClient.Buffered() != 0 {
+		_ = b.conn.Close()
+		return
+	}
+	b.release()
+}
@@ -70,6 +70,10 @@ const readerBuffer = 4096
 type ConnClient interface {
 	WriteRequest(*Request) error
 	ReadResponse(forceReadAll bool) (*Response, error)
+	// Written receives the result once the whole request including a chunked body has been written.
+	Written() <-chan error
+	// Buffered returns the number of bytes read from the connection but not consumed yet.
+	Buffered() int
 }
 
 // NewConnClient returns a ConnClient implementation which uses rw to communicate.
@@ -83,20 +87,35 @@ func NewConnClient(rw io.ReadWriter) ConnClient {
 type client struct {
 	reader
 	writer
+	written chan error
+}
+
+func (c *client) Written() <-chan error {
+	return c.written
 }
 
 // SendRequest marshalls a HTTP request to the wire.
 func (c *client) WriteRequest(req *Request) error {
+	c.written = make(chan error, 1)
+	async, err := c.writeRequest(req)
+	if !async {
+		c.written <- err
+	}
+	return err
+}
+
+// writeRequest returns true when the chunked body is still being written in the background
+func (c *client) writeRequest(req *Request) (bool, error) {
 	if len(req.RawBytes) > 0 {
 		_, err := c.Write(req.RawBytes)
-		return err
+		return false, err
 	}
 	if err := c.WriteRequestLine(req.Method, req.Path, req.Query, req.Version.String()); err != nil {
-		return err
+		return false, err
 	}
 	for _, h := range req.Headers {
 		if err := c.WriteHeader(h.Key, h.Value); err != nil {
-			return err
+			return false, err
 		}
 	}
 
@@ -104,29 +123,28 @@ func (c *client) WriteRequest(req *Request) error {
 	if req.AutomaticContentLength {
 		if l >= 0 {
 			if err := c.WriteHeader("Content-Length", fmt.Sprintf("%d", l)); err != nil {
-				return err
+				return false, err
 			}
 		} else {
 			if err := c.WriteHeader("Transfer-Encoding", "chunked"); err != nil {
-				return err
+				return false, err
 			}
 		}
 	}
 
 	if req.Body == nil {
 		// doesn't actually start the body, just sends the terminating \r\n
-		return c.StartBody()
+		return false, c.StartBody()
 	}
 
 	if err := c.StartBody(); err != nil {
-		return err
+		return false, err
 	}
 	if l >= 0 {
-		return c.WriteBody(req.Body)
-	} else {
-		go func() { _ = c.WriteChunked(req.Body) }()
-		return nil
+		return false, c.WriteBody(req.Body)
 	}
+	go func() { c.written <- c.WriteChunked(req.Body) }()
+	return true, nil
 }
 
 // ReadResponse unmarshalls a HTTP response.
@@ -159,7 +177,8 @@ func (c *client) ReadResponse(forceReadAll bool) (*Response, error) {
 	if l := resp.ContentLength(); l >= 0 && !forceReadAll {
 		resp.Body = io.LimitReader(resp.Body, l)
 	} else if resp.TransferEncoding() == "chunked" {
-		resp.Body = httputil.NewChunkedReader(resp.Body)
+		// the chunked reader shares the bufio.Reader, so nothing after the body is buffered elsewhere
+		resp.Body = &chunkedReader{r: httputil.NewChunkedReader(c.reader.Reader), trailer: &c.reader}
 	}
 	return &resp, err
 }
@@ -197,6 +216,14 @@ func (r *Response) CloseRequested() bool {
 	return false
 }
 
+// KeepAlive returns if the connection can be reused once the body has been read to the end.
+func (r *Response) KeepAlive() bool {
+	if r.Version.Major != 1 || r.Version.Minor < 1 || r.CloseRequested() {
+		return false
+	}
+	return r.ContentLength() >= 0 || r.TransferEncoding() == "chunked"
+}
+
 // TransferEncoding returns the transfer encoding this message was transmitted with.
 // If not is specified by the sender, "identity" is assumed.
 func (r *Response) TransferEncoding() string {
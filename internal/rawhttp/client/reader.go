@@ -138,3 +138,31 @@ func (r *reader) ReadBody() io.Reader {
 func (r *reader) readLine() ([]byte, error) {
 	return r.ReadBytes('\n')
 }
+
+// chunkedReader consumes the trailer after the last chunk, so the next response on the connection starts clean.
+type chunkedReader struct {
+	r       io.Reader
+	trailer *reader
+	done    bool
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	n, err := c.r.Read(p)
+	if err != io.EOF {
+		return n, err
+	}
+	for {
+		_, _, done, terr := c.trailer.ReadHeader()
+		if terr != nil {
+			return n, terr
+		}
+		if done {
+			break
+		}
+	}
+	c.done = true
+	return n, io.EOF
+}
@@ -104,7 +104,7 @@ func (w *writer) WriteChunked(r io.Reader) error {
 	}
 	cw := httputil.NewChunkedWriter(w)
 	if _, err := io.Copy(cw, r); err != nil {
-		return nil
+		return err
 	}
 	w.phase = requestline
 	err := cw.Close()
@@ -0,0 +1,147 @@
+package rawhttp
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestClient() *Client {
+	return NewClient(&Options{
+		AutomaticHostHeader:    true,
+		AutomaticContentLength: true,
+	})
+}
+
+// startCountingServer counts the tcp connections accepted by the server
+func startCountingServer(t *testing.T, h http.Handler) (*httptest.Server, *atomic.Int32) {
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(h)
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv, &conns
+}
+
+func get(t *testing.T, c *Client, url string, body io.Reader) string {
+	resp, err := c.DoRaw("POST", url, "", nil, body)
+	require.NoError(t, err)
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	return string(data)
+}
+
+func TestKeepAlive(t *testing.T) {
+	srv, conns := startCountingServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		if r.URL.Path == "/chunked" {
+			w.(http.Flusher).Flush()
+		}
+		_, _ = w.Write(data)
+		if r.URL.Path == "/slow" {
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+			_, _ = io.WriteString(w, "rest")
+		}
+	}))
+	c := newTestClient()
+
+	for _, path := range []string{"/", "/chunked"} {
+		assert.Equal(t, "hello", get(t, c, srv.URL+path, strings.NewReader("hello")))
+		// 长度未知的请求体使用 chunked 编码在后台写入
+		assert.Equal(t, "world", get(t, c, srv.URL+path, io.MultiReader(strings.NewReader("world"))))
+	}
+	assert.Equal(t, int32(1), conns.Load())
+	stats := c.PoolStats()
+	assert.Equal(t, uint64(3), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, 1, stats.Idle)
+
+	// 没有读完就关闭的响应体在后台读完后放回
+	resp, err := c.DoRaw("POST", srv.URL+"/slow", "", nil, strings.NewReader("a"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(resp.Body, make([]byte, 1))
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	_, err = resp.Body.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.Eventually(t, func() bool { return c.PoolStats().Idle == 1 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "hello", get(t, c, srv.URL, strings.NewReader("hello")))
+	assert.Equal(t, int32(1), conns.Load())
+}
+
+func TestKeepAliveNotReused(t *testing.T) {
+	srv, conns := startCountingServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/close" {
+			w.Header().Set("Connection", "close")
+		}
+		_, _ = io.WriteString(w, strings.Repeat("a", 2*maxDrainBytes))
+	}))
+	c := newTestClient()
+
+	// 服务端要求关闭
+	get(t, c, srv.URL+"/close", nil)
+	get(t, c, srv.URL+"/close", nil)
+	assert.Equal(t, int32(2), conns.Load())
+
+	// 没有读完响应体就关闭，剩下的部分超过了后台读取的上限
+	resp, err := c.Get(srv.URL)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	get(t, c, srv.URL, nil)
+	assert.Equal(t, int32(4), conns.Load())
+
+	// 服务端关闭了空闲的连接
+	srv.CloseClientConnections()
+	time.Sleep(100 * time.Millisecond)
+	get(t, c, srv.URL, nil)
+	assert.Equal(t, int32(5), conns.Load())
+}
+
+func TestKeepAliveOptions(t *testing.T) {
+	srv, conns := startCountingServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+
+	c := newTestClient()
+	c.Options.MaxIdleConnsPerHost = -1
+	get(t, c, srv.URL, nil)
+	get(t, c, srv.URL, nil)
+	assert.Equal(t, int32(2), conns.Load())
+	assert.Equal(t, 0, c.PoolStats().Idle)
+
+	c = newTestClient()
+	c.Options.IdleConnTimeout = 50 * time.Millisecond
+	get(t, c, srv.URL, nil)
+	time.Sleep(100 * time.Millisecond)
+	get(t, c, srv.URL, nil)
+	assert.Equal(t, int32(4), conns.Load())
+
+	// 通过代理建立的连接同样复用
+	var dials atomic.Int32
+	c = newTestClient()
+	c.Options.Proxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials.Add(1)
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "ok", get(t, c, srv.URL, nil))
+	}
+	assert.Equal(t, int32(1), dials.Load())
+	assert.Equal(t, int32(5), conns.Load())
+}
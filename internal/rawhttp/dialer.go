@@ -3,10 +3,12 @@ package rawhttp
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,11 +21,37 @@ type Dialer interface {
 	DialWithProxy(protocol, addr string, upstream ContextDialFunc, timeout time.Duration, options *Options) (net.Conn, error)
 	// Dial dials a remote http server with timeout returning a Conn.
 	DialTimeout(protocol, addr string, timeout time.Duration, options *Options) (net.Conn, error)
+	// Release returns a conn whose response has been fully read to the idle pool, it is closed when the pool is full.
+	Release(protocol, addr string, proxied bool, conn net.Conn, options *Options)
+	// Stats returns the pool counters.
+	Stats() PoolStats
+}
+
+// PoolStats counts how often a request reused an idle connection.
+type PoolStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+	Idle   int    `json:"idle"`
+}
+
+// poolKey connections dialed through a proxy are kept apart from direct ones
+type poolKey struct {
+	protocol string
+	addr     string
+	proxied  bool
+}
+
+type idleConn struct {
+	conn   net.Conn
+	idleAt time.Time
 }
 
 type dialer struct {
-	sync.Mutex                       // protects following fields
-	conns      map[string][]net.Conn // maps addr to a, possibly empty, slice of existing Conns
+	sync.Mutex                        // protects following fields
+	conns      map[poolKey][]idleConn // maps addr to a, possibly empty, slice of idle Conns, the most recent last
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
 }
 
 func (d *dialer) Dial(protocol, addr string, options *Options) (net.Conn, error) {
@@ -35,31 +63,102 @@ func (d *dialer) DialTimeout(protocol, addr string, timeout time.Duration, optio
 }
 
 func (d *dialer) dialTimeout(protocol, addr string, timeout time.Duration, options *Options) (net.Conn, error) {
-	d.Lock()
-	if d.conns == nil {
-		d.conns = make(map[string][]net.Conn)
+	if conn := d.get(poolKey{protocol, addr, false}, options); conn != nil {
+		return conn, nil
 	}
-	if c, ok := d.conns[addr]; ok {
-		if len(c) > 0 {
-			conn := c[0]
-			c[0] = c[len(c)-1]
+	return clientDial(protocol, addr, timeout, options)
+}
+
+// get pops the most recently used idle conn which is still alive, expired or closed ones are dropped
+func (d *dialer) get(key poolKey, options *Options) net.Conn {
+	if options.maxIdleConnsPerHost() <= 0 {
+		return nil
+	}
+	for {
+		d.Lock()
+		idle := d.conns[key]
+		if len(idle) == 0 {
 			d.Unlock()
-			return conn, nil
+			d.misses.Add(1)
+			return nil
+		}
+		c := idle[len(idle)-1]
+		d.conns[key] = idle[:len(idle)-1]
+		d.Unlock()
+
+		if time.Since(c.idleAt) < options.idleConnTimeout() && alive(c.conn) {
+			d.hits.Add(1)
+			return c.conn
 		}
+		_ = c.conn.Close()
 	}
+}
+
+func (d *dialer) Release(protocol, addr string, proxied bool, conn net.Conn, options *Options) {
+	maxIdle := options.maxIdleConnsPerHost()
+	if maxIdle <= 0 {
+		_ = conn.Close()
+		return
+	}
+	key := poolKey{protocol, addr, proxied}
+	now := time.Now()
+	var closing []net.Conn
+	d.Lock()
+	if d.conns == nil {
+		d.conns = make(map[poolKey][]idleConn)
+	}
+	idle := d.conns[key]
+	for len(idle) > 0 && (len(idle) >= maxIdle || now.Sub(idle[0].idleAt) >= options.idleConnTimeout()) {
+		closing = append(closing, idle[0].conn)
+		idle = idle[1:]
+	}
+	d.conns[key] = append(idle, idleConn{conn: conn, idleAt: now})
 	d.Unlock()
-	return clientDial(protocol, addr, timeout, options)
+	for _, c := range closing {
+		_ = c.Close()
+	}
+}
+
+func (d *dialer) Stats() PoolStats {
+	d.Lock()
+	idle := 0
+	for _, conns := range d.conns {
+		idle += len(conns)
+	}
+	d.Unlock()
+	return PoolStats{Hits: d.hits.Load(), Misses: d.misses.Load(), Idle: idle}
+}
+
+// alive reports whether an idle conn was not closed by the server. Nothing is expected on an idle conn,
+// so a read should time out, data or EOF means it can not be reused
+func alive(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+	n, err := conn.Read(make([]byte, 1))
+	var ne net.Error
+	if n != 0 || !errors.As(err, &ne) || !ne.Timeout() {
+		return false
+	}
+	return conn.SetReadDeadline(time.Time{}) == nil
 }
 
 func (d *dialer) DialWithProxy(protocol, addr string, upstream ContextDialFunc, timeout time.Duration, options *Options) (net.Conn, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-	conn, err := upstream(ctx, "tcp", addr)
+	if conn := d.get(poolKey{protocol, addr, true}, options); conn != nil {
+		return conn, nil
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	conn, err := upstream(ctx, "tcp", options.dialAddress(addr))
 	if err != nil {
 		return nil, fmt.Errorf("proxy error: %w", err)
 	}
 	if protocol == "https" {
-		if conn, err = TlsHandshake(conn, addr, options); err != nil {
+		if conn, err = tlsHandshake(conn, addr, options); err != nil {
 			if conn != nil {
 				_ = conn.Close()
 			}
@@ -73,21 +172,26 @@ func clientDial(protocol, addr string, timeout time.Duration, options *Options)
 	// http
 	if protocol == "http" {
 		if timeout > 0 {
-			return net.DialTimeout("tcp", addr, timeout)
+			return net.DialTimeout("tcp", options.dialAddress(addr), timeout)
 		}
-		return net.Dial("tcp", addr)
+		return net.Dial("tcp", options.dialAddress(addr))
 	}
 
-	conn, err := net.DialTimeout("tcp", addr, timeout)
+	// the tls handshake still uses addr for the server name
+	conn, err := net.DialTimeout("tcp", options.dialAddress(addr), timeout)
 	if err != nil {
 		return nil, err
 	}
 	// https
+	return tlsHandshake(conn, addr, options)
+}
+
+// tlsHandshake prefers the custom handshake in options
+func tlsHandshake(conn net.Conn, addr string, options *Options) (net.Conn, error) {
 	if options.TLSHandshake != nil {
 		return options.TLSHandshake(conn, addr, options)
-	} else {
-		return TlsHandshake(conn, addr, options)
 	}
+	return TlsHandshake(conn, addr, options)
 }
 
 // TlsHandshake tls handshake on a plain connection
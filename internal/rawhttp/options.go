@@ -20,7 +20,50 @@ type Options struct {
 	Proxy                  ContextDialFunc
 	ProxyDialTimeout       time.Duration
 	SNI                    string
-	TLSHandshake           func(conn net.Conn, addr string, options *Options) (net.Conn, error)
+	// ConnectAddress overrides the host dialed for every request, the port of the URL is kept when it has none
+	ConnectAddress string
+	// HostHeader overrides the automatic Host header
+	HostHeader   string
+	TLSHandshake func(conn net.Conn, addr string, options *Options) (net.Conn, error)
+	// MaxIdleConnsPerHost limits the idle connections kept for reuse per host, zero means DefaultMaxIdleConnsPerHost
+	// and a negative value disables keep-alive
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is how long an idle connection is kept, zero means DefaultIdleConnTimeout
+	IdleConnTimeout time.Duration
+}
+
+const (
+	DefaultMaxIdleConnsPerHost = 4
+	DefaultIdleConnTimeout     = 60 * time.Second
+)
+
+func (o *Options) maxIdleConnsPerHost() int {
+	if o.MaxIdleConnsPerHost == 0 {
+		return DefaultMaxIdleConnsPerHost
+	}
+	return o.MaxIdleConnsPerHost
+}
+
+func (o *Options) idleConnTimeout() time.Duration {
+	if o.IdleConnTimeout <= 0 {
+		return DefaultIdleConnTimeout
+	}
+	return o.IdleConnTimeout
+}
+
+// dialAddress returns the address actually dialed for addr
+func (o *Options) dialAddress(addr string) string {
+	if o.ConnectAddress == "" {
+		return addr
+	}
+	if _, _, err := net.SplitHostPort(o.ConnectAddress); err == nil {
+		return o.ConnectAddress
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return o.ConnectAddress
+	}
+	return net.JoinHostPort(o.ConnectAddress, port)
 }
 
 // DefaultOptions is the default configuration options for the client
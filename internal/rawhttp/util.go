@@ -5,7 +5,6 @@ import (
 	"compress/gzip"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
 	stdurl "net/url"
 	"strings"
@@ -45,7 +44,7 @@ func toRequest(method string, path string, query []string, headers map[string][]
 		Body:    body,
 	}
 }
-func toHTTPResponse(conn net.Conn, resp *client.Response) (*http.Response, error) {
+func toHTTPResponse(closer io.Closer, resp *client.Response) (*http.Response, error) {
 	rheaders := fromHeaders(resp.Headers)
 	r := http.Response{
 		ProtoMinor:    resp.Version.Minor,
@@ -64,7 +63,7 @@ func toHTTPResponse(conn net.Conn, resp *client.Response) (*http.Response, error
 			return nil, err
 		}
 	}
-	rc := &readCloser{rbody, conn}
+	rc := &readCloser{rbody, closer}
 
 	r.Body = rc
 
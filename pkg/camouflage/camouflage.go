@@ -0,0 +1,107 @@
+// Package camouflage 隧道请求的外观。数据帧可以被包装成表单、JSON、文件上传或者 Cookie、查询参数中的 base64，
+// 请求的类型（连通性检测、全双工、半双工）也由各个配置自己标记，客户端和服务端需要使用相同的配置
+package camouflage
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Mode 请求的类型
+type Mode byte
+
+const (
+	ModeCheck Mode = iota + 1
+	ModeFull
+	ModeHalf
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeCheck:
+		return "check"
+	case ModeFull:
+		return "full"
+	case ModeHalf:
+		return "half"
+	default:
+		return fmt.Sprintf("mode(%d)", byte(m))
+	}
+}
+
+// 配置的名字
+const (
+	Raw       = "raw"
+	Form      = "form"
+	JSON      = "json"
+	Multipart = "multipart"
+	Cookie    = "cookie"
+	Query     = "query"
+)
+
+// DefaultField 存放数据的字段的默认名字
+const DefaultField = "data"
+
+// headerPayload 放在请求头或者 URL 中的数据的上限，base64 之后约 5.5KB，
+// 加上其他请求头仍然小于 Tomcat 的 maxHttpHeaderSize 和 nginx 的 large_client_header_buffers 的默认值 8KB
+const headerPayload = 4096
+
+// MarkerField 除 raw 外的配置都使用这个字段标记请求的类型
+const MarkerField = "t"
+
+// markers 请求类型在 MarkerField 中的取值
+var markers = map[Mode]string{
+	ModeCheck: "c",
+	ModeFull:  "f",
+	ModeHalf:  "h",
+}
+
+func parseMarker(s string) (Mode, bool) {
+	for mode, marker := range markers {
+		if marker == s {
+			return mode, true
+		}
+	}
+	return 0, false
+}
+
+// Profile 客户端用 Encode 构造请求，服务端用 Decode 还原
+type Profile interface {
+	Name() string
+	// Streaming 为 false 时数据放在请求头或者 URL 中，请求发出前需要读完整个请求体，只能使用半双工模式
+	Streaming() bool
+	// MaxPayload 一个请求能携带的原始数据的最大长度，0 表示不限制。客户端需要把更长的数据拆成多个请求
+	MaxPayload() int
+	// Encode 设置 req 的请求体和类型标记。body 为 *bytes.Reader 时会设置 ContentLength，
+	// 否则作为持续写入的流，每次读到的数据都会立即编码发出
+	Encode(req *http.Request, mode Mode, body io.Reader) error
+	// Decode 识别请求的类型并返回原始的请求体，不是这个配置的请求时返回 false
+	Decode(r *http.Request) (Mode, io.Reader, bool)
+}
+
+// New 按名字创建配置，field 为存放数据的字段名，为空时使用 DefaultField
+func New(name, field string) (Profile, error) {
+	if field == "" {
+		field = DefaultField
+	}
+	if field == MarkerField {
+		return nil, fmt.Errorf("profile field %q is reserved for the mode marker", field)
+	}
+	switch name {
+	case "", Raw:
+		return rawProfile{}, nil
+	case Form:
+		return formProfile{field: field}, nil
+	case JSON:
+		return jsonProfile{field: field}, nil
+	case Multipart:
+		return multipartProfile{field: field}, nil
+	case Cookie:
+		return cookieProfile{field: field}, nil
+	case Query:
+		return queryProfile{field: field}, nil
+	default:
+		return nil, fmt.Errorf("unknown profile %q, expected raw, form, json, multipart, cookie or query", name)
+	}
+}
@@ -0,0 +1,138 @@
+package camouflage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var names = []string{Raw, Form, JSON, Multipart, Cookie, Query}
+
+// roundTrip 经过真实的 HTTP 服务发送请求，返回服务端解码得到的类型和数据
+func roundTrip(t *testing.T, p Profile, mode Mode, body io.Reader) (Mode, []byte) {
+	type result struct {
+		mode Mode
+		data []byte
+		ok   bool
+	}
+	ch := make(chan result, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mode, body, ok := p.Decode(r)
+		var data []byte
+		if ok {
+			var err error
+			data, err = io.ReadAll(body)
+			ok = err == nil
+		}
+		ch <- result{mode, data, ok}
+	}))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/?id=1", nil)
+	require.NoError(t, err)
+	req.Header.Set("Cookie", "JSESSIONID=abc; t=x")
+	require.NoError(t, p.Encode(req, mode, body))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	r := <-ch
+	require.True(t, r.ok, "request not recognized")
+	return r.mode, r.data
+}
+
+func TestRoundTrip(t *testing.T) {
+	data := make([]byte, 100*1024+7)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			p, err := New(name, "")
+			require.NoError(t, err)
+			data := data
+			if limit := p.MaxPayload(); limit > 0 {
+				req := httptest.NewRequest(http.MethodPost, "/", nil)
+				require.Error(t, p.Encode(req, ModeHalf, bytes.NewReader(data[:limit+1])))
+				data = data[:limit]
+			}
+			for _, mode := range []Mode{ModeCheck, ModeFull, ModeHalf} {
+				got, body := roundTrip(t, p, mode, bytes.NewReader(data))
+				require.Equal(t, mode, got)
+				require.True(t, bytes.Equal(data, body), "data mismatch")
+			}
+			got, body := roundTrip(t, p, ModeHalf, nil)
+			require.Equal(t, ModeHalf, got)
+			require.Empty(t, body)
+		})
+	}
+}
+
+// TestStream 流式的请求体分多次写入，每段各自编码
+func TestStream(t *testing.T) {
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			p, err := New(name, "blob")
+			require.NoError(t, err)
+			pr, pw := io.Pipe()
+			var want []byte
+			sizes := []int{1, 2, 3, 4, 5, 1000, 32 * 1024}
+			if p.MaxPayload() > 0 {
+				sizes = sizes[:len(sizes)-1]
+			}
+			go func() {
+				for _, size := range sizes {
+					chunk := make([]byte, size)
+					_, _ = rand.Read(chunk)
+					want = append(want, chunk...)
+					_, _ = pw.Write(chunk)
+				}
+				_ = pw.Close()
+			}()
+			got, body := roundTrip(t, p, ModeFull, pr)
+			require.Equal(t, ModeFull, got)
+			require.True(t, bytes.Equal(want, body), "data mismatch")
+		})
+	}
+}
+
+func TestDecodeOther(t *testing.T) {
+	for _, name := range names {
+		p, err := New(name, "")
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		_, _, ok := p.Decode(req)
+		require.False(t, ok, name)
+
+		// 缺少类型标记
+		req = httptest.NewRequest(http.MethodPost, "/?data=AAAA", bytes.NewReader([]byte("data=AAAA")))
+		req.Header.Set(HeaderKey, contentTypeForm)
+		req.AddCookie(&http.Cookie{Name: DefaultField, Value: "AAAA"})
+		if name != Raw {
+			_, _, ok = p.Decode(req)
+			require.False(t, ok, name)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	_, err := New("xml", "")
+	require.Error(t, err)
+	_, err = New(Form, MarkerField)
+	require.Error(t, err)
+	p, err := New("", "")
+	require.NoError(t, err)
+	require.Equal(t, Raw, p.Name())
+	p, err = New(Cookie, "")
+	require.NoError(t, err)
+	require.False(t, p.Streaming())
+	require.Positive(t, p.MaxPayload())
+	p, err = New(Form, "")
+	require.NoError(t, err)
+	require.Zero(t, p.MaxPayload())
+}
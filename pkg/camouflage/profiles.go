@@ -0,0 +1,331 @@
+package camouflage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// raw 与原版 suo5 相同，请求体是原始的数据帧，用 Content-Type 区分请求的类型
+const (
+	HeaderKey          = "Content-Type"
+	RawValueChecking   = "application/plain"
+	RawValueFull       = "application/octet-stream"
+	RawValueHalf       = "application/x-binary"
+	contentTypeForm    = "application/x-www-form-urlencoded"
+	contentTypeJSON    = "application/json"
+	contentTypeUpload  = "application/octet-stream"
+	multipartMediaType = "multipart/form-data"
+)
+
+type rawProfile struct{}
+
+func (rawProfile) Name() string    { return Raw }
+func (rawProfile) Streaming() bool { return true }
+func (rawProfile) MaxPayload() int { return 0 }
+
+func (rawProfile) Encode(req *http.Request, mode Mode, body io.Reader) error {
+	switch mode {
+	case ModeCheck:
+		req.Header.Set(HeaderKey, RawValueChecking)
+	case ModeFull:
+		req.Header.Set(HeaderKey, RawValueFull)
+	default:
+		req.Header.Set(HeaderKey, RawValueHalf)
+	}
+	if body == nil {
+		body = bytes.NewReader(nil)
+	}
+	if b, ok := body.(*bytes.Reader); ok {
+		data, err := io.ReadAll(b)
+		if err != nil {
+			return err
+		}
+		setBytes(req, data)
+		return nil
+	}
+	setStream(req, body, body)
+	return nil
+}
+
+// Decode 除了检测和全双工以外的 Content-Type 都视为半双工，与原版的脚本一致
+func (rawProfile) Decode(r *http.Request) (Mode, io.Reader, bool) {
+	switch r.Header.Get(HeaderKey) {
+	case "":
+		return 0, nil, false
+	case RawValueChecking:
+		return ModeCheck, r.Body, true
+	case RawValueFull:
+		return ModeFull, r.Body, true
+	default:
+		return ModeHalf, r.Body, true
+	}
+}
+
+// formProfile t=<类型>&<field>=<base64>
+type formProfile struct {
+	field string
+}
+
+func (p formProfile) Name() string  { return Form }
+func (formProfile) Streaming() bool { return true }
+func (formProfile) MaxPayload() int { return 0 }
+
+func (p formProfile) Encode(req *http.Request, mode Mode, body io.Reader) error {
+	req.Header.Set(HeaderKey, contentTypeForm)
+	prefix := fmt.Sprintf("%s=%s&%s=", MarkerField, markers[mode], url.QueryEscape(p.field))
+	return setBody(req, body, []byte(prefix), nil, appendBase64(base64.URLEncoding))
+}
+
+func (p formProfile) Decode(r *http.Request) (Mode, io.Reader, bool) {
+	if !hasMediaType(r, contentTypeForm) {
+		return 0, nil, false
+	}
+	br := bufio.NewReader(r.Body)
+	var mode Mode
+	total := 0
+	for {
+		key, err := readUntil(br, '=', &total)
+		if err != nil {
+			return 0, nil, false
+		}
+		key, _ = url.QueryUnescape(key)
+		if key == p.field {
+			break
+		}
+		value, err := readUntil(br, '&', &total)
+		if err != nil {
+			return 0, nil, false
+		}
+		if key == MarkerField {
+			value, _ = url.QueryUnescape(value)
+			mode, _ = parseMarker(value)
+		}
+	}
+	if mode == 0 {
+		return 0, nil, false
+	}
+	return mode, newBase64Reader(br, base64.URLEncoding, '&'), true
+}
+
+// jsonProfile {"t":"<类型>","<field>":"<base64>"}
+type jsonProfile struct {
+	field string
+}
+
+func (p jsonProfile) Name() string  { return JSON }
+func (jsonProfile) Streaming() bool { return true }
+func (jsonProfile) MaxPayload() int { return 0 }
+
+func (p jsonProfile) Encode(req *http.Request, mode Mode, body io.Reader) error {
+	req.Header.Set(HeaderKey, contentTypeJSON)
+	prefix := fmt.Sprintf(`{"%s":"%s","%s":"`, MarkerField, markers[mode], p.field)
+	return setBody(req, body, []byte(prefix), []byte(`"}`), appendBase64(base64.StdEncoding))
+}
+
+// Decode 只识别 Encode 生成的紧凑格式，字段的值中不能有转义字符
+func (p jsonProfile) Decode(r *http.Request) (Mode, io.Reader, bool) {
+	if !hasMediaType(r, contentTypeJSON) {
+		return 0, nil, false
+	}
+	br := bufio.NewReader(r.Body)
+	total := 0
+	expect := func(s string) bool {
+		for i := 0; i < len(s); i++ {
+			c, err := br.ReadByte()
+			total++
+			if err != nil || c != s[i] {
+				return false
+			}
+		}
+		return true
+	}
+	if !expect(`{"`) {
+		return 0, nil, false
+	}
+	var mode Mode
+	for {
+		key, err := readUntil(br, '"', &total)
+		if err != nil || !expect(`:"`) {
+			return 0, nil, false
+		}
+		if key == p.field {
+			break
+		}
+		value, err := readUntil(br, '"', &total)
+		if err != nil || !expect(`,"`) {
+			return 0, nil, false
+		}
+		if key == MarkerField {
+			mode, _ = parseMarker(value)
+		}
+	}
+	if mode == 0 {
+		return 0, nil, false
+	}
+	return mode, newBase64Reader(br, base64.StdEncoding, '"'), true
+}
+
+// multipartProfile 类型是一个普通的表单字段，数据以 base64 的形式作为名为 blob 的文件上传
+type multipartProfile struct {
+	field string
+}
+
+func (p multipartProfile) Name() string  { return Multipart }
+func (multipartProfile) Streaming() bool { return true }
+func (multipartProfile) MaxPayload() int { return 0 }
+
+func (p multipartProfile) Encode(req *http.Request, mode Mode, body io.Reader) error {
+	boundary := randomBoundary()
+	req.Header.Set(HeaderKey, mime.FormatMediaType(multipartMediaType, map[string]string{"boundary": boundary}))
+	var prefix strings.Builder
+	fmt.Fprintf(&prefix, "--%s\r\nContent-Disposition: form-data; name=\"%s\"\r\n\r\n%s\r\n", boundary, MarkerField, markers[mode])
+	fmt.Fprintf(&prefix, "--%s\r\nContent-Disposition: form-data; name=\"%s\"; filename=\"blob\"\r\n", boundary, p.field)
+	fmt.Fprintf(&prefix, "Content-Type: %s\r\nContent-Transfer-Encoding: base64\r\n\r\n", contentTypeUpload)
+	suffix := fmt.Sprintf("\r\n--%s--\r\n", boundary)
+	return setBody(req, body, []byte(prefix.String()), []byte(suffix), appendBase64(base64.StdEncoding))
+}
+
+func (p multipartProfile) Decode(r *http.Request) (Mode, io.Reader, bool) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get(HeaderKey))
+	if err != nil || mediaType != multipartMediaType || params["boundary"] == "" {
+		return 0, nil, false
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	var mode Mode
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return 0, nil, false
+		}
+		switch part.FormName() {
+		case MarkerField:
+			value, err := io.ReadAll(io.LimitReader(part, 16))
+			if err != nil {
+				return 0, nil, false
+			}
+			mode, _ = parseMarker(string(value))
+		case p.field:
+			if mode == 0 {
+				return 0, nil, false
+			}
+			return mode, newBase64Reader(bufio.NewReader(part), base64.StdEncoding, -1), true
+		}
+	}
+}
+
+func randomBoundary() string {
+	var buf [16]byte
+	_, _ = rand.Read(buf[:])
+	return "----WebKitFormBoundary" + hex.EncodeToString(buf[:])[:16]
+}
+
+// cookieProfile 类型和数据都放在 Cookie 中，请求体为空
+type cookieProfile struct {
+	field string
+}
+
+func (p cookieProfile) Name() string  { return Cookie }
+func (cookieProfile) Streaming() bool { return false }
+func (cookieProfile) MaxPayload() int { return headerPayload }
+
+func (p cookieProfile) Encode(req *http.Request, mode Mode, body io.Reader) error {
+	data, err := readHeaderPayload(body, p.Name())
+	if err != nil {
+		return err
+	}
+	// 去掉转发的请求中原有的同名 Cookie
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != MarkerField && c.Name != p.field {
+			req.AddCookie(c)
+		}
+	}
+	req.AddCookie(&http.Cookie{Name: MarkerField, Value: markers[mode]})
+	req.AddCookie(&http.Cookie{Name: p.field, Value: base64.RawURLEncoding.EncodeToString(data)})
+	setBytes(req, nil)
+	return nil
+}
+
+func (p cookieProfile) Decode(r *http.Request) (Mode, io.Reader, bool) {
+	marker, err := r.Cookie(MarkerField)
+	if err != nil {
+		return 0, nil, false
+	}
+	mode, ok := parseMarker(marker.Value)
+	if !ok {
+		return 0, nil, false
+	}
+	var data []byte
+	if c, err := r.Cookie(p.field); err == nil {
+		if data, err = base64.RawURLEncoding.DecodeString(c.Value); err != nil {
+			return 0, nil, false
+		}
+	}
+	return mode, bytes.NewReader(data), true
+}
+
+// queryProfile 类型和数据都放在查询参数中，请求体为空
+type queryProfile struct {
+	field string
+}
+
+func (p queryProfile) Name() string  { return Query }
+func (queryProfile) Streaming() bool { return false }
+func (queryProfile) MaxPayload() int { return headerPayload }
+
+func (p queryProfile) Encode(req *http.Request, mode Mode, body io.Reader) error {
+	data, err := readHeaderPayload(body, p.Name())
+	if err != nil {
+		return err
+	}
+	q := req.URL.Query()
+	q.Set(MarkerField, markers[mode])
+	q.Set(p.field, base64.RawURLEncoding.EncodeToString(data))
+	req.URL.RawQuery = q.Encode()
+	setBytes(req, nil)
+	return nil
+}
+
+func (p queryProfile) Decode(r *http.Request) (Mode, io.Reader, bool) {
+	q := r.URL.Query()
+	mode, ok := parseMarker(q.Get(MarkerField))
+	if !ok {
+		return 0, nil, false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(q.Get(p.field))
+	if err != nil {
+		return 0, nil, false
+	}
+	return mode, bytes.NewReader(data), true
+}
+
+// readHeaderPayload 读取放在请求头或 URL 中的数据，超过上限时返回错误，避免发出会被前端拒绝的请求
+func readHeaderPayload(body io.Reader, name string) ([]byte, error) {
+	if body == nil {
+		return nil, nil
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > headerPayload {
+		return nil, fmt.Errorf("payload of %d bytes exceeds the %d bytes limit of the %s profile", len(data), headerPayload, name)
+	}
+	return data, nil
+}
+
+func hasMediaType(r *http.Request, expected string) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get(HeaderKey))
+	return err == nil && mediaType == expected
+}
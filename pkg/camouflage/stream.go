@@ -0,0 +1,202 @@
+package camouflage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// maxPrefixSize 服务端读取数据字段之前的内容时的上限
+const maxPrefixSize = 4096
+
+var errPrefixTooLarge = errors.New("request prefix too large")
+
+// encodeReader 依次返回 prefix、编码后的 body 和 suffix。每次 Read 只读取一次 body，
+// 全双工请求中写入的每一帧都会被立即编码发出
+type encodeReader struct {
+	prefix []byte
+	suffix []byte
+	body   io.Reader
+	encode func(dst, src []byte) []byte
+
+	pending []byte
+	tmp     []byte
+	out     []byte
+	eof     bool
+}
+
+func newEncodeReader(prefix, suffix []byte, body io.Reader, encode func(dst, src []byte) []byte) *encodeReader {
+	return &encodeReader{
+		prefix:  prefix,
+		suffix:  suffix,
+		body:    body,
+		encode:  encode,
+		pending: prefix,
+		tmp:     make([]byte, 16*1024),
+	}
+}
+
+func (r *encodeReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		n, err := r.body.Read(r.tmp)
+		if n > 0 {
+			r.out = r.encode(r.out[:0], r.tmp[:n])
+			r.pending = r.out
+		}
+		if errors.Is(err, io.EOF) {
+			r.eof = true
+			r.pending = append(r.pending, r.suffix...)
+		} else if err != nil {
+			return 0, err
+		}
+		if len(r.pending) == 0 && !r.eof {
+			return 0, nil
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// appendBase64 每一段都带有填充，服务端按 4 字节一组解码
+func appendBase64(enc *base64.Encoding) func(dst, src []byte) []byte {
+	return func(dst, src []byte) []byte {
+		return enc.AppendEncode(dst, src)
+	}
+}
+
+// setBody 完整的请求体直接编码，其余的作为流
+func setBody(req *http.Request, body io.Reader, prefix, suffix []byte, encode func(dst, src []byte) []byte) error {
+	if body == nil {
+		body = bytes.NewReader(nil)
+	}
+	r := newEncodeReader(prefix, suffix, body, encode)
+	if _, ok := body.(*bytes.Reader); ok {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		setBytes(req, data)
+		return nil
+	}
+	setStream(req, r, body)
+	return nil
+}
+
+// setStream 关闭请求体时关闭原始的 body
+func setStream(req *http.Request, r io.Reader, body io.Reader) {
+	req.ContentLength = -1
+	req.GetBody = nil
+	if closer, ok := body.(io.Closer); ok {
+		req.Body = readCloser{Reader: r, Closer: closer}
+	} else {
+		req.Body = io.NopCloser(r)
+	}
+}
+
+func setBytes(req *http.Request, data []byte) {
+	req.ContentLength = int64(len(data))
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// base64Reader 按 4 字节一组解码，可以处理多段各自带有填充的 base64 拼接成的流，读到 stop 或者 EOF 时结束
+type base64Reader struct {
+	r    *bufio.Reader
+	enc  *base64.Encoding
+	stop int
+
+	quantum [4]byte
+	n       int
+	dec     [3]byte
+	out     []byte
+	buf     []byte
+	err     error
+}
+
+// newBase64Reader stop 为 -1 时读到 EOF 结束
+func newBase64Reader(r *bufio.Reader, enc *base64.Encoding, stop int) *base64Reader {
+	return &base64Reader{r: r, enc: enc, stop: stop}
+}
+
+func (d *base64Reader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.fill()
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// fill 至少解码一组，之后只处理已经到达的数据，不等待客户端还没有发出的部分
+func (d *base64Reader) fill() {
+	d.buf = d.buf[:0]
+	defer func() { d.out = d.buf }()
+	for {
+		c, err := d.r.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) && d.n != 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			d.err = err
+			return
+		}
+		if int(c) == d.stop {
+			d.err = io.EOF
+			if d.n != 0 {
+				d.err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		d.quantum[d.n] = c
+		d.n++
+		if d.n < len(d.quantum) {
+			continue
+		}
+		d.n = 0
+		n, err := d.enc.Decode(d.dec[:], d.quantum[:])
+		if err != nil {
+			d.err = err
+			return
+		}
+		d.buf = append(d.buf, d.dec[:n]...)
+		if d.r.Buffered() == 0 || len(d.buf) >= 32*1024 {
+			return
+		}
+	}
+}
+
+// readUntil 读到 delim 为止，返回的内容不包括 delim
+func readUntil(r *bufio.Reader, delim byte, total *int) (string, error) {
+	var b []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		*total++
+		if *total > maxPrefixSize {
+			return "", errPrefixTooLarge
+		}
+		if c == delim {
+			return string(b), nil
+		}
+		b = append(b, c)
+	}
+}
@@ -4,18 +4,24 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"github.com/PurpleNewNew/bs5/pkg/camouflage"
+	"github.com/PurpleNewNew/bs5/pkg/metrics"
 	"github.com/PurpleNewNew/bs5/pkg/netrans"
 	log "github.com/kataras/golog"
 	"io"
 	"net/http"
 	"sync"
+	"time"
 )
 
 type fullChunkedReadWriter struct {
 	id         string
+	codec      netrans.Codec
 	reqBody    io.WriteCloser
 	serverResp io.ReadCloser
 	once       sync.Once
+	// writeMu 数据、心跳和关闭的帧按编码的顺序写入请求体
+	writeMu sync.Mutex
 
 	readBuf  bytes.Buffer
 	readTmp  []byte
@@ -23,9 +29,10 @@ type fullChunkedReadWriter struct {
 }
 
 // NewFullChunkedReadWriter 全双工读写流
-func NewFullChunkedReadWriter(id string, reqBody io.WriteCloser, serverResp io.ReadCloser) io.ReadWriteCloser {
+func NewFullChunkedReadWriter(id string, codec netrans.Codec, reqBody io.WriteCloser, serverResp io.ReadCloser) io.ReadWriteCloser {
 	rw := &fullChunkedReadWriter{
 		id:         id,
+		codec:      codec,
 		reqBody:    reqBody,
 		serverResp: serverResp,
 		readBuf:    bytes.Buffer{},
@@ -39,7 +46,7 @@ func (s *fullChunkedReadWriter) Read(p []byte) (n int, err error) {
 	if s.readBuf.Len() != 0 {
 		return s.readBuf.Read(p)
 	}
-	fr, err := netrans.ReadFrame(s.serverResp)
+	fr, err := s.codec.ReadFrame(s.serverResp)
 	if err != nil {
 		return 0, err
 	}
@@ -66,19 +73,30 @@ func (s *fullChunkedReadWriter) Read(p []byte) (n int, err error) {
 
 func (s *fullChunkedReadWriter) Write(p []byte) (n int, err error) {
 	log.Debugf("write socket data, length: %d", len(p))
-	body := BuildBody(NewActionData(s.id, p, ""))
-	return s.WriteRaw(body)
+	return s.WriteFrame(NewActionData(s.id, p, ""))
 }
 
 func (s *fullChunkedReadWriter) WriteRaw(p []byte) (n int, err error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
 	return s.reqBody.Write(p)
 }
 
+func (s *fullChunkedReadWriter) WriteFrame(m map[string][]byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.reqBody.Write(BuildBodyWith(s.codec, m))
+}
+
+func (s *fullChunkedReadWriter) CloseWrite() error {
+	_, err := s.WriteFrame(NewCloseWrite(s.id, ""))
+	return err
+}
+
 func (s *fullChunkedReadWriter) Close() error {
 	s.once.Do(func() {
 		defer s.reqBody.Close()
-		body := BuildBody(NewDelete(s.id, ""))
-		_, _ = s.reqBody.Write(body)
+		_, _ = s.WriteFrame(NewDelete(s.id, ""))
 		_ = s.serverResp.Close()
 	})
 	return nil
@@ -87,35 +105,40 @@ func (s *fullChunkedReadWriter) Close() error {
 type halfChunkedReadWriter struct {
 	ctx        context.Context
 	id         string
+	config     *Suo5Config
+	codec      netrans.Codec
+	readCodec  netrans.Codec
 	client     *http.Client
-	method     string
-	target     string
 	serverResp io.ReadCloser
 	once       sync.Once
 	chunked    bool
-	baseHeader http.Header
 	redirect   string
 
+	// coalescer 非空时写入交给它合并发送，发送失败的错误在之后的 Write、CloseWrite 或 Close 中返回
+	coalescer *halfCoalescer
+	inflight  sync.WaitGroup
+	errMu     sync.Mutex
+	writeErr  error
+
 	readBuf  bytes.Buffer
 	readTmp  []byte
 	writeTmp []byte
 }
 
 // NewHalfChunkedReadWriter 半双工读写流, 用发送请求的方式模拟写
-func NewHalfChunkedReadWriter(ctx context.Context, id string, client *http.Client, method, target string,
-	serverResp io.ReadCloser, baseHeader http.Header, redirect string) io.ReadWriteCloser {
+func NewHalfChunkedReadWriter(ctx context.Context, id string, config *Suo5Config, client *http.Client, serverResp io.ReadCloser) io.ReadWriteCloser {
 	return &halfChunkedReadWriter{
 		ctx:        ctx,
 		id:         id,
+		config:     config,
+		codec:      config.frameCodec(),
+		readCodec:  netrans.NewStream(config.frameCodec()),
 		client:     client,
-		method:     method,
-		target:     target,
 		serverResp: serverResp,
 		readBuf:    bytes.Buffer{},
 		readTmp:    make([]byte, 16*1024),
 		writeTmp:   make([]byte, 8*1024),
-		baseHeader: baseHeader,
-		redirect:   redirect,
+		redirect:   config.redirect(),
 	}
 }
 
@@ -123,7 +146,7 @@ func (s *halfChunkedReadWriter) Read(p []byte) (n int, err error) {
 	if s.readBuf.Len() != 0 {
 		return s.readBuf.Read(p)
 	}
-	fr, err := netrans.ReadFrame(s.serverResp)
+	fr, err := s.readCodec.ReadFrame(s.serverResp)
 	if err != nil {
 		return 0, err
 	}
@@ -151,22 +174,76 @@ func (s *halfChunkedReadWriter) Read(p []byte) (n int, err error) {
 }
 
 func (s *halfChunkedReadWriter) Write(p []byte) (n int, err error) {
-	body := BuildBody(NewActionData(s.id, p, s.redirect))
-	log.Debugf("send request, length: %d", len(body))
-	return s.WriteRaw(body)
+	bodies := splitFrames(s.codec, s.config.maxPayload(), p, func(data []byte) map[string][]byte {
+		return NewActionData(s.id, data, s.redirect)
+	})
+	if s.coalescer == nil {
+		for _, body := range bodies {
+			if delay := s.config.writeDelay(); delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-s.ctx.Done():
+					return 0, s.ctx.Err()
+				}
+			}
+			log.Debugf("send request, length: %d", len(body))
+			if _, err := s.WriteRaw(body); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	}
+
+	if err := s.sendErr(); err != nil {
+		return 0, err
+	}
+	for _, body := range bodies {
+		s.inflight.Add(1)
+		s.coalescer.Submit(s.id, body, func(err error) {
+			if err != nil {
+				s.errMu.Lock()
+				if s.writeErr == nil {
+					s.writeErr = err
+				}
+				s.errMu.Unlock()
+			}
+			s.inflight.Done()
+		})
+	}
+	return len(p), nil
+}
+
+// splitFrames 伪装方式限制了每个请求的长度时，把 data 拆成多帧，每一帧编码之后都不超过 limit。
+// 填充的长度每次编码都会变化，超出时按超出的部分缩小后重新编码。limit 为 0 时只有一帧
+func splitFrames(codec netrans.Codec, limit int, data []byte, build func([]byte) map[string][]byte) [][]byte {
+	if limit <= 0 {
+		return [][]byte{BuildBodyWith(codec, build(data))}
+	}
+	var bodies [][]byte
+	for {
+		n := min(len(data), limit)
+		body := BuildBodyWith(codec, build(data[:n]))
+		for len(body) > limit && n > 1 {
+			n = max(1, n-(len(body)-limit))
+			body = BuildBodyWith(codec, build(data[:n]))
+		}
+		bodies = append(bodies, body)
+		data = data[n:]
+		if len(data) == 0 {
+			return bodies
+		}
+	}
 }
 
 func (s *halfChunkedReadWriter) WriteRaw(p []byte) (n int, err error) {
-	req, err := http.NewRequestWithContext(s.ctx, s.method, s.target, bytes.NewReader(p))
+	req, err := NewTunnelRequest(s.ctx, s.config, camouflage.ModeHalf, bytes.NewReader(p))
 	if err != nil {
 		return 0, err
 	}
 	if s.chunked {
 		req.ContentLength = -1
-	} else {
-		req.ContentLength = int64(len(p))
 	}
-	req.Header = s.baseHeader.Clone()
+	metrics.HalfRequestSent()
 	resp, err := s.client.Do(req)
 	if err != nil {
 		return 0, err
@@ -179,15 +256,46 @@ func (s *halfChunkedReadWriter) WriteRaw(p []byte) (n int, err error) {
 	}
 }
 
+// WriteFrame 单独发送一帧，每个请求体都是新的一串帧。伪装方式限制了请求的长度时，超出的帧无法发送
+func (s *halfChunkedReadWriter) WriteFrame(m map[string][]byte) (int, error) {
+	body := BuildBodyWith(s.codec, m)
+	if limit := s.config.maxPayload(); limit > 0 && len(body) > limit {
+		return 0, fmt.Errorf("frame of %d bytes is too large for the profile", len(body))
+	}
+	return s.WriteRaw(body)
+}
+
+// sendErr 合并发送中第一个失败的错误
+func (s *halfChunkedReadWriter) sendErr() error {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	return s.writeErr
+}
+
+// CloseWrite 等待合并发送的数据发出后再发送，保证服务端先写完数据
+func (s *halfChunkedReadWriter) CloseWrite() error {
+	s.inflight.Wait()
+	if err := s.sendErr(); err != nil {
+		return err
+	}
+	_, err := s.WriteRaw(BuildBodyWith(s.codec, NewCloseWrite(s.id, s.redirect)))
+	return err
+}
+
+// Close 返回之前提交的数据中发送失败的错误，这些数据没有送达服务端
 func (s *halfChunkedReadWriter) Close() error {
+	var sendErr error
 	s.once.Do(func() {
-		body := BuildBody(NewDelete(s.id, s.redirect))
-		req, err := http.NewRequestWithContext(s.ctx, s.method, s.target, bytes.NewReader(body))
+		// 等待已经提交的数据发送完成，保证关闭请求在数据之后到达
+		s.inflight.Wait()
+		sendErr = s.sendErr()
+		body := BuildBodyWith(s.codec, NewDelete(s.id, s.redirect))
+		req, err := NewTunnelRequest(s.ctx, s.config, camouflage.ModeHalf, bytes.NewReader(body))
 		if err != nil {
 			log.Error(err)
 			return
 		}
-		req.Header = s.baseHeader.Clone()
+		metrics.HalfRequestSent()
 		resp, err := s.client.Do(req)
 		if err != nil {
 			log.Errorf("send close error: %v", err)
@@ -196,5 +304,5 @@ func (s *halfChunkedReadWriter) Close() error {
 		_ = resp.Body.Close()
 		_ = s.serverResp.Close()
 	})
-	return nil
+	return sendErr
 }
@@ -1,11 +1,12 @@
 package core
 
 import (
+	"context"
 	"github.com/PurpleNewNew/bs5/internal/rawhttp"
-	utls "github.com/refraction-networking/utls"
+	"github.com/PurpleNewNew/bs5/pkg/camouflage"
 	"net"
 	"net/http"
-	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,11 +19,12 @@ const (
 	HalfDuplex ConnectionType = "half"
 )
 
+// 默认的 raw 伪装方式使用的 Content-Type，其他方式见 camouflage 包
 const (
-	HeaderKey           = "Content-Type"
-	HeaderValueChecking = "application/plain"
-	HeaderValueFull     = "application/octet-stream"
-	HeaderValueHalf     = "application/x-binary"
+	HeaderKey           = camouflage.HeaderKey
+	HeaderValueChecking = camouflage.RawValueChecking
+	HeaderValueFull     = camouflage.RawValueFull
+	HeaderValueHalf     = camouflage.RawValueHalf
 )
 
 type Suo5Client struct {
@@ -30,11 +32,19 @@ type Suo5Client struct {
 	NormalClient    *http.Client
 	NoTimeoutClient *http.Client
 	RawClient       *rawhttp.Client
+	// H2Client Transport 为 h2 时发送全双工的请求
+	H2Client *http.Client
+
+	muxMu       sync.Mutex
+	mux         *muxCarrier
+	muxDisabled bool
+	coalescer   *halfCoalescer
+	// pool 配置了多个地址时不为空，新的连接从中选择一个地址的客户端
+	pool *targetPool
 }
 
-func newRawClient(upstream rawhttp.ContextDialFunc, timeout time.Duration) *rawhttp.Client {
-	return rawhttp.NewClient(&rawhttp.Options{
-		Proxy:                  upstream,
+func newRawClient(config *Suo5Config, timeout time.Duration) *rawhttp.Client {
+	options := &rawhttp.Options{
 		ProxyDialTimeout:       timeout,
 		Timeout:                timeout,
 		FollowRedirects:        false,
@@ -42,24 +52,15 @@ func newRawClient(upstream rawhttp.ContextDialFunc, timeout time.Duration) *rawh
 		AutomaticHostHeader:    true,
 		AutomaticContentLength: true,
 		ForceReadAllBody:       false,
+		SNI:                    config.TLSServerName,
+		ConnectAddress:         config.ConnectAddress,
+		HostHeader:             config.HostHeader,
 		TLSHandshake: func(conn net.Conn, addr string, options *rawhttp.Options) (net.Conn, error) {
-			colonPos := strings.LastIndex(addr, ":")
-			if colonPos == -1 {
-				colonPos = len(addr)
-			}
-			hostname := addr[:colonPos]
-			uTlsConn := utls.UClient(conn, &utls.Config{
-				InsecureSkipVerify: true,
-				ServerName:         hostname,
-				MinVersion:         utls.VersionTLS10,
-				Renegotiation:      utls.RenegotiateOnceAsClient,
-			}, utls.HelloRandomizedNoALPN)
-			if err := uTlsConn.Handshake(); err != nil {
-				_ = conn.Close()
-				return nil, err
-			}
-			return uTlsConn, nil
+			return config.tls.Handshake(context.Background(), conn, addr)
 		},
-	})
-
+	}
+	if config.ProxyClient != nil {
+		options.Proxy = config.ProxyClient.DialContext
+	}
+	return rawhttp.NewClient(options)
 }
@@ -0,0 +1,265 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PurpleNewNew/bs5/pkg/camouflage"
+	"github.com/PurpleNewNew/bs5/pkg/metrics"
+	"github.com/PurpleNewNew/bs5/pkg/netrans"
+	log "github.com/kataras/golog"
+	"github.com/pkg/errors"
+)
+
+var (
+	errBatchUnsupported = errors.New("the server does not support batch")
+	ErrFrameRejected    = errors.New("frame rejected by server")
+)
+
+// halfMaxInflight 同时发送的批次数，一个慢的请求不会挡住其他流
+const halfMaxInflight = 4
+
+// batchFrame 等待合并发送的一帧，done 在发送完成后被调用一次
+type batchFrame struct {
+	stream string
+	body   []byte
+	done   func(err error)
+}
+
+// halfCoalescer 半双工模式下合并写入，在刷新窗口内积累的数据帧（可以属于不同的流）
+// 会被打包进一个 ActionBatch 请求，服务端按顺序返回每一帧的处理结果。
+// 最多 halfMaxInflight 个批次同时发送，一个流有批次在发送时它之后的帧留在队列中，因此同一个流的数据不会乱序
+type halfCoalescer struct {
+	ctx      context.Context
+	client   *http.Client
+	config   *Suo5Config
+	codec    netrans.Codec
+	redirect string
+	offset   int
+	window   time.Duration
+	maxBatch int
+	// limit 伪装方式限制的请求长度，0 表示不限制
+	limit int
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	queue []*batchFrame
+	size  int
+	first time.Time
+	delay time.Duration
+	// busy 有批次正在发送的流，sending 正在发送的批次数
+	busy        map[string]int
+	sending     int
+	unsupported atomic.Bool
+}
+
+func newHalfCoalescer(ctx context.Context, client *Suo5Client) *halfCoalescer {
+	config := client.Config
+	c := &halfCoalescer{
+		ctx:      ctx,
+		client:   client.NormalClient,
+		config:   config,
+		codec:    config.frameCodec(),
+		redirect: config.redirect(),
+		offset:   config.Offset,
+		window:   time.Duration(config.HalfFlushWindow) * time.Millisecond,
+		maxBatch: config.HalfBatchSize,
+		limit:    config.maxPayload(),
+		busy:     make(map[string]int),
+	}
+	if c.limit > 0 {
+		c.maxBatch = min(c.maxBatch, c.limit)
+	}
+	c.cond = sync.NewCond(&c.mu)
+	context.AfterFunc(ctx, func() {
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+	go c.loop()
+	return c
+}
+
+// Submit 将流 stream 的一帧加入队列，队列中积压的数据过多时阻塞，发送结果通过 done 回调
+func (c *halfCoalescer) Submit(stream string, body []byte, done func(err error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.size >= c.maxBatch*4 && c.ctx.Err() == nil {
+		c.cond.Wait()
+	}
+	if err := c.ctx.Err(); err != nil {
+		done(err)
+		return
+	}
+	if len(c.queue) == 0 {
+		c.first = time.Now()
+		c.delay = c.config.writeDelay()
+	}
+	c.queue = append(c.queue, &batchFrame{stream: stream, body: body, done: done})
+	c.size += len(body)
+	c.cond.Broadcast()
+}
+
+func (c *halfCoalescer) loop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		for (len(c.queue) == 0 || c.sending >= halfMaxInflight) && c.ctx.Err() == nil {
+			c.cond.Wait()
+		}
+		if err := c.ctx.Err(); err != nil {
+			for _, fr := range c.queue {
+				fr.done(err)
+			}
+			c.queue = nil
+			return
+		}
+
+		// 等待刷新窗口和随机的延迟结束，期间到达的帧一起发送
+		if wait := c.window + c.delay - time.Since(c.first); wait > 0 && c.size < c.maxBatch {
+			c.mu.Unlock()
+			select {
+			case <-time.After(wait):
+			case <-c.ctx.Done():
+			}
+			c.mu.Lock()
+			continue
+		}
+
+		batch := c.take()
+		if len(batch) == 0 {
+			// 队列中的帧都属于正在发送的流
+			c.cond.Wait()
+			continue
+		}
+		c.sending++
+		c.cond.Broadcast()
+		go func() {
+			c.send(batch)
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.sending--
+			for _, fr := range batch {
+				if c.busy[fr.stream]--; c.busy[fr.stream] == 0 {
+					delete(c.busy, fr.stream)
+				}
+			}
+			c.cond.Broadcast()
+		}()
+	}
+}
+
+// take 按顺序取出不超过 maxBatch 的帧组成一个批次。一个流的帧被留下后，它之后的帧也要留下，
+// 正在发送的流的帧同样留在队列中，等之前的批次完成后再发送
+func (c *halfCoalescer) take() []*batchFrame {
+	var batch, rest []*batchFrame
+	size := 0
+	held := make(map[string]bool)
+	for _, fr := range c.queue {
+		if held[fr.stream] || c.busy[fr.stream] > 0 || (len(batch) != 0 && size+len(fr.body) > c.maxBatch) {
+			held[fr.stream] = true
+			rest = append(rest, fr)
+			continue
+		}
+		batch = append(batch, fr)
+		size += len(fr.body)
+	}
+	for _, fr := range batch {
+		c.busy[fr.stream]++
+	}
+	c.queue = rest
+	c.size -= size
+	return batch
+}
+
+func (c *halfCoalescer) send(batch []*batchFrame) {
+	if len(batch) > 1 && !c.unsupported.Load() {
+		body := c.batchBody(batch)
+		// 加上外层的帧之后超过了请求的上限，分成两半分别发送
+		if c.limit > 0 && len(body) > c.limit {
+			c.send(batch[:len(batch)/2])
+			c.send(batch[len(batch)/2:])
+			return
+		}
+		errs, err := c.postBatch(body, len(batch))
+		if !errors.Is(err, errBatchUnsupported) {
+			for i, fr := range batch {
+				if err != nil {
+					fr.done(err)
+				} else {
+					fr.done(errs[i])
+				}
+			}
+			return
+		}
+		// 服务端没有处理这个请求，可以安全地逐帧重发
+		log.Warnf("%s, fallback to one request per write", err)
+		c.unsupported.Store(true)
+	}
+	for _, fr := range batch {
+		_, err := c.post(fr.body)
+		fr.done(err)
+	}
+}
+
+// batchBody 将 batch 中的帧打包为一个 ActionBatch 帧
+func (c *halfCoalescer) batchBody(batch []*batchFrame) []byte {
+	var buf bytes.Buffer
+	for _, fr := range batch {
+		buf.Write(fr.body)
+	}
+	return BuildBodyWith(c.codec, NewActionBatch(buf.Bytes(), c.redirect))
+}
+
+// postBatch 发送打包了 count 帧的 body，返回服务端对每一帧的处理结果
+func (c *halfCoalescer) postBatch(body []byte, count int) ([]error, error) {
+	data, err := c.post(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < c.offset {
+		return nil, errBatchUnsupported
+	}
+	fr, err := c.codec.ReadFrame(bytes.NewReader(data[c.offset:]))
+	if err != nil {
+		return nil, errors.Wrap(errBatchUnsupported, err.Error())
+	}
+	m, err := Unmarshal(fr.Data)
+	if err != nil {
+		return nil, errors.Wrap(errBatchUnsupported, err.Error())
+	}
+	status := m["s"]
+	if action := m["ac"]; len(action) != 1 || action[0] != ActionBatch || len(status) != count {
+		return nil, errBatchUnsupported
+	}
+	errs := make([]error, count)
+	for i, s := range status {
+		if s != 0x00 {
+			errs[i] = ErrFrameRejected
+		}
+	}
+	return errs, nil
+}
+
+func (c *halfCoalescer) post(body []byte) ([]byte, error) {
+	req, err := NewTunnelRequest(c.ctx, c.config, camouflage.ModeHalf, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	metrics.HalfRequestSent()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status of %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+}
@@ -0,0 +1,98 @@
+package core
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCoalescerClient(t *testing.T, h http.HandlerFunc) *Suo5Client {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	config := DefaultSuo5Config()
+	config.Target = srv.URL
+	require.NoError(t, config.Parse())
+	return &Suo5Client{Config: config, NormalClient: srv.Client()}
+}
+
+// TestCoalescerSlowPost 一个流的请求卡住时其他流继续发送，同一个流之后的帧等它完成
+func TestCoalescerSlowPost(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	started, release := make(chan struct{}), make(chan struct{})
+	client := newCoalescerClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, string(body))
+		mu.Unlock()
+		if string(body) == "slow" {
+			close(started)
+			<-release
+		}
+	})
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newHalfCoalescer(ctx, client)
+	result := func() (chan error, func(error)) {
+		ch := make(chan error, 1)
+		return ch, func(err error) { ch <- err }
+	}
+
+	slowDone, slow := result()
+	c.Submit("a", []byte("slow"), slow)
+	<-started
+	nextDone, next := result()
+	c.Submit("a", []byte("next"), next)
+	otherDone, other := result()
+	c.Submit("b", []byte("other"), other)
+
+	select {
+	case err := <-otherDone:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream b is blocked by the slow request of stream a")
+	}
+	select {
+	case <-nextDone:
+		t.Fatal("frame of stream a is sent before the previous one")
+	default:
+	}
+
+	close(release)
+	require.NoError(t, <-slowDone)
+	require.NoError(t, <-nextDone)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"slow", "other", "next"}, got)
+}
+
+// TestHalfCloseSendError 合并发送失败的数据不能在 Close 时被忽略
+func TestHalfCloseSendError(t *testing.T) {
+	client := newCoalescerClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rw := NewHalfChunkedReadWriter(ctx, "abcd", client.Config, client.NormalClient, io.NopCloser(nil)).(*halfChunkedReadWriter)
+	rw.coalescer = newHalfCoalescer(ctx, client)
+	n, err := rw.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+	require.ErrorContains(t, rw.Close(), "unexpected status of 502")
+}
@@ -1,24 +1,28 @@
 package core
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httputil"
 	"net/url"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/PurpleNewNew/bs5/internal/proxyclient"
-	"github.com/PurpleNewNew/bs5/internal/rawhttp"
+	"github.com/PurpleNewNew/bs5/pkg/camouflage"
 	"github.com/PurpleNewNew/bs5/pkg/netrans"
-	"github.com/gobwas/glob"
+	"github.com/PurpleNewNew/bs5/pkg/route"
 	log "github.com/kataras/golog"
-	utls "github.com/refraction-networking/utls"
 )
 
 type Suo5Config struct {
@@ -34,40 +38,354 @@ type Suo5Config struct {
 	Debug            bool           `json:"debug"`
 	UpstreamProxy    []string       `json:"upstream_proxy"`
 	RedirectURL      string         `json:"redirect_url"`
+	RedirectChain    []string       `json:"redirect_chain" mapstructure:"redirect_chain"`
 	RawHeader        []string       `json:"raw_header"`
 	DisableHeartbeat bool           `json:"disable_heartbeat"`
 	DisableGzip      bool           `json:"disable_gzip"`
 	EnableCookieJar  bool           `json:"enable_cookiejar"`
 	ExcludeDomain    []string       `json:"exclude_domain"`
 	ForwardTarget    string         `json:"forward_target"`
+	Cipher           string         `json:"cipher"`
+	Key              string         `json:"key"`
+	EnableMux        bool           `json:"enable_mux" mapstructure:"enable_mux"`
+	HalfFlushWindow  int            `json:"half_flush_window" mapstructure:"half_flush_window"`
+	HalfBatchSize    int            `json:"half_batch_size" mapstructure:"half_batch_size"`
+	ResumeTimeout    int            `json:"resume_timeout" mapstructure:"resume_timeout"`
+	HTTPListen       string         `json:"http_listen" mapstructure:"http_listen"`
+	// Rules 路由规则，格式为 type,value,action，按顺序匹配
+	Rules []string `json:"rules"`
+	// Upstreams 上游代理链，规则的 action 可以使用这里的名字
+	Upstreams    map[string][]string `json:"upstreams"`
+	DefaultRoute string              `json:"default_route" mapstructure:"default_route"`
+	// Forwards 与代理同时运行的端口转发，格式为 listen->target
+	Forwards []string `json:"forwards"`
+	// ReverseForwards 反向转发，在服务端监听 listen，接受的连接转发到本地的 target，格式同 Forwards
+	ReverseForwards []string `json:"reverse_forwards" mapstructure:"reverse_forwards"`
+	// RedirListen 透明代理的监听地址，接受 iptables REDIRECT 过来的连接，仅支持 Linux
+	RedirListen string `json:"redir_listen" mapstructure:"redir_listen"`
+	// DNSListen 本地 DNS 服务的监听地址，同时监听 UDP 和 TCP
+	DNSListen string `json:"dns_listen" mapstructure:"dns_listen"`
+	// DNSServer 内网的解析服务器，查询以 DNS over TCP 的方式经过隧道发给它
+	DNSServer string `json:"dns_server" mapstructure:"dns_server"`
+	// DNSDomains 通过隧道解析的域名后缀，其余的使用系统的解析器，为空时全部通过隧道解析
+	DNSDomains []string `json:"dns_domains" mapstructure:"dns_domains"`
+	// MetricsListen Prometheus 指标的监听地址，指标在 /metrics 路径下
+	MetricsListen string `json:"metrics_listen" mapstructure:"metrics_listen"`
+	// AdminListen 管理接口的监听地址，可以查看和关闭隧道中的流，以及重新加载路由规则
+	AdminListen string `json:"admin_listen" mapstructure:"admin_listen"`
+	// AdminToken 不为空时管理接口需要 Authorization: Bearer <token>
+	AdminToken string `json:"admin_token" mapstructure:"admin_token"`
+	// Profile 请求的伪装方式，raw、form、json、multipart、cookie 或 query，服务端需要使用相同的配置
+	Profile string `json:"profile"`
+	// ProfileField 伪装后存放数据的字段名，为空时使用 data
+	ProfileField string `json:"profile_field" mapstructure:"profile_field"`
+	// Padding 每个数据帧附加的随机填充的长度分布，uniform:MIN-MAX、normal:MEAN,STDDEV 或 exp:MEAN，为空时不填充
+	Padding string `json:"padding"`
+	// Jitter 半双工模式下每次发送前随机等待的最长时间（毫秒），不为 0 时心跳的间隔也会随机
+	Jitter int `json:"jitter"`
+	// CoverInterval 空闲时发送掩护流量的间隔（毫秒），0 表示关闭
+	CoverInterval int `json:"cover_interval" mapstructure:"cover_interval"`
+	// TLSFingerprint ClientHello 的预设，randomized、chrome、firefox、safari、ios 或 edge
+	TLSFingerprint string `json:"tls_fingerprint" mapstructure:"tls_fingerprint"`
+	// TLSSpecFile 从 JSON 文件读取自定义的 ClientHello，优先于 TLSFingerprint
+	TLSSpecFile string `json:"tls_spec_file" mapstructure:"tls_spec_file"`
+	// TLSServerName 覆盖握手时发送的 SNI，为空时使用目标的域名
+	TLSServerName string `json:"tls_server_name" mapstructure:"tls_server_name"`
+	// TLSALPN 握手时声明的应用层协议，浏览器的预设默认为 http/1.1
+	TLSALPN []string `json:"tls_alpn" mapstructure:"tls_alpn"`
+	// TLSPins 服务端证书公钥的 sha256（base64），证书链中任意一个匹配即可，为空时不校验
+	TLSPins []string `json:"tls_pins" mapstructure:"tls_pins"`
+	// TLSCert TLSKey 双向认证使用的客户端证书和私钥，PEM 格式
+	TLSCert string `json:"tls_cert" mapstructure:"tls_cert"`
+	TLSKey  string `json:"tls_key" mapstructure:"tls_key"`
+	// ConnectAddress 实际连接的 IP 或者前置域名，可以带端口，为空时连接目标 URL 中的地址
+	ConnectAddress string `json:"connect_address" mapstructure:"connect_address"`
+	// HostHeader 覆盖请求的 Host 头，为空时使用目标 URL 中的地址
+	HostHeader string `json:"host_header" mapstructure:"host_header"`
+	// Targets 其他部署了服务端的地址，与 Target 组成连接池，新的连接分配到其中可用的地址
+	Targets []string `json:"targets"`
+	// Balance 连接池的分配方式，round-robin 或 least-conn
+	Balance string `json:"balance"`
+	// HealthInterval 连接池检测各个地址是否可用的间隔（秒），0 表示只在请求失败时标记为不可用
+	HealthInterval int `json:"health_interval" mapstructure:"health_interval"`
+	// Transport 全双工请求使用的协议，http1 或 h2，h2 不可用时回退到 http1
+	Transport string `json:"transport"`
+	// WebSocket 普通的全双工请求不可用时尝试通过 WebSocket 承载，检测后只在实际使用时保持为 true
+	WebSocket bool `json:"websocket"`
+	// RequireEncryption 配置了密钥时要求服务端支持加密，不再回退为异或混淆
+	RequireEncryption bool `json:"require_encryption" mapstructure:"require_encryption"`
 
 	TestExit                string                               `mapstructure:"test_exit"`
-	ExcludeGlobs            []glob.Glob                          `json:"-"`
+	ForwardRules            []ForwardRule                        `json:"-"`
+	ReverseRules            []ForwardRule                        `json:"-"`
 	Offset                  int                                  `json:"-"`
 	Header                  http.Header                          `json:"-"`
+	Codec                   netrans.Codec                        `json:"-"`
+	Camouflage              camouflage.Profile                   `json:"-"`
 	ProxyClient             proxyclient.Dial                     `json:"-"`
 	OnRemoteConnected       func(e *ConnectedEvent)              `json:"-"`
 	OnNewClientConnection   func(event *ClientConnectionEvent)   `json:"-"`
 	OnClientConnectionClose func(event *ClientConnectCloseEvent) `json:"-"`
 	GuiLog                  io.Writer                            `json:"-"`
+	// OnReload 重新读取配置，管理接口在请求中没有给出新的规则时使用它的排除域名和路由规则
+	OnReload func() (*Suo5Config, error) `json:"-"`
+
+	routes   *atomic.Pointer[routeTable]
+	padding  *Padding
+	lastSend atomic.Int64
+	tls      *tlsDialer
 }
 
 func (s *Suo5Config) Parse() error {
-	if err := s.parseExcludeDomain(); err != nil {
+	if err := s.parseCipher(); err != nil {
+		return err
+	}
+	if err := s.parseRoute(); err != nil {
+		return err
+	}
+	if err := s.parseForwards(); err != nil {
+		return err
+	}
+	if err := s.parseProfile(); err != nil {
+		return err
+	}
+	switch s.Balance {
+	case "":
+		s.Balance = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastConn:
+	default:
+		return fmt.Errorf("unknown balance %q, expected round-robin or least-conn", s.Balance)
+	}
+	switch s.Transport {
+	case "":
+		s.Transport = TransportHTTP1
+	case TransportHTTP1, TransportH2:
+	default:
+		return fmt.Errorf("unknown transport %q, expected http1 or h2", s.Transport)
+	}
+	padding, err := ParsePadding(s.Padding)
+	if err != nil {
+		return err
+	}
+	s.padding = padding
+	// 填充过长时拆分后的每一帧几乎都是填充
+	if limit := s.maxPayload(); padding != nil && padding.Mean() > float64(limit/2) && limit > 0 {
+		return fmt.Errorf("padding %s is too large for the %s profile, which carries at most %d bytes per request", padding, s.Camouflage.Name(), limit)
+	}
+	if s.tls, err = newTLSDialer(s); err != nil {
 		return err
 	}
 	return s.parseHeader()
 }
 
-func (s *Suo5Config) parseExcludeDomain() error {
-	s.ExcludeGlobs = make([]glob.Glob, 0)
-	for _, domain := range s.ExcludeDomain {
-		g, err := glob.Compile(domain)
+// maxPayload 一个请求的请求体的上限，0 表示不限制
+func (s *Suo5Config) maxPayload() int {
+	if s.Camouflage == nil {
+		return 0
+	}
+	return s.Camouflage.MaxPayload()
+}
+
+// frameCodec 客户端构造数据帧使用的编解码器，在协商得到的 Codec 之上加入填充，并记录最近一次发送的时间
+func (s *Suo5Config) frameCodec() netrans.Codec {
+	return frameCodec{Codec: s.Codec, padding: s.padding, lastSend: &s.lastSend}
+}
+
+// connectAddress 返回 addr 实际连接的地址，ConnectAddress 没有端口时沿用 addr 的端口
+func (s *Suo5Config) connectAddress(addr string) string {
+	if s.ConnectAddress == "" {
+		return addr
+	}
+	if _, _, err := net.SplitHostPort(s.ConnectAddress); err == nil {
+		return s.ConnectAddress
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return s.ConnectAddress
+	}
+	return net.JoinHostPort(s.ConnectAddress, port)
+}
+
+// redirect 帧中携带的转发地址，RedirectURL 在前，RedirectChain 依次在后，以换行分隔
+func (s *Suo5Config) redirect() string {
+	var hops []string
+	for _, hop := range append([]string{s.RedirectURL}, s.RedirectChain...) {
+		if hop = strings.TrimSpace(hop); hop != "" {
+			hops = append(hops, hop)
+		}
+	}
+	return strings.Join(hops, "\n")
+}
+
+// writeDelay 半双工模式下发送请求前随机等待的时间
+func (s *Suo5Config) writeDelay() time.Duration {
+	if s.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(s.Jitter)+1)) * time.Millisecond
+}
+
+// parseProfile 只能放在请求头或 URL 中的伪装方式不支持全双工
+func (s *Suo5Config) parseProfile() error {
+	profile, err := camouflage.New(s.Profile, s.ProfileField)
+	if err != nil {
+		return err
+	}
+	if !profile.Streaming() {
+		switch s.Mode {
+		case FullDuplex:
+			return fmt.Errorf("profile %s only supports half duplex mode", profile.Name())
+		case AutoDuplex:
+			s.Mode = HalfDuplex
+		}
+	}
+	s.Camouflage = profile
+	return nil
+}
+
+// ForwardRule 端口转发规则，Listen 上接受的连接转发到 Target
+type ForwardRule struct {
+	Listen string
+	Target string
+}
+
+func (r ForwardRule) String() string {
+	return r.Listen + "->" + r.Target
+}
+
+// ParseForwardRule 解析 listen->target 形式的转发规则
+func ParseForwardRule(s string) (ForwardRule, error) {
+	listen, target, ok := strings.Cut(s, "->")
+	rule := ForwardRule{Listen: strings.TrimSpace(listen), Target: strings.TrimSpace(target)}
+	if !ok {
+		return rule, fmt.Errorf("invalid forward rule %q, expected listen->target", s)
+	}
+	for _, addr := range []string{rule.Listen, rule.Target} {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return rule, fmt.Errorf("invalid forward rule %q, %s", s, err)
+		}
+	}
+	return rule, nil
+}
+
+func (s *Suo5Config) parseForwards() error {
+	s.ForwardRules = make([]ForwardRule, 0, len(s.Forwards))
+	for _, f := range s.Forwards {
+		rule, err := ParseForwardRule(f)
+		if err != nil {
+			return err
+		}
+		s.ForwardRules = append(s.ForwardRules, rule)
+	}
+	s.ReverseRules = make([]ForwardRule, 0, len(s.ReverseForwards))
+	for _, f := range s.ReverseForwards {
+		rule, err := ParseForwardRule(f)
 		if err != nil {
 			return err
 		}
-		s.ExcludeGlobs = append(s.ExcludeGlobs, g)
+		s.ReverseRules = append(s.ReverseRules, rule)
+	}
+	return nil
+}
+
+// RouteConfig 可以在运行时重新加载的路由配置
+type RouteConfig struct {
+	ExcludeDomain []string            `json:"exclude_domain"`
+	Rules         []string            `json:"rules"`
+	Upstreams     map[string][]string `json:"upstreams"`
+	DefaultRoute  string              `json:"default_route"`
+}
+
+func (c RouteConfig) clone() RouteConfig {
+	c.ExcludeDomain = slices.Clone(c.ExcludeDomain)
+	c.Rules = slices.Clone(c.Rules)
+	if c.Upstreams != nil {
+		upstreams := make(map[string][]string, len(c.Upstreams))
+		for name, chain := range c.Upstreams {
+			upstreams[name] = slices.Clone(chain)
+		}
+		c.Upstreams = upstreams
+	}
+	return c
+}
+
+// routeTable 路由配置和由它生成的 Router，创建后不再修改，重新加载时整体替换
+type routeTable struct {
+	config RouteConfig
+	router *route.Router
+}
+
+// newRouteTable 排除的域名作为 direct 规则放在最前面
+func newRouteTable(config RouteConfig) (*routeTable, error) {
+	config = config.clone()
+	all := make([]string, 0, len(config.ExcludeDomain)+len(config.Rules))
+	for _, domain := range config.ExcludeDomain {
+		all = append(all, route.TypeDomain+","+domain+","+route.ActionDirect)
+	}
+	all = append(all, config.Rules...)
+	router, err := route.New(all, config.Upstreams, config.DefaultRoute)
+	if err != nil {
+		return nil, err
+	}
+	return &routeTable{config: config, router: router}, nil
+}
+
+// parseRoute 配置文件中的路由规则只在启动时读取，之后以 ActiveRoute 为准
+func (s *Suo5Config) parseRoute() error {
+	table, err := newRouteTable(RouteConfig{
+		ExcludeDomain: s.ExcludeDomain,
+		Rules:         s.Rules,
+		Upstreams:     s.Upstreams,
+		DefaultRoute:  s.DefaultRoute,
+	})
+	if err != nil {
+		return err
+	}
+	s.routes = &atomic.Pointer[routeTable]{}
+	s.routes.Store(table)
+	return nil
+}
+
+// Router 当前使用的路由规则，ReloadRoute 之后会被替换
+func (s *Suo5Config) Router() *route.Router {
+	if s.routes == nil {
+		return nil
+	}
+	return s.routes.Load().router
+}
+
+// ActiveRoute 当前生效的路由配置，返回的是副本
+func (s *Suo5Config) ActiveRoute() RouteConfig {
+	if s.routes == nil {
+		return RouteConfig{}
+	}
+	return s.routes.Load().config.clone()
+}
+
+// ReloadRoute 换用 from 中的排除域名和路由规则，已经建立的连接不受影响。新的规则有错误时保留原来的规则
+func (s *Suo5Config) ReloadRoute(from RouteConfig) error {
+	if s.routes == nil {
+		return errors.New("routing is not initialized")
+	}
+	table, err := newRouteTable(from)
+	if err != nil {
+		return err
 	}
+	s.routes.Store(table)
+	return nil
+}
+
+// parseCipher 配置了密钥时先假定使用 AEAD 加密，最终是否启用由 checkConnectMode 与服务端协商决定
+func (s *Suo5Config) parseCipher() error {
+	s.Codec = netrans.XORCodec
+	if s.Key == "" {
+		return nil
+	}
+	codec, err := netrans.NewAEADCodec(s.Cipher, s.Key)
+	if err != nil {
+		return err
+	}
+	s.Codec = codec
 	return nil
 }
 
@@ -85,17 +403,21 @@ func (s *Suo5Config) parseHeader() error {
 	}
 
 	if s.Header.Get("Referer") == "" {
-		n := strings.LastIndex(s.Target, "/")
-		if n == -1 {
-			s.Header.Set("Referer", s.Target)
-		} else {
-			s.Header.Set("Referer", s.Target[:n+1])
-		}
+		s.Header.Set("Referer", referer(s.Target))
 	}
 
 	return nil
 }
 
+// referer 默认的 Referer 为目标所在的目录
+func referer(target string) string {
+	n := strings.LastIndex(target, "/")
+	if n == -1 {
+		return target
+	}
+	return target[:n+1]
+}
+
 func (config *Suo5Config) Init(ctx context.Context) (*Suo5Client, error) {
 	err := config.Parse()
 	if err != nil {
@@ -120,20 +442,51 @@ func (config *Suo5Config) Init(ctx context.Context) (*Suo5Client, error) {
 		Transport: tr.Clone(),
 	}
 
-	var rawClient *rawhttp.Client
-	if config.ProxyClient != nil {
-		rawClient = newRawClient(config.ProxyClient.DialContext, 0)
-	} else {
-		rawClient = newRawClient(nil, 0)
-	}
+	rawClient := newRawClient(config, 0)
 
 	log.Infof("header: %s", config.HeaderString())
 	log.Infof("method: %s", config.Method)
+	client := &Suo5Client{
+		Config:          config,
+		NormalClient:    normalClient,
+		NoTimeoutClient: noTimeoutClient,
+		RawClient:       rawClient,
+	}
+	if len(config.Targets) != 0 {
+		if config.Transport == TransportH2 {
+			client.H2Client = newH2Client(config)
+		}
+		if err := client.initPool(ctx); err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+
 	log.Infof("connecting to target %s", config.Target)
-	result, offset, err := checkConnectMode(ctx, config)
-	if err != nil {
+	probe := probeH2(ctx, config)
+	if probe == nil {
+		probe, err = checkConnectMode(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ws := probeWebSocket(ctx, config, probe); ws != nil {
+		probe = ws
+	}
+	if err := config.applyProbe(probe); err != nil {
 		return nil, err
 	}
+	if config.Transport == TransportH2 {
+		log.Infof("full duplex requests will be multiplexed over h2")
+		client.H2Client = newH2Client(config)
+	}
+	client.start(ctx)
+	return client, nil
+}
+
+// applyProbe 根据检测的结果确定连接模式、响应的偏移和编解码器
+func (config *Suo5Config) applyProbe(probe *connectModeResult) error {
+	result := probe.mode
 	if config.Mode == AutoDuplex {
 		config.Mode = result
 		if result == FullDuplex {
@@ -145,16 +498,32 @@ func (config *Suo5Config) Init(ctx context.Context) (*Suo5Client, error) {
 		if result == FullDuplex && config.Mode == HalfDuplex {
 			log.Infof("the target support full duplex, you can try FullDuplex mode to obtain better performance")
 		} else if result == HalfDuplex && config.Mode == FullDuplex {
-			return nil, fmt.Errorf("the target doesn't support full duplex, you should use HalfDuplex or AutoDuplex mode")
+			return fmt.Errorf("the target doesn't support full duplex, you should use HalfDuplex or AutoDuplex mode")
+		}
+	}
+	config.Codec = probe.codec
+	config.Offset = probe.offset
+	return nil
+}
+
+// start 启动半双工的合并发送和掩护流量，ctx 结束时停止
+func (suo *Suo5Client) start(ctx context.Context) {
+	config := suo.Config
+	if config.Mode == HalfDuplex && config.HalfFlushWindow > 0 && config.HalfBatchSize > 0 {
+		log.Infof("coalesce half duplex writes, flush window %dms, max batch size %d", config.HalfFlushWindow, config.HalfBatchSize)
+		suo.coalescer = newHalfCoalescer(ctx, suo)
+	}
+	if config.CoverInterval > 0 {
+		log.Infof("send cover traffic every %dms while idle", config.CoverInterval)
+		go suo.coverTraffic(ctx)
+	}
+	if config.EnableMux {
+		if config.Mode == FullDuplex {
+			log.Infof("mux enabled, all connections will share one request")
+		} else {
+			log.Warnf("mux requires FullDuplex mode, ignored")
 		}
 	}
-	config.Offset = offset
-	return &Suo5Client{
-		Config:          config,
-		NormalClient:    normalClient,
-		NoTimeoutClient: noTimeoutClient,
-		RawClient:       rawClient,
-	}, nil
 }
 
 // newHTTPTransport creates and configures an http.Transport based on the Suo5Config.
@@ -167,6 +536,9 @@ func newHTTPTransport(config *Suo5Config) (*http.Transport, error) {
 	if len(config.ExcludeDomain) != 0 {
 		log.Infof("exclude domains: %v", config.ExcludeDomain)
 	}
+	if len(config.Rules) != 0 {
+		log.Infof("route rules: %v, default route: %s", config.Rules, config.DefaultRoute)
+	}
 
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{
@@ -174,29 +546,20 @@ func newHTTPTransport(config *Suo5Config) (*http.Transport, error) {
 			Renegotiation:      tls.RenegotiateOnceAsClient,
 			InsecureSkipVerify: true,
 		},
-		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			conn, err := net.DialTimeout(network, addr, 5*time.Second)
-			if err != nil {
-				return nil, err
-			}
-			colonPos := strings.LastIndex(addr, ":")
-			if colonPos == -1 {
-				colonPos = len(addr)
-			}
-			hostname := addr[:colonPos]
-			tlsConfig := &utls.Config{
-				ServerName:         hostname,
-				InsecureSkipVerify: true,
-				Renegotiation:      utls.RenegotiateOnceAsClient,
-				MinVersion:         utls.VersionTLS10,
-			}
-			uTlsConn := utls.UClient(conn, tlsConfig, utls.HelloRandomizedNoALPN)
-			if err = uTlsConn.HandshakeContext(ctx); err != nil {
-				_ = conn.Close()
-				return nil, err
-			}
-			return uTlsConn, nil
-		},
+	}
+	// 连接 ConnectAddress，SNI 和 Host 仍然来自目标的 URL 或者单独的配置
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, config.connectAddress(addr))
+	}
+	tr.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		conn, err := tr.DialContext(dialCtx, network, addr)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		return config.tls.Handshake(ctx, conn, addr)
 	}
 
 	if len(config.UpstreamProxy) > 0 {
@@ -210,7 +573,10 @@ func newHTTPTransport(config *Suo5Config) (*http.Transport, error) {
 		if err != nil {
 			return nil, err
 		}
-		tr.DialContext = config.ProxyClient.DialContext
+		// 配置了上游代理时 TLS 连接也经过代理
+		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return config.ProxyClient.DialContext(ctx, network, config.connectAddress(addr))
+		}
 	}
 
 	if config.RedirectURL != "" {
@@ -220,6 +586,14 @@ func newHTTPTransport(config *Suo5Config) (*http.Transport, error) {
 		}
 		log.Infof("using redirect url %v", config.RedirectURL)
 	}
+	for _, hop := range config.RedirectChain {
+		if _, err := url.Parse(hop); err != nil || strings.TrimSpace(hop) == "" {
+			return nil, fmt.Errorf("invalid redirect chain url %q", hop)
+		}
+	}
+	if len(config.RedirectChain) != 0 {
+		log.Infof("using redirect chain %s", strings.Join(config.RedirectChain, " -> "))
+	}
 
 	return tr, nil
 }
@@ -256,59 +630,117 @@ func DefaultSuo5Config() *Suo5Config {
 		Debug:            false,
 		UpstreamProxy:    []string{},
 		RedirectURL:      "",
+		RedirectChain:    []string{},
 		RawHeader:        []string{"User-Agent: Mozilla/5.0 (Linux; Android 6.0; Nexus 5 Build/MRA58N) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/109.1.2.3"},
 		DisableHeartbeat: false,
 		DisableGzip:      false,
 		EnableCookieJar:  false,
 		ForwardTarget:    "",
+		HalfFlushWindow:  10,
+		HalfBatchSize:    1024 * 256,
+		ResumeTimeout:    60,
+		DefaultRoute:     "tunnel",
+		Profile:          camouflage.Raw,
+		ProfileField:     camouflage.DefaultField,
+		TLSFingerprint:   TLSRandomized,
+		Balance:          BalanceRoundRobin,
+		HealthInterval:   10,
+		Transport:        TransportHTTP1,
+		WebSocket:        false,
 	}
 }
 
-func checkConnectMode(ctx context.Context, config *Suo5Config) (ConnectionType, int, error) {
+type connectModeResult struct {
+	mode   ConnectionType
+	offset int
+	codec  netrans.Codec
+	// timedOut 检测超时，此时按照半双工处理
+	timedOut bool
+	// response 无法识别的响应，用于排查问题
+	response string
+}
+
+func checkConnectMode(ctx context.Context, config *Suo5Config) (*connectModeResult, error) {
+	probe, err := probeConnectMode(ctx, config, true)
+	if err != nil {
+		if probe != nil {
+			log.Errorf("response are as follows:\n%s", probe.response)
+		}
+		return nil, err
+	}
+	if probe.timedOut {
+		log.Warnf("connection mode check timed out: %v", context.DeadlineExceeded)
+		if _, ok := config.Codec.(*netrans.AEADCodec); ok {
+			log.Warnf("unable to check whether the server supports encryption, keep frame encryption enabled")
+		}
+		return probe, nil
+	}
+	log.Infof("got data offset, %d", probe.offset)
+	if _, ok := config.Codec.(*netrans.AEADCodec); ok {
+		if probe.codec == config.Codec {
+			log.Infof("frame encryption enabled")
+		} else {
+			log.Warnf("the server does not support encryption, fallback to xor obfuscation")
+		}
+	}
+	return probe, nil
+}
+
+// probeConnectMode 发送一个检测请求，不输出日志，连接池的健康检查也使用它。detect 为 false 时一次性发送请求体，
+// 只检查服务端是否可用，得到的结果总是半双工。响应无法识别时同时返回结果和错误，结果中只有 response
+func probeConnectMode(ctx context.Context, config *Suo5Config, detect bool) (*connectModeResult, error) {
 	// Use a context with a timeout for this check
 	checkCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	var rawClient *rawhttp.Client
-	if config.ProxyClient != nil {
-		rawClient = newRawClient(config.ProxyClient.DialContext, 0) // Timeout is handled by context
-	} else {
-		rawClient = newRawClient(nil, 0)
+	do := newRawClient(config, 0).Do // Timeout is handled by context
+	if config.Transport == TransportH2 {
+		h2Client := newH2Client(config)
+		defer h2Client.CloseIdleConnections()
+		do = h2Client.Do
 	}
 
-	randLen := rander.Intn(1024)
+	randLen := rand.Intn(1024)
 	if randLen <= 32 {
 		randLen += 32
 	}
 	data := RandString(randLen)
-	ch := make(chan []byte, 1)
-	ch <- []byte(data)
-
-	// Use a goroutine to close the channel when the context is done
-	go func() {
-		<-checkCtx.Done()
-		close(ch)
-	}()
+	streaming := detect && config.Camouflage.Streaming()
+	var reqBody io.Reader
+	if streaming {
+		ch := make(chan []byte, 1)
+		ch <- []byte(data)
+
+		// Use a goroutine to close the channel when the context is done
+		go func() {
+			<-checkCtx.Done()
+			close(ch)
+		}()
+		reqBody = netrans.NewChannelReader(ch)
+	} else {
+		// 数据需要一次性放入请求头或 URL，无法通过耗时判断是否支持全双工
+		reqBody = bytes.NewReader([]byte(data))
+	}
 
-	req, err := http.NewRequestWithContext(checkCtx, config.Method, config.Target, netrans.NewChannelReader(ch))
+	req, err := NewTunnelRequest(checkCtx, config, camouflage.ModeCheck, reqBody)
 	if err != nil {
-		return Undefined, 0, err
+		return nil, err
 	}
-	req.Header = config.Header.Clone()
-	req.Header.Set(HeaderKey, HeaderValueChecking)
 
 	now := time.Now()
-	resp, err := rawClient.Do(req)
+	resp, err := do(req)
 	if err != nil {
 		// Check if the error is due to context cancellation
-		if ctxErr := checkCtx.Err(); ctxErr != nil {
-			log.Warnf("connection mode check timed out: %v", ctxErr)
+		if checkCtx.Err() != nil {
 			// This is not a fatal error, we can assume HalfDuplex
-			return HalfDuplex, 0, nil
+			// 无法得知服务端是否支持加密，保留配置的编解码器，避免拖慢响应就能让加密降级
+			return &connectModeResult{mode: HalfDuplex, codec: config.Codec, timedOut: true}, nil
 		}
-		return Undefined, 0, err
+		return nil, err
 	}
 	defer func(Body io.ReadCloser) {
+		// 先结束请求体，h2 的响应体关闭时会等待请求体发送完
+		cancel()
 		err := Body.Close()
 		if err != nil {
 			log.Warnf("got error while closing body: %s", err)
@@ -325,15 +757,38 @@ func checkConnectMode(ctx context.Context, config *Suo5Config) (ConnectionType,
 	offset := strings.Index(string(body), data[:32])
 	if offset == -1 {
 		header, _ := httputil.DumpResponse(resp, false)
-		log.Errorf("response are as follows:\n%s", string(header)+string(body))
-		return Undefined, 0, fmt.Errorf("got unexpected body, remote server test failed")
+		return &connectModeResult{response: string(header) + string(body)}, fmt.Errorf("got unexpected body, remote server test failed")
+	}
+
+	codec, err := negotiateCodec(config, body[offset+32:])
+	if err != nil {
+		return nil, err
 	}
-	log.Infof("got data offset, %d", offset)
 
 	// If the request completed quickly, we can assume FullDuplex
-	if duration < 3*time.Second {
-		return FullDuplex, offset, nil
+	if duration < 3*time.Second && streaming {
+		return &connectModeResult{mode: FullDuplex, offset: offset, codec: codec}, nil
 	} else {
-		return HalfDuplex, offset, nil
+		return &connectModeResult{mode: HalfDuplex, offset: offset, codec: codec}, nil
+	}
+}
+
+// negotiateCodec 支持加密的服务端会在回显数据之后追加一个加密帧，内容由服务端生成，能通过认证说明双方的密钥一致。
+// 旧版本的服务端没有这部分内容，此时回退为异或混淆，开启 RequireEncryption 时直接报错；能读到加密帧但无法解密说明密钥不一致
+func negotiateCodec(config *Suo5Config, rest []byte) (netrans.Codec, error) {
+	aead, ok := config.Codec.(*netrans.AEADCodec)
+	if !ok {
+		return netrans.XORCodec, nil
+	}
+	fr, err := netrans.ReadAnyFrame(bytes.NewReader(rest), aead)
+	if errors.Is(err, netrans.ErrAuthFailed) || errors.Is(err, netrans.ErrCipherMismatch) {
+		return nil, fmt.Errorf("encryption negotiation failed, please check the key and cipher, %w", err)
+	}
+	if err != nil || !fr.Sealed {
+		if config.RequireEncryption {
+			return nil, fmt.Errorf("encryption negotiation failed, the server does not support encryption")
+		}
+		return netrans.XORCodec, nil
 	}
+	return aead, nil
 }
@@ -0,0 +1,51 @@
+package core
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseForwardRule(t *testing.T) {
+	rule, err := ParseForwardRule(" 127.0.0.1:80 -> 10.0.0.1:8080 ")
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:80", rule.Listen)
+	assert.Equal(t, "10.0.0.1:8080", rule.Target)
+
+	for _, s := range []string{"127.0.0.1:80", "127.0.0.1->10.0.0.1:80", "127.0.0.1:80->"} {
+		_, err := ParseForwardRule(s)
+		assert.Error(t, err, s)
+	}
+}
+
+// TestProbeTimeoutKeepsEncryption 探测请求超时后无法得知服务端是否支持加密，不能因此降级为异或混淆
+func TestProbeTimeoutKeepsEncryption(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+
+	config := DefaultSuo5Config()
+	config.Target = srv.URL
+	config.Transport = TransportH2
+	config.Key = "secret"
+	config.RequireEncryption = true
+	require.NoError(t, config.Parse())
+
+	probe, err := probeConnectMode(context.Background(), config, true)
+	require.NoError(t, err)
+	require.True(t, probe.timedOut)
+	assert.Equal(t, config.Codec, probe.codec)
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"github.com/PurpleNewNew/bs5/pkg/camouflage"
+	"github.com/PurpleNewNew/bs5/pkg/metrics"
 	netrans2 "github.com/PurpleNewNew/bs5/pkg/netrans"
 	log "github.com/kataras/golog"
 	"github.com/pkg/errors"
@@ -11,6 +13,8 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"sync"
+	"time"
 )
 
 var (
@@ -32,39 +36,158 @@ type Suo5Conn struct {
 	io.ReadWriteCloser
 	ctx context.Context
 	*Suo5Client
+
+	// node 使用连接池时连接所在的地址，关闭时更新它的连接数
+	node      *targetNode
+	closeOnce sync.Once
 }
 
 // 连接方法，
 func (suo *Suo5Conn) Connect(address string) error {
+	if suo.pool != nil {
+		node, err := suo.balance(func() error {
+			return suo.Connect(address)
+		})
+		if err == nil {
+			node.active.Add(1)
+			suo.node = node
+		}
+		return err
+	}
+
 	id := RandString(8)
+	host, port, _ := net.SplitHostPort(address)
+	uport, _ := strconv.Atoi(port)
+
+	if suo.Config.EnableMux && suo.Config.Mode == FullDuplex {
+		start := time.Now()
+		carrier, err := suo.getMuxCarrier(suo.ctx)
+		if err == nil {
+			stream, err := carrier.Open(suo.ctx, id, host, uint16(uport))
+			if err != nil {
+				metrics.DialFailed(metricsModeMux, failureReason(err))
+				return err
+			}
+			metrics.ObserveConnect(metricsModeMux, start)
+			suo.ReadWriteCloser = metrics.NewStream(metricsModeMux, stream)
+			return nil
+		}
+		if !errors.Is(err, errMuxUnsupported) {
+			return targetError{err}
+		}
+	}
+
+	return suo.connect(id, NewActionCreate(id, host, uint16(uport), suo.Config.redirect()))
+}
+
+// Attach 接管服务端在反向监听上接受的连接，id 来自 RemoteListener.Accept，不使用多路复用
+func (suo *Suo5Conn) Attach(id string) error {
+	create := NewActionCreate(id, "", 0, suo.Config.redirect())
+	create["a"] = []byte(id)
+	return suo.connect(id, create)
+}
+
+func (suo *Suo5Conn) connect(id string, create map[string][]byte) error {
+	resumable := suo.Config.Mode == FullDuplex && suo.Config.ResumeTimeout > 0
+	if resumable {
+		// 请求服务端保留这个流，服务端支持时会在响应中带上 rs
+		create["rs"] = []byte{0x01}
+	}
+	mode := string(suo.Config.Mode)
+	start := time.Now()
+	chWR, respBody, codec, serverData, err := suo.dial(create)
+	if err != nil {
+		metrics.DialFailed(mode, failureReason(err))
+		return err
+	}
+	metrics.ObserveConnect(mode, start)
+
+	var streamRW io.ReadWriteCloser
+	if resumable && len(serverData["rs"]) != 0 {
+		streamRW = newResumableReadWriter(suo.ctx, suo.Suo5Client, id, chWR, respBody, codec)
+	} else {
+		streamRW = suo.newStreamRW(id, chWR, respBody, codec)
+	}
+
+	if !suo.Config.DisableHeartbeat {
+		streamRW = newHeartbeatRW(streamRW.(RawReadWriteCloser), id, suo.Config.redirect(), suo.Config.frameCodec(), heartbeatInterval, suo.Config.Jitter > 0)
+	}
+
+	suo.ReadWriteCloser = metrics.NewStream(mode, streamRW)
+	return nil
+}
+
+// Close 关闭流，使用连接池时同时减少所在地址的连接数
+func (suo *Suo5Conn) Close() error {
+	if suo.node != nil {
+		suo.closeOnce.Do(func() {
+			suo.node.active.Add(-1)
+		})
+	}
+	return suo.ReadWriteCloser.Close()
+}
+
+// CloseWrite 半关闭，服务端会关闭到目标连接的写入端，之后仍然可以读取目标返回的数据
+func (suo *Suo5Conn) CloseWrite() error {
+	if cw, ok := suo.ReadWriteCloser.(CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("stream does not support close write")
+}
+
+// metricsModeMux 多路复用的流在指标中单独统计
+const metricsModeMux = "mux"
+
+// failureReason 指标中使用的错误类别
+func failureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrConnRefused):
+		return "conn_refused"
+	case errors.Is(err, ErrDialFailed):
+		return "dial_failed"
+	case errors.Is(err, ErrHostUnreachable):
+		return "host_unreachable"
+	default:
+		return "other"
+	}
+}
+
+// dial 发送创建流的请求并检查服务端返回的状态，成功时返回全双工的请求体写入端、响应体、
+// 之后的帧继续使用的编解码器以及服务端的第一帧
+func (suo *Suo5Conn) dial(create map[string][]byte) (io.WriteCloser, io.ReadCloser, netrans2.Codec, map[string][]byte, error) {
 	var req *http.Request
 	var resp *http.Response
 	var err error
-	host, port, _ := net.SplitHostPort(address)
-	uport, _ := strconv.Atoi(port)
-	dialData := BuildBody(NewActionCreate(id, host, uint16(uport), suo.Config.RedirectURL))
+	codec := netrans2.NewStream(suo.Config.frameCodec())
+	dialData := BuildBodyWith(codec, create)
 	ch, chWR := netrans2.NewChannelWriteCloser(suo.ctx)
-
-	baseHeader := suo.Config.Header.Clone()
+	connected := false
+	defer func() {
+		// 连接失败时释放请求体和响应体，否则全双工的请求会一直挂在服务端
+		if !connected {
+			_ = chWR.Close()
+			if resp != nil {
+				_ = resp.Body.Close()
+			}
+		}
+	}()
 
 	if suo.Config.Mode == FullDuplex {
 		body := netrans2.MultiReadCloser(
 			io.NopCloser(bytes.NewReader(dialData)),
 			io.NopCloser(netrans2.NewChannelReader(ch)),
 		)
-		req, _ = http.NewRequestWithContext(suo.ctx, suo.Config.Method, suo.Config.Target, body)
-		baseHeader.Set(HeaderKey, HeaderValueFull)
-		req.Header = baseHeader
-		resp, err = suo.RawClient.Do(req)
+		resp, err = suo.openFull(suo.ctx, body)
 	} else {
-		req, _ = http.NewRequestWithContext(suo.ctx, suo.Config.Method, suo.Config.Target, bytes.NewReader(dialData))
-		baseHeader.Set(HeaderKey, HeaderValueHalf)
-		req.Header = baseHeader
-		resp, err = suo.NoTimeoutClient.Do(req)
+		req, err = NewTunnelRequest(suo.ctx, suo.Config, camouflage.ModeHalf, bytes.NewReader(dialData))
+		if err == nil {
+			metrics.HalfRequestSent()
+			resp, err = suo.NoTimeoutClient.Do(req)
+		}
 	}
 	if err != nil {
 		log.Debugf("request error to target, %s", err)
-		return errors.Wrap(ErrHostUnreachable, err.Error())
+		return nil, nil, nil, nil, targetError{errors.Wrap(ErrHostUnreachable, err.Error())}
 	}
 
 	if resp.Header.Get("Set-Cookie") != "" && suo.Config.EnableCookieJar {
@@ -77,39 +200,101 @@ func (suo *Suo5Conn) Connect(address string) error {
 		_, err = io.CopyN(io.Discard, resp.Body, int64(suo.Config.Offset))
 		if err != nil {
 			log.Errorf("failed to skip offset, %s", err)
-			return errors.Wrap(ErrDialFailed, err.Error())
+			return nil, nil, nil, nil, targetError{errors.Wrap(ErrDialFailed, err.Error())}
 		}
 	}
-	fr, err := netrans2.ReadFrame(resp.Body)
+	fr, err := codec.ReadFrame(resp.Body)
 	if err != nil {
 		log.Errorf("failed to read response frame, may be the target has load balancing?")
 
-		return errors.Wrap(ErrHostUnreachable, err.Error())
+		return nil, nil, nil, nil, targetError{errors.Wrap(ErrHostUnreachable, err.Error())}
 	}
 	log.Debugf("recv dial response from server: length: %d", fr.Length)
 
 	serverData, err := Unmarshal(fr.Data)
 	if err != nil {
 		log.Errorf("failed to process frame, %v", err)
-		return errors.Wrap(ErrHostUnreachable, err.Error())
+		return nil, nil, nil, nil, targetError{errors.Wrap(ErrHostUnreachable, err.Error())}
 	}
 	status := serverData["s"]
 	if len(status) != 1 || status[0] != 0x00 {
-		return errors.Wrap(ErrHostUnreachable, fmt.Sprintf("failed to dial, status: %v", status))
+		return nil, nil, nil, nil, errors.Wrap(ErrHostUnreachable, fmt.Sprintf("failed to dial, status: %v", status))
 	}
+	connected = true
+	return chWR, resp.Body, codec, serverData, nil
+}
 
-	var streamRW io.ReadWriteCloser
+// newStreamRW 根据连接模式创建流的读写器，codec 为 dial 返回的编解码器，半双工时 chWR 不会被使用
+func (suo *Suo5Conn) newStreamRW(id string, chWR io.WriteCloser, respBody io.ReadCloser, codec netrans2.Codec) streamReadWriter {
 	if suo.Config.Mode == FullDuplex {
-		streamRW = NewFullChunkedReadWriter(id, chWR, resp.Body)
-	} else {
-		streamRW = NewHalfChunkedReadWriter(suo.ctx, id, suo.NormalClient, suo.Config.Method, suo.Config.Target,
-			resp.Body, baseHeader, suo.Config.RedirectURL)
+		return NewFullChunkedReadWriter(id, codec, chWR, respBody).(streamReadWriter)
 	}
+	_ = chWR.Close()
+	rw := NewHalfChunkedReadWriter(suo.ctx, id, suo.Config, suo.NormalClient, respBody).(*halfChunkedReadWriter)
+	rw.coalescer = suo.coalescer
+	// 半双工每个上行请求单独编码，只有响应体延续 dial 时的序号
+	rw.readCodec = codec
+	return rw
+}
 
-	if !suo.Config.DisableHeartbeat {
-		streamRW = NewHeartbeatRW(streamRW.(RawReadWriteCloser), id, suo.Config.RedirectURL)
+// NewTunnelRequest 按照配置的伪装方式构造发往服务端的请求，body 为 *bytes.Reader 时是完整的请求体，否则作为流发送
+func NewTunnelRequest(ctx context.Context, config *Suo5Config, mode camouflage.Mode, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, config.Method, config.Target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = config.Header.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
 	}
+	if config.HostHeader != "" {
+		req.Host = config.HostHeader
+	}
+	profile := config.Camouflage
+	if profile == nil {
+		profile, _ = camouflage.New(camouflage.Raw, "")
+	}
+	if err := profile.Encode(req, mode, body); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
 
-	suo.ReadWriteCloser = streamRW
-	return nil
+var errUnexpectedResponse = errors.New("unexpected response")
+
+// openFullRequest 发起一个以 first 为第一帧的全双工请求，返回请求体的写入端、响应体、之后的帧继续使用的编解码器以及服务端的第一帧。
+// 请求本身失败时返回原始错误，服务端的响应无法解析时返回 errUnexpectedResponse
+func openFullRequest(ctx context.Context, client *Suo5Client, first map[string][]byte) (io.WriteCloser, io.ReadCloser, netrans2.Codec, map[string][]byte, error) {
+	config := client.Config
+	codec := netrans2.NewStream(config.frameCodec())
+	ch, chWR := netrans2.NewChannelWriteCloser(ctx)
+	body := netrans2.MultiReadCloser(
+		io.NopCloser(bytes.NewReader(BuildBodyWith(codec, first))),
+		io.NopCloser(netrans2.NewChannelReader(ch)),
+	)
+	resp, err := client.openFull(ctx, body)
+	if err != nil {
+		_ = chWR.Close()
+		return nil, nil, nil, nil, err
+	}
+
+	fail := func(err error) (io.WriteCloser, io.ReadCloser, netrans2.Codec, map[string][]byte, error) {
+		_ = chWR.Close()
+		_ = resp.Body.Close()
+		return nil, nil, nil, nil, errors.Wrap(errUnexpectedResponse, err.Error())
+	}
+	if config.Offset > 0 {
+		if _, err := io.CopyN(io.Discard, resp.Body, int64(config.Offset)); err != nil {
+			return fail(err)
+		}
+	}
+	fr, err := codec.ReadFrame(resp.Body)
+	if err != nil {
+		return fail(err)
+	}
+	m, err := Unmarshal(fr.Data)
+	if err != nil {
+		return fail(err)
+	}
+	return chWR, resp.Body, codec, m, nil
 }
@@ -0,0 +1,44 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/PurpleNewNew/bs5/pkg/camouflage"
+	log "github.com/kataras/golog"
+)
+
+// coverTraffic 距离上一次发送超过一个间隔时发送一个半双工的心跳请求，使空闲时的请求保持固定的频率。
+// 心跳使用随机的 id，服务端找不到对应的连接会直接忽略
+func (suo *Suo5Client) coverTraffic(ctx context.Context) {
+	config := suo.Config
+	interval := time.Duration(config.CoverInterval) * time.Millisecond
+	// 掩护流量本身不计入最近一次发送的时间
+	codec := NewPaddingCodec(config.Codec, config.padding)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		if time.Since(time.Unix(0, config.lastSend.Load())) < interval {
+			continue
+		}
+		body := BuildBodyWith(codec, NewHeartbeat(RandString(8), config.redirect()))
+		req, err := NewTunnelRequest(ctx, config, camouflage.ModeHalf, bytes.NewReader(body))
+		if err != nil {
+			log.Debugf("build cover request error, %s", err)
+			return
+		}
+		resp, err := suo.NormalClient.Do(req)
+		if err != nil {
+			log.Debugf("send cover request error, %s", err)
+			continue
+		}
+		_ = resp.Body.Close()
+		log.Debugf("send cover request, length: %d", len(body))
+	}
+}
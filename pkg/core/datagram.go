@@ -0,0 +1,104 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/PurpleNewNew/bs5/pkg/netrans"
+	"github.com/pkg/errors"
+)
+
+// DatagramConn 通过隧道收发 UDP 数据报，对应服务端的一个 UDP socket。
+// 数据报不保证送达，也不保证顺序，与直接使用 UDP 的语义相同
+type DatagramConn struct {
+	id       string
+	codec    netrans.Codec
+	redirect string
+	rw       streamReadWriter
+	closer   io.Closer
+	resp     io.Reader
+}
+
+// Associate 建立一个 UDP 关联，多路复用开启时也会单独使用一个请求
+func (suo *Suo5Conn) Associate() (*DatagramConn, error) {
+	if suo.pool != nil {
+		var d *DatagramConn
+		_, err := suo.balance(func() (err error) {
+			d, err = suo.Associate()
+			return err
+		})
+		return d, err
+	}
+	id := RandString(8)
+	chWR, respBody, codec, _, err := suo.dial(NewActionAssociate(id, suo.Config.redirect()))
+	if err != nil {
+		return nil, errors.Wrap(err, "udp associate, the server may not support it")
+	}
+	rw := suo.newStreamRW(id, chWR, respBody, codec)
+	d := &DatagramConn{
+		id:     id,
+		codec:  codec,
+		rw:     rw,
+		closer: rw,
+		resp:   respBody,
+	}
+	if suo.Config.Mode != FullDuplex {
+		d.redirect = suo.Config.redirect()
+	}
+	if !suo.Config.DisableHeartbeat {
+		d.closer = newHeartbeatRW(rw, id, suo.Config.redirect(), suo.Config.frameCodec(), heartbeatInterval, suo.Config.Jitter > 0)
+	}
+	return d, nil
+}
+
+// ReadFrom 读取一个数据报，addr 为数据报的来源地址
+func (d *DatagramConn) ReadFrom(p []byte) (n int, addr string, err error) {
+	for {
+		fr, err := d.codec.ReadFrame(d.resp)
+		if err != nil {
+			return 0, "", err
+		}
+		m, err := Unmarshal(fr.Data)
+		if err != nil {
+			return 0, "", err
+		}
+		action := m["ac"]
+		if len(action) != 1 {
+			return 0, "", fmt.Errorf("invalid action when read %v", action)
+		}
+		switch action[0] {
+		case ActionDatagram:
+			n = copy(p, m["dt"])
+			return n, net.JoinHostPort(string(m["h"]), string(m["p"])), nil
+		case ActionDelete:
+			return 0, "", io.EOF
+		case ActionHeartbeat:
+			continue
+		default:
+			return 0, "", fmt.Errorf("unpected action when read %v", action)
+		}
+	}
+}
+
+// WriteTo 发送一个数据报，addr 中的域名由服务端解析
+func (d *DatagramConn) WriteTo(p []byte, addr string) (int, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+	uport, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return 0, err
+	}
+	// 数据报不能拆分，超出伪装方式限制的长度时返回错误
+	if _, err := d.rw.WriteFrame(NewActionDatagram(d.id, host, uint16(uport), p, d.redirect)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (d *DatagramConn) Close() error {
+	return d.closer.Close()
+}
@@ -0,0 +1,100 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/kataras/golog"
+	"golang.org/x/net/http2"
+)
+
+// 全双工请求使用的协议
+const (
+	TransportHTTP1 = "http1"
+	TransportH2    = "h2"
+)
+
+// h2Transport https 的目标通过 uTLS 协商 h2，http 的目标使用 h2c，一个 TCP 连接上复用所有的隧道请求
+type h2Transport struct {
+	tls *http2.Transport
+	h2c *http2.Transport
+}
+
+func (t *h2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" {
+		return t.h2c.RoundTrip(req)
+	}
+	return t.tls.RoundTrip(req)
+}
+
+func (t *h2Transport) CloseIdleConnections() {
+	t.tls.CloseIdleConnections()
+	t.h2c.CloseIdleConnections()
+}
+
+// newH2Client 与 raw client 一样经过上游代理、连接 ConnectAddress，并使用相同的 TLS 指纹，只是 ALPN 为 h2
+func newH2Client(config *Suo5Config) *http.Client {
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		if config.ProxyClient != nil {
+			return config.ProxyClient.DialContext(dialCtx, network, config.connectAddress(addr))
+		}
+		var d net.Dialer
+		return d.DialContext(dialCtx, network, config.connectAddress(addr))
+	}
+	dialer := config.tls.forH2()
+	return &http.Client{
+		Transport: &h2Transport{
+			tls: &http2.Transport{
+				DisableCompression: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					conn, err := dial(ctx, network, addr)
+					if err != nil {
+						return nil, err
+					}
+					return dialer.Handshake(ctx, conn, addr)
+				},
+			},
+			h2c: &http2.Transport{
+				AllowHTTP:          true,
+				DisableCompression: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					return dial(ctx, network, addr)
+				},
+			},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// doFull 发送全双工的请求，启用了 h2 时所有的请求共享同一个连接
+func (suo *Suo5Client) doFull(req *http.Request) (*http.Response, error) {
+	if suo.Config.Transport == TransportH2 && suo.H2Client != nil {
+		return suo.H2Client.Do(req)
+	}
+	return suo.RawClient.Do(req)
+}
+
+// probeH2 检测通过 h2 能否全双工，不能时回退到 http1 并返回 nil，由调用方重新按照 http1 检测
+func probeH2(ctx context.Context, config *Suo5Config) *connectModeResult {
+	if config.Transport != TransportH2 {
+		return nil
+	}
+	probe, err := probeConnectMode(ctx, config, true)
+	switch {
+	case err != nil:
+		log.Warnf("h2 transport check failed, fallback to http1, %s", err)
+	case probe.timedOut || probe.mode != FullDuplex:
+		log.Warnf("full duplex does not work over h2, fallback to http1")
+	default:
+		return probe
+	}
+	config.Transport = TransportHTTP1
+	return nil
+}
@@ -6,21 +6,46 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/PurpleNewNew/bs5/pkg/metrics"
+	"github.com/PurpleNewNew/bs5/pkg/netrans"
 	log "github.com/kataras/golog"
 )
 
+// heartbeatInterval 心跳间隔，期间有数据写入时跳过本次心跳
+const heartbeatInterval = time.Second * 10
+
 type RawReadWriteCloser interface {
 	io.ReadWriteCloser
 	WriteRaw(p []byte) (n int, err error)
 }
 
-func NewHeartbeatRW(rw RawReadWriteCloser, id, redirect string) io.ReadWriteCloser {
+// streamReadWriter 自己编码并写入帧的流。加密时帧的序号需要与写入请求体的顺序一致，编码和写入在同一把锁内完成
+type streamReadWriter interface {
+	RawReadWriteCloser
+	WriteFrame(m map[string][]byte) (n int, err error)
+}
+
+// CloseWriter 支持半关闭的流，所有建立的流都实现了这个接口
+type CloseWriter interface {
+	CloseWrite() error
+}
+
+func NewHeartbeatRW(rw RawReadWriteCloser, id, redirect string, codec netrans.Codec) io.ReadWriteCloser {
+	return newHeartbeatRW(rw, id, redirect, codec, heartbeatInterval, false)
+}
+
+// newHeartbeatRW 每隔 interval 发送一次心跳，jitter 为 true 时每次心跳的间隔随机
+func newHeartbeatRW(rw RawReadWriteCloser, id, redirect string, codec netrans.Codec, interval time.Duration, jitter bool) io.ReadWriteCloser {
 	ctx, cancel := context.WithCancel(context.Background())
 	h := &heartbeatRW{
 		rw:       rw,
 		id:       id,
 		redirect: redirect,
+		codec:    codec,
+		interval: interval,
+		jitter:   jitter,
 		cancel:   cancel,
+		done:     make(chan struct{}),
 	}
 	go h.heartbeat(ctx)
 	return h
@@ -29,9 +54,14 @@ func NewHeartbeatRW(rw RawReadWriteCloser, id, redirect string) io.ReadWriteClos
 type heartbeatRW struct {
 	id            string
 	redirect      string
+	codec         netrans.Codec
+	interval      time.Duration
+	jitter        bool
 	rw            RawReadWriteCloser
 	lastHaveWrite atomic.Bool
 	cancel        func()
+	// done 心跳的 goroutine 退出后关闭
+	done chan struct{}
 }
 
 func (h *heartbeatRW) Read(p []byte) (n int, err error) {
@@ -43,6 +73,10 @@ func (h *heartbeatRW) Write(p []byte) (n int, err error) {
 	return h.rw.Write(p)
 }
 
+func (h *heartbeatRW) CloseWrite() error {
+	return h.rw.(CloseWriter).CloseWrite()
+}
+
 func (h *heartbeatRW) Close() error {
 	h.cancel()
 	return h.rw.Close()
@@ -50,22 +84,31 @@ func (h *heartbeatRW) Close() error {
 
 // write data to the remote server to avoid server's ReadTimeout
 func (h *heartbeatRW) heartbeat(ctx context.Context) {
-	t := time.NewTicker(time.Second * 10)
+	defer close(h.done)
+	t := time.NewTimer(heartbeatDelay(h.interval, h.jitter))
 	defer t.Stop()
 	for {
 		select {
 		case <-t.C:
+			t.Reset(heartbeatDelay(h.interval, h.jitter))
 			if h.lastHaveWrite.Load() {
 				h.lastHaveWrite.Store(false)
 				continue
 			}
-			body := BuildBody(NewHeartbeat(h.id, h.redirect))
-			log.Debugf("send heartbeat, length: %d", len(body))
-			_, err := h.rw.WriteRaw(body)
+			var err error
+			if rw, ok := h.rw.(streamReadWriter); ok {
+				log.Debugf("send heartbeat")
+				_, err = rw.WriteFrame(NewHeartbeat(h.id, h.redirect))
+			} else {
+				body := BuildBodyWith(h.codec, NewHeartbeat(h.id, h.redirect))
+				log.Debugf("send heartbeat, length: %d", len(body))
+				_, err = h.rw.WriteRaw(body)
+			}
 			if err != nil {
 				log.Errorf("send heartbeat error %s", err)
 				return
 			}
+			metrics.HeartbeatSent()
 			h.lastHaveWrite.Store(false)
 		case <-ctx.Done():
 			return
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"bytes"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PurpleNewNew/bs5/pkg/netrans"
+	"github.com/stretchr/testify/require"
+)
+
+type recordRW struct {
+	mu     sync.Mutex
+	frames [][]byte
+	closed bool
+}
+
+func (r *recordRW) Read(p []byte) (int, error)  { return 0, nil }
+func (r *recordRW) Write(p []byte) (int, error) { return len(p), nil }
+
+func (r *recordRW) WriteRaw(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.frames = append(r.frames, p)
+	return len(p), nil
+}
+
+func (r *recordRW) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+func (r *recordRW) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.frames)
+}
+
+func (r *recordRW) frame(i int) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.frames[i]
+}
+
+func TestHeartbeat(t *testing.T) {
+	assert := require.New(t)
+	const interval = 20 * time.Millisecond
+
+	raw := &recordRW{}
+	rw := newHeartbeatRW(raw, "abcd", "http://127.0.0.1/redirect", netrans.XORCodec, interval, false)
+	assert.Eventually(func() bool { return raw.count() >= 2 }, 5*time.Second, interval/4)
+
+	fr, err := netrans.ReadFrame(bytes.NewReader(raw.frame(0)))
+	assert.Nil(err)
+	m, err := Unmarshal(fr.Data)
+	assert.Nil(err)
+	assert.Equal([]byte{ActionHeartbeat}, m["ac"])
+	assert.Equal([]byte("abcd"), m["id"])
+	assert.Equal([]byte("http://127.0.0.1/redirect"), m["r"])
+
+	// 持续有数据写入时不发送心跳，最多在开始写入的边界上多发一次
+	before := raw.count()
+	stop := time.After(10 * interval)
+writing:
+	for {
+		select {
+		case <-stop:
+			break writing
+		default:
+			_, _ = rw.Write([]byte("x"))
+			runtime.Gosched()
+		}
+	}
+	assert.LessOrEqual(raw.count()-before, 1)
+
+	assert.Nil(rw.Close())
+	// 关闭后心跳的 goroutine 退出
+	select {
+	case <-rw.(*heartbeatRW).done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("heartbeat goroutine did not exit")
+	}
+	raw.mu.Lock()
+	defer raw.mu.Unlock()
+	assert.True(raw.closed)
+}
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/PurpleNewNew/bs5/pkg/netrans"
+	"github.com/pkg/errors"
+)
+
+// RemoteListener 服务端上的一个监听，用于反向转发。Accept 返回服务端接受的连接的 id，
+// 调用方再用 Suo5Conn.Attach 接管这个连接
+type RemoteListener struct {
+	client  *Suo5Client
+	codec   netrans.Codec
+	addr    string
+	reqBody io.WriteCloser
+	resp    io.ReadCloser
+	once    sync.Once
+}
+
+// Listen 请求服务端监听 address，多路复用开启时也会单独使用一个请求
+func (suo *Suo5Conn) Listen(address string) (*RemoteListener, error) {
+	if suo.pool != nil {
+		var lis *RemoteListener
+		_, err := suo.balance(func() (err error) {
+			lis, err = suo.Listen(address)
+			return err
+		})
+		return lis, err
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	uport, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	id := RandString(8)
+	chWR, respBody, codec, _, err := suo.dial(NewActionListen(id, host, uint16(uport), suo.Config.redirect()))
+	if err != nil {
+		return nil, errors.Wrapf(err, "listen on %s, the server may not support it", address)
+	}
+	return &RemoteListener{
+		client:  suo.Suo5Client,
+		codec:   codec,
+		addr:    address,
+		reqBody: chWR,
+		resp:    respBody,
+	}, nil
+}
+
+// Accept 等待服务端接受新的连接，返回连接的 id 和对端地址
+func (l *RemoteListener) Accept() (id string, remoteAddr string, err error) {
+	for {
+		fr, err := l.codec.ReadFrame(l.resp)
+		if err != nil {
+			return "", "", err
+		}
+		m, err := Unmarshal(fr.Data)
+		if err != nil {
+			return "", "", err
+		}
+		action := m["ac"]
+		if len(action) != 1 {
+			return "", "", fmt.Errorf("invalid action when read %v", action)
+		}
+		switch action[0] {
+		case ActionListen:
+			return string(m["id"]), net.JoinHostPort(string(m["h"]), string(m["p"])), nil
+		case ActionHeartbeat:
+			continue
+		case ActionDelete:
+			return "", "", io.EOF
+		default:
+			return "", "", fmt.Errorf("unpected action when read %v", action)
+		}
+	}
+}
+
+// Client 监听所在服务端的客户端，接受的连接需要通过它 Attach
+func (l *RemoteListener) Client() *Suo5Client {
+	return l.client
+}
+
+// Addr 返回服务端上监听的地址
+func (l *RemoteListener) Addr() string {
+	return l.addr
+}
+
+func (l *RemoteListener) Close() error {
+	// 关闭请求后服务端随之关闭监听
+	l.once.Do(func() {
+		_ = l.reqBody.Close()
+		_ = l.resp.Close()
+	})
+	return nil
+}
@@ -0,0 +1,518 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PurpleNewNew/bs5/pkg/metrics"
+	"github.com/PurpleNewNew/bs5/pkg/netrans"
+	log "github.com/kataras/golog"
+	"github.com/pkg/errors"
+)
+
+// muxFrameSize 单个数据帧的最大长度，较大的写入会被拆分，使多个流可以轮流发送
+const muxFrameSize = 16 * 1024
+
+var (
+	errMuxUnsupported = errors.New("the server does not support mux")
+	errMuxClosed      = errors.New("mux carrier closed")
+	errMuxStreamReset = errors.New("mux stream reset, receive buffer overflow")
+)
+
+// muxCarrier 一个长期存在的全双工请求，承载多个流的数据帧。
+// 读协程按 id 将下行数据分发到各个流，写协程优先发送控制帧，数据帧在有待发送数据的流之间轮转。
+// 服务端支持流控时每个流最多发送 MuxWindow 字节后等待窗口更新，读协程永远不会因为某个流没有被读取而阻塞
+type muxCarrier struct {
+	codec   netrans.Codec
+	jitter  bool
+	flow    bool
+	reqBody io.WriteCloser
+	resp    io.ReadCloser
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	streams map[string]*muxStream
+	control [][]byte
+	ready   []*muxStream
+	err     error
+	done    chan struct{}
+
+	lastHaveWrite atomic.Bool
+}
+
+// openMuxCarrier 发起承载请求，服务端不认识 ActionMux 时返回 errMuxUnsupported
+func openMuxCarrier(ctx context.Context, client *Suo5Client) (*muxCarrier, error) {
+	config := client.Config
+	reqBody, resp, codec, m, err := openFullRequest(ctx, client, NewActionMux(config.redirect()))
+	if err != nil {
+		if errors.Is(err, errUnexpectedResponse) {
+			return nil, errors.Wrap(errMuxUnsupported, err.Error())
+		}
+		return nil, errors.Wrap(ErrHostUnreachable, err.Error())
+	}
+	if status := m["s"]; len(status) != 1 || status[0] != 0x00 {
+		_ = reqBody.Close()
+		_ = resp.Close()
+		return nil, errors.Wrap(errMuxUnsupported, fmt.Sprintf("unexpected status %v", status))
+	}
+
+	c := &muxCarrier{
+		codec:   codec,
+		jitter:  config.Jitter > 0,
+		flow:    IsFlowControl(m),
+		reqBody: reqBody,
+		resp:    resp,
+		streams: make(map[string]*muxStream),
+		done:    make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	go c.readLoop()
+	go c.writeLoop()
+	if !config.DisableHeartbeat {
+		go c.heartbeat()
+	}
+	return c, nil
+}
+
+func (c *muxCarrier) Closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Open 在承载请求上创建一个新的流，等待服务端返回连接结果
+func (c *muxCarrier) Open(ctx context.Context, id, host string, port uint16) (*muxStream, error) {
+	s := &muxStream{
+		id:      id,
+		carrier: c,
+		status:  make(chan byte, 1),
+		notify:  make(chan struct{}, 1),
+		credit:  MuxWindow,
+		remote:  make(chan struct{}),
+		local:   make(chan struct{}),
+	}
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, errors.Wrap(ErrHostUnreachable, c.err.Error())
+	}
+	c.streams[id] = s
+	c.control = append(c.control, BuildBodyWith(c.codec, NewActionCreate(id, host, port, "")))
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	select {
+	case status := <-s.status:
+		if status == 0x00 {
+			return s, nil
+		}
+		s.release(false)
+		return nil, errors.Wrap(ErrHostUnreachable, fmt.Sprintf("failed to dial, status: %v", status))
+	case <-c.done:
+		return nil, errors.Wrap(ErrHostUnreachable, c.err.Error())
+	case <-ctx.Done():
+		s.release(true)
+		return nil, errors.Wrap(ErrHostUnreachable, ctx.Err().Error())
+	}
+}
+
+// fail 调用时需要持有 c.mu
+func (c *muxCarrier) fail(err error) {
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	_ = c.reqBody.Close()
+	_ = c.resp.Close()
+	c.cond.Broadcast()
+}
+
+func (c *muxCarrier) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fail(errMuxClosed)
+	return nil
+}
+
+func (c *muxCarrier) readLoop() {
+	for {
+		fr, err := c.codec.ReadFrame(c.resp)
+		if err == nil {
+			err = c.dispatch(fr)
+		}
+		if err != nil {
+			log.Debugf("mux carrier read error, %s", err)
+			c.mu.Lock()
+			c.fail(err)
+			c.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (c *muxCarrier) dispatch(fr *netrans.DataFrame) error {
+	m, err := Unmarshal(fr.Data)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	s := c.streams[string(m["id"])]
+	c.mu.Unlock()
+	if s == nil {
+		return nil
+	}
+	if status, ok := m["s"]; ok && len(status) == 1 {
+		select {
+		case s.status <- status[0]:
+		default:
+		}
+		return nil
+	}
+	action := m["ac"]
+	if len(action) != 1 {
+		return fmt.Errorf("invalid action when read %v", action)
+	}
+	switch action[0] {
+	case ActionData:
+		// 服务端不应该发送超出窗口的数据，超出时只重置这一个流
+		if !s.deliver(m["dt"]) {
+			log.Debugf("mux stream %s receive buffer overflow", s.id)
+			s.release(true)
+		}
+	case ActionWindow:
+		if n, ok := WindowSize(m); ok {
+			s.grant(n)
+		}
+	case ActionDelete:
+		s.remoteOnce.Do(func() { close(s.remote) })
+	}
+	return nil
+}
+
+func (c *muxCarrier) writeLoop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		for c.err == nil && len(c.control) == 0 && len(c.ready) == 0 {
+			c.cond.Wait()
+		}
+		if c.err != nil {
+			return
+		}
+
+		var body []byte
+		if len(c.control) != 0 {
+			body = c.control[0]
+			c.control = c.control[1:]
+		} else {
+			s := c.ready[0]
+			c.ready = c.ready[1:]
+			if len(s.pending) == 0 || (c.flow && s.credit == 0) {
+				// 窗口用完的流在收到窗口更新后重新加入队列
+				s.queued = false
+				continue
+			}
+			data := s.pending[0]
+			if c.flow && len(data) > s.credit {
+				s.pending[0] = data[s.credit:]
+				data = data[:s.credit]
+			} else {
+				s.pending = s.pending[1:]
+			}
+			if c.flow {
+				s.credit -= len(data)
+			}
+			if len(s.pending) != 0 && (!c.flow || s.credit != 0) {
+				c.ready = append(c.ready, s)
+			} else {
+				s.queued = false
+			}
+			body = BuildBodyWith(c.codec, NewActionData(s.id, data, ""))
+		}
+
+		c.mu.Unlock()
+		_, err := c.reqBody.Write(body)
+		c.lastHaveWrite.Store(true)
+		c.mu.Lock()
+		if err != nil {
+			c.fail(err)
+		}
+		c.cond.Broadcast()
+	}
+}
+
+func (c *muxCarrier) heartbeat() {
+	t := time.NewTimer(heartbeatDelay(heartbeatInterval, c.jitter))
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			t.Reset(heartbeatDelay(heartbeatInterval, c.jitter))
+			if c.lastHaveWrite.Swap(false) {
+				continue
+			}
+			c.mu.Lock()
+			c.control = append(c.control, BuildBodyWith(c.codec, NewHeartbeat("", "")))
+			c.cond.Broadcast()
+			c.mu.Unlock()
+			metrics.HeartbeatSent()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// CloseMux 关闭多路复用的承载请求以及其上的所有流，之后建立的连接会重新建立承载请求
+func (c *Suo5Client) CloseMux() error {
+	if c.pool != nil {
+		for _, node := range c.pool.nodes {
+			if client := node.client.Load(); client != nil {
+				_ = client.CloseMux()
+			}
+		}
+		return nil
+	}
+	c.muxMu.Lock()
+	carrier := c.mux
+	c.mux = nil
+	c.muxMu.Unlock()
+	if carrier != nil {
+		return carrier.Close()
+	}
+	return nil
+}
+
+// getMuxCarrier 返回当前可用的承载请求，断开后在下一次连接时重建。
+// 服务端不支持时记录下来，之后的连接直接回退为每个连接一个请求
+func (c *Suo5Client) getMuxCarrier(ctx context.Context) (*muxCarrier, error) {
+	c.muxMu.Lock()
+	defer c.muxMu.Unlock()
+	if c.muxDisabled {
+		return nil, errMuxUnsupported
+	}
+	if c.mux != nil && !c.mux.Closed() {
+		return c.mux, nil
+	}
+	carrier, err := openMuxCarrier(ctx, c)
+	if err != nil {
+		if errors.Is(err, errMuxUnsupported) {
+			log.Warnf("%s, fallback to one request per connection", err)
+			c.muxDisabled = true
+		}
+		return nil, err
+	}
+	log.Infof("mux carrier established")
+	c.mux = carrier
+	return carrier, nil
+}
+
+// muxStream 承载请求上的一个流
+type muxStream struct {
+	id      string
+	carrier *muxCarrier
+	status  chan byte
+	readBuf bytes.Buffer
+
+	// 下行数据的队列，读协程只追加不等待，notify 唤醒等待中的 Read
+	rmu      sync.Mutex
+	recv     [][]byte
+	recvSize int
+	consumed int
+	reset    bool
+	notify   chan struct{}
+
+	// 以下字段由 carrier.mu 保护
+	pending [][]byte
+	queued  bool
+	closed  bool
+	credit  int
+
+	remote     chan struct{}
+	remoteOnce sync.Once
+	local      chan struct{}
+}
+
+func (s *muxStream) Read(p []byte) (int, error) {
+	if s.readBuf.Len() != 0 {
+		return s.readBuf.Read(p)
+	}
+	for {
+		if data, ok := s.pop(); ok {
+			return s.fill(data, p)
+		}
+		select {
+		case <-s.notify:
+		case <-s.remote:
+			// 服务端关闭前发送的数据仍然需要读完
+			if data, ok := s.pop(); ok {
+				return s.fill(data, p)
+			}
+			return 0, io.EOF
+		case <-s.local:
+			s.rmu.Lock()
+			reset := s.reset
+			s.rmu.Unlock()
+			if reset {
+				return 0, errMuxStreamReset
+			}
+			return 0, io.EOF
+		case <-s.carrier.done:
+			return 0, s.carrier.err
+		}
+	}
+}
+
+// deliver 将下行数据加入队列，缓存的数据超过窗口时返回 false
+func (s *muxStream) deliver(data []byte) bool {
+	if len(data) == 0 {
+		return true
+	}
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+	if s.recvSize+len(data) > MuxWindow {
+		s.reset = true
+		return false
+	}
+	s.recv = append(s.recv, data)
+	s.recvSize += len(data)
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// pop 取出一段下行数据，取走的数据累计达到半个窗口时通知服务端继续发送
+func (s *muxStream) pop() ([]byte, bool) {
+	s.rmu.Lock()
+	if len(s.recv) == 0 {
+		s.rmu.Unlock()
+		return nil, false
+	}
+	data := s.recv[0]
+	s.recv[0] = nil
+	s.recv = s.recv[1:]
+	s.recvSize -= len(data)
+	s.consumed += len(data)
+	update := 0
+	if s.consumed >= MuxWindow/2 {
+		update, s.consumed = s.consumed, 0
+	}
+	s.rmu.Unlock()
+
+	c := s.carrier
+	if update != 0 && c.flow {
+		c.mu.Lock()
+		if !s.closed && c.err == nil {
+			c.control = append(c.control, BuildBodyWith(c.codec, NewActionWindow(s.id, update)))
+			c.cond.Broadcast()
+		}
+		c.mu.Unlock()
+	}
+	return data, true
+}
+
+// grant 服务端取走了 n 字节，可以继续发送
+func (s *muxStream) grant(n int) {
+	c := s.carrier
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.credit += n
+	if len(s.pending) != 0 && !s.queued && !s.closed {
+		s.queued = true
+		c.ready = append(c.ready, s)
+	}
+	c.cond.Broadcast()
+}
+
+func (s *muxStream) fill(data []byte, p []byte) (int, error) {
+	s.readBuf.Reset()
+	s.readBuf.Write(data)
+	return s.readBuf.Read(p)
+}
+
+// Write 将数据拆分后加入发送队列，等待队列中的数据全部交给写协程后返回
+func (s *muxStream) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c := s.carrier
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+	for i := 0; i < len(p); i += muxFrameSize {
+		end := i + muxFrameSize
+		if end > len(p) {
+			end = len(p)
+		}
+		s.pending = append(s.pending, append([]byte(nil), p[i:end]...))
+	}
+	if !s.queued {
+		s.queued = true
+		c.ready = append(c.ready, s)
+	}
+	c.cond.Broadcast()
+	for len(s.pending) != 0 && c.err == nil && !s.closed {
+		c.cond.Wait()
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+	return len(p), nil
+}
+
+// CloseWrite 写协程按顺序发送，Write 返回后队列中的数据都已经在半关闭之前交给了写协程
+func (s *muxStream) CloseWrite() error {
+	c := s.carrier
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	if s.closed {
+		return io.ErrClosedPipe
+	}
+	c.control = append(c.control, BuildBodyWith(c.codec, NewCloseWrite(s.id, "")))
+	c.cond.Broadcast()
+	return nil
+}
+
+func (s *muxStream) Close() error {
+	s.release(true)
+	return nil
+}
+
+// release 从承载请求中移除该流，notify 为 true 时通知服务端关闭对应的连接
+func (s *muxStream) release(notify bool) {
+	c := s.carrier
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.pending = nil
+	close(s.local)
+	delete(c.streams, s.id)
+	if notify && c.err == nil {
+		c.control = append(c.control, BuildBodyWith(c.codec, NewDelete(s.id, "")))
+	}
+	c.cond.Broadcast()
+}
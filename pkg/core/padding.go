@@ -0,0 +1,169 @@
+package core
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/PurpleNewNew/bs5/pkg/netrans"
+)
+
+// PaddingKey 填充字段，服务端和原版的脚本都会忽略不认识的字段
+const PaddingKey = "pd"
+
+// maxPaddingSize 单帧填充长度的上限
+const maxPaddingSize = 64 * 1024
+
+// 填充长度的分布
+const (
+	PaddingUniform = "uniform"
+	PaddingNormal  = "normal"
+	PaddingExp     = "exp"
+)
+
+// Padding 每个数据帧附加的随机填充的长度分布
+type Padding struct {
+	dist string
+	a, b float64
+}
+
+// ParsePadding 支持 uniform:MIN-MAX、normal:MEAN,STDDEV 和 exp:MEAN 三种格式，为空时不填充
+func ParsePadding(s string) (*Padding, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	dist, args, _ := strings.Cut(s, ":")
+	var sep string
+	switch dist {
+	case PaddingUniform:
+		sep = "-"
+	case PaddingNormal:
+		sep = ","
+	case PaddingExp:
+	default:
+		return nil, fmt.Errorf("invalid padding %q, expected uniform:MIN-MAX, normal:MEAN,STDDEV or exp:MEAN", s)
+	}
+
+	p := &Padding{dist: dist}
+	var values []string
+	if sep == "" {
+		values = []string{args}
+	} else {
+		first, second, ok := strings.Cut(args, sep)
+		if !ok {
+			return nil, fmt.Errorf("invalid padding %q, missing %q", s, sep)
+		}
+		values = []string{first, second}
+	}
+	for i, v := range values {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n < 0 || n > maxPaddingSize {
+			return nil, fmt.Errorf("invalid padding %q, values must be between 0 and %d", s, maxPaddingSize)
+		}
+		if i == 0 {
+			p.a = float64(n)
+		} else {
+			p.b = float64(n)
+		}
+	}
+	if dist == PaddingUniform && p.a > p.b {
+		return nil, fmt.Errorf("invalid padding %q, min is greater than max", s)
+	}
+	return p, nil
+}
+
+// Size 按分布取一个填充长度
+func (p *Padding) Size() int {
+	var n float64
+	switch p.dist {
+	case PaddingUniform:
+		n = p.a + float64(rand.Intn(int(p.b-p.a)+1))
+	case PaddingNormal:
+		n = math.Round(rand.NormFloat64()*p.b + p.a)
+	case PaddingExp:
+		n = math.Round(rand.ExpFloat64() * p.a)
+	}
+	return int(max(0, min(n, maxPaddingSize)))
+}
+
+// Mean 平均每帧增加的字节数，包括字段名和长度
+func (p *Padding) Mean() float64 {
+	overhead := float64(1 + len(PaddingKey) + 4)
+	switch p.dist {
+	case PaddingUniform:
+		return overhead + (p.a+p.b)/2
+	default:
+		// 截断在 0 处带来的偏差可以忽略
+		return overhead + p.a
+	}
+}
+
+func (p *Padding) String() string {
+	switch p.dist {
+	case PaddingUniform:
+		return fmt.Sprintf("%s:%d-%d", p.dist, int(p.a), int(p.b))
+	case PaddingNormal:
+		return fmt.Sprintf("%s:%d,%d", p.dist, int(p.a), int(p.b))
+	default:
+		return fmt.Sprintf("%s:%d", p.dist, int(p.a))
+	}
+}
+
+// appendPadding 在序列化后的数据之后追加一个填充字段，不修改 data
+func appendPadding(data []byte, size int) []byte {
+	out := make([]byte, len(data), len(data)+1+len(PaddingKey)+4+size)
+	copy(out, data)
+	out = append(out, byte(len(PaddingKey)))
+	out = append(out, PaddingKey...)
+	out = binary.BigEndian.AppendUint32(out, uint32(size))
+	pad := out[len(out) : len(out)+size]
+	_, _ = crand.Read(pad)
+	return out[:len(out)+size]
+}
+
+// frameCodec 在加密或混淆之前为每一帧加入填充，lastSend 不为空时记录最近一次发送的时间
+type frameCodec struct {
+	netrans.Codec
+	padding  *Padding
+	lastSend *atomic.Int64
+}
+
+func (c frameCodec) Encode(data []byte) []byte {
+	if c.lastSend != nil {
+		c.lastSend.Store(time.Now().UnixNano())
+	}
+	if c.padding != nil {
+		data = appendPadding(data, c.padding.Size())
+	}
+	return c.Codec.Encode(data)
+}
+
+// Stream 内层的编解码器为一串连续的帧维护序号，填充不变
+func (c frameCodec) Stream() netrans.Codec {
+	c.Codec = netrans.NewStream(c.Codec)
+	return c
+}
+
+// NewPaddingCodec 为 codec 编码的每一帧加入 padding 分布的填充，padding 为空时原样返回
+func NewPaddingCodec(codec netrans.Codec, padding *Padding) netrans.Codec {
+	if padding == nil {
+		return codec
+	}
+	return frameCodec{Codec: codec, padding: padding}
+}
+
+// heartbeatDelay jitter 为 true 时在 [interval/2, interval] 之间随机，不会比原来的间隔更长
+func heartbeatDelay(interval time.Duration, jitter bool) time.Duration {
+	if !jitter {
+		return interval
+	}
+	half := interval / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
@@ -0,0 +1,113 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/PurpleNewNew/bs5/pkg/netrans"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePadding(t *testing.T) {
+	p, err := ParsePadding("")
+	require.NoError(t, err)
+	require.Nil(t, p)
+
+	for _, s := range []string{"uniform:16-64", "normal:128,32", "exp:64"} {
+		p, err := ParsePadding(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, s, p.String())
+	}
+	for _, s := range []string{"uniform:64-16", "uniform:16", "normal:128", "exp:-1", "exp:100000", "zipf:1", "16-64"} {
+		_, err := ParsePadding(s)
+		assert.Error(t, err, s)
+	}
+
+	p, err = ParsePadding("uniform:16-64")
+	require.NoError(t, err)
+	seen := map[int]bool{}
+	for i := 0; i < 1000; i++ {
+		n := p.Size()
+		require.True(t, n >= 16 && n <= 64, n)
+		seen[n] = true
+	}
+	assert.Greater(t, len(seen), 10)
+
+	p, err = ParsePadding("normal:10,100")
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		require.True(t, p.Size() >= 0)
+	}
+}
+
+func TestPaddingCodec(t *testing.T) {
+	padding, err := ParsePadding("uniform:100-200")
+	require.NoError(t, err)
+	aead, err := netrans.NewAEADCodec(netrans.CipherAESGCM, "secret")
+	require.NoError(t, err)
+
+	for _, codec := range []netrans.Codec{netrans.XORCodec, aead} {
+		m := NewActionData("abcd", []byte("hello"), "")
+		data := Marshal(m)
+		orig := append([]byte(nil), data...)
+		padded := NewPaddingCodec(codec, padding)
+		body := padded.Encode(data)
+		assert.Equal(t, orig, data, "input modified")
+
+		reader := codec
+		if aead, ok := codec.(*netrans.AEADCodec); ok {
+			reader = aead.Server()
+		}
+		fr, err := NewPaddingCodec(reader, padding).ReadFrame(bytes.NewReader(body))
+		require.NoError(t, err)
+		got, err := Unmarshal(fr.Data)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("hello"), got["dt"])
+		assert.Equal(t, []byte("abcd"), got["id"])
+		assert.True(t, len(got[PaddingKey]) >= 100 && len(got[PaddingKey]) <= 200)
+	}
+	assert.Equal(t, netrans.XORCodec, NewPaddingCodec(netrans.XORCodec, nil))
+}
+
+func TestSplitFrames(t *testing.T) {
+	padding, err := ParsePadding("exp:200")
+	require.NoError(t, err)
+	codec := NewPaddingCodec(netrans.XORCodec, padding)
+	data := make([]byte, 100*1024+3)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	build := func(p []byte) map[string][]byte { return NewActionData("abcd", p, "") }
+
+	bodies := splitFrames(codec, 4096, data, build)
+	require.Greater(t, len(bodies), 25)
+	var got []byte
+	for _, body := range bodies {
+		assert.LessOrEqual(t, len(body), 4096)
+		fr, err := codec.ReadFrame(bytes.NewReader(body))
+		require.NoError(t, err)
+		m, err := Unmarshal(fr.Data)
+		require.NoError(t, err)
+		got = append(got, m["dt"]...)
+	}
+	assert.Equal(t, data, got)
+
+	assert.Len(t, splitFrames(codec, 0, data, build), 1)
+	assert.Len(t, splitFrames(codec, 4096, nil, build), 1)
+}
+
+func TestHeartbeatDelay(t *testing.T) {
+	assert.Equal(t, heartbeatInterval, heartbeatDelay(heartbeatInterval, false))
+	for i := 0; i < 100; i++ {
+		d := heartbeatDelay(heartbeatInterval, true)
+		require.True(t, d >= heartbeatInterval/2 && d <= heartbeatInterval, d)
+	}
+	config := DefaultSuo5Config()
+	assert.Equal(t, time.Duration(0), config.writeDelay())
+	config.Jitter = 50
+	for i := 0; i < 100; i++ {
+		require.LessOrEqual(t, config.writeDelay(), 50*time.Millisecond)
+	}
+}
@@ -0,0 +1,263 @@
+package core
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PurpleNewNew/bs5/pkg/netrans"
+	log "github.com/kataras/golog"
+	"github.com/pkg/errors"
+)
+
+// 连接池的分配方式
+const (
+	BalanceRoundRobin = "round-robin"
+	BalanceLeastConn  = "least-conn"
+)
+
+var errNoTarget = errors.New("no available target")
+
+// targetError 请求本身失败或者响应无法解析，说明服务端不可用，而不是隧道的目标不可达
+type targetError struct{ error }
+
+func (e targetError) Unwrap() error { return e.error }
+
+// targetNode 连接池中的一个服务端。config 保持用户的设置，client 的配置中是这个地址检测得到的连接模式、偏移和编解码器
+type targetNode struct {
+	config  *Suo5Config
+	client  atomic.Pointer[Suo5Client]
+	healthy atomic.Bool
+	// active 通过这个地址建立的、还没有关闭的连接数
+	active atomic.Int64
+
+	// mu 保证同一时间只有一个检测，stop 停止当前 client 的后台任务
+	mu   sync.Mutex
+	stop context.CancelFunc
+}
+
+type targetPool struct {
+	nodes   []*targetNode
+	balance string
+	next    atomic.Uint64
+}
+
+// withTarget 复制一份连接 target 的配置，没有单独设置 Referer 时换成 target 所在的目录
+func (s *Suo5Config) withTarget(target string) *Suo5Config {
+	c := &Suo5Config{}
+	dst, src := reflect.ValueOf(c).Elem(), reflect.ValueOf(s).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		if src.Type().Field(i).IsExported() {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+	c.padding = s.padding
+	c.tls = s.tls
+	// 共用同一个路由表，重新加载的规则对所有地址生效
+	c.routes = s.routes
+	c.Target = target
+	c.Targets = nil
+	c.Header = s.Header.Clone()
+	if c.Header.Get("Referer") == referer(s.Target) {
+		c.Header.Set("Referer", referer(target))
+	}
+	return c
+}
+
+// initPool 检测 Target 和 Targets 中的每个地址，至少有一个可用时才能启动，之后按 HealthInterval 重新检测
+func (suo *Suo5Client) initPool(ctx context.Context) error {
+	config := suo.Config
+	pool := &targetPool{balance: config.Balance}
+	seen := make(map[string]bool)
+	for _, target := range append([]string{config.Target}, config.Targets...) {
+		target = strings.TrimSpace(target)
+		if target == "" || seen[target] {
+			continue
+		}
+		seen[target] = true
+		pool.nodes = append(pool.nodes, &targetNode{config: config.withTarget(target)})
+	}
+
+	if len(pool.nodes) == 0 {
+		return errors.New("no target is specified")
+	}
+
+	errs := make([]error, len(pool.nodes))
+	var wg sync.WaitGroup
+	for i, node := range pool.nodes {
+		log.Infof("connecting to target %s", node.config.Target)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = pool.check(ctx, suo, node)
+		}()
+	}
+	wg.Wait()
+
+	var first *targetNode
+	for i, node := range pool.nodes {
+		if errs[i] != nil {
+			log.Warnf("target %s is unavailable, %s", node.config.Target, errs[i])
+		} else if first == nil {
+			first = node
+		}
+	}
+	if first == nil {
+		return errors.Wrap(errs[0], "no target is available")
+	}
+	// 连接池的配置本身不直接使用，其中的连接模式等字段取第一个可用的地址，用于展示
+	c := first.client.Load().Config
+	config.Mode, config.Offset, config.Codec = c.Mode, c.Offset, c.Codec
+	suo.pool = pool
+
+	log.Infof("target pool: %d targets, balance: %s", len(pool.nodes), pool.balance)
+	if config.HealthInterval > 0 {
+		go pool.healthCheck(ctx, suo, time.Duration(config.HealthInterval)*time.Second)
+	}
+	return nil
+}
+
+// check 检测 node 是否可用，刚恢复或者偏移、编解码器发生变化时重新确定连接模式并创建新的客户端
+func (p *targetPool) check(ctx context.Context, front *Suo5Client, node *targetNode) error {
+	if !node.mu.TryLock() {
+		return nil
+	}
+	defer node.mu.Unlock()
+
+	config := node.config
+	// 检查是否可用时总是使用 http1，h2 只用于全双工的请求，在下面单独检测
+	c := config.withTarget(config.Target)
+	c.Transport = TransportHTTP1
+	probe, err := probeConnectMode(ctx, c, false)
+	if err == nil && probe.timedOut {
+		err = errors.New("connection mode check timed out")
+	}
+	if err != nil {
+		p.down(node, err)
+		return err
+	}
+	current := node.client.Load()
+	// 通过 WebSocket 承载时没有偏移
+	if node.healthy.Load() && current != nil && current.Config.Codec == probe.codec &&
+		(current.Config.WebSocket || current.Config.Offset == probe.offset) {
+		return nil
+	}
+
+	// 一次性发送的请求无法判断是否支持全双工，单独再检测一次，超时说明经过了缓冲请求体的反向代理
+	if config.Mode != HalfDuplex && config.Camouflage.Streaming() {
+		c.Transport = config.Transport
+		if h2 := probeH2(ctx, c); h2 != nil {
+			probe.mode = h2.mode
+		} else if detect, err := probeConnectMode(ctx, c, true); err == nil && !detect.timedOut {
+			probe.mode = detect.mode
+		}
+	}
+	if ws := probeWebSocket(ctx, c, probe); ws != nil {
+		probe = ws
+	}
+	if _, ok := config.Codec.(*netrans.AEADCodec); ok && probe.codec != config.Codec {
+		log.Warnf("target %s does not support encryption, fallback to xor obfuscation", config.Target)
+	}
+	if err := c.applyProbe(probe); err != nil {
+		p.down(node, err)
+		return err
+	}
+	client := &Suo5Client{
+		Config:          c,
+		NormalClient:    front.NormalClient,
+		NoTimeoutClient: front.NoTimeoutClient,
+		RawClient:       front.RawClient,
+		H2Client:        front.H2Client,
+	}
+	clientCtx, cancel := context.WithCancel(ctx)
+	client.start(clientCtx)
+	if old := node.client.Swap(client); old != nil {
+		_ = old.CloseMux()
+	}
+	if node.stop != nil {
+		node.stop()
+	}
+	node.stop = cancel
+	if !node.healthy.Swap(true) && current != nil {
+		log.Infof("target %s is available again, mode: %s, offset: %d", c.Target, c.Mode, c.Offset)
+	} else {
+		log.Infof("target %s is available, mode: %s, offset: %d", c.Target, c.Mode, c.Offset)
+	}
+	return nil
+}
+
+// down 将 node 移出连接池，之后的检测成功时重新加入
+func (p *targetPool) down(node *targetNode, err error) {
+	if node.healthy.CompareAndSwap(true, false) {
+		log.Warnf("target %s is down, %s", node.config.Target, err)
+	}
+}
+
+func (p *targetPool) healthCheck(ctx context.Context, front *Suo5Client, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		for _, node := range p.nodes {
+			go func() {
+				_ = p.check(ctx, front, node)
+			}()
+		}
+	}
+}
+
+// pick 选择一个可用且还没有尝试过的地址，都不可用时再尝试之前检测成功过的地址
+func (p *targetPool) pick(tried map[*targetNode]bool) *targetNode {
+	n := uint64(len(p.nodes))
+	start := p.next.Add(1) - 1
+	for _, healthyOnly := range []bool{true, false} {
+		var best *targetNode
+		for i := uint64(0); i < n; i++ {
+			node := p.nodes[(start+i)%n]
+			if tried[node] || node.client.Load() == nil || (healthyOnly && !node.healthy.Load()) {
+				continue
+			}
+			if p.balance != BalanceLeastConn {
+				return node
+			}
+			if best == nil || node.active.Load() < best.active.Load() {
+				best = node
+			}
+		}
+		if best != nil {
+			return best
+		}
+	}
+	return nil
+}
+
+// balance 从连接池中选择服务端执行 fn，服务端本身不可用时将其移出连接池并换下一个。
+// fn 执行时 suo 已经换成了所选地址的客户端
+func (suo *Suo5Conn) balance(fn func() error) (*targetNode, error) {
+	pool := suo.pool
+	tried := make(map[*targetNode]bool)
+	err := errNoTarget
+	for {
+		node := pool.pick(tried)
+		if node == nil {
+			return nil, err
+		}
+		tried[node] = true
+		suo.Suo5Client = node.client.Load()
+		if err = fn(); err == nil {
+			return node, nil
+		}
+		var te targetError
+		if !errors.As(err, &te) {
+			return nil, err
+		}
+		pool.down(node, err)
+	}
+}
@@ -6,10 +6,16 @@ import (
 	"fmt"
 	"github.com/PurpleNewNew/bs5/pkg/netrans"
 	"strconv"
+	"strings"
 )
 
 func BuildBody(m map[string][]byte) []byte {
-	return netrans.NewDataFrame(Marshal(m)).MarshalBinary()
+	return BuildBodyWith(netrans.XORCodec, m)
+}
+
+// BuildBodyWith 使用指定的编解码器构造数据帧
+func BuildBodyWith(codec netrans.Codec, m map[string][]byte) []byte {
+	return codec.Encode(Marshal(m))
 }
 
 const (
@@ -17,17 +23,31 @@ const (
 	ActionData      byte = 0x01
 	ActionDelete    byte = 0x02
 	ActionHeartbeat byte = 0x03
+	// ActionMux 0x04 已被 jsp 的 newCreate 占用
+	ActionMux byte = 0x05
+	// ActionBatch dt 中是若干个完整的数据帧，服务端依次处理并在 s 中返回每一帧的结果
+	ActionBatch byte = 0x06
+	// ActionResume 承载请求断开后用原来的 id 重新建立全双工请求，ak 为客户端已经收到的字节数
+	ActionResume byte = 0x07
+	// ActionDatagram 一个 UDP 数据报，h、p 在上行时是目标地址，在下行时是来源地址
+	ActionDatagram byte = 0x08
+	// ActionListen 请求服务端监听 h:p，之后服务端在同一个响应中用 ActionListen 通知接受的连接，
+	// 客户端再用带有 a 字段的 ActionCreate 接管这个连接
+	ActionListen byte = 0x09
+	// ActionWindow 多路复用的流控，接收方已经取走了 wn 字节，发送方可以再发送这么多数据
+	ActionWindow byte = 0x0A
 )
 
+// MuxWindow 多路复用时每个流在收到窗口更新前最多发送的字节数，接收方也最多为每个流缓存这么多数据
+const MuxWindow = 256 * 1024
+
 func NewActionCreate(id, addr string, port uint16, redirect string) map[string][]byte {
 	m := make(map[string][]byte)
 	m["ac"] = []byte{ActionCreate}
 	m["id"] = []byte(id)
 	m["h"] = []byte(addr)
 	m["p"] = []byte(strconv.Itoa(int(port)))
-	if len(redirect) != 0 {
-		m["r"] = []byte(redirect)
-	}
+	setRedirect(m, redirect)
 	return m
 }
 
@@ -36,19 +56,29 @@ func NewActionData(id string, data []byte, redirect string) map[string][]byte {
 	m["ac"] = []byte{ActionData}
 	m["id"] = []byte(id)
 	m["dt"] = []byte(data)
-	if len(redirect) != 0 {
-		m["r"] = []byte(redirect)
-	}
+	setRedirect(m, redirect)
 	return m
 }
 
+// NewCloseWrite 半关闭，服务端关闭到目标连接的写入端后仍然继续转发目标返回的数据。
+// 不认识 cw 的服务端会把它当作一个空的数据帧
+func NewCloseWrite(id string, redirect string) map[string][]byte {
+	m := NewActionData(id, nil, redirect)
+	m["cw"] = []byte{0x01}
+	return m
+}
+
+// IsCloseWrite 数据帧是否带有半关闭的标记
+func IsCloseWrite(m map[string][]byte) bool {
+	cw := m["cw"]
+	return len(cw) == 1 && cw[0] == 0x01
+}
+
 func NewDelete(id string, redirect string) map[string][]byte {
 	m := make(map[string][]byte)
 	m["ac"] = []byte{ActionDelete}
 	m["id"] = []byte(id)
-	if len(redirect) != 0 {
-		m["r"] = []byte(redirect)
-	}
+	setRedirect(m, redirect)
 	return m
 }
 
@@ -56,12 +86,140 @@ func NewHeartbeat(id string, redirect string) map[string][]byte {
 	m := make(map[string][]byte)
 	m["ac"] = []byte{ActionHeartbeat}
 	m["id"] = []byte(id)
-	if len(redirect) != 0 {
-		m["r"] = []byte(redirect)
+	setRedirect(m, redirect)
+	return m
+}
+
+// NewActionAssociate 建立一个 UDP 关联，之后通过 ActionDatagram 收发数据报
+func NewActionAssociate(id string, redirect string) map[string][]byte {
+	m := make(map[string][]byte)
+	m["ac"] = []byte{ActionCreate}
+	m["id"] = []byte(id)
+	m["u"] = []byte{0x01}
+	setRedirect(m, redirect)
+	return m
+}
+
+func NewActionDatagram(id, host string, port uint16, data []byte, redirect string) map[string][]byte {
+	m := make(map[string][]byte)
+	m["ac"] = []byte{ActionDatagram}
+	m["id"] = []byte(id)
+	m["h"] = []byte(host)
+	m["p"] = []byte(strconv.Itoa(int(port)))
+	m["dt"] = data
+	setRedirect(m, redirect)
+	return m
+}
+
+func NewActionListen(id, addr string, port uint16, redirect string) map[string][]byte {
+	m := NewActionCreate(id, addr, port, redirect)
+	m["ac"] = []byte{ActionListen}
+	return m
+}
+
+// NewActionMux 建立多路复用的承载请求，之后所有帧都依靠 id 区分所属的流。
+// fc 表示客户端支持流控，服务端在返回的状态帧中带上 fc 时双方都按照 MuxWindow 发送数据
+func NewActionMux(redirect string) map[string][]byte {
+	m := make(map[string][]byte)
+	m["ac"] = []byte{ActionMux}
+	m["fc"] = []byte{0x01}
+	setRedirect(m, redirect)
+	return m
+}
+
+// IsFlowControl 承载请求或者它的状态帧是否带有流控的标记
+func IsFlowControl(m map[string][]byte) bool {
+	fc := m["fc"]
+	return len(fc) == 1 && fc[0] == 0x01
+}
+
+func NewActionWindow(id string, n int) map[string][]byte {
+	m := make(map[string][]byte)
+	m["ac"] = []byte{ActionWindow}
+	m["id"] = []byte(id)
+	m["wn"] = binary.BigEndian.AppendUint32(nil, uint32(n))
+	return m
+}
+
+// WindowSize 读取窗口更新帧中的增量
+func WindowSize(m map[string][]byte) (int, bool) {
+	wn := m["wn"]
+	if len(wn) != 4 {
+		return 0, false
 	}
+	return int(binary.BigEndian.Uint32(wn)), true
+}
+
+func NewActionBatch(frames []byte, redirect string) map[string][]byte {
+	m := make(map[string][]byte)
+	m["ac"] = []byte{ActionBatch}
+	m["dt"] = frames
+	setRedirect(m, redirect)
+	return m
+}
+
+func NewActionResume(id string, ack uint64, redirect string) map[string][]byte {
+	m := make(map[string][]byte)
+	m["ac"] = []byte{ActionResume}
+	m["id"] = []byte(id)
+	SetUint64(m, "ak", ack)
+	setRedirect(m, redirect)
 	return m
 }
 
+// RedirectChainKey 第一跳之后的转发地址，以换行分隔。只有 Go 的服务端支持，其他服务端会忽略这个字段
+const RedirectChainKey = "rc"
+
+// setRedirect redirect 为换行分隔的转发地址，第一跳写入 r，其余写入 rc
+func setRedirect(m map[string][]byte, redirect string) {
+	if len(redirect) == 0 {
+		return
+	}
+	SetRedirectHops(m, strings.Split(redirect, "\n"))
+}
+
+// SetRedirectHops 按顺序写入转发地址，hops 为空时删除对应的字段
+func SetRedirectHops(m map[string][]byte, hops []string) {
+	delete(m, "r")
+	delete(m, RedirectChainKey)
+	if len(hops) == 0 {
+		return
+	}
+	m["r"] = []byte(hops[0])
+	if len(hops) > 1 {
+		m[RedirectChainKey] = []byte(strings.Join(hops[1:], "\n"))
+	}
+}
+
+// RedirectHops 读取帧中按顺序排列的转发地址
+func RedirectHops(m map[string][]byte) []string {
+	var hops []string
+	if r := m["r"]; len(r) != 0 {
+		hops = append(hops, string(r))
+	}
+	for _, hop := range strings.Split(string(m[RedirectChainKey]), "\n") {
+		if hop != "" {
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// SetUint64 以 8 字节大端序写入一个整数字段，用于可恢复流的 sq（本帧数据的起始序号）和 ak（已收到的字节数）
+func SetUint64(m map[string][]byte, key string, v uint64) {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, v)
+	m[key] = buf
+}
+
+func GetUint64(m map[string][]byte, key string) (uint64, bool) {
+	v, ok := m[key]
+	if !ok || len(v) != 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(v), true
+}
+
 // 定义一个最简的序列化协议，k,v 交替，每一项是len+data
 // 其中 k 最长 255，v 最长 MaxUInt32
 func Marshal(m map[string][]byte) []byte {
@@ -90,7 +248,7 @@ func Unmarshal(bs []byte) (map[string][]byte, error) {
 		key := string(bs[i : i+kLen])
 		i += kLen
 
-		if i+4 >= total {
+		if i+4 > total {
 			return nil, fmt.Errorf("unexpected eof when read value size")
 		}
 		vLen := int(binary.BigEndian.Uint32(bs[i : i+4]))
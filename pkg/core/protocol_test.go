@@ -0,0 +1,35 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnmarshalEmptyValue(t *testing.T) {
+	// 值为空的字段可能被序列化在最后
+	for i := 0; i < 20; i++ {
+		m := NewActionCreate("abc", "", 0, "")
+		got, err := Unmarshal(Marshal(m))
+		require.NoError(t, err)
+		require.Equal(t, m["id"], got["id"])
+		require.Empty(t, got["h"])
+	}
+}
+
+func TestRedirectHops(t *testing.T) {
+	m := NewActionCreate("abc", "", 0, "http://a/\nhttp://b/\nhttp://c/")
+	got, err := Unmarshal(Marshal(m))
+	require.NoError(t, err)
+	require.Equal(t, "http://a/", string(got["r"]))
+	require.Equal(t, []string{"http://a/", "http://b/", "http://c/"}, RedirectHops(got))
+
+	SetRedirectHops(got, []string{"http://c/"})
+	require.Equal(t, []string{"http://c/"}, RedirectHops(got))
+	require.NotContains(t, got, RedirectChainKey)
+	SetRedirectHops(got, nil)
+	require.Empty(t, RedirectHops(got))
+	require.NotContains(t, got, "r")
+
+	require.NotContains(t, NewActionCreate("abc", "", 0, ""), "r")
+}
@@ -0,0 +1,367 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/PurpleNewNew/bs5/pkg/netrans"
+	log "github.com/kataras/golog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxUnacked 未被对端确认的数据上限，超过后写入阻塞直到对端确认
+	maxUnacked = 4 * 1024 * 1024
+	// ackThreshold 收到的数据超过该值还没有确认时主动发送一次确认
+	ackThreshold = 64 * 1024
+	// resumeFrameSize 重放数据时单帧的最大长度
+	resumeFrameSize = 32 * 1024
+)
+
+var ErrResumeFailed = errors.New("failed to resume stream")
+
+// resumableReadWriter 可恢复的全双工读写流。每个数据帧都带有 sq 序号，并在 ak 中捎带已经收到的字节数，
+// 未被确认的数据保留在 sendBuf 中。承载请求断开后使用 ActionResume 以相同的 id 重新建立请求，
+// 双方交换已收到的字节数后重放对方缺失的部分，上层的连接不会感知到中断
+type resumableReadWriter struct {
+	ctx     context.Context
+	client  *Suo5Client
+	id      string
+	timeout time.Duration
+
+	// writeMu 保证数据帧按序号顺序写入当前的承载请求
+	writeMu sync.Mutex
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// codec 当前承载请求使用的编解码器，恢复后随请求一起替换
+	codec    netrans.Codec
+	reqBody  io.WriteCloser
+	resp     io.ReadCloser
+	sendBuf  []byte
+	sendBase uint64
+	recvNext uint64
+	lastAck  uint64
+	err      error
+	closed   bool
+	// writeClosed 已经半关闭，恢复后重放完数据需要再次通知服务端
+	writeClosed bool
+
+	readBuf bytes.Buffer
+	once    sync.Once
+}
+
+func newResumableReadWriter(ctx context.Context, client *Suo5Client, id string, reqBody io.WriteCloser, resp io.ReadCloser, codec netrans.Codec) *resumableReadWriter {
+	s := &resumableReadWriter{
+		ctx:     ctx,
+		client:  client,
+		id:      id,
+		codec:   codec,
+		timeout: time.Duration(client.Config.ResumeTimeout) * time.Second,
+		reqBody: reqBody,
+		resp:    resp,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *resumableReadWriter) Read(p []byte) (int, error) {
+	if s.readBuf.Len() != 0 {
+		return s.readBuf.Read(p)
+	}
+	for {
+		s.mu.Lock()
+		resp, codec := s.resp, s.codec
+		s.mu.Unlock()
+
+		fr, err := codec.ReadFrame(resp)
+		if err != nil {
+			if err := s.resume(err); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		m, err := Unmarshal(fr.Data)
+		if err != nil {
+			return 0, err
+		}
+		if ack, ok := GetUint64(m, "ak"); ok {
+			s.acked(ack)
+		}
+		action := m["ac"]
+		if len(action) != 1 {
+			return 0, fmt.Errorf("invalid action when read %v", action)
+		}
+		switch action[0] {
+		case ActionData:
+			data, err := s.accept(m)
+			if err != nil {
+				return 0, err
+			}
+			if len(data) == 0 {
+				continue
+			}
+			s.readBuf.Reset()
+			s.readBuf.Write(data)
+			return s.readBuf.Read(p)
+		case ActionDelete:
+			return 0, io.EOF
+		case ActionHeartbeat:
+			continue
+		default:
+			return 0, fmt.Errorf("unpected action when read %v", action)
+		}
+	}
+}
+
+// accept 根据序号去掉重放时重复的数据，需要时向服务端发送确认
+func (s *resumableReadWriter) accept(m map[string][]byte) ([]byte, error) {
+	data := m["dt"]
+	s.mu.Lock()
+	seq, ok := GetUint64(m, "sq")
+	if !ok {
+		seq = s.recvNext
+	}
+	if seq > s.recvNext {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("stream %s lost data, expect seq %d got %d", s.id, s.recvNext, seq)
+	}
+	if skip := s.recvNext - seq; skip < uint64(len(data)) {
+		data = data[skip:]
+	} else {
+		data = nil
+	}
+	s.recvNext += uint64(len(data))
+	needAck := s.recvNext-s.lastAck >= ackThreshold
+	s.mu.Unlock()
+
+	if needAck {
+		s.writeMu.Lock()
+		s.mu.Lock()
+		m := NewHeartbeat(s.id, "")
+		SetUint64(m, "ak", s.recvNext)
+		s.lastAck = s.recvNext
+		reqBody, codec := s.reqBody, s.codec
+		s.mu.Unlock()
+		_, _ = reqBody.Write(BuildBodyWith(codec, m))
+		s.writeMu.Unlock()
+	}
+	return data, nil
+}
+
+// acked 丢弃对端已经确认收到的数据
+func (s *resumableReadWriter) acked(ack uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ack <= s.sendBase || ack > s.sendBase+uint64(len(s.sendBuf)) {
+		return
+	}
+	s.sendBuf = s.sendBuf[ack-s.sendBase:]
+	s.sendBase = ack
+	s.cond.Broadcast()
+}
+
+func (s *resumableReadWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	for len(s.sendBuf) >= maxUnacked && s.err == nil && !s.closed {
+		s.cond.Wait()
+	}
+	err := s.err
+	if s.closed {
+		err = io.ErrClosedPipe
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	log.Debugf("write socket data, length: %d", len(p))
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.mu.Lock()
+	m := NewActionData(s.id, p, "")
+	SetUint64(m, "sq", s.sendBase+uint64(len(s.sendBuf)))
+	SetUint64(m, "ak", s.recvNext)
+	s.lastAck = s.recvNext
+	s.sendBuf = append(s.sendBuf, p...)
+	reqBody, codec := s.reqBody, s.codec
+	s.mu.Unlock()
+
+	// 写入失败时数据仍然保留在 sendBuf 中，恢复后会被重放
+	if _, err := reqBody.Write(BuildBodyWith(codec, m)); err != nil {
+		log.Debugf("write to carrier error, %s, waiting for resume", err)
+	}
+	return len(p), nil
+}
+
+func (s *resumableReadWriter) WriteRaw(p []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.mu.Lock()
+	reqBody := s.reqBody
+	s.mu.Unlock()
+	return reqBody.Write(p)
+}
+
+func (s *resumableReadWriter) WriteFrame(m map[string][]byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.mu.Lock()
+	reqBody, codec := s.reqBody, s.codec
+	s.mu.Unlock()
+	return reqBody.Write(BuildBodyWith(codec, m))
+}
+
+func (s *resumableReadWriter) CloseWrite() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return io.ErrClosedPipe
+	}
+	s.writeClosed = true
+	m := s.closeWriteFrame()
+	reqBody, codec := s.reqBody, s.codec
+	s.mu.Unlock()
+	if _, err := reqBody.Write(BuildBodyWith(codec, m)); err != nil {
+		log.Debugf("write to carrier error, %s, waiting for resume", err)
+	}
+	return nil
+}
+
+// closeWriteFrame 半关闭帧的序号在所有数据之后，调用时需要持有 s.mu
+func (s *resumableReadWriter) closeWriteFrame() map[string][]byte {
+	m := NewCloseWrite(s.id, "")
+	SetUint64(m, "sq", s.sendBase+uint64(len(s.sendBuf)))
+	return m
+}
+
+func (s *resumableReadWriter) Close() error {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		s.cond.Broadcast()
+		s.mu.Unlock()
+
+		s.writeMu.Lock()
+		s.mu.Lock()
+		reqBody, resp, codec := s.reqBody, s.resp, s.codec
+		s.mu.Unlock()
+		_, _ = reqBody.Write(BuildBodyWith(codec, NewDelete(s.id, "")))
+		s.writeMu.Unlock()
+		_ = reqBody.Close()
+		_ = resp.Close()
+	})
+	return nil
+}
+
+// resume 在承载请求断开后重新建立请求，直到成功、服务端已经丢弃了这个流或者超时
+func (s *resumableReadWriter) resume(cause error) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return cause
+	}
+	reqBody, resp := s.reqBody, s.resp
+	s.mu.Unlock()
+	// 关闭旧的请求体，让阻塞在上面的写入返回
+	_ = reqBody.Close()
+	_ = resp.Close()
+	log.Warnf("stream %s carrier dropped, %s, trying to resume", s.id, cause)
+
+	deadline := time.Now().Add(s.timeout)
+	backoff := 200 * time.Millisecond
+	for {
+		err := s.reopen()
+		if err == nil {
+			log.Infof("stream %s resumed", s.id)
+			return nil
+		}
+		fatal := errors.Is(err, ErrResumeFailed) || errors.Is(err, io.ErrClosedPipe)
+		if !fatal && time.Now().Add(backoff).Before(deadline) {
+			log.Debugf("resume stream %s error, %s", s.id, err)
+			select {
+			case <-time.After(backoff):
+			case <-s.ctx.Done():
+				err = s.ctx.Err()
+			}
+			if backoff *= 2; backoff > 5*time.Second {
+				backoff = 5 * time.Second
+			}
+			if s.ctx.Err() == nil {
+				continue
+			}
+		}
+		log.Errorf("failed to resume stream %s, %s", s.id, err)
+		s.mu.Lock()
+		s.err = err
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		return err
+	}
+}
+
+func (s *resumableReadWriter) reopen() error {
+	s.mu.Lock()
+	closed, recv := s.closed, s.recvNext
+	s.mu.Unlock()
+	if closed {
+		return io.ErrClosedPipe
+	}
+
+	reqBody, resp, codec, m, err := openFullRequest(s.ctx, s.client, NewActionResume(s.id, recv, s.client.Config.redirect()))
+	if err != nil {
+		return err
+	}
+	status := m["s"]
+	peerAck, ok := GetUint64(m, "ak")
+	if len(status) != 1 || status[0] != 0x00 || !ok {
+		_ = reqBody.Close()
+		_ = resp.Close()
+		return errors.Wrap(ErrResumeFailed, fmt.Sprintf("status: %v", status))
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.mu.Lock()
+	if peerAck < s.sendBase || peerAck > s.sendBase+uint64(len(s.sendBuf)) {
+		s.mu.Unlock()
+		_ = reqBody.Close()
+		_ = resp.Close()
+		return errors.Wrap(ErrResumeFailed, fmt.Sprintf("server has received %d bytes, but only %d-%d are buffered",
+			peerAck, s.sendBase, s.sendBase+uint64(len(s.sendBuf))))
+	}
+	s.sendBuf = s.sendBuf[peerAck-s.sendBase:]
+	s.sendBase = peerAck
+	s.reqBody, s.resp, s.codec = reqBody, resp, codec
+	s.lastAck = recv
+	replay := append([]byte(nil), s.sendBuf...)
+	var closeWrite map[string][]byte
+	if s.writeClosed {
+		closeWrite = s.closeWriteFrame()
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	// 重放服务端还没有收到的数据
+	for off := 0; off < len(replay); off += resumeFrameSize {
+		end := off + resumeFrameSize
+		if end > len(replay) {
+			end = len(replay)
+		}
+		m := NewActionData(s.id, replay[off:end], "")
+		SetUint64(m, "sq", peerAck+uint64(off))
+		if _, err := reqBody.Write(BuildBodyWith(codec, m)); err != nil {
+			return nil
+		}
+	}
+	if closeWrite != nil {
+		_, _ = reqBody.Write(BuildBodyWith(codec, closeWrite))
+	}
+	return nil
+}
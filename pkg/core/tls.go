@@ -0,0 +1,239 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// ClientHello 的预设
+const (
+	TLSRandomized = "randomized"
+	TLSChrome     = "chrome"
+	TLSFirefox    = "firefox"
+	TLSSafari     = "safari"
+	TLSIOS        = "ios"
+	TLSEdge       = "edge"
+)
+
+var tlsPresets = map[string]utls.ClientHelloID{
+	TLSChrome:  utls.HelloChrome_Auto,
+	TLSFirefox: utls.HelloFirefox_Auto,
+	TLSSafari:  utls.HelloSafari_Auto,
+	TLSIOS:     utls.HelloIOS_Auto,
+	TLSEdge:    utls.HelloEdge_Auto,
+}
+
+// defaultALPN 连接只使用 HTTP/1.1，浏览器的预设和自定义的 spec 默认只声明 http/1.1
+var defaultALPN = []string{"http/1.1"}
+
+// tlsDialer 在已经建立的连接上完成 uTLS 握手，net/http 的 Transport 和 raw client 使用同一份配置
+type tlsDialer struct {
+	// newSpec 每次握手都需要一份新的 spec，为空时使用随机生成的 ClientHello
+	newSpec    func() (*utls.ClientHelloSpec, error)
+	helloID    utls.ClientHelloID
+	serverName string
+	alpn       []string
+	pins       [][]byte
+	certs      []utls.Certificate
+	// h2 为 true 时只声明 h2，服务端没有选择 h2 时握手失败
+	h2 bool
+}
+
+func newTLSDialer(config *Suo5Config) (*tlsDialer, error) {
+	d := &tlsDialer{
+		serverName: config.TLSServerName,
+		alpn:       config.TLSALPN,
+	}
+
+	switch {
+	case config.TLSSpecFile != "":
+		data, err := os.ReadFile(config.TLSSpecFile)
+		if err != nil {
+			return nil, fmt.Errorf("read tls spec file, %w", err)
+		}
+		d.newSpec = func() (*utls.ClientHelloSpec, error) {
+			var u utls.ClientHelloSpecJSONUnmarshaler
+			if err := json.Unmarshal(data, &u); err != nil {
+				return nil, fmt.Errorf("invalid tls spec file %s, %w", config.TLSSpecFile, err)
+			}
+			spec := u.ClientHelloSpec()
+			return &spec, nil
+		}
+		// 提前解析一次，尽早发现格式错误
+		if _, err := d.newSpec(); err != nil {
+			return nil, err
+		}
+		if len(d.alpn) == 0 {
+			d.alpn = defaultALPN
+		}
+	case config.TLSFingerprint == "" || config.TLSFingerprint == TLSRandomized:
+		// 与之前的版本相同，没有指定 ALPN 时不带这个扩展
+		d.helloID = utls.HelloRandomizedNoALPN
+		if len(d.alpn) != 0 {
+			d.helloID = utls.HelloRandomizedALPN
+		}
+	default:
+		id, ok := tlsPresets[config.TLSFingerprint]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls fingerprint %q, expected randomized, chrome, firefox, safari, ios or edge", config.TLSFingerprint)
+		}
+		d.newSpec = func() (*utls.ClientHelloSpec, error) {
+			spec, err := utls.UTLSIdToSpec(id)
+			if err != nil {
+				return nil, err
+			}
+			return &spec, nil
+		}
+		if len(d.alpn) == 0 {
+			d.alpn = defaultALPN
+		}
+	}
+
+	for _, pin := range config.TLSPins {
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(pin), "sha256/"))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid tls pin %q, expected the base64 sha256 of the server public key", pin)
+		}
+		d.pins = append(d.pins, hash)
+	}
+
+	if config.TLSCert != "" || config.TLSKey != "" {
+		if config.TLSCert == "" || config.TLSKey == "" {
+			return nil, fmt.Errorf("both tls cert and tls key are required for the client certificate")
+		}
+		cert, err := utls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate, %w", err)
+		}
+		d.certs = []utls.Certificate{cert}
+	}
+	return d, nil
+}
+
+// Handshake addr 为 host:port，没有指定 SNI 时使用其中的 host
+func (d *tlsDialer) Handshake(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	serverName := d.serverName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		serverName = host
+	}
+	config := &utls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		Renegotiation:      utls.RenegotiateOnceAsClient,
+		MinVersion:         utls.VersionTLS10,
+		NextProtos:         d.alpn,
+		Certificates:       d.certs,
+	}
+
+	var uConn *utls.UConn
+	if d.newSpec == nil {
+		var err error
+		uConn, err = d.randomized(conn, config)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	} else {
+		spec, err := d.newSpec()
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		if len(d.alpn) != 0 {
+			for _, ext := range spec.Extensions {
+				if alpn, ok := ext.(*utls.ALPNExtension); ok {
+					alpn.AlpnProtocols = d.alpn
+				}
+			}
+		}
+		uConn = utls.UClient(conn, config, utls.HelloCustom)
+		if err := uConn.ApplyPreset(spec); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("apply tls spec, %w", err)
+		}
+	}
+	if err := uConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	state := uConn.ConnectionState()
+	if err := d.verifyPins(state.PeerCertificates); err != nil {
+		_ = uConn.Close()
+		return nil, err
+	}
+	if d.h2 {
+		if state.NegotiatedProtocol != "h2" {
+			_ = uConn.Close()
+			return nil, fmt.Errorf("server does not support h2, negotiated protocol %q", state.NegotiatedProtocol)
+		}
+		return uConn, nil
+	}
+	if state.NegotiatedProtocol != "" && state.NegotiatedProtocol != "http/1.1" {
+		_ = uConn.Close()
+		return nil, fmt.Errorf("server selected unsupported protocol %q, check the tls alpn", state.NegotiatedProtocol)
+	}
+	return uConn, nil
+}
+
+// forH2 返回只声明 h2 的副本，指纹和其他配置保持不变
+func (d *tlsDialer) forH2() *tlsDialer {
+	h2 := *d
+	h2.alpn = []string{"h2"}
+	h2.h2 = true
+	if h2.newSpec == nil {
+		h2.helloID = utls.HelloRandomizedALPN
+	}
+	return &h2
+}
+
+// randomized 随机生成的 ClientHello 可能声明了 X25519MLKEM768 却没有附带对应的 key share，
+// 服务端选择这个曲线时握手会失败。此时连接上还没有发送数据，重新生成即可
+func (d *tlsDialer) randomized(conn net.Conn, config *utls.Config) (*utls.UConn, error) {
+	for i := 0; ; i++ {
+		uConn := utls.UClient(conn, config, d.helloID)
+		if err := uConn.BuildHandshakeState(); err != nil {
+			return nil, err
+		}
+		hello := uConn.HandshakeState.Hello
+		if i >= 16 || !slices.Contains(hello.SupportedCurves, utls.X25519MLKEM768) ||
+			slices.ContainsFunc(hello.KeyShares, func(ks utls.KeyShare) bool { return ks.Group == utls.X25519MLKEM768 }) {
+			return uConn, nil
+		}
+	}
+}
+
+// verifyPins 从叶子证书开始沿证书链向上检查，匹配的证书到叶子之间的每一级签名都必须有效，
+// 否则中间人可以在自己的证书后面附上真实的证书绕过固定。没有配置时不检查
+func (d *tlsDialer) verifyPins(certs []*x509.Certificate) error {
+	if len(d.pins) == 0 {
+		return nil
+	}
+	for i, cert := range certs {
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range d.pins {
+			if bytes.Equal(hash[:], pin) {
+				return nil
+			}
+		}
+		if i+1 >= len(certs) || cert.CheckSignatureFrom(certs[i+1]) != nil {
+			break
+		}
+	}
+	return fmt.Errorf("server certificate does not match any tls pin")
+}
@@ -0,0 +1,63 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newCert 创建由 parent 签名的证书，parent 为空时自签名
+func newCert(t *testing.T, name string, ca bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
+
+func pinOf(cert *x509.Certificate) []byte {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hash[:]
+}
+
+func TestVerifyPins(t *testing.T) {
+	ca, caKey := newCert(t, "ca", true, nil, nil)
+	leaf, _ := newCert(t, "leaf", false, ca, caKey)
+	fake, _ := newCert(t, "fake", false, nil, nil)
+
+	d := &tlsDialer{}
+	require.NoError(t, d.verifyPins([]*x509.Certificate{fake}))
+
+	d.pins = [][]byte{pinOf(leaf)}
+	require.NoError(t, d.verifyPins([]*x509.Certificate{leaf, ca}))
+	require.Error(t, d.verifyPins([]*x509.Certificate{fake, leaf}))
+
+	// 固定 CA 时叶子证书必须由它签名
+	d.pins = [][]byte{pinOf(ca)}
+	require.NoError(t, d.verifyPins([]*x509.Certificate{leaf, ca}))
+	require.Error(t, d.verifyPins([]*x509.Certificate{fake, ca}))
+	require.Error(t, d.verifyPins([]*x509.Certificate{fake, leaf, ca}))
+	require.Error(t, d.verifyPins(nil))
+}
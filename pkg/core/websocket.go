@@ -0,0 +1,165 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/PurpleNewNew/bs5/pkg/camouflage"
+	log "github.com/kataras/golog"
+	"golang.org/x/net/websocket"
+)
+
+// wsBody WebSocket 连接收到的数据，关闭时同时关闭连接
+type wsBody struct {
+	ws   *websocket.Conn
+	stop func() bool
+}
+
+func (b *wsBody) Read(p []byte) (int, error) {
+	return b.ws.Read(p)
+}
+
+func (b *wsBody) Close() error {
+	b.stop()
+	return b.ws.Close()
+}
+
+// dialWebSocket 通过 WebSocket 发送一个隧道请求，第一个消息为请求的类型，之后 body 中的数据作为二进制消息依次发出，
+// 返回的响应体为服务端发来的数据。WebSocket 的请求不经过伪装，也没有页面输出的偏移
+func dialWebSocket(ctx context.Context, config *Suo5Config, mode camouflage.Mode, body io.Reader) (*http.Response, error) {
+	u, err := url.Parse(config.Target)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	origin := &url.URL{Scheme: u.Scheme, Host: u.Host}
+	location := *u
+	location.Scheme = "ws"
+	if u.Scheme == "https" {
+		location.Scheme = "wss"
+	}
+	if config.HostHeader != "" {
+		location.Host = config.HostHeader
+	}
+	wsConfig := &websocket.Config{
+		Location: &location,
+		Origin:   origin,
+		Version:  websocket.ProtocolVersionHybi13,
+		Header:   config.Header.Clone(),
+	}
+	if wsConfig.Header == nil {
+		wsConfig.Header = make(http.Header)
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	var conn net.Conn
+	if config.ProxyClient != nil {
+		conn, err = config.ProxyClient.DialContext(dialCtx, "tcp", config.connectAddress(addr))
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(dialCtx, "tcp", config.connectAddress(addr))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "https" {
+		if conn, err = config.tls.Handshake(dialCtx, conn, addr); err != nil {
+			return nil, err
+		}
+	}
+	// 请求结束前 ctx 被取消时关闭连接，打断握手和之后的读写
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	ws, err := websocket.NewClient(wsConfig, conn)
+	if err != nil {
+		stop()
+		_ = conn.Close()
+		return nil, fmt.Errorf("websocket handshake failed, %w", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+
+	go func() {
+		if _, err := ws.Write([]byte{byte(mode)}); err != nil {
+			return
+		}
+		_, _ = io.Copy(ws, body)
+	}()
+	return &http.Response{
+		Status:     "101 Switching Protocols",
+		StatusCode: http.StatusSwitchingProtocols,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       &wsBody{ws: ws, stop: stop},
+	}, nil
+}
+
+// openFull 发送全双工的请求，启用了 WebSocket 时通过 WebSocket 承载，否则按照配置的伪装方式发送
+func (suo *Suo5Client) openFull(ctx context.Context, body io.Reader) (*http.Response, error) {
+	if suo.Config.WebSocket {
+		return dialWebSocket(ctx, suo.Config, camouflage.ModeFull, body)
+	}
+	req, err := NewTunnelRequest(ctx, suo.Config, camouflage.ModeFull, body)
+	if err != nil {
+		return nil, err
+	}
+	return suo.doFull(req)
+}
+
+// probeWebSocket 普通的全双工请求不可用时尝试 WebSocket，WebSocket 也不可用或者不需要时关闭这个选项并返回 nil
+func probeWebSocket(ctx context.Context, config *Suo5Config, probe *connectModeResult) *connectModeResult {
+	if !config.WebSocket {
+		return nil
+	}
+	if config.Mode == HalfDuplex || (probe.mode == FullDuplex && !probe.timedOut) {
+		config.WebSocket = false
+		return nil
+	}
+	result, err := probeWebSocketMode(ctx, config)
+	if err != nil {
+		log.Warnf("websocket carrier check failed, %s", err)
+		config.WebSocket = false
+		return nil
+	}
+	log.Infof("full duplex requests will be carried over websocket")
+	return result
+}
+
+// probeWebSocketMode 与普通的检测请求相同，服务端原样返回前 32 字节，支持加密时再附带一个加密帧
+func probeWebSocketMode(ctx context.Context, config *Suo5Config) (*connectModeResult, error) {
+	checkCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	data := []byte(RandString(32 + rand.Intn(992)))
+	resp, err := dialWebSocket(checkCtx, config, camouflage.ModeCheck, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !bytes.HasPrefix(body, data[:32]) {
+		return nil, fmt.Errorf("got unexpected websocket response")
+	}
+	codec, err := negotiateCodec(config, body[32:])
+	if err != nil {
+		return nil, err
+	}
+	return &connectModeResult{mode: FullDuplex, codec: codec}, nil
+}
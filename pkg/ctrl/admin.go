@@ -0,0 +1,154 @@
+package ctrl
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/PurpleNewNew/bs5/pkg/core"
+	log "github.com/kataras/golog"
+	"github.com/pkg/errors"
+)
+
+// routePatch 重新加载时请求体中没有给出的字段保持当前的配置
+type routePatch struct {
+	ExcludeDomain *[]string            `json:"exclude_domain"`
+	Rules         *[]string            `json:"rules"`
+	Upstreams     *map[string][]string `json:"upstreams"`
+	DefaultRoute  *string              `json:"default_route"`
+}
+
+func (p *routePatch) apply(c core.RouteConfig) core.RouteConfig {
+	if p.ExcludeDomain != nil {
+		c.ExcludeDomain = *p.ExcludeDomain
+	}
+	if p.Rules != nil {
+		c.Rules = *p.Rules
+	}
+	if p.Upstreams != nil {
+		c.Upstreams = *p.Upstreams
+	}
+	if p.DefaultRoute != nil {
+		c.DefaultRoute = *p.DefaultRoute
+	}
+	return c
+}
+
+// newAdminHandler 管理接口，只应监听在本地地址上
+func newAdminHandler(config *core.Suo5Config, streams *registry) http.Handler {
+	// 读取当前配置和替换之间不能穿插别的重新加载
+	var reloadMu sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/streams", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, streams.list())
+	})
+	mux.HandleFunc("GET /api/streams/{id}", func(w http.ResponseWriter, r *http.Request) {
+		s, ok := streams.get(r.PathValue("id"))
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "stream not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, s.Info())
+	})
+	mux.HandleFunc("DELETE /api/streams/{id}", func(w http.ResponseWriter, r *http.Request) {
+		s, ok := streams.get(r.PathValue("id"))
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "stream not found")
+			return
+		}
+		// 本地的连接会在读到 EOF 后关闭
+		_ = s.Close()
+		log.Infof("stream %s to %s closed by admin", s.info.ID, s.info.Target)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /api/reload", func(w http.ResponseWriter, r *http.Request) {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+		from, err := readReloadConfig(config, r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := config.ReloadRoute(from); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Infof("routing reloaded, %d exclude domains, %d rules", len(from.ExcludeDomain), len(from.Rules))
+		writeJSON(w, http.StatusOK, config.ActiveRoute())
+	})
+
+	if config.AdminToken == "" {
+		return mux
+	}
+	expected := []byte("Bearer " + config.AdminToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// readReloadConfig 请求体中带有 JSON 配置时把它合并到当前的配置上，否则通过 OnReload 重新读取配置文件
+func readReloadConfig(config *core.Suo5Config, r *http.Request) (core.RouteConfig, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return core.RouteConfig{}, err
+	}
+	if len(body) != 0 {
+		patch := &routePatch{}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(patch); err != nil {
+			return core.RouteConfig{}, errors.Wrap(err, "invalid reload config")
+		}
+		return patch.apply(config.ActiveRoute()), nil
+	}
+	if config.OnReload == nil {
+		return core.RouteConfig{}, errors.New("no config to reload from, post the rules as json instead")
+	}
+	from, err := config.OnReload()
+	if err != nil {
+		return core.RouteConfig{}, err
+	}
+	return core.RouteConfig{
+		ExcludeDomain: from.ExcludeDomain,
+		Rules:         from.Rules,
+		Upstreams:     from.Upstreams,
+		DefaultRoute:  from.DefaultRoute,
+	}, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// serveAdmin 启动管理接口，ctx 结束时关闭
+func serveAdmin(ctx context.Context, config *core.Suo5Config, streams *registry) error {
+	lis, err := net.Listen("tcp", config.AdminListen)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: newAdminHandler(config, streams), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	return nil
+}
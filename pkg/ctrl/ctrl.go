@@ -3,7 +3,10 @@ package ctrl
 import (
 	"context"
 	"fmt"
+	"github.com/PurpleNewNew/bs5/pkg/camouflage"
 	"github.com/PurpleNewNew/bs5/pkg/core"
+	"github.com/PurpleNewNew/bs5/pkg/dns"
+	"github.com/PurpleNewNew/bs5/pkg/metrics"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -21,6 +24,10 @@ import (
 )
 
 func Run(ctx context.Context, config *core.Suo5Config) error {
+	// 返回时关闭已经启动的所有监听，启动中途失败时不会留下仍在运行的服务
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	if config.GuiLog != nil {
 		// 防止多次执行出错
 		log.Default = log.New()
@@ -43,6 +50,12 @@ func Run(ctx context.Context, config *core.Suo5Config) error {
 	var socks5Addr string
 	msg := "[Tunnel Info]\n"
 	msg += fmt.Sprintf("Target:  %s\n", config.Target)
+	if len(config.Targets) != 0 {
+		for _, target := range config.Targets {
+			msg += fmt.Sprintf("         %s\n", target)
+		}
+		msg += fmt.Sprintf("Balance: %s\n", config.Balance)
+	}
 
 	if config.ForwardTarget != "" {
 		msg += fmt.Sprintf("Forward: %s\n", config.ForwardTarget)
@@ -54,8 +67,54 @@ func Run(ctx context.Context, config *core.Suo5Config) error {
 			socks5Addr = fmt.Sprintf("socks5://%s:%s@%s", config.Username, config.Password, config.Listen)
 		}
 		msg += fmt.Sprintf("Proxy:   %s\n", socks5Addr)
+		httpAddr := config.Listen
+		if config.HTTPListen != "" {
+			httpAddr = config.HTTPListen
+		}
+		if config.NoAuth {
+			msg += fmt.Sprintf("HTTP:    http://%s\n", httpAddr)
+		} else {
+			msg += fmt.Sprintf("HTTP:    http://%s:%s@%s\n", config.Username, config.Password, httpAddr)
+		}
 	}
 
+	if config.RedirListen != "" {
+		msg += fmt.Sprintf("Redir:   %s\n", config.RedirListen)
+	}
+	if config.MetricsListen != "" {
+		msg += fmt.Sprintf("Metrics: http://%s/metrics\n", config.MetricsListen)
+	}
+	if config.Profile != "" && config.Profile != camouflage.Raw {
+		msg += fmt.Sprintf("Profile: %s, field %s\n", config.Profile, config.ProfileField)
+	}
+	if config.TLSSpecFile != "" {
+		msg += fmt.Sprintf("TLS:     %s\n", config.TLSSpecFile)
+	} else if config.TLSFingerprint != "" && config.TLSFingerprint != core.TLSRandomized {
+		msg += fmt.Sprintf("TLS:     %s\n", config.TLSFingerprint)
+	}
+	if config.ConnectAddress != "" {
+		msg += fmt.Sprintf("Connect: %s\n", config.ConnectAddress)
+	}
+	if config.WebSocket {
+		msg += "Proto:   websocket\n"
+	} else if config.Transport == core.TransportH2 {
+		msg += fmt.Sprintf("Proto:   %s\n", config.Transport)
+	}
+	if config.Padding != "" {
+		msg += fmt.Sprintf("Padding: %s\n", config.Padding)
+	}
+	if config.AdminListen != "" {
+		msg += fmt.Sprintf("Admin:   http://%s/api/streams\n", config.AdminListen)
+	}
+	if config.DNSListen != "" {
+		msg += fmt.Sprintf("DNS:     %s -> %s\n", config.DNSListen, config.DNSServer)
+	}
+	for _, rule := range config.ForwardRules {
+		msg += fmt.Sprintf("Local:   %s\n", rule)
+	}
+	for _, rule := range config.ReverseRules {
+		msg += fmt.Sprintf("Reverse: %s\n", rule)
+	}
 	msg += fmt.Sprintf("Mode:    %s\n", config.Mode)
 	fmt.Println(pio.Rich(msg, pio.Green))
 
@@ -70,7 +129,10 @@ func Run(ctx context.Context, config *core.Suo5Config) error {
 	go func() {
 		<-ctx.Done()
 		log.Infof("server stopped")
+		stats := suo5Client.RawClient.PoolStats()
+		log.Debugf("raw connection pool, %d hits, %d misses, %d idle", stats.Hits, stats.Misses, stats.Idle)
 		_ = srv.Close()
+		_ = suo5Client.CloseMux()
 	}()
 
 	trPool := &sync.Pool{
@@ -79,12 +141,13 @@ func Run(ctx context.Context, config *core.Suo5Config) error {
 		},
 	}
 
+	streams := newRegistry()
 	var handler server.Handler
 
 	if config.ForwardTarget != "" {
 		// 使用 Forward 模式
 		handler = &core.ClientEventHandler{
-			Inner:                   NewForwardHandler(ctx, suo5Client, trPool, config.ForwardTarget),
+			Inner:                   NewForwardHandler(ctx, suo5Client, trPool, streams, config.ForwardTarget),
 			OnNewClientConnection:   config.OnNewClientConnection,
 			OnClientConnectionClose: config.OnClientConnectionClose,
 		}
@@ -97,16 +160,112 @@ func Run(ctx context.Context, config *core.Suo5Config) error {
 		}
 		selector := NewServerSelector(u)
 
+		socks := &socks5Handler{
+			Suo5Client: suo5Client,
+			ctx:        ctx,
+			pool:       trPool,
+			streams:    streams,
+			selector:   selector,
+		}
+		httpProxy := newHTTPProxyHandler(ctx, suo5Client, streams)
+		// 监听端口同时支持 SOCKS4/4a、SOCKS5 和 HTTP 代理
 		handler = &core.ClientEventHandler{
-			Inner: &socks5Handler{
-				Suo5Client: suo5Client,
-				ctx:        ctx,
-				pool:       trPool,
-				selector:   selector,
-			},
+			Inner:                   &mixedHandler{socks4: newSocks4Handler(ctx, suo5Client, streams), socks5: socks, http: httpProxy},
 			OnNewClientConnection:   config.OnNewClientConnection,
 			OnClientConnectionClose: config.OnClientConnectionClose,
 		}
+
+		if config.HTTPListen != "" {
+			httpLis, err := net.Listen("tcp", config.HTTPListen)
+			if err != nil {
+				return err
+			}
+			httpSrv := &server.Server{Listener: httpLis}
+			go func() {
+				<-ctx.Done()
+				_ = httpSrv.Close()
+			}()
+			go func() {
+				_ = httpSrv.Serve(&core.ClientEventHandler{
+					Inner:                   httpProxy,
+					OnNewClientConnection:   config.OnNewClientConnection,
+					OnClientConnectionClose: config.OnClientConnectionClose,
+				})
+			}()
+			log.Infof("http proxy listening at %s", config.HTTPListen)
+		}
+	}
+
+	if config.RedirListen != "" {
+		redirLis, err := net.Listen("tcp", config.RedirListen)
+		if err != nil {
+			return err
+		}
+		redirSrv := &server.Server{Listener: redirLis}
+		go func() {
+			<-ctx.Done()
+			_ = redirSrv.Close()
+		}()
+		go func() {
+			_ = redirSrv.Serve(&core.ClientEventHandler{
+				Inner:                   &redirHandler{Suo5Client: suo5Client, ctx: ctx, pool: trPool, streams: streams},
+				OnNewClientConnection:   config.OnNewClientConnection,
+				OnClientConnectionClose: config.OnClientConnectionClose,
+			})
+		}()
+		log.Infof("transparent proxy listening at %s", config.RedirListen)
+	}
+
+	if config.MetricsListen != "" {
+		if err := metrics.Serve(ctx, config.MetricsListen); err != nil {
+			return err
+		}
+		log.Infof("metrics listening at %s", config.MetricsListen)
+	}
+
+	if config.AdminListen != "" {
+		if err := serveAdmin(ctx, config, streams); err != nil {
+			return err
+		}
+		log.Infof("admin api listening at %s", config.AdminListen)
+	}
+
+	if config.DNSListen != "" {
+		dnsSrv := &dns.Server{
+			Upstream: config.DNSServer,
+			Domains:  config.DNSDomains,
+			Dial: func(ctx context.Context, _, address string) (net.Conn, error) {
+				return dialTunnel(ctx, suo5Client, streams, address)
+			},
+		}
+		if err := dnsSrv.Start(ctx, config.DNSListen); err != nil {
+			return err
+		}
+		log.Infof("dns server listening at %s, resolving via %s", config.DNSListen, config.DNSServer)
+	}
+
+	// 额外的本地转发规则，与代理同时运行
+	for _, rule := range config.ForwardRules {
+		fwdLis, err := net.Listen("tcp", rule.Listen)
+		if err != nil {
+			return err
+		}
+		fwdSrv := &server.Server{Listener: fwdLis}
+		go func() {
+			<-ctx.Done()
+			_ = fwdSrv.Close()
+		}()
+		go func(rule core.ForwardRule) {
+			_ = fwdSrv.Serve(&core.ClientEventHandler{
+				Inner:                   NewForwardHandler(ctx, suo5Client, trPool, streams, rule.Target),
+				OnNewClientConnection:   config.OnNewClientConnection,
+				OnClientConnectionClose: config.OnClientConnectionClose,
+			})
+		}(rule)
+		log.Infof("local forwarding %s", rule)
+	}
+	for _, rule := range config.ReverseRules {
+		go NewReverseForwarder(ctx, suo5Client, trPool, streams, rule).Run()
 	}
 
 	go func() {
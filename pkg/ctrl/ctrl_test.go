@@ -0,0 +1,1770 @@
+package ctrl
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PurpleNewNew/bs5/internal/proxyclient"
+	httpproxy "github.com/PurpleNewNew/bs5/internal/proxyclient/http"
+	"github.com/PurpleNewNew/bs5/pkg/camouflage"
+	"github.com/PurpleNewNew/bs5/pkg/core"
+	"github.com/PurpleNewNew/bs5/pkg/netrans"
+	"github.com/PurpleNewNew/bs5/pkg/server"
+	"github.com/go-gost/gosocks5"
+	"github.com/go-gost/gosocks5/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startEchoServer 启动一个原样返回数据的 TCP 服务
+func startEchoServer(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return lis.Addr().String()
+}
+
+// startSuo5Server 启动 Go 实现的服务端，buffered 为 true 时在前面加一层会缓存请求体的反向代理，
+// 模拟 Nginx 等场景，使客户端只能使用半双工模式
+func startSuo5Server(t *testing.T, buffered bool) string {
+	return startSuo5ServerWith(t, server.NewHandler(), buffered)
+}
+
+func startSuo5ServerWith(t *testing.T, h http.Handler, buffered bool) string {
+	backend := httptest.NewServer(h)
+	t.Cleanup(backend.Close)
+	if !buffered {
+		return backend.URL
+	}
+
+	u, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.FlushInterval = -1
+	frontend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.TransferEncoding = nil
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(frontend.Close)
+	return frontend.URL
+}
+
+func freeAddr(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+	return lis.Addr().String()
+}
+
+func newTestConfig(t *testing.T, target string) *core.Suo5Config {
+	config := core.DefaultSuo5Config()
+	config.Target = target
+	config.Listen = freeAddr(t)
+	require.NoError(t, config.Parse())
+	return config
+}
+
+// startTunnel 在后台运行 Run，直到监听地址可以连接，返回实际使用的连接模式
+func startTunnel(t *testing.T, config *core.Suo5Config) core.ConnectionType {
+	ctx, cancel := context.WithCancel(context.Background())
+	modeCh := make(chan core.ConnectionType, 1)
+	config.OnRemoteConnected = func(e *core.ConnectedEvent) {
+		modeCh <- e.Mode
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- Run(ctx, config)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case <-errCh:
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	deadline := time.Now().Add(15 * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-errCh:
+			require.NoError(t, err)
+			t.Fatal("tunnel exited unexpectedly")
+		default:
+		}
+		conn, err := net.DialTimeout("tcp", config.Listen, time.Second)
+		if err == nil {
+			_ = conn.Close()
+			return <-modeCh
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("tunnel not ready")
+	return core.Undefined
+}
+
+func dialSocks5(t *testing.T, config *core.Suo5Config, address string) (net.Conn, error) {
+	proxy := &url.URL{Scheme: "socks5", Host: config.Listen}
+	if !config.NoAuth {
+		proxy.User = url.UserPassword(config.Username, config.Password)
+	}
+	dial, err := proxyclient.NewClient(proxy)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return dial.DialContext(ctx, "tcp", address)
+}
+
+// assertEcho 发送随机数据并校验回显的每一个字节
+func assertEcho(t *testing.T, conn net.Conn, size int) {
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	go func() {
+		_, _ = conn.Write(data)
+	}()
+	_ = conn.SetReadDeadline(time.Now().Add(20 * time.Second))
+	got := make([]byte, size)
+	_, err = io.ReadFull(conn, got)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, got), "echo data mismatch")
+}
+
+func TestSocks5FullDuplex(t *testing.T) {
+	echo := startEchoServer(t)
+	config := newTestConfig(t, startSuo5Server(t, false))
+	require.Equal(t, core.FullDuplex, startTunnel(t, config))
+
+	for i := 0; i < 3; i++ {
+		conn, err := dialSocks5(t, config, echo)
+		require.NoError(t, err)
+		assertEcho(t, conn, 256*1024)
+		_ = conn.Close()
+	}
+}
+
+func TestSocks5HalfDuplex(t *testing.T) {
+	echo := startEchoServer(t)
+	config := newTestConfig(t, startSuo5Server(t, true))
+	require.Equal(t, core.HalfDuplex, startTunnel(t, config))
+
+	conn, err := dialSocks5(t, config, echo)
+	require.NoError(t, err)
+	defer conn.Close()
+	assertEcho(t, conn, 64*1024)
+}
+
+func TestSocks5Auth(t *testing.T) {
+	echo := startEchoServer(t)
+	config := newTestConfig(t, startSuo5Server(t, false))
+	config.NoAuth = false
+	config.Username = "suo5"
+	config.Password = core.RandString(8)
+	startTunnel(t, config)
+
+	conn, err := dialSocks5(t, config, echo)
+	require.NoError(t, err)
+	assertEcho(t, conn, 1024)
+	_ = conn.Close()
+
+	config.Password = "wrong"
+	_, err = dialSocks5(t, config, echo)
+	require.Error(t, err)
+}
+
+func TestSocks5ConnRefused(t *testing.T) {
+	config := newTestConfig(t, startSuo5Server(t, false))
+	startTunnel(t, config)
+
+	_, err := dialSocks5(t, config, freeAddr(t))
+	require.Error(t, err)
+}
+
+func TestForwardMode(t *testing.T) {
+	echo := startEchoServer(t)
+	config := newTestConfig(t, startSuo5Server(t, false))
+	config.ForwardTarget = echo
+	startTunnel(t, config)
+
+	conn, err := net.Dial("tcp", config.Listen)
+	require.NoError(t, err)
+	defer conn.Close()
+	assertEcho(t, conn, 128*1024)
+}
+
+func TestExcludeDomain(t *testing.T) {
+	echo := startEchoServer(t)
+	config := newTestConfig(t, startSuo5Server(t, false))
+	config.ExcludeDomain = []string{"*.excluded.test"}
+	require.NoError(t, config.Parse())
+	startTunnel(t, config)
+
+	_, err := dialSocks5(t, config, "www.excluded.test:80")
+	require.Error(t, err)
+
+	conn, err := dialSocks5(t, config, echo)
+	require.NoError(t, err)
+	defer conn.Close()
+	assertEcho(t, conn, 1024)
+}
+
+func TestTestExit(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer web.Close()
+
+	config := newTestConfig(t, startSuo5Server(t, false))
+	config.TestExit = web.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	require.NoError(t, Run(ctx, config))
+}
+
+func TestEncryption(t *testing.T) {
+	echo := startEchoServer(t)
+	h := server.NewHandler()
+	var err error
+	h.AEAD, err = netrans.NewAEADCodec(netrans.CipherChaCha20Poly1305, "secret")
+	require.NoError(t, err)
+
+	for _, buffered := range []bool{false, true} {
+		config := newTestConfig(t, startSuo5ServerWith(t, h, buffered))
+		config.Cipher = netrans.CipherChaCha20Poly1305
+		config.Key = "secret"
+		startTunnel(t, config)
+		_, ok := config.Codec.(*netrans.AEADCodec)
+		require.True(t, ok, "encryption not negotiated")
+
+		conn, err := dialSocks5(t, config, echo)
+		require.NoError(t, err)
+		assertEcho(t, conn, 64*1024)
+		_ = conn.Close()
+	}
+}
+
+func TestProfile(t *testing.T) {
+	echo := startEchoServer(t)
+	for _, tc := range []struct {
+		profile string
+		mode    core.ConnectionType
+	}{
+		{camouflage.Form, core.FullDuplex},
+		{camouflage.JSON, core.FullDuplex},
+		{camouflage.Multipart, core.FullDuplex},
+		{camouflage.Cookie, core.HalfDuplex},
+		{camouflage.Query, core.HalfDuplex},
+	} {
+		t.Run(tc.profile, func(t *testing.T) {
+			h := server.NewHandler()
+			var err error
+			h.Profile, err = camouflage.New(tc.profile, "payload")
+			require.NoError(t, err)
+			// 与 Tomcat 和 nginx 的默认值一样，请求行和请求头最多 8KB，net/http 会在 MaxHeaderBytes 之上再多读 4KB
+			srv := httptest.NewUnstartedServer(h)
+			srv.Config.MaxHeaderBytes = 4096
+			srv.Start()
+			t.Cleanup(srv.Close)
+
+			for _, padding := range []string{"", "uniform:0-512"} {
+				config := newTestConfig(t, srv.URL)
+				config.Profile = tc.profile
+				config.ProfileField = "payload"
+				config.Padding = padding
+				require.NoError(t, config.Parse())
+				require.Equal(t, tc.mode, startTunnel(t, config))
+
+				conn, err := dialSocks5(t, config, echo)
+				require.NoError(t, err)
+				assertEcho(t, conn, 256*1024)
+				_ = conn.Close()
+			}
+		})
+	}
+
+	config := newTestConfig(t, "http://127.0.0.1/")
+	config.Profile = camouflage.Cookie
+	config.Padding = "exp:4096"
+	require.ErrorContains(t, config.Parse(), "too large")
+}
+
+func TestPadding(t *testing.T) {
+	echo := startEchoServer(t)
+	padding, err := core.ParsePadding("exp:128")
+	require.NoError(t, err)
+	h := server.NewHandler()
+	h.Padding = padding
+	var halfRequests atomic.Int32
+	counter := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(core.HeaderKey) == core.HeaderValueHalf {
+			halfRequests.Add(1)
+		}
+		h.ServeHTTP(w, r)
+	})
+
+	for _, buffered := range []bool{false, true} {
+		config := newTestConfig(t, startSuo5ServerWith(t, counter, buffered))
+		config.Padding = "uniform:0-512"
+		config.Jitter = 20
+		config.CoverInterval = 200
+		startTunnel(t, config)
+
+		conn, err := dialSocks5(t, config, echo)
+		require.NoError(t, err)
+		assertEcho(t, conn, 64*1024)
+		_ = conn.Close()
+	}
+
+	// 空闲时持续发送掩护流量
+	time.Sleep(300 * time.Millisecond)
+	before := halfRequests.Load()
+	time.Sleep(time.Second)
+	require.GreaterOrEqual(t, halfRequests.Load()-before, int32(4))
+}
+
+// writeClientCert 生成自签名的客户端证书，返回证书和私钥的路径
+func writeClientCert(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "bs5"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func TestTLS(t *testing.T) {
+	echo := startEchoServer(t)
+	var sni atomic.Value
+	srv := httptest.NewUnstartedServer(server.NewHandler())
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAnyClientCert,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni.Store(hello.ServerName)
+			return nil, nil
+		},
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	hash := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	pin := "sha256/" + base64.StdEncoding.EncodeToString(hash[:])
+	certFile, keyFile := writeClientCert(t)
+
+	newConfig := func() *core.Suo5Config {
+		config := newTestConfig(t, srv.URL)
+		config.TLSCert, config.TLSKey = certFile, keyFile
+		config.TLSPins = []string{pin}
+		config.TLSServerName = "www.example.com"
+		return config
+	}
+
+	for _, tc := range []struct {
+		fingerprint, specFile string
+		mode                  core.ConnectionType
+	}{
+		{core.TLSRandomized, "", core.FullDuplex},
+		{core.TLSChrome, "", core.FullDuplex},
+		{core.TLSFirefox, "", core.HalfDuplex},
+		{core.TLSSafari, "", core.FullDuplex},
+		{core.TLSIOS, "", core.HalfDuplex},
+		{core.TLSEdge, "", core.FullDuplex},
+		{"", "../../assets/config/clienthello.json", core.HalfDuplex},
+	} {
+		t.Run(tc.fingerprint+tc.specFile, func(t *testing.T) {
+			config := newConfig()
+			config.TLSFingerprint = tc.fingerprint
+			config.TLSSpecFile = tc.specFile
+			// 半双工模式下数据通过 net/http 的客户端发送
+			config.Mode = tc.mode
+			require.Equal(t, tc.mode, startTunnel(t, config))
+			assert.Equal(t, "www.example.com", sni.Load())
+
+			conn, err := dialSocks5(t, config, echo)
+			require.NoError(t, err)
+			assertEcho(t, conn, 64*1024)
+			_ = conn.Close()
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	config := newConfig()
+	config.TLSPins = []string{"sha256/" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))}
+	_, err := config.Init(ctx)
+	require.ErrorContains(t, err, "tls pin")
+
+	// 中间人使用自签名的证书，并在后面附上真实的服务端证书
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "mitm"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	mitm := httptest.NewUnstartedServer(server.NewHandler())
+	mitm.TLS = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{der, srv.Certificate().Raw},
+		PrivateKey:  key,
+	}}}
+	mitm.StartTLS()
+	t.Cleanup(mitm.Close)
+	config = newTestConfig(t, mitm.URL)
+	config.TLSPins = []string{pin}
+	require.NoError(t, config.Parse())
+	_, err = config.Init(ctx)
+	require.ErrorContains(t, err, "tls pin")
+
+	config = newConfig()
+	config.TLSCert, config.TLSKey = "", ""
+	_, err = config.Init(ctx)
+	require.Error(t, err)
+
+	config = newConfig()
+	config.TLSFingerprint = "opera"
+	_, err = config.Init(ctx)
+	require.Error(t, err)
+}
+
+func TestDomainFronting(t *testing.T) {
+	echo := startEchoServer(t)
+	var mu sync.Mutex
+	hosts := map[string]bool{}
+	h := server.NewHandler()
+	record := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hosts[r.Host] = true
+		if r.TLS != nil {
+			hosts["sni:"+r.TLS.ServerName] = true
+		}
+		mu.Unlock()
+		h.ServeHTTP(w, r)
+	})
+	plain := httptest.NewServer(record)
+	t.Cleanup(plain.Close)
+	secure := httptest.NewTLSServer(record)
+	t.Cleanup(secure.Close)
+
+	for _, tc := range []struct {
+		name   string
+		srv    *httptest.Server
+		mode   core.ConnectionType
+		expect []string
+	}{
+		{"http-full", plain, core.FullDuplex, []string{"virtual.example.com"}},
+		{"http-half", plain, core.HalfDuplex, []string{"virtual.example.com"}},
+		{"https-full", secure, core.FullDuplex, []string{"virtual.example.com", "sni:front.example.com"}},
+		{"https-half", secure, core.HalfDuplex, []string{"virtual.example.com", "sni:front.example.com"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mu.Lock()
+			clear(hosts)
+			mu.Unlock()
+			u, err := url.Parse(tc.srv.URL)
+			require.NoError(t, err)
+			// 目标的域名无法解析，只能通过 ConnectAddress 连接
+			config := newTestConfig(t, fmt.Sprintf("%s://origin.invalid:%s/suo5", u.Scheme, u.Port()))
+			config.ConnectAddress = "127.0.0.1"
+			config.TLSServerName = "front.example.com"
+			config.HostHeader = "virtual.example.com"
+			config.Mode = tc.mode
+			require.Equal(t, tc.mode, startTunnel(t, config))
+
+			conn, err := dialSocks5(t, config, echo)
+			require.NoError(t, err)
+			assertEcho(t, conn, 64*1024)
+			_ = conn.Close()
+
+			mu.Lock()
+			defer mu.Unlock()
+			want := map[string]bool{}
+			for _, host := range tc.expect {
+				want[host] = true
+			}
+			assert.Equal(t, want, hosts)
+		})
+	}
+}
+
+func TestH2Transport(t *testing.T) {
+	echo := startEchoServer(t)
+	var mu sync.Mutex
+	// 记录 HTTP/2 请求来自的 TCP 连接
+	h2Conns := map[string]bool{}
+	h := server.NewHandler()
+	record := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 {
+			mu.Lock()
+			h2Conns[r.RemoteAddr] = true
+			mu.Unlock()
+		}
+		h.ServeHTTP(w, r)
+	})
+	secure := httptest.NewUnstartedServer(record)
+	secure.EnableHTTP2 = true
+	secure.StartTLS()
+	t.Cleanup(secure.Close)
+	h2c := httptest.NewUnstartedServer(record)
+	h2c.Config.Protocols = new(http.Protocols)
+	h2c.Config.Protocols.SetHTTP1(true)
+	h2c.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2c.Start()
+	t.Cleanup(h2c.Close)
+	// 不支持 HTTP/2 的服务端，回退到 http1
+	http1 := httptest.NewTLSServer(record)
+	t.Cleanup(http1.Close)
+
+	for _, tc := range []struct {
+		name, target, fingerprint, transport string
+	}{
+		{"randomized", secure.URL, core.TLSRandomized, core.TransportH2},
+		{"chrome", secure.URL, core.TLSChrome, core.TransportH2},
+		{"h2c", h2c.URL, core.TLSRandomized, core.TransportH2},
+		{"fallback", http1.URL, core.TLSRandomized, core.TransportHTTP1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := newTestConfig(t, tc.target)
+			config.TLSFingerprint = tc.fingerprint
+			config.Transport = core.TransportH2
+			require.NoError(t, config.Parse())
+			require.Equal(t, core.FullDuplex, startTunnel(t, config))
+			assert.Equal(t, tc.transport, config.Transport)
+
+			mu.Lock()
+			clear(h2Conns)
+			mu.Unlock()
+			conns := make([]net.Conn, 3)
+			for i := range conns {
+				conn, err := dialSocks5(t, config, echo)
+				require.NoError(t, err)
+				conns[i] = conn
+			}
+			for _, conn := range conns {
+				assertEcho(t, conn, 64*1024)
+				_ = conn.Close()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if tc.transport == core.TransportH2 {
+				// 所有的隧道请求复用同一个 TCP 连接
+				assert.Len(t, h2Conns, 1)
+			} else {
+				assert.Empty(t, h2Conns)
+			}
+		})
+	}
+
+	config := core.DefaultSuo5Config()
+	config.Target = secure.URL
+	config.Transport = "h3"
+	require.ErrorContains(t, config.Parse(), "unknown transport")
+}
+
+func TestWebSocket(t *testing.T) {
+	echo := startEchoServer(t)
+	var upgrades atomic.Int32
+	newHandler := func(key string) http.Handler {
+		h := server.NewHandler()
+		if key != "" {
+			var err error
+			h.AEAD, err = netrans.NewAEADCodec(netrans.CipherChaCha20Poly1305, key)
+			require.NoError(t, err)
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Upgrade") != "" {
+				upgrades.Add(1)
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+
+	for _, tc := range []struct {
+		name      string
+		buffered  bool
+		key       string
+		mux       bool
+		websocket bool
+	}{
+		// 反向代理缓冲了请求体，只有 WebSocket 可以全双工
+		{"buffered", true, "", false, true},
+		{"encryption", true, "secret", false, true},
+		{"mux", true, "", true, true},
+		// 普通的全双工可用时不使用 WebSocket
+		{"unbuffered", false, "", false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := newTestConfig(t, startSuo5ServerWith(t, newHandler(tc.key), tc.buffered))
+			if tc.key != "" {
+				config.Cipher = netrans.CipherChaCha20Poly1305
+				config.Key = tc.key
+			}
+			config.EnableMux = tc.mux
+			config.WebSocket = true
+			require.NoError(t, config.Parse())
+			upgrades.Store(0)
+			require.Equal(t, core.FullDuplex, startTunnel(t, config))
+			assert.Equal(t, tc.websocket, config.WebSocket)
+			if tc.key != "" {
+				_, ok := config.Codec.(*netrans.AEADCodec)
+				require.True(t, ok, "encryption not negotiated")
+			}
+
+			for i := 0; i < 3; i++ {
+				conn, err := dialSocks5(t, config, echo)
+				require.NoError(t, err)
+				assertEcho(t, conn, 64*1024)
+				_ = conn.Close()
+			}
+			if tc.websocket {
+				assert.Positive(t, upgrades.Load())
+			} else {
+				assert.Zero(t, upgrades.Load())
+			}
+		})
+	}
+
+	// 服务端不支持升级时与之前一样使用半双工
+	h := newHandler("")
+	config := newTestConfig(t, startSuo5ServerWith(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" {
+			_, _ = io.WriteString(w, "<html></html>")
+			return
+		}
+		h.ServeHTTP(w, r)
+	}), true))
+	config.WebSocket = true
+	require.Equal(t, core.HalfDuplex, startTunnel(t, config))
+	assert.False(t, config.WebSocket)
+	conn, err := dialSocks5(t, config, echo)
+	require.NoError(t, err)
+	assertEcho(t, conn, 64*1024)
+	_ = conn.Close()
+}
+
+// poolServer 可以随时停止服务的服务端，记录收到的全双工请求数，每个全双工的连接对应一个请求
+type poolServer struct {
+	url   string
+	down  atomic.Bool
+	opens atomic.Int32
+}
+
+func startPoolServer(t *testing.T, buffered bool) *poolServer {
+	s := &poolServer{}
+	h := server.NewHandler()
+	s.url = startSuo5ServerWith(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.down.Load() {
+			// 模拟服务端被删除，直接断开连接
+			if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+				_ = conn.Close()
+			}
+			return
+		}
+		if r.Header.Get(core.HeaderKey) == core.HeaderValueFull {
+			s.opens.Add(1)
+		}
+		h.ServeHTTP(w, r)
+	}), buffered)
+	return s
+}
+
+func TestTargetPool(t *testing.T) {
+	echo := startEchoServer(t)
+	connect := func(t *testing.T, config *core.Suo5Config) {
+		conn, err := dialSocks5(t, config, echo)
+		require.NoError(t, err)
+		assertEcho(t, conn, 16*1024)
+		_ = conn.Close()
+	}
+	newPoolConfig := func(t *testing.T, servers ...*poolServer) *core.Suo5Config {
+		config := newTestConfig(t, servers[0].url)
+		for _, s := range servers[1:] {
+			config.Targets = append(config.Targets, s.url)
+		}
+		config.HealthInterval = 1
+		// 恢复流的请求也是全双工的请求，关闭以便准确计数
+		config.ResumeTimeout = 0
+		return config
+	}
+	opens := func(servers ...*poolServer) []int32 {
+		var ret []int32
+		for _, s := range servers {
+			ret = append(ret, s.opens.Load())
+		}
+		return ret
+	}
+
+	t.Run("round-robin", func(t *testing.T) {
+		a, b, c := startPoolServer(t, false), startPoolServer(t, false), startPoolServer(t, false)
+		config := newPoolConfig(t, a, b, c)
+		require.Equal(t, core.FullDuplex, startTunnel(t, config))
+		before := opens(a, b, c)
+		for i := 0; i < 6; i++ {
+			connect(t, config)
+		}
+		after := opens(a, b, c)
+		for i := range before {
+			require.Equal(t, before[i]+2, after[i])
+		}
+
+		// 停止服务的地址被移出连接池，新的连接由其他地址承担
+		a.down.Store(true)
+		for i := 0; i < 4; i++ {
+			connect(t, config)
+		}
+		n := a.opens.Load()
+		require.Equal(t, after[0], n)
+
+		// 健康检查成功后重新加入
+		a.down.Store(false)
+		deadline := time.Now().Add(10 * time.Second)
+		for a.opens.Load() == n && time.Now().Before(deadline) {
+			time.Sleep(200 * time.Millisecond)
+			connect(t, config)
+		}
+		require.Greater(t, a.opens.Load(), n)
+	})
+
+	t.Run("least-conn", func(t *testing.T) {
+		a, b, c := startPoolServer(t, false), startPoolServer(t, false), startPoolServer(t, false)
+		config := newPoolConfig(t, a, b, c)
+		config.Balance = core.BalanceLeastConn
+		startTunnel(t, config)
+
+		start := opens(a, b, c)
+		held, err := dialSocks5(t, config, echo)
+		require.NoError(t, err)
+		defer held.Close()
+		assertEcho(t, held, 1024)
+		before := opens(a, b, c)
+		for i := 0; i < 6; i++ {
+			connect(t, config)
+			// 等待关闭的连接从计数中移除
+			time.Sleep(100 * time.Millisecond)
+		}
+		after := opens(a, b, c)
+		var idle int32
+		for i := range before {
+			if before[i] > start[i] {
+				assert.Equal(t, before[i], after[i], "busy target picked")
+			} else {
+				idle += after[i] - before[i]
+			}
+		}
+		assert.Equal(t, int32(6), idle)
+	})
+
+	t.Run("mixed", func(t *testing.T) {
+		half, full, down := startPoolServer(t, true), startPoolServer(t, false), startPoolServer(t, false)
+		down.down.Store(true)
+		config := newPoolConfig(t, half, full, down)
+		// 每个地址单独检测连接模式，启动时不可用的地址不影响其他地址
+		require.Equal(t, core.HalfDuplex, startTunnel(t, config))
+		n := full.opens.Load()
+		for i := 0; i < 4; i++ {
+			connect(t, config)
+		}
+		require.Equal(t, n+2, full.opens.Load())
+		require.Equal(t, int32(0), down.opens.Load())
+
+		down.down.Store(false)
+		deadline := time.Now().Add(10 * time.Second)
+		for down.opens.Load() == 0 && time.Now().Before(deadline) {
+			time.Sleep(200 * time.Millisecond)
+			connect(t, config)
+		}
+		require.Greater(t, down.opens.Load(), int32(0))
+	})
+}
+
+func TestEncryptionWrongKey(t *testing.T) {
+	h := server.NewHandler()
+	var err error
+	h.AEAD, err = netrans.NewAEADCodec(netrans.CipherAESGCM, "secret")
+	require.NoError(t, err)
+
+	config := newTestConfig(t, startSuo5ServerWith(t, h, false))
+	config.Key = "wrong"
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err = Run(ctx, config)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "check the key")
+}
+
+func TestEncryptionFallback(t *testing.T) {
+	echo := startEchoServer(t)
+	config := newTestConfig(t, startSuo5Server(t, false))
+	config.Key = "secret"
+	startTunnel(t, config)
+	require.Equal(t, netrans.XORCodec, config.Codec)
+
+	conn, err := dialSocks5(t, config, echo)
+	require.NoError(t, err)
+	defer conn.Close()
+	assertEcho(t, conn, 1024)
+}
+
+func TestEncryptionRequired(t *testing.T) {
+	config := newTestConfig(t, startSuo5Server(t, false))
+	config.Key = "secret"
+	config.RequireEncryption = true
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err := Run(ctx, config)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "does not support encryption")
+}
+
+func TestMux(t *testing.T) {
+	echo := startEchoServer(t)
+	var requests atomic.Int32
+	h := server.NewHandler()
+	target := startSuo5ServerWith(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(core.HeaderKey) == core.HeaderValueFull {
+			requests.Add(1)
+		}
+		h.ServeHTTP(w, r)
+	}), false)
+	config := newTestConfig(t, target)
+	config.EnableMux = true
+	require.Equal(t, core.FullDuplex, startTunnel(t, config))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := dialSocks5(t, config, echo)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+			assertEcho(t, conn, 64*1024)
+		}()
+	}
+	wg.Wait()
+
+	// 连接失败不影响承载请求上的其他流
+	_, err := dialSocks5(t, config, freeAddr(t))
+	require.Error(t, err)
+	conn, err := dialSocks5(t, config, echo)
+	require.NoError(t, err)
+	defer conn.Close()
+	assertEcho(t, conn, 1024)
+
+	// 启动时的测试连接和之后所有的连接共用一个承载请求
+	require.Equal(t, int32(1), requests.Load())
+}
+
+// TestMuxBackpressure 一个流的数据没有被读取时，同一个承载请求上的其他流不受影响
+func TestMuxBackpressure(t *testing.T) {
+	// flood 不停地发送数据，sink 从不读取
+	serve := func(handle func(net.Conn)) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = ln.Close() })
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				t.Cleanup(func() { _ = conn.Close() })
+				go handle(conn)
+			}
+		}()
+		return ln.Addr().String()
+	}
+	flood := serve(func(conn net.Conn) {
+		buf := make([]byte, 32*1024)
+		for {
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+		}
+	})
+	sink := serve(func(net.Conn) {})
+	echo := startEchoServer(t)
+
+	target := startSuo5Server(t, false)
+	config := newTestConfig(t, target)
+	config.EnableMux = true
+	require.Equal(t, core.FullDuplex, startTunnel(t, config))
+
+	down, err := dialSocks5(t, config, flood)
+	require.NoError(t, err)
+	defer down.Close()
+	up, err := dialSocks5(t, config, sink)
+	require.NoError(t, err)
+	defer up.Close()
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			if _, err := up.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	// 等待两个方向的缓冲区都被填满
+	time.Sleep(2 * time.Second)
+
+	// 服务端写目标连接的超时之前就应该完成
+	start := time.Now()
+	conn, err := dialSocks5(t, config, echo)
+	require.NoError(t, err)
+	defer conn.Close()
+	assertEcho(t, conn, 256*1024)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+// TestMuxLegacyClient 不支持流控的客户端不知道窗口，目标写得慢时数据不能因为超出窗口被丢弃
+func TestMuxLegacyClient(t *testing.T) {
+	const size = 16 * 1024 * 1024
+	received := make(chan int64, 1)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		time.Sleep(time.Second)
+		n, _ := io.CopyN(io.Discard, conn, size)
+		received <- n
+	}()
+
+	// 去掉承载请求中流控的标记，模拟旧版本的客户端
+	h := server.NewHandler()
+	target := startSuo5ServerWith(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(core.HeaderKey) == core.HeaderValueFull {
+			fr, err := netrans.XORCodec.ReadFrame(r.Body)
+			if err != nil {
+				return
+			}
+			m, err := core.Unmarshal(fr.Data)
+			if err != nil {
+				return
+			}
+			delete(m, "fc")
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(core.BuildBodyWith(netrans.XORCodec, m)), r.Body))
+		}
+		h.ServeHTTP(w, r)
+	}), false)
+	config := newTestConfig(t, target)
+	config.EnableMux = true
+	require.Equal(t, core.FullDuplex, startTunnel(t, config))
+
+	conn, err := dialSocks5(t, config, ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(make([]byte, size))
+	require.NoError(t, err)
+	select {
+	case n := <-received:
+		require.EqualValues(t, size, n)
+	case <-time.After(30 * time.Second):
+		t.Fatal("target did not receive the data")
+	}
+}
+
+// batchCounter 统计半双工批量请求的数量，unsupported 为 true 时模拟不认识批量请求的旧版服务端
+func batchCounter(h http.Handler, unsupported bool, count *atomic.Int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(core.HeaderKey) == core.HeaderValueHalf {
+			body, _ := io.ReadAll(r.Body)
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			if fr, err := netrans.ReadFrame(bytes.NewReader(body)); err == nil {
+				m, _ := core.Unmarshal(fr.Data)
+				if ac := m["ac"]; len(ac) == 1 && ac[0] == core.ActionBatch {
+					count.Add(1)
+					if unsupported {
+						return
+					}
+				}
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// chattyEcho 模拟交互式协议，每次只写几个字节并等待回显
+func chattyEcho(t *testing.T, conn net.Conn, rounds int) {
+	buf := make([]byte, 16)
+	for i := 0; i < rounds; i++ {
+		data := []byte(core.RandString(8))
+		for _, b := range data {
+			_, err := conn.Write([]byte{b})
+			require.NoError(t, err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		_, err := io.ReadFull(conn, buf[:len(data)])
+		require.NoError(t, err)
+		require.Equal(t, data, buf[:len(data)])
+	}
+}
+
+func TestHalfDuplexBatch(t *testing.T) {
+	for _, unsupported := range []bool{false, true} {
+		echo := startEchoServer(t)
+		var batches atomic.Int32
+		config := newTestConfig(t, startSuo5ServerWith(t, batchCounter(server.NewHandler(), unsupported, &batches), true))
+		config.HalfFlushWindow = 20
+		require.Equal(t, core.HalfDuplex, startTunnel(t, config))
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := dialSocks5(t, config, echo)
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer conn.Close()
+				chattyEcho(t, conn, 5)
+			}()
+		}
+		wg.Wait()
+
+		conn, err := dialSocks5(t, config, echo)
+		require.NoError(t, err)
+		assertEcho(t, conn, 64*1024)
+		_ = conn.Close()
+
+		if unsupported {
+			// 第一次批量请求失败后不再尝试
+			require.Equal(t, int32(1), batches.Load())
+		} else {
+			require.Greater(t, batches.Load(), int32(1))
+		}
+	}
+}
+
+// startFlakyProxy 启动一个 TCP 代理，每个连接在 lifetime 后被强制断开，模拟网关超时或负载均衡清理空闲连接
+func startFlakyProxy(t *testing.T, target string, lifetime time.Duration) (string, *atomic.Int32) {
+	u, err := url.Parse(target)
+	require.NoError(t, err)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = lis.Close() })
+	var kills atomic.Int32
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				remote, err := net.Dial("tcp", u.Host)
+				if err != nil {
+					return
+				}
+				defer remote.Close()
+				done := make(chan struct{}, 2)
+				go func() { _, _ = io.Copy(remote, conn); done <- struct{}{} }()
+				go func() { _, _ = io.Copy(conn, remote); done <- struct{}{} }()
+				select {
+				case <-done:
+				case <-time.After(lifetime):
+					kills.Add(1)
+				}
+			}()
+		}
+	}()
+	return "http://" + lis.Addr().String(), &kills
+}
+
+func TestResume(t *testing.T) {
+	echo := startEchoServer(t)
+	target, kills := startFlakyProxy(t, startSuo5Server(t, false), 800*time.Millisecond)
+	config := newTestConfig(t, target)
+	config.DisableHeartbeat = true
+	require.Equal(t, core.FullDuplex, startTunnel(t, config))
+
+	conn, err := dialSocks5(t, config, echo)
+	require.NoError(t, err)
+	defer conn.Close()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		chattyEcho(t, conn, 1)
+		assertEcho(t, conn, 32*1024)
+		time.Sleep(50 * time.Millisecond)
+	}
+	require.Greater(t, kills.Load(), int32(1))
+}
+
+func dialHTTPProxy(t *testing.T, listen string, user *url.Userinfo, address string) (net.Conn, error) {
+	dial, err := proxyclient.NewClient(&url.URL{Scheme: "http", Host: listen, User: user})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return dial.DialContext(ctx, "tcp", address)
+}
+
+func TestHTTPProxy(t *testing.T) {
+	echo := startEchoServer(t)
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Test", "ok")
+		w.WriteHeader(http.StatusTeapot)
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer web.Close()
+
+	config := newTestConfig(t, startSuo5Server(t, false))
+	config.NoAuth = false
+	config.Username = "suo5"
+	config.Password = core.RandString(8)
+	config.HTTPListen = freeAddr(t)
+	config.Rules = []string{"domain-suffix,excluded.test,reject"}
+	require.NoError(t, config.Parse())
+	startTunnel(t, config)
+	user := url.UserPassword(config.Username, config.Password)
+
+	// 与 SOCKS5 共用的端口和单独的 HTTP 端口
+	for _, listen := range []string{config.Listen, config.HTTPListen} {
+		conn, err := dialHTTPProxy(t, listen, user, echo)
+		require.NoError(t, err)
+		assertEcho(t, conn, 64*1024)
+		_ = conn.Close()
+
+		_, err = dialHTTPProxy(t, listen, url.UserPassword(config.Username, "wrong"), echo)
+		require.ErrorContains(t, err, "407")
+		_, err = dialHTTPProxy(t, listen, user, "www.excluded.test:80")
+		require.ErrorContains(t, err, "403")
+
+		proxyURL := &url.URL{Scheme: "http", Host: listen, User: user}
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		resp, err := client.Get(web.URL + "/hello")
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusTeapot, resp.StatusCode)
+		require.Equal(t, "ok", resp.Header.Get("X-Test"))
+		require.Equal(t, "/hello", string(body))
+		client.CloseIdleConnections()
+	}
+
+	// SOCKS5 仍然可用
+	conn, err := dialSocks5(t, config, echo)
+	require.NoError(t, err)
+	defer conn.Close()
+	assertEcho(t, conn, 1024)
+}
+
+func startUDPEchoServer(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestUDPAssociate(t *testing.T) {
+	echo := startUDPEchoServer(t)
+	for _, buffered := range []bool{false, true} {
+		t.Run(fmt.Sprintf("buffered=%v", buffered), func(t *testing.T) {
+			config := newTestConfig(t, startSuo5Server(t, buffered))
+			startTunnel(t, config)
+
+			u := url.UserPassword(config.Username, config.Password)
+			ctrl, err := client.Dial(config.Listen,
+				client.TimeoutDialOption(5*time.Second),
+				client.SelectorDialOption(NewCustomClientSelector(u)))
+			require.NoError(t, err)
+			defer ctrl.Close()
+			anyAddr, _ := gosocks5.NewAddr("0.0.0.0:0")
+			require.NoError(t, gosocks5.NewRequest(gosocks5.CmdUdp, anyAddr).Write(ctrl))
+			reply, err := gosocks5.ReadReply(ctrl)
+			require.NoError(t, err)
+			require.Equal(t, gosocks5.Succeeded, reply.Rep)
+
+			local, err := net.ListenPacket("udp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer local.Close()
+			relay, err := net.ResolveUDPAddr("udp", reply.Addr.String())
+			require.NoError(t, err)
+			target, _ := gosocks5.NewAddr(echo)
+
+			for i := 0; i < 5; i++ {
+				payload := []byte(core.RandString(100 + i*1000))
+				var out bytes.Buffer
+				_, err := gosocks5.NewUDPDatagram(gosocks5.NewUDPHeader(0, 0, target), payload).WriteTo(&out)
+				require.NoError(t, err)
+				_, err = local.WriteTo(out.Bytes(), relay)
+				require.NoError(t, err)
+
+				buf := make([]byte, 64*1024)
+				require.NoError(t, local.SetReadDeadline(time.Now().Add(10*time.Second)))
+				n, _, err := local.ReadFrom(buf)
+				require.NoError(t, err)
+				dgram := &gosocks5.UDPDatagram{}
+				_, err = dgram.ReadFrom(bytes.NewReader(buf[:n]))
+				require.NoError(t, err)
+				require.Equal(t, echo, dgram.Header.Addr.String())
+				require.Equal(t, payload, dgram.Data)
+			}
+		})
+	}
+}
+
+func TestSocks4(t *testing.T) {
+	echo := startEchoServer(t)
+	config := newTestConfig(t, startSuo5Server(t, false))
+	config.NoAuth = false
+	config.Username = "suo5"
+	config.Password = core.RandString(8)
+	startTunnel(t, config)
+
+	dial := func(scheme string, user *url.Userinfo, address string) (net.Conn, error) {
+		d, err := proxyclient.NewClient(&url.URL{Scheme: scheme, Host: config.Listen, User: user})
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return d.DialContext(ctx, "tcp", address)
+	}
+	user := url.UserPassword(config.Username, config.Password)
+
+	for _, scheme := range []string{"socks4a", "socks4"} {
+		conn, err := dial(scheme, user, echo)
+		require.NoError(t, err)
+		assertEcho(t, conn, 64*1024)
+		_ = conn.Close()
+	}
+
+	_, err := dial("socks4a", url.UserPassword(config.Username, "wrong"), echo)
+	require.ErrorContains(t, err, "different user-ids")
+
+	_, err = dial("socks4a", user, freeAddr(t))
+	require.ErrorContains(t, err, "rejected or failed")
+}
+
+func TestRoute(t *testing.T) {
+	tunnelEcho, directEcho, upstreamEcho, rejected := startEchoServer(t), startEchoServer(t), startEchoServer(t), startEchoServer(t)
+
+	var tunneled atomic.Int32
+	h := server.NewHandler()
+	h.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		tunneled.Add(1)
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	}
+
+	var upstreamed atomic.Int32
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = upstream.Close() })
+	go func() {
+		_ = httpproxy.Serve(upstream, func(network, address string) (net.Conn, error) {
+			upstreamed.Add(1)
+			return net.Dial(network, address)
+		})
+	}()
+
+	port := func(address string) string {
+		_, p, _ := net.SplitHostPort(address)
+		return p
+	}
+	config := newTestConfig(t, startSuo5ServerWith(t, h, false))
+	config.Rules = []string{
+		"port," + port(directEcho) + ",direct",
+		"port," + port(upstreamEcho) + ",up",
+		"port," + port(rejected) + ",reject",
+	}
+	config.Upstreams = map[string][]string{"up": {"http://" + upstream.Addr().String()}}
+	// 排除的域名直接连接
+	config.ExcludeDomain = []string{"localhost"}
+	require.NoError(t, config.Parse())
+	startTunnel(t, config)
+	tunneled.Store(0)
+
+	for _, address := range []string{tunnelEcho, directEcho, upstreamEcho} {
+		conn, err := dialSocks5(t, config, address)
+		require.NoError(t, err)
+		assertEcho(t, conn, 1024)
+		_ = conn.Close()
+	}
+	require.EqualValues(t, 1, tunneled.Load())
+	require.EqualValues(t, 1, upstreamed.Load())
+
+	conn, err := dialSocks5(t, config, net.JoinHostPort("localhost", port(tunnelEcho)))
+	require.NoError(t, err)
+	assertEcho(t, conn, 1024)
+	_ = conn.Close()
+	require.EqualValues(t, 1, tunneled.Load())
+
+	_, err = dialSocks5(t, config, rejected)
+	require.Error(t, err)
+	require.EqualValues(t, 1, tunneled.Load())
+}
+
+// TestRouteSelfTest 默认直接连接时，启动时的自检仍然需要经过隧道
+func TestRouteSelfTest(t *testing.T) {
+	var tunneled atomic.Int32
+	h := server.NewHandler()
+	h.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		tunneled.Add(1)
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	}
+	config := newTestConfig(t, startSuo5ServerWith(t, h, false))
+	config.DefaultRoute = "direct"
+	require.NoError(t, config.Parse())
+	startTunnel(t, config)
+	require.Positive(t, tunneled.Load())
+}
+
+func TestLocalForward(t *testing.T) {
+	echo := startEchoServer(t)
+	config := newTestConfig(t, startSuo5Server(t, false))
+	listen := freeAddr(t)
+	config.Forwards = []string{listen + "->" + echo}
+	require.NoError(t, config.Parse())
+	startTunnel(t, config)
+
+	conn, err := net.Dial("tcp", listen)
+	require.NoError(t, err)
+	defer conn.Close()
+	assertEcho(t, conn, 128*1024)
+
+	// 转发规则与代理同时运行
+	conn, err = dialSocks5(t, config, echo)
+	require.NoError(t, err)
+	defer conn.Close()
+	assertEcho(t, conn, 1024)
+}
+
+func TestReverseForward(t *testing.T) {
+	for _, buffered := range []bool{false, true} {
+		t.Run(fmt.Sprintf("buffered=%v", buffered), func(t *testing.T) {
+			echo := startEchoServer(t)
+			config := newTestConfig(t, startSuo5Server(t, buffered))
+			remote := freeAddr(t)
+			config.ReverseForwards = []string{remote + "->" + echo}
+			require.NoError(t, config.Parse())
+			startTunnel(t, config)
+
+			var conn net.Conn
+			require.Eventually(t, func() bool {
+				var err error
+				conn, err = net.Dial("tcp", remote)
+				return err == nil
+			}, 10*time.Second, 100*time.Millisecond)
+			defer conn.Close()
+			assertEcho(t, conn, 64*1024)
+
+			conn2, err := net.Dial("tcp", remote)
+			require.NoError(t, err)
+			defer conn2.Close()
+			assertEcho(t, conn2, 1024)
+		})
+	}
+}
+
+// prefixHandler 在响应之前输出页面自身的内容，模拟嵌在其他页面中的服务端
+func prefixHandler(prefix string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, prefix)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func TestRedirectChain(t *testing.T) {
+	echo := startEchoServer(t)
+	// 只有最后一跳可以连接目标，前面的节点只能转发
+	refuse := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, fmt.Errorf("dial %s refused", address)
+	}
+	var hits atomic.Int32
+	last := server.NewHandler()
+	lastURL := startSuo5ServerWith(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		prefixHandler("<html>last</html>", last).ServeHTTP(w, r)
+	}), false)
+	middle := server.NewHandler()
+	middle.Dial = refuse
+	middleURL := startSuo5ServerWith(t, prefixHandler(strings.Repeat("middle", 20), middle), false)
+	first := server.NewHandler()
+	first.Dial = refuse
+	firstURL := startSuo5ServerWith(t, prefixHandler("first", first), true)
+
+	config := newTestConfig(t, firstURL)
+	config.RedirectURL = middleURL
+	config.RedirectChain = []string{lastURL}
+	require.Equal(t, core.HalfDuplex, startTunnel(t, config))
+
+	for i := 0; i < 2; i++ {
+		conn, err := dialSocks5(t, config, echo)
+		require.NoError(t, err)
+		assertEcho(t, conn, 32*1024)
+		_ = conn.Close()
+	}
+	assert.Greater(t, hits.Load(), int32(0))
+}
+
+func TestRedirNotRedirected(t *testing.T) {
+	config := newTestConfig(t, startSuo5Server(t, false))
+	config.RedirListen = freeAddr(t)
+	startTunnel(t, config)
+
+	// 直接连接透明代理的监听地址，没有可用的原始目标，连接会被关闭
+	conn, err := net.Dial("tcp", config.RedirListen)
+	require.NoError(t, err)
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+// startDNSServer 启动一个 DNS over TCP 的服务，所有查询都返回 10.1.2.3
+func startDNSServer(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var size [2]byte
+				for {
+					if _, err := io.ReadFull(conn, size[:]); err != nil {
+						return
+					}
+					query := make([]byte, int(size[0])<<8|int(size[1]))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					var msg dnsmessage.Message
+					if err := msg.Unpack(query); err != nil {
+						return
+					}
+					rh := dnsmessage.ResourceHeader{Name: msg.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60}
+					msg.Header.Response = true
+					msg.Answers = []dnsmessage.Resource{{Header: rh, Body: &dnsmessage.AResource{A: [4]byte{10, 1, 2, 3}}}}
+					resp, _ := msg.Pack()
+					if _, err := conn.Write(append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return lis.Addr().String()
+}
+
+func TestDNS(t *testing.T) {
+	upstream := startDNSServer(t)
+	var dials atomic.Int32
+	h := server.NewHandler()
+	h.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == upstream {
+			dials.Add(1)
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	}
+	config := newTestConfig(t, startSuo5ServerWith(t, h, false))
+	config.DNSServer = upstream
+	config.DNSDomains = []string{"corp.local"}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	config.DNSListen = pc.LocalAddr().String()
+	_ = pc.Close()
+	startTunnel(t, config)
+
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, config.DNSListen)
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addrs, err := r.LookupHost(ctx, "db.corp.local")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.1.2.3"}, addrs)
+
+	// 之后的查询复用隧道中空闲的连接
+	dials.Store(0)
+	for _, name := range []string{"web.corp.local", "mail.corp.local"} {
+		ips, err := r.LookupNetIP(ctx, "ip4", name)
+		require.NoError(t, err)
+		require.Len(t, ips, 1)
+	}
+	require.EqualValues(t, 0, dials.Load())
+}
+
+// TestRunListenError 后面的监听失败时，Run 返回前关闭已经启动的监听
+func TestRunListenError(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer busy.Close()
+
+	config := newTestConfig(t, startSuo5Server(t, false))
+	config.HTTPListen = freeAddr(t)
+	config.RedirListen = freeAddr(t)
+	config.AdminListen = busy.Addr().String()
+	require.Error(t, Run(context.Background(), config))
+
+	for _, addr := range []string{config.Listen, config.HTTPListen, config.RedirListen} {
+		require.Eventually(t, func() bool {
+			lis, err := net.Listen("tcp", addr)
+			if err != nil {
+				return false
+			}
+			_ = lis.Close()
+			return true
+		}, 5*time.Second, 50*time.Millisecond, addr)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	echo := startEchoServer(t)
+	config := newTestConfig(t, startSuo5Server(t, false))
+	config.MetricsListen = freeAddr(t)
+	startTunnel(t, config)
+
+	conn, err := dialSocks5(t, config, echo)
+	require.NoError(t, err)
+	assertEcho(t, conn, 4096)
+	_, err = dialSocks5(t, config, freeAddr(t))
+	require.Error(t, err)
+
+	resp, err := http.Get("http://" + config.MetricsListen + "/metrics")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	require.NoError(t, err)
+	text := string(body)
+	// 指标是全局的，其他测试的流也会计入，这里只检查出现了对应的序列
+	assert.Regexp(t, `bs5_active_streams\{mode="full"\} [1-9]`, text)
+	assert.Regexp(t, `bs5_stream_bytes_total\{direction="in",mode="full"\} [1-9]`, text)
+	assert.Regexp(t, `bs5_connect_duration_seconds_count\{mode="full"\} [1-9]`, text)
+	assert.Regexp(t, `bs5_dial_failures_total\{mode="full",reason="host_unreachable"\} [1-9]`, text)
+	_ = conn.Close()
+}
+
+// adminRequest 使用 token secret 调用 config 的管理接口
+func adminRequest(t *testing.T, config *core.Suo5Config, method, path, body string) *http.Response {
+	req, err := http.NewRequest(method, "http://"+config.AdminListen+"/api"+path, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+func listStreams(t *testing.T, config *core.Suo5Config) []StreamInfo {
+	var infos []StreamInfo
+	resp := adminRequest(t, config, http.MethodGet, "/streams", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&infos))
+	return infos
+}
+
+func TestAdmin(t *testing.T) {
+	echo := startEchoServer(t)
+	config := newTestConfig(t, startSuo5Server(t, false))
+	config.AdminListen = freeAddr(t)
+	config.AdminToken = "secret"
+	config.ExcludeDomain = []string{"*.internal"}
+	require.NoError(t, config.Parse())
+	startTunnel(t, config)
+	api := "http://" + config.AdminListen + "/api"
+
+	adminDo := func(method, path, body string) *http.Response {
+		return adminRequest(t, config, method, path, body)
+	}
+
+	resp, err := http.Get(api + "/streams")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	conn, err := dialSocks5(t, config, echo)
+	require.NoError(t, err)
+	defer conn.Close()
+	assertEcho(t, conn, 4096)
+
+	var stream StreamInfo
+	for _, info := range listStreams(t, config) {
+		if info.Target == echo {
+			stream = info
+		}
+	}
+	require.NotEmpty(t, stream.ID)
+	assert.Equal(t, "socks5", stream.Handler)
+	assert.Equal(t, conn.LocalAddr().String(), stream.Source)
+	assert.Equal(t, "full", stream.Mode)
+	assert.EqualValues(t, 4096, stream.BytesOut)
+	assert.EqualValues(t, 4096, stream.BytesIn)
+
+	resp = adminDo(http.MethodGet, "/streams/"+stream.ID, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = adminDo(http.MethodDelete, "/streams/"+stream.ID, "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = adminDo(http.MethodGet, "/streams/"+stream.ID, "")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// 流被关闭后本地的连接读到 EOF
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	_, echoPort, _ := net.SplitHostPort(echo)
+	resp = adminDo(http.MethodPost, "/reload", `{"rules": ["port,`+echoPort+`,reject"]}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = dialSocks5(t, config, echo)
+	require.Error(t, err)
+
+	// 请求中没有给出的字段保持原来的配置
+	var active core.RouteConfig
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&active))
+	assert.Equal(t, []string{"*.internal"}, active.ExcludeDomain)
+	assert.Equal(t, []string{"port," + echoPort + ",reject"}, active.Rules)
+	assert.Equal(t, "tunnel", active.DefaultRoute)
+	assert.Equal(t, active, config.ActiveRoute())
+
+	// 没有 OnReload 时必须在请求中给出规则
+	resp = adminDo(http.MethodPost, "/reload", "")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = adminDo(http.MethodPost, "/reload", `{"rules": ["bad"]}`)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = adminDo(http.MethodPost, "/reload", `{"rule": []}`)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, []string{"port," + echoPort + ",reject"}, config.ActiveRoute().Rules)
+}
+
+func TestAdminUDPAssociate(t *testing.T) {
+	echo := startUDPEchoServer(t)
+	server := startSuo5Server(t, false)
+	config := newTestConfig(t, server)
+	config.AdminListen = freeAddr(t)
+	config.AdminToken = "secret"
+	startTunnel(t, config)
+	// 同一进程中的另一个隧道有自己的登记表
+	other := newTestConfig(t, server)
+	other.AdminListen = freeAddr(t)
+	other.AdminToken = "secret"
+	startTunnel(t, other)
+
+	u := url.UserPassword(config.Username, config.Password)
+	ctrl, err := client.Dial(config.Listen,
+		client.TimeoutDialOption(5*time.Second),
+		client.SelectorDialOption(NewCustomClientSelector(u)))
+	require.NoError(t, err)
+	defer ctrl.Close()
+	anyAddr, _ := gosocks5.NewAddr("0.0.0.0:0")
+	require.NoError(t, gosocks5.NewRequest(gosocks5.CmdUdp, anyAddr).Write(ctrl))
+	reply, err := gosocks5.ReadReply(ctrl)
+	require.NoError(t, err)
+	require.Equal(t, gosocks5.Succeeded, reply.Rep)
+
+	local, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer local.Close()
+	relay, err := net.ResolveUDPAddr("udp", reply.Addr.String())
+	require.NoError(t, err)
+	target, _ := gosocks5.NewAddr(echo)
+	var out bytes.Buffer
+	_, err = gosocks5.NewUDPDatagram(gosocks5.NewUDPHeader(0, 0, target), []byte("hello")).WriteTo(&out)
+	require.NoError(t, err)
+	_, err = local.WriteTo(out.Bytes(), relay)
+	require.NoError(t, err)
+	require.NoError(t, local.SetReadDeadline(time.Now().Add(10*time.Second)))
+	_, _, err = local.ReadFrom(make([]byte, 64*1024))
+	require.NoError(t, err)
+
+	var stream StreamInfo
+	for _, info := range listStreams(t, config) {
+		if info.Handler == "socks5-udp" {
+			stream = info
+		}
+	}
+	require.NotEmpty(t, stream.ID)
+	assert.Equal(t, ctrl.LocalAddr().String(), stream.Source)
+	assert.EqualValues(t, 5, stream.BytesOut)
+	assert.EqualValues(t, 5, stream.BytesIn)
+	assert.Empty(t, listStreams(t, other))
+
+	resp := adminRequest(t, config, http.MethodDelete, "/streams/"+stream.ID, "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	// 关闭关联时控制连接随之断开
+	_ = ctrl.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = ctrl.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
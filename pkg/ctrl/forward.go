@@ -17,14 +17,16 @@ type ForwardHandler struct {
 
 	ctx        context.Context
 	pool       *sync.Pool
+	streams    *registry
 	targetAddr string
 }
 
-func NewForwardHandler(ctx context.Context, client *core.Suo5Client, pool *sync.Pool, targetAddr string) *ForwardHandler {
+func NewForwardHandler(ctx context.Context, client *core.Suo5Client, pool *sync.Pool, streams *registry, targetAddr string) *ForwardHandler {
 	return &ForwardHandler{
 		Suo5Client: client,
 		ctx:        ctx,
 		pool:       pool,
+		streams:    streams,
 		targetAddr: targetAddr,
 	}
 }
@@ -43,13 +45,15 @@ func (f *ForwardHandler) Handle(conn net.Conn) error {
 	}
 
 	log.Infof("successfully connected to %s", f.targetAddr)
+	ctx := withStreamSource(f.ctx, "forward", conn.RemoteAddr().String())
+	rw := f.streams.track(ctx, streamRW.Suo5Client, f.targetAddr, streamRW)
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		defer streamRW.Close()
-		if err := f.pipe(conn, streamRW); err != nil {
+		defer rw.Close()
+		if err := f.pipe(conn, rw); err != nil {
 			log.Debugf("local conn closed, %s", f.targetAddr)
 		}
 	}()
@@ -57,7 +61,7 @@ func (f *ForwardHandler) Handle(conn net.Conn) error {
 	go func() {
 		defer wg.Done()
 		defer conn.Close()
-		if err := f.pipe(streamRW, conn); err != nil {
+		if err := f.pipe(rw, conn); err != nil {
 			log.Debugf("remote readwriter closed, %s", f.targetAddr)
 		}
 	}()
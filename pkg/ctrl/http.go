@@ -0,0 +1,129 @@
+package ctrl
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	httpproxy "github.com/PurpleNewNew/bs5/internal/proxyclient/http"
+	"github.com/PurpleNewNew/bs5/pkg/core"
+	log "github.com/kataras/golog"
+)
+
+// httpProxyHandler HTTP 代理，支持 CONNECT 和普通的代理请求，所有连接都通过隧道建立。
+// 连接由 Handle 交给内部的 http.Server 处理，直到 http.Server 关闭这个连接后 Handle 才返回
+type httpProxyHandler struct {
+	*core.Suo5Client
+
+	ctx     context.Context
+	streams *registry
+	lis     *connListener
+}
+
+func newHTTPProxyHandler(ctx context.Context, client *core.Suo5Client, streams *registry) *httpProxyHandler {
+	h := &httpProxyHandler{
+		Suo5Client: client,
+		ctx:        ctx,
+		streams:    streams,
+		lis:        newConnListener(),
+	}
+	proxy := &httpproxy.Handler{
+		DialContext: h.dial,
+		HandleError: func(err error, r *http.Request) {
+			log.Debugf("http proxy error, %s %s, %s", r.Method, r.Host, err)
+		},
+	}
+	if !client.Config.NoAuth {
+		proxy.Auth = func(username, password string) bool {
+			return username == client.Config.Username && password == client.Config.Password
+		}
+	}
+	srv := &http.Server{
+		Handler:           proxy,
+		ReadHeaderTimeout: 10 * time.Second,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return withStreamSource(ctx, "http", c.RemoteAddr().String())
+		},
+	}
+	go func() {
+		_ = srv.Serve(h.lis)
+	}()
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+		// 复用的空闲连接占着隧道中的流，监听停止后一并关闭
+		proxy.CloseIdleConnections()
+	}()
+	return h
+}
+
+func (h *httpProxyHandler) Handle(conn net.Conn) error {
+	c := &trackedConn{Conn: conn, done: make(chan struct{})}
+	if err := h.lis.push(c); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	<-c.done
+	return nil
+}
+
+// dial 流的生命周期跟随 h.ctx 而不是请求，普通代理请求的连接会被复用
+func (h *httpProxyHandler) dial(ctx context.Context, _, address string) (net.Conn, error) {
+	return dialRoute(copyStreamSource(h.ctx, ctx), h.Suo5Client, h.streams, address)
+}
+
+// connListener 将 Handle 收到的连接交给 http.Server
+type connListener struct {
+	ch   chan net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{
+		ch:   make(chan net.Conn),
+		done: make(chan struct{}),
+	}
+}
+
+func (l *connListener) push(conn net.Conn) error {
+	select {
+	case l.ch <- conn:
+		return nil
+	case <-l.done:
+		return net.ErrClosed
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.ch:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// trackedConn 在连接被关闭时通知 Handle 返回
+type trackedConn struct {
+	net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { close(c.done) })
+	return err
+}
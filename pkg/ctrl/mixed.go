@@ -0,0 +1,49 @@
+package ctrl
+
+import (
+	"bufio"
+	"net"
+	"time"
+
+	"github.com/go-gost/gosocks5/server"
+)
+
+// mixedHandler 根据连接的第一个字节区分协议，使 SOCKS4/4a、SOCKS5 和 HTTP 代理可以共用一个端口
+type mixedHandler struct {
+	socks4 server.Handler
+	socks5 server.Handler
+	http   server.Handler
+}
+
+func (m *mixedHandler) Handle(conn net.Conn) error {
+	pc := newPeekConn(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	first, err := pc.r.Peek(1)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	switch first[0] {
+	case 0x04:
+		return m.socks4.Handle(pc)
+	case 0x05:
+		return m.socks5.Handle(pc)
+	default:
+		return m.http.Handle(pc)
+	}
+}
+
+// peekConn 读取时先返回已经预读的数据
+type peekConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newPeekConn(conn net.Conn) *peekConn {
+	return &peekConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *peekConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,83 @@
+package ctrl
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/PurpleNewNew/bs5/pkg/core"
+	log "github.com/kataras/golog"
+	"github.com/pkg/errors"
+)
+
+var errRedirLoop = errors.New("connection is not redirected")
+
+// redirHandler 透明代理，接受 iptables REDIRECT 过来的 TCP 连接，通过 SO_ORIGINAL_DST 取回原始的目标地址，
+// 之后和 socks5 一样按路由规则连接。原始地址总是 IP，只有 ip-cidr 和 port 类型的规则能够命中
+type redirHandler struct {
+	*core.Suo5Client
+
+	ctx     context.Context
+	pool    *sync.Pool
+	streams *registry
+}
+
+func (m *redirHandler) Handle(conn net.Conn) error {
+	defer conn.Close()
+
+	address, err := originalDst(conn)
+	if err != nil {
+		log.Errorf("failed to get original destination, %s", err)
+		return err
+	}
+	// 没有经过 REDIRECT 的连接取回的就是监听地址本身，继续转发会连回自己
+	if address == conn.LocalAddr().String() {
+		log.Warnf("connection from %s is not redirected", conn.RemoteAddr())
+		return errRedirLoop
+	}
+
+	ctx := withStreamSource(m.ctx, "redir", conn.RemoteAddr().String())
+	streamRW, err := dialRoute(ctx, m.Suo5Client, m.streams, address)
+	if err != nil {
+		log.Errorf("failed to connect to %s, %s", address, err)
+		return err
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer streamRW.Close()
+		if err := m.pipe(conn, streamRW); err != nil {
+			log.Debugf("local conn closed, %s", address)
+		}
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer conn.Close()
+		if err := m.pipe(streamRW, conn); err != nil {
+			log.Debugf("remote readwriter closed, %s", address)
+		}
+	}()
+
+	wg.Wait()
+	log.Infof("connection closed, %s", address)
+	return nil
+}
+
+func (m *redirHandler) pipe(r io.Reader, w io.Writer) error {
+	buf := m.pool.Get().([]byte)
+	defer m.pool.Put(buf) //nolint:staticcheck
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(buf[:n])
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,105 @@
+//go:build linux
+
+package ctrl
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// soOriginalDst linux/netfilter_ipv4.h 中的 SO_ORIGINAL_DST
+	soOriginalDst = 80
+	// ip6tSoOriginalDst linux/netfilter_ipv6/ip6_tables.h 中的 IP6T_SO_ORIGINAL_DST
+	ip6tSoOriginalDst = 80
+)
+
+// originalDst 取回被 REDIRECT 的连接原本的目标地址
+func originalDst(conn net.Conn) (string, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("not a tcp connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	local, _ := tc.LocalAddr().(*net.TCPAddr)
+	ipv6 := local != nil && local.IP.To4() == nil
+	var address string
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			address, sockErr = originalDst6(int(fd))
+		} else {
+			address, sockErr = originalDst4(int(fd))
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	return address, sockErr
+}
+
+// originalDst4 结果是 sockaddr_in
+func originalDst4(fd int) (string, error) {
+	buf := make([]byte, unix.SizeofSockaddrInet4)
+	n, err := getsockoptBytes(fd, unix.SOL_IP, soOriginalDst, buf)
+	if err != nil {
+		return "", errors.Wrap(err, "getsockopt SO_ORIGINAL_DST")
+	}
+	return parseSockaddr(buf[:n])
+}
+
+// originalDst6 结果是 sockaddr_in6
+func originalDst6(fd int) (string, error) {
+	buf := make([]byte, unix.SizeofSockaddrInet6)
+	n, err := getsockoptBytes(fd, unix.SOL_IPV6, ip6tSoOriginalDst, buf)
+	if err != nil {
+		return "", errors.Wrap(err, "getsockopt IP6T_SO_ORIGINAL_DST")
+	}
+	return parseSockaddr(buf[:n])
+}
+
+// getsockoptBytes 将选项的值原样读入 buf，返回内核写入的长度
+func getsockoptBytes(fd, level, opt int, buf []byte) (int, error) {
+	n := uint32(len(buf))
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt),
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&n)), 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+// parseSockaddr 解析 sockaddr_in 或 sockaddr_in6，family 为本机字节序，端口为网络字节序
+func parseSockaddr(b []byte) (string, error) {
+	if len(b) < 2 {
+		return "", errors.New("short sockaddr")
+	}
+	var ip net.IP
+	switch binary.NativeEndian.Uint16(b) {
+	case unix.AF_INET:
+		// family(2) | port(2) | addr(4)
+		if len(b) < 8 {
+			return "", errors.New("short sockaddr_in")
+		}
+		ip = net.IPv4(b[4], b[5], b[6], b[7])
+	case unix.AF_INET6:
+		// family(2) | port(2) | flowinfo(4) | addr(16) | scope_id(4)
+		if len(b) < 24 {
+			return "", errors.New("short sockaddr_in6")
+		}
+		ip = append(net.IP(nil), b[8:24]...)
+	default:
+		return "", errors.Errorf("unsupported address family %d", binary.NativeEndian.Uint16(b))
+	}
+	port := binary.BigEndian.Uint16(b[2:4])
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+}
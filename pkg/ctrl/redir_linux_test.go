@@ -0,0 +1,133 @@
+//go:build linux
+
+package ctrl
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/PurpleNewNew/bs5/pkg/core"
+	"github.com/PurpleNewNew/bs5/pkg/server"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// rawBytes 按照内核中的内存布局取出结构体的字节
+func rawBytes[T any](v *T) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(v)), unsafe.Sizeof(*v))
+}
+
+func TestParseSockaddr(t *testing.T) {
+	v4 := unix.RawSockaddrInet4{Family: unix.AF_INET, Addr: [4]byte{10, 1, 2, 3}}
+	port := (*[2]byte)(unsafe.Pointer(&v4.Port))
+	port[0], port[1] = 0x1f, 0x90
+	address, err := parseSockaddr(rawBytes(&v4))
+	require.NoError(t, err)
+	require.Equal(t, "10.1.2.3:8080", address)
+
+	v6 := unix.RawSockaddrInet6{Family: unix.AF_INET6, Flowinfo: 7, Scope_id: 2}
+	copy(v6.Addr[:], net.ParseIP("2001:db8::1"))
+	port = (*[2]byte)(unsafe.Pointer(&v6.Port))
+	port[0], port[1] = 0x01, 0xbb
+	address, err = parseSockaddr(rawBytes(&v6))
+	require.NoError(t, err)
+	require.Equal(t, "[2001:db8::1]:443", address)
+
+	// IPv4 映射的地址按 IPv4 输出
+	v6.Addr = [16]byte{}
+	copy(v6.Addr[:], net.ParseIP("192.168.1.1"))
+	address, err = parseSockaddr(rawBytes(&v6))
+	require.NoError(t, err)
+	require.Equal(t, "192.168.1.1:443", address)
+
+	_, err = parseSockaddr(nil)
+	require.Error(t, err)
+	_, err = parseSockaddr(rawBytes(&v4)[:6])
+	require.Error(t, err)
+	_, err = parseSockaddr(rawBytes(&v6)[:20])
+	require.Error(t, err)
+	v4.Family = unix.AF_UNIX
+	_, err = parseSockaddr(rawBytes(&v4))
+	require.ErrorContains(t, err, "unsupported address family")
+}
+
+// hasNetAdmin 当前进程是否有 CAP_NET_ADMIN，修改 iptables 和设置 SO_MARK 都需要
+func hasNetAdmin() bool {
+	data, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if caps, ok := strings.CutPrefix(line, "CapEff:"); ok {
+			v, err := strconv.ParseUint(strings.TrimSpace(caps), 16, 64)
+			return err == nil && v&(1<<unix.CAP_NET_ADMIN) != 0
+		}
+	}
+	return false
+}
+
+// TestRedirIptables 用 iptables 的 REDIRECT 把连接转到透明代理，经过隧道连接原本的目标。
+// 测试会修改当前网络命名空间的 nat 表，只在设置了 BS5_IPTABLES_TEST=1 时运行，建议放在单独的命名空间中，
+// 例如 BS5_IPTABLES_TEST=1 unshare -rn sh -c 'ip link set lo up && go test -run TestRedirIptables ./pkg/ctrl'
+func TestRedirIptables(t *testing.T) {
+	if os.Getenv("BS5_IPTABLES_TEST") != "1" {
+		t.Skip("modifies the nat table, set BS5_IPTABLES_TEST=1 to run")
+	}
+	iptables, err := exec.LookPath("iptables")
+	if err != nil {
+		t.Skip("iptables not found")
+	}
+	if !hasNetAdmin() {
+		t.Skip("requires CAP_NET_ADMIN")
+	}
+
+	echo := startEchoServer(t)
+	var requests atomic.Int32
+	h := server.NewHandler()
+	target := startSuo5ServerWith(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(core.HeaderKey) == core.HeaderValueFull {
+			requests.Add(1)
+		}
+		h.ServeHTTP(w, r)
+	}), false)
+	config := newTestConfig(t, target)
+	config.RedirListen = freeAddr(t)
+	startTunnel(t, config)
+	before := requests.Load()
+
+	// 只重定向带有这个标记的连接，服务端连接 echo 时不会再被重定向
+	const mark = 0xb55
+	_, redirPort, _ := net.SplitHostPort(config.RedirListen)
+	rule := []string{"OUTPUT", "-p", "tcp", "-m", "mark", "--mark", strconv.Itoa(mark), "-j", "REDIRECT", "--to-ports", redirPort}
+	if out, err := exec.Command(iptables, append([]string{"-t", "nat", "-A"}, rule...)...).CombinedOutput(); err != nil {
+		t.Skipf("iptables nat table unavailable, %s", out)
+	}
+	t.Cleanup(func() {
+		_ = exec.Command(iptables, append([]string{"-t", "nat", "-D"}, rule...)...).Run()
+	})
+
+	d := net.Dialer{Control: func(_, _ string, c syscall.RawConn) error {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+		}); err != nil {
+			return err
+		}
+		return sockErr
+	}}
+	conn, err := d.Dial("tcp", echo)
+	require.NoError(t, err)
+	defer conn.Close()
+	assertEcho(t, conn, 64*1024)
+
+	// 连接确实经过了隧道，而不是直接到达 echo
+	require.Greater(t, requests.Load(), before)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package ctrl
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+func originalDst(net.Conn) (string, error) {
+	return "", errors.New("transparent proxy is only supported on linux")
+}
@@ -0,0 +1,163 @@
+package ctrl
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PurpleNewNew/bs5/pkg/core"
+)
+
+// streamSource 发起连接的本地客户端，通过 ctx 传给 dialTunnel 用于登记
+type streamSource struct {
+	handler string
+	addr    string
+}
+
+type streamSourceKey struct{}
+
+func withStreamSource(ctx context.Context, handler, addr string) context.Context {
+	return context.WithValue(ctx, streamSourceKey{}, streamSource{handler: handler, addr: addr})
+}
+
+// copyStreamSource 把 from 中的来源带到 ctx 上，流的生命周期仍然由 ctx 决定
+func copyStreamSource(ctx, from context.Context) context.Context {
+	if source, ok := from.Value(streamSourceKey{}).(streamSource); ok {
+		return context.WithValue(ctx, streamSourceKey{}, source)
+	}
+	return ctx
+}
+
+// StreamInfo 管理接口返回的流信息，数据量是经过隧道的载荷字节数
+type StreamInfo struct {
+	ID          string    `json:"id"`
+	Handler     string    `json:"handler"`
+	Source      string    `json:"source"`
+	Target      string    `json:"target"`
+	Mode        string    `json:"mode"`
+	Created     time.Time `json:"created"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	IdleSeconds float64   `json:"idle_seconds"`
+}
+
+// registry 登记通过隧道打开的流，供管理接口查看和关闭
+type registry struct {
+	mu      sync.RWMutex
+	streams map[string]*registeredStream
+}
+
+// newRegistry 每次 Run 使用独立的登记表，同一进程中的多个隧道互不影响
+func newRegistry() *registry {
+	return &registry{streams: make(map[string]*registeredStream)}
+}
+
+// track 登记一个流，流关闭时自动移除
+func (r *registry) track(ctx context.Context, client *core.Suo5Client, target string, rw io.ReadWriteCloser) *registeredStream {
+	source, _ := ctx.Value(streamSourceKey{}).(streamSource)
+	if source.handler == "" {
+		source.handler = "tunnel"
+	}
+	now := time.Now()
+	s := &registeredStream{
+		ReadWriteCloser: rw,
+		registry:        r,
+		info: StreamInfo{
+			ID:      core.RandString(8),
+			Handler: source.handler,
+			Source:  source.addr,
+			Target:  target,
+			Mode:    string(client.Config.Mode),
+			Created: now,
+		},
+	}
+	s.lastActive.Store(now.UnixNano())
+	r.mu.Lock()
+	r.streams[s.info.ID] = s
+	r.mu.Unlock()
+	return s
+}
+
+func (r *registry) get(id string) (*registeredStream, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.streams[id]
+	return s, ok
+}
+
+// list 按创建时间排序
+func (r *registry) list() []StreamInfo {
+	r.mu.RLock()
+	infos := make([]StreamInfo, 0, len(r.streams))
+	for _, s := range r.streams {
+		infos = append(infos, s.Info())
+	}
+	r.mu.RUnlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Created.Before(infos[j].Created)
+	})
+	return infos
+}
+
+func (r *registry) remove(id string) {
+	r.mu.Lock()
+	delete(r.streams, id)
+	r.mu.Unlock()
+}
+
+type registeredStream struct {
+	io.ReadWriteCloser
+	registry *registry
+	info     StreamInfo
+
+	bytesIn    atomic.Int64
+	bytesOut   atomic.Int64
+	lastActive atomic.Int64
+	once       sync.Once
+}
+
+func (s *registeredStream) Read(p []byte) (int, error) {
+	n, err := s.ReadWriteCloser.Read(p)
+	s.addIn(n)
+	return n, err
+}
+
+func (s *registeredStream) Write(p []byte) (int, error) {
+	n, err := s.ReadWriteCloser.Write(p)
+	s.addOut(n)
+	return n, err
+}
+
+// addIn 和 addOut 记录不经过 Read/Write 的流量，例如 UDP 关联
+func (s *registeredStream) addIn(n int) {
+	if n > 0 {
+		s.bytesIn.Add(int64(n))
+		s.lastActive.Store(time.Now().UnixNano())
+	}
+}
+
+func (s *registeredStream) addOut(n int) {
+	if n > 0 {
+		s.bytesOut.Add(int64(n))
+		s.lastActive.Store(time.Now().UnixNano())
+	}
+}
+
+// Close 关闭隧道中的流，服务端会收到 ActionDelete
+func (s *registeredStream) Close() error {
+	s.once.Do(func() {
+		s.registry.remove(s.info.ID)
+	})
+	return s.ReadWriteCloser.Close()
+}
+
+func (s *registeredStream) Info() StreamInfo {
+	info := s.info
+	info.BytesIn = s.bytesIn.Load()
+	info.BytesOut = s.bytesOut.Load()
+	info.IdleSeconds = time.Since(time.Unix(0, s.lastActive.Load())).Seconds()
+	return info
+}
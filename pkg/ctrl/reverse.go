@@ -0,0 +1,133 @@
+package ctrl
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/PurpleNewNew/bs5/pkg/core"
+	log "github.com/kataras/golog"
+)
+
+// ReverseForwarder 反向转发，服务端监听 rule.Listen，接受的连接通过隧道转发到本地的 rule.Target
+type ReverseForwarder struct {
+	*core.Suo5Client
+
+	ctx     context.Context
+	pool    *sync.Pool
+	streams *registry
+	rule    core.ForwardRule
+}
+
+func NewReverseForwarder(ctx context.Context, client *core.Suo5Client, pool *sync.Pool, streams *registry, rule core.ForwardRule) *ReverseForwarder {
+	return &ReverseForwarder{
+		Suo5Client: client,
+		ctx:        ctx,
+		pool:       pool,
+		streams:    streams,
+		rule:       rule,
+	}
+}
+
+// Run 保持服务端上的监听，承载监听的请求断开后重新监听，直到 ctx 结束
+func (r *ReverseForwarder) Run() {
+	backoff := time.Second
+	for {
+		lis, err := core.NewSuo5Conn(r.ctx, r.Suo5Client).Listen(r.rule.Listen)
+		if err != nil {
+			log.Errorf("reverse forward %s failed, %s", r.rule, err)
+		} else {
+			backoff = time.Second
+			log.Infof("reverse forwarding %s", r.rule)
+			r.serve(lis)
+			log.Warnf("reverse forward %s stopped", r.rule)
+		}
+
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+func (r *ReverseForwarder) serve(lis *core.RemoteListener) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.ctx.Done():
+		case <-done:
+		}
+		_ = lis.Close()
+	}()
+
+	for {
+		id, remoteAddr, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		go r.handle(lis.Client(), id, remoteAddr)
+	}
+}
+
+// handle 接受的连接只能通过监听所在的服务端接管
+func (r *ReverseForwarder) handle(client *core.Suo5Client, id, remoteAddr string) {
+	log.Infof("reverse connection from %s, forwarding to %s", remoteAddr, r.rule.Target)
+	streamRW := core.NewSuo5Conn(r.ctx, client)
+	if err := streamRW.Attach(id); err != nil {
+		log.Errorf("failed to attach reverse connection from %s, %s", remoteAddr, err)
+		return
+	}
+	ctx := withStreamSource(r.ctx, "reverse", remoteAddr)
+	rw := r.streams.track(ctx, client, r.rule.Target, streamRW)
+	defer rw.Close()
+
+	conn, err := (&net.Dialer{Timeout: 5 * time.Second}).DialContext(r.ctx, "tcp", r.rule.Target)
+	if err != nil {
+		log.Errorf("failed to connect to %s, %s", r.rule.Target, err)
+		return
+	}
+	defer conn.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer rw.Close()
+		if err := r.pipe(conn, rw); err != nil {
+			log.Debugf("local conn closed, %s", r.rule.Target)
+		}
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer conn.Close()
+		if err := r.pipe(rw, conn); err != nil {
+			log.Debugf("remote readwriter closed, %s", remoteAddr)
+		}
+	}()
+
+	wg.Wait()
+	log.Infof("reverse connection closed, %s", remoteAddr)
+}
+
+func (r *ReverseForwarder) pipe(src io.Reader, dst io.Writer) error {
+	buf := r.pool.Get().([]byte)
+	defer r.pool.Put(buf) //nolint:staticcheck
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return err
+		}
+		_, err = dst.Write(buf[:n])
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package ctrl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	httpproxy "github.com/PurpleNewNew/bs5/internal/proxyclient/http"
+	"github.com/PurpleNewNew/bs5/pkg/core"
+	"github.com/PurpleNewNew/bs5/pkg/route"
+	log "github.com/kataras/golog"
+	"github.com/pkg/errors"
+)
+
+// dialRoute 按路由规则连接目标，被拒绝的地址返回的错误同时满足 httpproxy.ErrForbidden 和 route.ErrRejected
+func dialRoute(ctx context.Context, client *core.Suo5Client, streams *registry, address string) (net.Conn, error) {
+	// 端口为 0 是启动时的自检，服务端会连接自身，不受路由规则影响
+	if _, port, _ := net.SplitHostPort(address); port == "0" {
+		return dialTunnel(ctx, client, streams, address)
+	}
+	router := client.Config.Router()
+	action, rule, err := router.MatchAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if rule != nil {
+		log.Debugf("%s matched rule %s", address, rule)
+	}
+
+	switch action {
+	case route.ActionTunnel:
+		return dialTunnel(ctx, client, streams, address)
+	case route.ActionReject:
+		log.Debugf("reject connection to %s", address)
+		return nil, fmt.Errorf("%w, %w", httpproxy.ErrForbidden, route.ErrRejected)
+	}
+
+	log.Infof("start connection to %s via %s", address, action)
+	conn, err := router.Dial(ctx, action, "tcp", address)
+	if err != nil {
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, errors.Wrap(core.ErrConnRefused, err.Error())
+		}
+		return nil, errors.Wrap(core.ErrHostUnreachable, err.Error())
+	}
+	log.Infof("successfully connected to %s via %s", address, action)
+	return conn, nil
+}
+
+// dialTunnel 通过隧道连接目标，打开的流登记到 streams
+func dialTunnel(ctx context.Context, client *core.Suo5Client, streams *registry, address string) (net.Conn, error) {
+	log.Infof("start connection to %s", address)
+	streamRW := core.NewSuo5Conn(ctx, client)
+	if err := streamRW.Connect(address); err != nil {
+		return nil, err
+	}
+	log.Infof("successfully connected to %s", address)
+	return &streamConn{ReadWriteCloser: streams.track(ctx, streamRW.Suo5Client, address, streamRW), address: address}, nil
+}
+
+// streamConn 将隧道中的流包装为 net.Conn，不支持超时设置
+type streamConn struct {
+	io.ReadWriteCloser
+	address string
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// RemoteAddr 返回原始的目标地址，不在本地解析域名
+func (c *streamConn) RemoteAddr() net.Addr {
+	return streamAddr(c.address)
+}
+
+type streamAddr string
+
+func (a streamAddr) Network() string { return "tcp" }
+func (a streamAddr) String() string  { return string(a) }
+
+func (c *streamConn) SetDeadline(time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(time.Time) error { return nil }
@@ -0,0 +1,47 @@
+package ctrl
+
+import (
+	"context"
+	"net"
+
+	socksproxy "github.com/PurpleNewNew/bs5/internal/proxyclient/socks"
+	"github.com/PurpleNewNew/bs5/pkg/core"
+	log "github.com/kataras/golog"
+)
+
+// socks4Handler 兼容 SOCKS4/4a 的客户端，只支持 CONNECT。SOCKS4 只有 91 一个失败的状态码，
+// 隧道返回的 ErrHostUnreachable、ErrConnRefused 以及被规则拒绝的地址都会回复 91，认证失败时回复 93
+type socks4Handler struct {
+	*core.Suo5Client
+
+	ctx     context.Context
+	streams *registry
+	auth    func(username, password string) bool
+}
+
+func newSocks4Handler(ctx context.Context, client *core.Suo5Client, streams *registry) *socks4Handler {
+	h := &socks4Handler{Suo5Client: client, ctx: ctx, streams: streams}
+	if !client.Config.NoAuth {
+		// SOCKS4 没有密码认证，user id 需要是 username:password 的形式
+		h.auth = func(username, password string) bool {
+			return username == client.Config.Username && password == client.Config.Password
+		}
+	}
+	return h
+}
+
+func (m *socks4Handler) Handle(conn net.Conn) error {
+	defer conn.Close()
+	ctx := withStreamSource(m.ctx, "socks4", conn.RemoteAddr().String())
+	conf := &socksproxy.SOCKSConf{
+		Auth: m.auth,
+		Dial: func(_ context.Context, _, address string) (net.Conn, error) {
+			return dialRoute(ctx, m.Suo5Client, m.streams, address)
+		},
+	}
+	if err := socksproxy.ServeConn(conn, conf); err != nil {
+		log.Debugf("socks4 connection error, %s", err)
+		return err
+	}
+	return nil
+}
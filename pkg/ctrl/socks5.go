@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/PurpleNewNew/bs5/pkg/netrans"
+	"github.com/PurpleNewNew/bs5/pkg/route"
 	"github.com/go-gost/gosocks5"
 	log "github.com/kataras/golog"
 )
@@ -20,6 +21,7 @@ type socks5Handler struct {
 
 	ctx      context.Context
 	pool     *sync.Pool
+	streams  *registry
 	selector gosocks5.Selector
 }
 
@@ -33,28 +35,21 @@ func (m *socks5Handler) Handle(conn net.Conn) error {
 		return err
 	}
 
-	if len(m.Config.ExcludeGlobs) != 0 {
-		for _, g := range m.Config.ExcludeGlobs {
-			if g.Match(req.Addr.Host) {
-				log.Debugf("drop connection to %s", req.Addr.Host)
-				return nil
-			}
-		}
-	}
-
-	log.Infof("start connection to %s", req.Addr.String())
 	switch req.Cmd {
 	case gosocks5.CmdConnect:
 		m.handleConnect(conn, req)
 		return nil
+	case gosocks5.CmdUdp:
+		m.handleAssociate(conn, req)
+		return nil
 	default:
 		return fmt.Errorf("%d: unsupported command", gosocks5.CmdUnsupported)
 	}
 }
 
 func (m *socks5Handler) handleConnect(conn net.Conn, sockReq *gosocks5.Request) {
-	streamRW := core.NewSuo5Conn(m.ctx, m.Suo5Client)
-	err := streamRW.Connect(sockReq.Addr.String())
+	ctx := withStreamSource(m.ctx, "socks5", conn.RemoteAddr().String())
+	streamRW, err := dialRoute(ctx, m.Suo5Client, m.streams, sockReq.Addr.String())
 	if err != nil {
 		ReplyError(conn, err)
 		return
@@ -62,10 +57,10 @@ func (m *socks5Handler) handleConnect(conn net.Conn, sockReq *gosocks5.Request)
 	rep := gosocks5.NewReply(gosocks5.Succeeded, nil)
 	err = rep.Write(conn)
 	if err != nil {
-		log.Errorf("write data failed, %w", err)
+		_ = streamRW.Close()
+		log.Errorf("write data failed, %s", err)
 		return
 	}
-	log.Infof("successfully connected to %s", sockReq.Addr)
 
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -113,6 +108,10 @@ func ReplyError(conn net.Conn, err error) {
 		rep = gosocks5.NewReply(gosocks5.Failure, nil)
 	case errors.Is(err, core.ErrConnRefused):
 		rep = gosocks5.NewReply(gosocks5.ConnRefused, nil)
+	case errors.Is(err, route.ErrRejected):
+		rep = gosocks5.NewReply(gosocks5.NotAllowed, nil)
+	default:
+		rep = gosocks5.NewReply(gosocks5.Failure, nil)
 	}
 	_ = rep.Write(conn)
 }
@@ -0,0 +1,227 @@
+package ctrl
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/PurpleNewNew/bs5/pkg/core"
+	"github.com/PurpleNewNew/bs5/pkg/route"
+	"github.com/go-gost/gosocks5"
+	log "github.com/kataras/golog"
+)
+
+// handleAssociate 处理 UDP ASSOCIATE，在本地监听一个 UDP 端口，收到的数据报去掉 SOCKS5 的头部后通过隧道发送，
+// 控制连接断开时关联随之结束
+func (m *socks5Handler) handleAssociate(conn net.Conn, sockReq *gosocks5.Request) {
+	localHost, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	relay, err := net.ListenPacket("udp", net.JoinHostPort(localHost, "0"))
+	if err != nil {
+		log.Errorf("listen udp error, %s", err)
+		_ = gosocks5.NewReply(gosocks5.Failure, nil).Write(conn)
+		return
+	}
+	defer relay.Close()
+
+	dc, err := core.NewSuo5Conn(m.ctx, m.Suo5Client).Associate()
+	if err != nil {
+		log.Errorf("udp associate failed, %s", err)
+		ReplyError(conn, err)
+		return
+	}
+	// 登记后管理接口可以查看和关闭这个关联，关闭时断开控制连接，关联随之结束
+	ctx := withStreamSource(m.ctx, "socks5-udp", conn.RemoteAddr().String())
+	stream := m.streams.track(ctx, m.Suo5Client, "udp", &associateStream{dc: dc, conn: conn})
+	defer stream.Close()
+
+	bind, _ := gosocks5.NewAddr(relay.LocalAddr().String())
+	if err := gosocks5.NewReply(gosocks5.Succeeded, bind).Write(conn); err != nil {
+		log.Errorf("write data failed, %s", err)
+		return
+	}
+	log.Infof("udp associate relaying at %s", relay.LocalAddr())
+
+	peerHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	a := &udpAssociation{
+		socks5Handler: m,
+		relay:         relay,
+		dc:            dc,
+		stream:        stream,
+		peerIP:        net.ParseIP(peerHost),
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer dc.Close()
+		a.uplink()
+	}()
+	go func() {
+		defer wg.Done()
+		defer relay.Close()
+		a.downlink()
+	}()
+
+	_, _ = io.Copy(io.Discard, conn)
+	_ = relay.Close()
+	_ = dc.Close()
+	a.closeDirect()
+	wg.Wait()
+	log.Infof("udp associate closed, %s", sockReq.Addr)
+}
+
+type udpAssociation struct {
+	*socks5Handler
+	relay  net.PacketConn
+	dc     *core.DatagramConn
+	stream *registeredStream
+	peerIP net.IP
+
+	mu     sync.Mutex
+	client net.Addr
+	// direct 路由规则为 direct 的数据报直接从本地发送，第一次使用时创建
+	direct net.PacketConn
+	closed bool
+}
+
+// uplink 只接受来自控制连接同一 IP 的数据报，不支持分片
+func (a *udpAssociation) uplink() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := a.relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if udpAddr, ok := addr.(*net.UDPAddr); !ok || !udpAddr.IP.Equal(a.peerIP) {
+			log.Debugf("drop udp datagram from %s", addr)
+			continue
+		}
+		r := bytes.NewReader(buf[:n])
+		header := &gosocks5.UDPHeader{}
+		if _, err := header.ReadFrom(r); err != nil || header.Frag != 0 {
+			log.Debugf("drop invalid udp datagram from %s", addr)
+			continue
+		}
+		a.mu.Lock()
+		a.client = addr
+		a.mu.Unlock()
+
+		payload := buf[n-r.Len() : n]
+		action, _ := a.Config.Router().Match(header.Addr.Host, int(header.Addr.Port))
+		switch action {
+		case route.ActionTunnel:
+			if _, err := a.dc.WriteTo(payload, header.Addr.String()); err != nil {
+				log.Debugf("write udp datagram error, %s", err)
+				return
+			}
+			a.stream.addOut(len(payload))
+		case route.ActionDirect:
+			a.writeDirect(payload, header.Addr.String())
+		default:
+			// 上游代理只支持 TCP
+			log.Debugf("drop udp datagram to %s, action %s", header.Addr, action)
+		}
+	}
+}
+
+func (a *udpAssociation) writeDirect(payload []byte, address string) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		log.Debugf("resolve udp address error, %s", err)
+		return
+	}
+	a.mu.Lock()
+	if a.direct == nil && !a.closed {
+		direct, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			a.mu.Unlock()
+			log.Debugf("listen udp error, %s", err)
+			return
+		}
+		a.direct = direct
+		go a.directDownlink(direct)
+	}
+	direct := a.direct
+	a.mu.Unlock()
+	if direct == nil {
+		return
+	}
+	if _, err := direct.WriteTo(payload, addr); err != nil {
+		log.Debugf("write udp datagram error, %s", err)
+	}
+}
+
+func (a *udpAssociation) directDownlink(direct net.PacketConn) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := direct.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		a.reply(buf[:n], from.String())
+	}
+}
+
+func (a *udpAssociation) closeDirect() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+	if a.direct != nil {
+		_ = a.direct.Close()
+	}
+}
+
+func (a *udpAssociation) downlink() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := a.dc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		a.stream.addIn(n)
+		a.reply(buf[:n], from)
+	}
+}
+
+// reply 加上 SOCKS5 的头部后将数据报发回客户端，from 为数据报的来源地址
+func (a *udpAssociation) reply(data []byte, from string) {
+	a.mu.Lock()
+	client := a.client
+	a.mu.Unlock()
+	if client == nil {
+		return
+	}
+	addr, err := gosocks5.NewAddr(from)
+	if err != nil {
+		return
+	}
+	var out bytes.Buffer
+	dgram := gosocks5.NewUDPDatagram(gosocks5.NewUDPHeader(0, 0, addr), data)
+	if _, err := dgram.WriteTo(&out); err != nil {
+		return
+	}
+	if _, err := a.relay.WriteTo(out.Bytes(), client); err != nil {
+		log.Debugf("write udp datagram to client error, %s", err)
+	}
+}
+
+// associateStream 把 UDP 关联登记为一个流，数据报不经过 Read 和 Write，流量由 uplink 和 downlink 记录
+type associateStream struct {
+	dc   *core.DatagramConn
+	conn net.Conn
+}
+
+func (s *associateStream) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (s *associateStream) Write([]byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func (s *associateStream) Close() error {
+	_ = s.conn.Close()
+	return s.dc.Close()
+}
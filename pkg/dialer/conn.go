@@ -0,0 +1,324 @@
+package dialer
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/PurpleNewNew/bs5/pkg/core"
+)
+
+// errWriteClosed 半关闭之后继续写入
+var errWriteClosed = errors.New("write after close write")
+
+// Addr 通过隧道连接的地址，域名不会在本地解析
+type Addr struct {
+	Net     string
+	Address string
+}
+
+func (a *Addr) Network() string { return a.Net }
+func (a *Addr) String() string  { return a.Address }
+
+// newRemoteAddr IP 地址返回 *net.TCPAddr，域名返回 *Addr
+func newRemoteAddr(address string) (net.Addr, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		addrPort, err := netip.ParseAddrPort(address)
+		if err != nil {
+			return nil, err
+		}
+		return net.TCPAddrFromAddrPort(addrPort), nil
+	}
+	return &Addr{Net: "tcp", Address: address}, nil
+}
+
+type stream interface {
+	io.ReadWriteCloser
+	core.CloseWriter
+}
+
+// conn 隧道中的流对应的 net.Conn。读写在单独的协程中进行，超时或者关闭时不需要等待底层的请求返回
+type conn struct {
+	rw            stream
+	local, remote net.Addr
+	onClose       func()
+
+	readMu   sync.Mutex
+	readCh   chan []byte
+	readDone chan struct{}
+	readErr  error
+	readBuf  []byte
+
+	// writeSem 同一时间只有一个写入，超时返回后写入仍在进行时，之后的写入需要等待
+	writeSem    chan struct{}
+	writeClosed bool
+
+	readDeadline  *deadline
+	writeDeadline *deadline
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConn(rw stream, local, remote net.Addr, onClose func()) *conn {
+	c := &conn{
+		rw:            rw,
+		local:         local,
+		remote:        remote,
+		onClose:       onClose,
+		readCh:        make(chan []byte),
+		readDone:      make(chan struct{}),
+		writeSem:      make(chan struct{}, 1),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		closed:        make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *conn) readLoop() {
+	defer close(c.readDone)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := c.rw.Read(buf)
+		if n > 0 {
+			select {
+			case c.readCh <- append([]byte(nil), buf[:n]...):
+			case <-c.closed:
+				return
+			}
+		}
+		if err != nil {
+			c.readErr = err
+			return
+		}
+	}
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if c.isClosed() {
+		return 0, c.opError("read", net.ErrClosed)
+	}
+	if len(c.readBuf) == 0 {
+		select {
+		case c.readBuf = <-c.readCh:
+		case <-c.readDone:
+			if errors.Is(c.readErr, io.EOF) {
+				return 0, io.EOF
+			}
+			if c.isClosed() {
+				return 0, c.opError("read", net.ErrClosed)
+			}
+			return 0, c.opError("read", c.readErr)
+		case <-c.readDeadline.wait():
+			return 0, c.opError("read", os.ErrDeadlineExceeded)
+		case <-c.closed:
+			return 0, c.opError("read", net.ErrClosed)
+		}
+	}
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+// acquireWrite 等待之前的写入完成
+func (c *conn) acquireWrite() error {
+	select {
+	case c.writeSem <- struct{}{}:
+		return nil
+	case <-c.writeDeadline.wait():
+		return os.ErrDeadlineExceeded
+	case <-c.closed:
+		return net.ErrClosed
+	}
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	if err := c.acquireWrite(); err != nil {
+		return 0, c.opError("write", err)
+	}
+	if c.writeClosed {
+		<-c.writeSem
+		return 0, c.opError("write", errWriteClosed)
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+	done := make(chan result, 1)
+	// 超时返回后调用方可能会复用 p
+	data := append([]byte(nil), p...)
+	go func() {
+		n, err := c.rw.Write(data)
+		<-c.writeSem
+		done <- result{n, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return r.n, c.opError("write", r.err)
+		}
+		return r.n, nil
+	case <-c.writeDeadline.wait():
+		return 0, c.opError("write", os.ErrDeadlineExceeded)
+	case <-c.closed:
+		return 0, c.opError("write", net.ErrClosed)
+	}
+}
+
+// CloseWrite 在已经写入的数据之后通知服务端关闭到目标连接的写入端，之后仍然可以读取
+func (c *conn) CloseWrite() error {
+	if err := c.acquireWrite(); err != nil {
+		return c.opError("close", err)
+	}
+	defer func() { <-c.writeSem }()
+	if c.writeClosed {
+		return nil
+	}
+	c.writeClosed = true
+	if err := c.rw.CloseWrite(); err != nil {
+		return c.opError("close", err)
+	}
+	return nil
+}
+
+func (c *conn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.readDeadline.close()
+		c.writeDeadline.close()
+		err = c.rw.Close()
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	if err != nil {
+		return c.opError("close", err)
+	}
+	return nil
+}
+
+func (c *conn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *conn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "tcp", Source: c.local, Addr: c.remote, Err: err}
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	if c.isClosed() {
+		return c.opError("set", net.ErrClosed)
+	}
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	if c.isClosed() {
+		return c.opError("set", net.ErrClosed)
+	}
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	if c.isClosed() {
+		return c.opError("set", net.ErrClosed)
+	}
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// deadline 到期时关闭 wait 返回的 channel，与 net.Pipe 的实现相同
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		// 等待定时器关闭 cancel
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// close 停止定时器，连接关闭后不再需要
+func (d *deadline) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
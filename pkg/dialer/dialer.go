@@ -0,0 +1,133 @@
+// Package dialer 在进程内通过隧道建立 TCP 连接，不需要经过本地的 SOCKS5 端口
+//
+//	d, err := dialer.New(ctx, config)
+//	conn, err := d.DialContext(ctx, "tcp", "10.0.0.5:22")
+//	client := &http.Client{Transport: d.Transport()}
+package dialer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/PurpleNewNew/bs5/pkg/core"
+	log "github.com/kataras/golog"
+)
+
+// Dialer 通过隧道建立连接，可以被多个协程同时使用
+type Dialer struct {
+	client *core.Suo5Client
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu    sync.Mutex
+	conns map[*conn]struct{}
+}
+
+// New 连接 config.Target 并确定使用的传输模式。ctx 结束或者调用 Close 后，通过它建立的所有连接都会被关闭
+func New(ctx context.Context, config *core.Suo5Config) (*Dialer, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	client, err := config.Init(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	d := &Dialer{client: client, ctx: ctx, cancel: cancel, conns: make(map[*conn]struct{})}
+	go func() {
+		<-ctx.Done()
+		d.closeAll()
+	}()
+	return d, nil
+}
+
+// Config 实际使用的配置，Mode 是协商后的传输模式
+func (d *Dialer) Config() *core.Suo5Config {
+	return d.client.Config
+}
+
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext 通过隧道连接 address，只支持 tcp、tcp4 和 tcp6。域名由服务端解析。
+// ctx 只作用于建立连接的过程，连接建立后的生命周期与 Dialer 相同
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	remote, err := newRemoteAddr(address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	log.Debugf("dial %s through the tunnel", address)
+	suo := core.NewSuo5Conn(d.ctx, d.client)
+	done := make(chan error, 1)
+	go func() {
+		done <- suo.Connect(address)
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// 建立连接的请求无法中途取消，成功后立即关闭
+		go func() {
+			if <-done == nil {
+				_ = suo.Close()
+			}
+		}()
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: remote, Err: ctx.Err()}
+	}
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: remote, Err: err}
+	}
+	var c *conn
+	c = newConn(suo, &Addr{Net: "bs5", Address: suo.Config.Target}, remote, func() {
+		d.mu.Lock()
+		delete(d.conns, c)
+		d.mu.Unlock()
+	})
+	d.mu.Lock()
+	if d.conns == nil {
+		d.mu.Unlock()
+		_ = c.Close()
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: remote, Err: net.ErrClosed}
+	}
+	d.conns[c] = struct{}{}
+	d.mu.Unlock()
+	return c, nil
+}
+
+// Transport 返回通过隧道发送请求的 http.Transport，不使用环境变量中的代理，
+// 需要调整 TLS 等设置时直接修改返回值
+func (d *Dialer) Transport() *http.Transport {
+	return &http.Transport{
+		DialContext:           d.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// Close 关闭所有通过这个 Dialer 建立的连接，之后不能再建立新的连接
+func (d *Dialer) Close() error {
+	d.cancel()
+	d.closeAll()
+	return nil
+}
+
+func (d *Dialer) closeAll() {
+	d.mu.Lock()
+	conns := d.conns
+	d.conns = nil
+	d.mu.Unlock()
+	for c := range conns {
+		_ = c.Close()
+	}
+	_ = d.client.CloseMux()
+}
@@ -0,0 +1,209 @@
+package dialer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/PurpleNewNew/bs5/pkg/core"
+	"github.com/PurpleNewNew/bs5/pkg/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startSuo5Server buffered 为 true 时在前面加一层缓存请求体的反向代理，客户端只能使用半双工模式
+func startSuo5Server(t *testing.T, buffered bool) string {
+	backend := httptest.NewServer(server.NewHandler())
+	t.Cleanup(backend.Close)
+	if !buffered {
+		return backend.URL
+	}
+	u, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.FlushInterval = -1
+	frontend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.TransferEncoding = nil
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(frontend.Close)
+	return frontend.URL
+}
+
+// startServer handle 处理每个接受的连接
+func startServer(t *testing.T, handle func(net.Conn)) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return lis.Addr().String()
+}
+
+func newTestDialer(t *testing.T, buffered, mux bool) *Dialer {
+	config := core.DefaultSuo5Config()
+	config.Target = startSuo5Server(t, buffered)
+	config.EnableMux = mux
+	d, err := New(context.Background(), config)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = d.Close() })
+	return d
+}
+
+var testModes = []struct {
+	name          string
+	buffered, mux bool
+}{
+	{"full", false, false},
+	{"half", true, false},
+	{"mux", false, true},
+}
+
+func TestDialer(t *testing.T) {
+	// 读到 EOF 后才返回收到的数据，用来检查半关闭
+	echo := startServer(t, func(conn net.Conn) {
+		data, _ := io.ReadAll(conn)
+		_, _ = conn.Write(data)
+	})
+	for _, mode := range testModes {
+		t.Run(mode.name, func(t *testing.T) {
+			d := newTestDialer(t, mode.buffered, mode.mux)
+			conn, err := d.DialContext(context.Background(), "tcp", echo)
+			require.NoError(t, err)
+			defer conn.Close()
+			assert.Equal(t, echo, conn.RemoteAddr().String())
+			assert.IsType(t, &net.TCPAddr{}, conn.RemoteAddr())
+			assert.Equal(t, d.Config().Target, conn.LocalAddr().String())
+
+			data := make([]byte, 64*1024)
+			_, err = rand.Read(data)
+			require.NoError(t, err)
+			_, err = conn.Write(data)
+			require.NoError(t, err)
+			require.NoError(t, conn.(interface{ CloseWrite() error }).CloseWrite())
+			_, err = conn.Write(data)
+			require.Error(t, err)
+
+			_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			got, err := io.ReadAll(conn)
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(data, got), "echo data mismatch")
+		})
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	silent := startServer(t, func(conn net.Conn) {
+		_, _ = io.Copy(io.Discard, conn)
+	})
+	d := newTestDialer(t, false, false)
+	conn, err := d.Dial("tcp", silent)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr) && netErr.Timeout())
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// 过去的时间立即超时，清除后恢复
+	require.NoError(t, conn.SetDeadline(time.Now().Add(-time.Second)))
+	_, err = conn.Write([]byte("x"))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	require.NoError(t, conn.SetDeadline(time.Time{}))
+	_, err = conn.Write([]byte("x"))
+	require.NoError(t, err)
+
+	// 关闭后阻塞的读取立即返回
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_ = conn.Close()
+	}()
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestDialError(t *testing.T) {
+	d := newTestDialer(t, false, false)
+	_, err := d.Dial("udp", "127.0.0.1:53")
+	require.Error(t, err)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := lis.Addr().String()
+	_ = lis.Close()
+	_, err = d.Dial("tcp", closed)
+	require.ErrorIs(t, err, core.ErrHostUnreachable)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = d.DialContext(ctx, "tcp", closed)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestTransport(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	defer web.Close()
+	for _, mode := range testModes {
+		t.Run(mode.name, func(t *testing.T) {
+			d := newTestDialer(t, mode.buffered, mode.mux)
+			client := &http.Client{Transport: d.Transport(), Timeout: 10 * time.Second}
+			for i := 0; i < 3; i++ {
+				resp, err := client.Get(fmt.Sprintf("%s/%d", web.URL, i))
+				require.NoError(t, err)
+				body, err := io.ReadAll(resp.Body)
+				_ = resp.Body.Close()
+				require.NoError(t, err)
+				assert.Equal(t, fmt.Sprintf("hello /%d", i), string(body))
+			}
+		})
+	}
+}
+
+func TestClose(t *testing.T) {
+	echo := startServer(t, func(conn net.Conn) {
+		_, _ = io.Copy(conn, conn)
+	})
+	d := newTestDialer(t, false, false)
+	conn, err := d.Dial("tcp", echo)
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, net.ErrClosed)
+	_, err = d.Dial("tcp", echo)
+	require.Error(t, err)
+}
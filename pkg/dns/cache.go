@@ -0,0 +1,138 @@
+package dns
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// maxCacheEntries 缓存的应答数量上限
+const maxCacheEntries = 4096
+
+type cacheKey struct {
+	name  string
+	typ   dnsmessage.Type
+	class dnsmessage.Class
+}
+
+func newCacheKey(q dnsmessage.Question) cacheKey {
+	return cacheKey{name: strings.ToLower(q.Name.String()), typ: q.Type, class: q.Class}
+}
+
+type cacheEntry struct {
+	msg     dnsmessage.Message
+	created time.Time
+	expires time.Time
+}
+
+// cache 按 TTL 缓存应答，取出时把记录的 TTL 减去已经缓存的时间
+type cache struct {
+	mu      sync.Mutex
+	entries map[cacheKey]*cacheEntry
+}
+
+func newCache() *cache {
+	return &cache{entries: make(map[cacheKey]*cacheEntry)}
+}
+
+func (c *cache) get(key cacheKey, id uint16) []byte {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && !time.Now().Before(e.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	elapsed := uint32(time.Since(e.created) / time.Second)
+	msg := e.msg
+	msg.Header.ID = id
+	msg.Answers = decreaseTTL(msg.Answers, elapsed)
+	msg.Authorities = decreaseTTL(msg.Authorities, elapsed)
+	msg.Additionals = decreaseTTL(msg.Additionals, elapsed)
+	resp, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+// put 只缓存成功的应答以及带有 SOA 的否定应答，TTL 取所有记录中最小的
+func (c *cache) put(key cacheKey, resp []byte) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil || msg.Header.Truncated {
+		return
+	}
+	if msg.Header.RCode != dnsmessage.RCodeSuccess && msg.Header.RCode != dnsmessage.RCodeNameError {
+		return
+	}
+	ttl, ok := minTTL(msg)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCacheEntries {
+		c.evict(now)
+	}
+	c.entries[key] = &cacheEntry{msg: msg, created: now, expires: now.Add(time.Duration(ttl) * time.Second)}
+}
+
+// evict 清理过期的应答，仍然没有空间时随机删除一个
+func (c *cache) evict(now time.Time) {
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	if len(c.entries) < maxCacheEntries {
+		return
+	}
+	for k := range c.entries {
+		delete(c.entries, k)
+		return
+	}
+}
+
+func minTTL(msg dnsmessage.Message) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, rrs := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for _, rr := range rrs {
+			if rr.Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if !found || rr.Header.TTL < ttl {
+				ttl = rr.Header.TTL
+				found = true
+			}
+		}
+	}
+	return ttl, found
+}
+
+func decreaseTTL(rrs []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	if len(rrs) == 0 {
+		return rrs
+	}
+	out := make([]dnsmessage.Resource, len(rrs))
+	copy(out, rrs)
+	for i := range out {
+		if out[i].Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		if out[i].Header.TTL > elapsed {
+			out[i].Header.TTL -= elapsed
+		} else {
+			out[i].Header.TTL = 0
+		}
+	}
+	return out
+}
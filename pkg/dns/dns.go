@@ -0,0 +1,444 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/kataras/golog"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultTimeout = 5 * time.Second
+	// systemTTL 系统的解析器不返回 TTL，使用固定的值
+	systemTTL = 60
+	// maxIdleConns 保留的到 Upstream 的空闲连接数，每个连接都是隧道中的一个流
+	maxIdleConns = 4
+	// tcpIdleTimeout 本地 TCP 客户端两次查询之间的最长间隔
+	tcpIdleTimeout = 10 * time.Second
+	minUDPSize     = 512
+)
+
+// Server 本地的 DNS 服务，同时监听 UDP 和 TCP。命中 Domains 的查询以 DNS over TCP 的方式通过 Dial 发给 Upstream，
+// 其余的查询交给系统的解析器，Domains 为空时所有查询都发给 Upstream。应答按照 TTL 缓存
+type Server struct {
+	// Upstream 内网的解析服务器，没有端口时使用 53
+	Upstream string
+	// Domains 需要通过 Upstream 解析的域名后缀
+	Domains []string
+	// Dial 连接 Upstream，通常经过隧道。连接会被复用，ctx 在服务关闭前不会结束
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+	// Resolver 解析没有命中 Domains 的查询，为空时使用 net.DefaultResolver
+	Resolver *net.Resolver
+	Timeout  time.Duration
+
+	once  sync.Once
+	cache *cache
+	idle  chan net.Conn
+	// ctx 连接 Upstream 使用的 ctx，与服务的生命周期一致，单个查询的超时不会影响空闲的连接
+	ctx context.Context
+}
+
+func (s *Server) init() {
+	s.once.Do(func() {
+		s.cache = newCache()
+		s.idle = make(chan net.Conn, maxIdleConns)
+		s.ctx = context.Background()
+	})
+}
+
+// Start 在 address 上同时监听 UDP 和 TCP，ctx 结束时关闭
+func (s *Server) Start(ctx context.Context, address string) error {
+	s.init()
+	s.ctx = ctx
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	// address 的端口为 0 时 TCP 使用和 UDP 相同的端口
+	lis, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		_ = pc.Close()
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		_ = pc.Close()
+		_ = lis.Close()
+		s.closeIdle()
+	}()
+	go s.serveUDP(ctx, pc)
+	go s.serveTCP(ctx, lis)
+	return nil
+}
+
+func (s *Server) serveUDP(ctx context.Context, pc net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			resp := s.Exchange(ctx, query)
+			if resp == nil {
+				return
+			}
+			_, _ = pc.WriteTo(truncate(resp, udpSize(query)), addr)
+		}()
+	}
+}
+
+func (s *Server) serveTCP(ctx context.Context, lis net.Listener) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				_ = conn.SetDeadline(time.Now().Add(tcpIdleTimeout))
+				query, err := readMsg(conn)
+				if err != nil {
+					return
+				}
+				resp := s.Exchange(ctx, query)
+				if resp == nil {
+					return
+				}
+				if err := writeMsg(conn, resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Exchange 处理一个查询并返回打包好的应答，查询无法解析时返回 nil
+func (s *Server) Exchange(ctx context.Context, query []byte) []byte {
+	s.init()
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+
+	key := newCacheKey(q)
+	if resp := s.cache.get(key, h.ID); resp != nil {
+		log.Debugf("dns %s %s from cache", q.Type, q.Name)
+		return resp
+	}
+
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var resp []byte
+	if s.matchDomain(q.Name.String()) {
+		log.Debugf("dns %s %s via %s", q.Type, q.Name, s.upstream())
+		resp, err = s.exchangeUpstream(ctx, query)
+	} else {
+		log.Debugf("dns %s %s via system resolver", q.Type, q.Name)
+		resp, err = s.resolveSystem(ctx, h, q)
+	}
+	if err != nil {
+		log.Warnf("dns %s %s failed, %s", q.Type, q.Name, err)
+		return newResponse(h, q, dnsmessage.RCodeServerFailure, nil)
+	}
+	s.cache.put(key, resp)
+	return resp
+}
+
+func (s *Server) matchDomain(name string) bool {
+	if len(s.Domains) == 0 {
+		return true
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, domain := range s.Domains {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) upstream() string {
+	if _, _, err := net.SplitHostPort(s.Upstream); err == nil {
+		return s.Upstream
+	}
+	return net.JoinHostPort(strings.Trim(s.Upstream, "[]"), "53")
+}
+
+// exchangeUpstream 优先复用空闲的连接，复用的连接可能已经被 Upstream 关闭，失败时换新的连接重试
+func (s *Server) exchangeUpstream(ctx context.Context, query []byte) ([]byte, error) {
+	for {
+		conn, reused, err := s.getConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := exchangeConn(ctx, conn, query)
+		if err == nil {
+			s.putConn(conn)
+			return resp, nil
+		}
+		_ = conn.Close()
+		if !reused || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+func (s *Server) getConn(ctx context.Context) (net.Conn, bool, error) {
+	select {
+	case conn := <-s.idle:
+		return conn, true, nil
+	default:
+	}
+	if s.Dial == nil {
+		return nil, false, errors.New("no dialer for the dns upstream")
+	}
+	conn, err := s.dial(ctx)
+	return conn, false, err
+}
+
+// dial 使用服务的 ctx 连接 Upstream，ctx 只限制等待的时间，超时后连上的连接直接关闭
+func (s *Server) dial(ctx context.Context) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := s.Dial(s.ctx, "tcp", s.upstream())
+		ch <- result{conn, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.conn != nil {
+				_ = r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func (s *Server) putConn(conn net.Conn) {
+	select {
+	case s.idle <- conn:
+	default:
+		_ = conn.Close()
+	}
+}
+
+func (s *Server) closeIdle() {
+	for {
+		select {
+		case conn := <-s.idle:
+			_ = conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// exchangeConn 隧道中的流不支持超时设置，ctx 结束时直接关闭连接
+func exchangeConn(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	if err := writeMsg(conn, query); err != nil {
+		return nil, err
+	}
+	resp, err := readMsg(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 2 || resp[0] != query[0] || resp[1] != query[1] {
+		return nil, errors.New("dns response id mismatch")
+	}
+	return resp, nil
+}
+
+// resolveSystem 用系统的解析器构造应答，只支持常见的记录类型
+func (s *Server) resolveSystem(ctx context.Context, h dnsmessage.Header, q dnsmessage.Question) ([]byte, error) {
+	r := s.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	name := strings.TrimSuffix(q.Name.String(), ".")
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: systemTTL}
+
+	var answers []dnsmessage.Resource
+	var err error
+	switch q.Type {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+		// 同时查询两种地址，避免只有 A 记录的域名在查询 AAAA 时被当作不存在
+		ips, lookupErr := r.LookupNetIP(ctx, "ip", name)
+		err = lookupErr
+		for _, ip := range ips {
+			ip = ip.Unmap()
+			if q.Type == dnsmessage.TypeA && ip.Is4() {
+				answers = append(answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.AResource{A: ip.As4()}})
+			} else if q.Type == dnsmessage.TypeAAAA && ip.Is6() {
+				answers = append(answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.AAAAResource{AAAA: ip.As16()}})
+			}
+		}
+	case dnsmessage.TypeCNAME:
+		var cname string
+		if cname, err = r.LookupCNAME(ctx, name); err == nil {
+			answers = appendName(answers, rh, cname, func(n dnsmessage.Name) dnsmessage.ResourceBody {
+				return &dnsmessage.CNAMEResource{CNAME: n}
+			})
+		}
+	case dnsmessage.TypeTXT:
+		var txts []string
+		if txts, err = r.LookupTXT(ctx, name); err == nil {
+			for _, txt := range txts {
+				answers = append(answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.TXTResource{TXT: []string{txt}}})
+			}
+		}
+	case dnsmessage.TypeMX:
+		var mxs []*net.MX
+		if mxs, err = r.LookupMX(ctx, name); err == nil {
+			for _, mx := range mxs {
+				answers = appendName(answers, rh, mx.Host, func(n dnsmessage.Name) dnsmessage.ResourceBody {
+					return &dnsmessage.MXResource{Pref: mx.Pref, MX: n}
+				})
+			}
+		}
+	case dnsmessage.TypeNS:
+		var nss []*net.NS
+		if nss, err = r.LookupNS(ctx, name); err == nil {
+			for _, ns := range nss {
+				answers = appendName(answers, rh, ns.Host, func(n dnsmessage.Name) dnsmessage.ResourceBody {
+					return &dnsmessage.NSResource{NS: n}
+				})
+			}
+		}
+	default:
+		return newResponse(h, q, dnsmessage.RCodeNotImplemented, nil), nil
+	}
+
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return newResponse(h, q, dnsmessage.RCodeNameError, nil), nil
+		}
+		return nil, err
+	}
+	return newResponse(h, q, dnsmessage.RCodeSuccess, answers), nil
+}
+
+func appendName(answers []dnsmessage.Resource, rh dnsmessage.ResourceHeader, name string, body func(dnsmessage.Name) dnsmessage.ResourceBody) []dnsmessage.Resource {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return answers
+	}
+	return append(answers, dnsmessage.Resource{Header: rh, Body: body(n)})
+}
+
+func newResponse(h dnsmessage.Header, q dnsmessage.Question, rcode dnsmessage.RCode, answers []dnsmessage.Resource) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 h.ID,
+			Response:           true,
+			OpCode:             h.OpCode,
+			RecursionDesired:   h.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: []dnsmessage.Question{q},
+		Answers:   answers,
+	}
+	resp, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+// udpSize 客户端通过 EDNS 声明能接收的 UDP 应答大小
+func udpSize(query []byte) int {
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err != nil {
+		return minUDPSize
+	}
+	if p.SkipAllQuestions() != nil || p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+		return minUDPSize
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			return minUDPSize
+		}
+		if h.Type == dnsmessage.TypeOPT {
+			return max(minUDPSize, int(h.Class))
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return minUDPSize
+		}
+	}
+}
+
+// truncate 应答超过 size 时只保留问题并设置 TC，客户端会改用 TCP 重新查询
+func truncate(resp []byte, size int) []byte {
+	if len(resp) <= size {
+		return resp
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return resp[:size]
+	}
+	msg.Header.Truncated = true
+	msg.Answers, msg.Authorities, msg.Additionals = nil, nil, nil
+	truncated, err := msg.Pack()
+	if err != nil {
+		return resp[:size]
+	}
+	return truncated
+}
+
+// readMsg 读取一个 DNS over TCP 的消息，前两个字节是长度
+func readMsg(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeMsg(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,156 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startUpstream 启动一个 DNS over TCP 的服务，所有 A 查询都返回 10.1.2.3
+func startUpstream(t *testing.T, ttl uint32) (string, *atomic.Int32) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = lis.Close() })
+	var count atomic.Int32
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					query, err := readMsg(conn)
+					if err != nil {
+						return
+					}
+					count.Add(1)
+					var msg dnsmessage.Message
+					if err := msg.Unpack(query); err != nil {
+						return
+					}
+					q := msg.Questions[0]
+					rh := dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl}
+					msg.Header.Response = true
+					msg.Answers = []dnsmessage.Resource{{Header: rh, Body: &dnsmessage.AResource{A: [4]byte{10, 1, 2, 3}}}}
+					resp, _ := msg.Pack()
+					if err := writeMsg(conn, resp); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return lis.Addr().String(), &count
+}
+
+func newQuery(t *testing.T, id uint16, name string, typ dnsmessage.Type) []byte {
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}},
+	}
+	query, err := msg.Pack()
+	require.NoError(t, err)
+	return query
+}
+
+func parseAnswer(t *testing.T, resp []byte, id uint16) (dnsmessage.Message, []netip.Addr) {
+	var msg dnsmessage.Message
+	require.NoError(t, msg.Unpack(resp))
+	require.Equal(t, id, msg.Header.ID)
+	var addrs []netip.Addr
+	for _, rr := range msg.Answers {
+		if a, ok := rr.Body.(*dnsmessage.AResource); ok {
+			addrs = append(addrs, netip.AddrFrom4(a.A))
+		}
+	}
+	return msg, addrs
+}
+
+func TestExchange(t *testing.T) {
+	upstream, count := startUpstream(t, 300)
+	s := &Server{
+		Upstream: upstream,
+		Domains:  []string{"corp.local"},
+		Dial:     (&net.Dialer{}).DialContext,
+	}
+	ctx := context.Background()
+
+	// 命中 Domains 的查询发给 Upstream，第二次从缓存中返回
+	for i, id := range []uint16{1, 2} {
+		msg, addrs := parseAnswer(t, s.Exchange(ctx, newQuery(t, id, "DB.corp.local.", dnsmessage.TypeA)), id)
+		require.Equal(t, []netip.Addr{netip.MustParseAddr("10.1.2.3")}, addrs)
+		require.LessOrEqual(t, msg.Answers[0].Header.TTL, uint32(300))
+		require.EqualValues(t, 1, count.Load(), "query %d", i)
+	}
+
+	// 其余的查询使用系统的解析器
+	_, addrs := parseAnswer(t, s.Exchange(ctx, newQuery(t, 3, "localhost.", dnsmessage.TypeA)), 3)
+	require.Contains(t, addrs, netip.MustParseAddr("127.0.0.1"))
+	require.EqualValues(t, 1, count.Load())
+
+	// Upstream 不可用时返回 SERVFAIL
+	s = &Server{Upstream: "127.0.0.1:1", Dial: (&net.Dialer{}).DialContext}
+	msg, _ := parseAnswer(t, s.Exchange(ctx, newQuery(t, 4, "db.corp.local.", dnsmessage.TypeA)), 4)
+	require.Equal(t, dnsmessage.RCodeServerFailure, msg.Header.RCode)
+}
+
+func TestServerListen(t *testing.T) {
+	upstream, _ := startUpstream(t, 300)
+	s := &Server{Upstream: upstream, Dial: (&net.Dialer{}).DialContext}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := pc.LocalAddr().String()
+	_ = pc.Close()
+	require.NoError(t, s.Start(ctx, addr))
+
+	for _, network := range []string{"udp", "tcp"} {
+		conn, err := net.Dial(network, addr)
+		require.NoError(t, err)
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		query := newQuery(t, 7, "example.internal.", dnsmessage.TypeA)
+		var resp []byte
+		if network == "udp" {
+			_, err = conn.Write(query)
+			require.NoError(t, err)
+			buf := make([]byte, 1500)
+			n, err := conn.Read(buf)
+			require.NoError(t, err)
+			resp = buf[:n]
+		} else {
+			require.NoError(t, writeMsg(conn, query))
+			resp, err = readMsg(conn)
+			require.NoError(t, err)
+		}
+		_ = conn.Close()
+		_, addrs := parseAnswer(t, resp, 7)
+		require.Equal(t, []netip.Addr{netip.MustParseAddr("10.1.2.3")}, addrs, network)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	h := dnsmessage.Header{ID: 9}
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("big.test."), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET}
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60}
+	var answers []dnsmessage.Resource
+	for i := 0; i < 10; i++ {
+		answers = append(answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.TXTResource{TXT: []string{string(make([]byte, 200))}}})
+	}
+	resp := newResponse(h, q, dnsmessage.RCodeSuccess, answers)
+	require.Greater(t, len(resp), minUDPSize)
+
+	var msg dnsmessage.Message
+	require.NoError(t, msg.Unpack(truncate(resp, udpSize(newQuery(t, 9, "big.test.", dnsmessage.TypeTXT)))))
+	require.True(t, msg.Header.Truncated)
+	require.Empty(t, msg.Answers)
+}
@@ -0,0 +1,149 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "bs5"
+
+// Registry 隧道的指标，同时包含 Go 运行时和进程的指标
+var Registry = prometheus.NewRegistry()
+
+var (
+	activeStreams = promauto.With(Registry).NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_streams",
+		Help:      "Number of streams currently open through the tunnel.",
+	}, []string{"mode"})
+	streamBytes = promauto.With(Registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stream_bytes_total",
+		Help:      "Payload bytes transferred through the tunnel, direction is in (from remote) or out (to remote).",
+	}, []string{"mode", "direction"})
+	connectDuration = promauto.With(Registry).NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "connect_duration_seconds",
+		Help:      "Time taken to open a stream to the remote target through the tunnel.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"mode"})
+	dialFailures = promauto.With(Registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dial_failures_total",
+		Help:      "Failed attempts to open a stream through the tunnel by error class.",
+	}, []string{"mode", "reason"})
+	heartbeats = promauto.With(Registry).NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "heartbeats_sent_total",
+		Help:      "Heartbeat frames sent to the remote server.",
+	})
+	halfRequests = promauto.With(Registry).NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "half_requests_total",
+		Help:      "Upstream HTTP requests sent in half duplex mode.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// ObserveConnect 记录建立一个流的耗时
+func ObserveConnect(mode string, start time.Time) {
+	connectDuration.WithLabelValues(mode).Observe(time.Since(start).Seconds())
+}
+
+// DialFailed 记录一次建立流失败，reason 是错误的类别
+func DialFailed(mode, reason string) {
+	dialFailures.WithLabelValues(mode, reason).Inc()
+}
+
+func HeartbeatSent() {
+	heartbeats.Inc()
+}
+
+func HalfRequestSent() {
+	halfRequests.Inc()
+}
+
+// NewStream 统计流的数据量，关闭前计入 active_streams
+func NewStream(mode string, rw io.ReadWriteCloser) io.ReadWriteCloser {
+	activeStreams.WithLabelValues(mode).Inc()
+	return &stream{
+		ReadWriteCloser: rw,
+		mode:            mode,
+		in:              streamBytes.WithLabelValues(mode, "in"),
+		out:             streamBytes.WithLabelValues(mode, "out"),
+	}
+}
+
+type stream struct {
+	io.ReadWriteCloser
+	mode    string
+	in, out prometheus.Counter
+	once    sync.Once
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+	n, err := s.ReadWriteCloser.Read(p)
+	s.in.Add(float64(n))
+	return n, err
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	n, err := s.ReadWriteCloser.Write(p)
+	s.out.Add(float64(n))
+	return n, err
+}
+
+// CloseWrite 被包装的流不支持半关闭时返回 errors.ErrUnsupported
+func (s *stream) CloseWrite() error {
+	if cw, ok := s.ReadWriteCloser.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+func (s *stream) Close() error {
+	s.once.Do(func() {
+		activeStreams.WithLabelValues(s.mode).Dec()
+	})
+	return s.ReadWriteCloser.Close()
+}
+
+// Handler 以 Prometheus 的文本格式输出 Registry 中的指标
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// Serve 在 address 上监听，通过 /metrics 提供指标，ctx 结束时关闭
+func Serve(ctx context.Context, address string) error {
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	return nil
+}
@@ -0,0 +1,347 @@
+package netrans
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	CipherAESGCM           = "aes-gcm"
+	CipherChaCha20Poly1305 = "chacha20-poly1305"
+)
+
+const (
+	cipherIDAESGCM           byte = 0x01
+	cipherIDChaCha20Poly1305 byte = 0x02
+)
+
+// sealedFlag 标记在长度字段的最高位，明文帧的长度不会超过 32M，因此不会和旧的格式冲突
+const sealedFlag uint32 = 1 << 31
+
+var (
+	ErrAuthFailed     = errors.New("failed to decrypt frame, the key may be wrong")
+	ErrCipherMismatch = errors.New("cipher mismatch between client and server")
+	ErrUnsealedFrame  = errors.New("unexpected unencrypted frame")
+	ErrNoKeyForSealed = errors.New("got encrypted frame but no key configured")
+	ErrFrameOrder     = errors.New("encrypted frame out of order, it may be replayed or dropped")
+	ErrReplayed       = errors.New("encrypted body has been received before")
+)
+
+const (
+	// saltSize 每个请求体或响应体随机生成的 salt，用于派生这一串帧使用的密钥
+	saltSize = 16
+	// seqSize 帧序号，大端序，同时作为 nonce 的最后 8 字节
+	seqSize = 8
+	// sealedHeaderSize 参与认证的帧头，length (4) + cipher id (1) + salt + seq
+	sealedHeaderSize = 5 + saltSize + seqSize
+)
+
+// 两个方向使用不同的标签派生密钥，一个方向的帧无法被反射到另一个方向
+const (
+	labelClient = "bs5 client to server"
+	labelServer = "bs5 server to client"
+)
+
+// Codec 负责数据帧的编码与解码
+type Codec interface {
+	Encode(data []byte) []byte
+	ReadFrame(r io.Reader) (*DataFrame, error)
+}
+
+type xorCodec struct{}
+
+// XORCodec 原有的单字节异或混淆
+var XORCodec Codec = xorCodec{}
+
+func (xorCodec) Encode(data []byte) []byte {
+	return NewDataFrame(data).MarshalBinary()
+}
+
+func (xorCodec) ReadFrame(r io.Reader) (*DataFrame, error) {
+	return ReadFrame(r)
+}
+
+// AEADCodec 使用预共享密钥对每一帧进行认证加密，帧格式为
+// length|0x80000000 (4) + cipher id (1) + salt (16) + seq (8) + ciphertext，其中密文之前的部分作为附加数据参与认证。
+// 每个请求体或响应体随机生成 salt，通过 HKDF 从预共享密钥、salt 和发送方向派生出这一串帧使用的密钥，nonce 为帧序号。
+// 单独编码的帧序号为 0，一个请求体或响应体中连续的帧需要通过 Stream 编解码
+type AEADCodec struct {
+	id      byte
+	secret  []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+	// send recv 发送和接收时派生密钥使用的标签
+	send, recv string
+	replay     *replayFilter
+	// server 服务端使用的编解码器，为空时自身就是服务端的
+	server *AEADCodec
+}
+
+// NewAEADCodec 根据算法名称和预共享密钥创建客户端使用的加密编解码器，服务端需要通过 Server 取得对应的编解码器
+func NewAEADCodec(method, key string) (*AEADCodec, error) {
+	if key == "" {
+		return nil, errors.New("empty key")
+	}
+	c := &AEADCodec{secret: []byte(key), send: labelClient, recv: labelServer, replay: newReplayFilter()}
+	switch strings.ToLower(method) {
+	case "", CipherAESGCM:
+		c.id = cipherIDAESGCM
+		c.newAEAD = func(key []byte) (cipher.AEAD, error) {
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+			return cipher.NewGCM(block)
+		}
+	case CipherChaCha20Poly1305:
+		c.id = cipherIDChaCha20Poly1305
+		c.newAEAD = chacha20poly1305.New
+	default:
+		return nil, fmt.Errorf("unsupported cipher %s", method)
+	}
+	// 检查算法和密钥长度是否可用，之后派生密钥时不会再出错
+	if _, err := c.newAEAD(make([]byte, keySize)); err != nil {
+		return nil, err
+	}
+	server := *c
+	server.send, server.recv = c.recv, c.send
+	c.server = &server
+	return c, nil
+}
+
+// Server 返回服务端使用的编解码器，发送和接收的方向与客户端相反，重放检测的记录是共享的
+func (c *AEADCodec) Server() *AEADCodec {
+	if c.server == nil {
+		return c
+	}
+	return c.server
+}
+
+// keySize 派生出的密钥长度，AES-256-GCM 和 ChaCha20-Poly1305 都使用 32 字节
+const keySize = 32
+
+// derive 根据 salt 和方向标签派生一串帧使用的 AEAD
+func (c *AEADCodec) derive(salt []byte, label string) cipher.AEAD {
+	key, err := hkdf.Key(sha256.New, c.secret, salt, label, keySize)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := c.newAEAD(key)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+// Encode 单独编码一帧，使用新的 salt，序号为 0
+func (c *AEADCodec) Encode(data []byte) []byte {
+	return c.Stream().Encode(data)
+}
+
+// ReadFrame 只接受加密帧，避免协商后被降级为明文。单独读取时只接受序号为 0 的帧
+func (c *AEADCodec) ReadFrame(r io.Reader) (*DataFrame, error) {
+	return c.readSealed(r, &opener{})
+}
+
+// Stream 返回用于一串连续的帧的编解码器
+func (c *AEADCodec) Stream() Codec {
+	return &aeadStream{codec: c}
+}
+
+func (c *AEADCodec) readSealed(r io.Reader, o *opener) (*DataFrame, error) {
+	fr, err := readAnyFrame(r, c, o)
+	if err != nil {
+		return nil, err
+	}
+	if !fr.Sealed {
+		return nil, ErrUnsealedFrame
+	}
+	return fr, nil
+}
+
+// aeadStream 一个请求体或响应体中连续的加密帧。发送时使用自己的 salt 并从 0 开始编号，调用方需要保证编码的顺序与写入的顺序一致；
+// 接收时记录第一帧的 salt，之后的帧 salt 必须相同且序号连续，被重放、调换顺序或者丢弃的帧都无法通过校验
+type aeadStream struct {
+	codec *AEADCodec
+
+	mu   sync.Mutex
+	salt []byte
+	aead cipher.AEAD
+	next uint64
+
+	recv opener
+}
+
+func (s *aeadStream) Encode(data []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aead == nil {
+		s.salt = make([]byte, saltSize)
+		_, _ = rand.Read(s.salt)
+		s.aead = s.codec.derive(s.salt, s.codec.send)
+	}
+	seq := s.next
+	s.next++
+
+	length := saltSize + seqSize + len(data) + s.aead.Overhead()
+	result := make([]byte, 5, 5+length)
+	binary.BigEndian.PutUint32(result, uint32(length)|sealedFlag)
+	result[4] = s.codec.id
+	result = append(result, s.salt...)
+	result = binary.BigEndian.AppendUint64(result, seq)
+	return s.aead.Seal(result, nonce(s.aead, seq), data, result)
+}
+
+func (s *aeadStream) ReadFrame(r io.Reader) (*DataFrame, error) {
+	return s.codec.readSealed(r, &s.recv)
+}
+
+// nonce 序号放在最后 8 字节，其余部分为 0。每一串帧的密钥都不同，序号不会重复
+func nonce(aead cipher.AEAD, seq uint64) []byte {
+	n := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(n[len(n)-seqSize:], seq)
+	return n
+}
+
+// opener 接收方的一串帧，记录第一帧的 salt 和派生出的密钥，以及期望的下一个序号
+type opener struct {
+	mu   sync.Mutex
+	salt []byte
+	aead cipher.AEAD
+	next uint64
+}
+
+func (o *opener) open(c *AEADCodec, header []byte, ciphertext []byte) ([]byte, error) {
+	if header[4] != c.id {
+		return nil, ErrCipherMismatch
+	}
+	salt := header[5 : 5+saltSize]
+	seq := binary.BigEndian.Uint64(header[5+saltSize:])
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	aead := o.aead
+	if aead == nil {
+		if seq != 0 {
+			return nil, ErrFrameOrder
+		}
+		aead = c.derive(salt, c.recv)
+	} else if !bytes.Equal(salt, o.salt) || seq != o.next {
+		return nil, ErrFrameOrder
+	}
+	data, err := aead.Open(nil, nonce(aead, seq), ciphertext, header)
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+	if o.aead == nil {
+		// 通过认证后才记录 salt，伪造的帧不会占用重放检测的记录
+		if !c.replay.check(salt) {
+			return nil, ErrReplayed
+		}
+		o.salt = append([]byte(nil), salt...)
+		o.aead = aead
+	}
+	o.next = seq + 1
+	return data, nil
+}
+
+// replayWindow 每个 salt 至少记录的时长，超过 replayMaxEntries 时提前轮换
+const (
+	replayWindow     = 10 * time.Minute
+	replayMaxEntries = 1 << 18
+)
+
+// replayFilter 记录最近收到的 salt，同一个请求体或响应体不能被完整地重放。两代记录轮换，内存占用有上限
+type replayFilter struct {
+	mu      sync.Mutex
+	current map[[saltSize]byte]struct{}
+	prev    map[[saltSize]byte]struct{}
+	rotated time.Time
+}
+
+func newReplayFilter() *replayFilter {
+	return &replayFilter{current: make(map[[saltSize]byte]struct{}), rotated: time.Now()}
+}
+
+// check 第一次见到 salt 时返回 true
+func (f *replayFilter) check(salt []byte) bool {
+	key := [saltSize]byte(salt)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Since(f.rotated) > replayWindow || len(f.current) >= replayMaxEntries {
+		f.prev, f.current = f.current, make(map[[saltSize]byte]struct{})
+		f.rotated = time.Now()
+	}
+	if _, ok := f.current[key]; ok {
+		return false
+	}
+	if _, ok := f.prev[key]; ok {
+		return false
+	}
+	f.current[key] = struct{}{}
+	return true
+}
+
+// NewStream 为一个请求体或响应体中连续的帧创建编解码器，加密时编码和解码分别维护序号，否则原样返回
+func NewStream(codec Codec) Codec {
+	if s, ok := codec.(interface{ Stream() Codec }); ok {
+		return s.Stream()
+	}
+	return codec
+}
+
+// ReadAnyFrame 同时支持明文和加密帧，aead 为空时遇到加密帧会返回错误。加密帧作为单独的一帧读取，序号必须为 0
+func ReadAnyFrame(r io.Reader, aead *AEADCodec) (*DataFrame, error) {
+	return readAnyFrame(r, aead, &opener{})
+}
+
+func readAnyFrame(r io.Reader, aead *AEADCodec, o *opener) (*DataFrame, error) {
+	var header [sealedHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:4]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length&sealedFlag == 0 {
+		return readPlainFrame(r, length)
+	}
+
+	length &^= sealedFlag
+	if length > maxFrameLength {
+		return nil, fmt.Errorf("frame is too big, %d", length)
+	}
+	if length < saltSize+seqSize {
+		return nil, ErrAuthFailed
+	}
+	if _, err := io.ReadFull(r, header[4:]); err != nil {
+		return nil, fmt.Errorf("read type error %v", err)
+	}
+	payload := make([]byte, length-saltSize-seqSize)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("read data error: %v", err)
+	}
+	if aead == nil {
+		return nil, ErrNoKeyForSealed
+	}
+	data, err := o.open(aead, header[:], payload)
+	if err != nil {
+		return nil, err
+	}
+	return &DataFrame{
+		Length: uint32(len(data)),
+		Obs:    header[4],
+		Data:   data,
+		Sealed: true,
+	}, nil
+}
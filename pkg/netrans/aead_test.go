@@ -0,0 +1,125 @@
+package netrans
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAEADCodec(t *testing.T) {
+	assert := require.New(t)
+	data := []byte("hello")
+
+	for _, method := range []string{CipherAESGCM, CipherChaCha20Poly1305} {
+		codec, err := NewAEADCodec(method, "secret")
+		assert.NoError(err)
+		bin := codec.Encode(data)
+		assert.False(bytes.Contains(bin, data))
+
+		fr, err := codec.Server().ReadFrame(bytes.NewReader(bin))
+		assert.NoError(err)
+		assert.True(fr.Sealed)
+		assert.Equal(data, fr.Data)
+
+		// 每一帧使用不同的 salt
+		assert.NotEqual(bin, codec.Encode(data))
+
+		// 服务端发送的帧客户端可以读取，但是不能被反射回服务端
+		bin = codec.Server().Encode(data)
+		_, err = codec.Server().ReadFrame(bytes.NewReader(bin))
+		assert.ErrorIs(err, ErrAuthFailed)
+		fr, err = codec.ReadFrame(bytes.NewReader(bin))
+		assert.NoError(err)
+		assert.Equal(data, fr.Data)
+	}
+}
+
+func TestAEADReplay(t *testing.T) {
+	assert := require.New(t)
+	codec, _ := NewAEADCodec(CipherAESGCM, "secret")
+	server := codec.Server()
+	bin := codec.Encode([]byte("hello"))
+	_, err := server.ReadFrame(bytes.NewReader(bin))
+	assert.NoError(err)
+	// 完整的请求体被重放也会被拒绝
+	_, err = server.ReadFrame(bytes.NewReader(bin))
+	assert.ErrorIs(err, ErrReplayed)
+
+	sender := NewStream(codec)
+	body := append(sender.Encode([]byte{0}), sender.Encode([]byte{1})...)
+	for i, want := range []error{nil, ErrReplayed} {
+		receiver := NewStream(server)
+		_, err := receiver.ReadFrame(bytes.NewReader(body))
+		assert.ErrorIs(err, want, i)
+	}
+}
+
+func TestAEADCodecMismatch(t *testing.T) {
+	assert := require.New(t)
+	codec, _ := NewAEADCodec(CipherAESGCM, "secret")
+	bin := codec.Encode([]byte("hello"))
+
+	wrong, _ := NewAEADCodec(CipherAESGCM, "wrong")
+	_, err := wrong.Server().ReadFrame(bytes.NewReader(bin))
+	assert.ErrorIs(err, ErrAuthFailed)
+
+	chacha, _ := NewAEADCodec(CipherChaCha20Poly1305, "secret")
+	_, err = chacha.Server().ReadFrame(bytes.NewReader(bin))
+	assert.ErrorIs(err, ErrCipherMismatch)
+
+	_, err = ReadFrame(bytes.NewReader(bin))
+	assert.Error(err)
+	_, err = ReadAnyFrame(bytes.NewReader(bin), nil)
+	assert.ErrorIs(err, ErrNoKeyForSealed)
+
+	plain := NewDataFrame([]byte("hello")).MarshalBinary()
+	_, err = codec.ReadFrame(bytes.NewReader(plain))
+	assert.ErrorIs(err, ErrUnsealedFrame)
+	fr, err := ReadAnyFrame(bytes.NewReader(plain), codec)
+	assert.NoError(err)
+	assert.False(fr.Sealed)
+}
+
+func TestAEADStream(t *testing.T) {
+	assert := require.New(t)
+	newFrames := func() [][]byte {
+		codec, _ := NewAEADCodec(CipherAESGCM, "secret")
+		sender := NewStream(codec)
+		frames := make([][]byte, 3)
+		for i := range frames {
+			frames[i] = sender.Encode([]byte{byte(i)})
+		}
+		return frames
+	}
+	// 每次读取使用新的编解码器，不受重放检测的影响
+	var codec *AEADCodec
+	read := func(frames ...[]byte) error {
+		codec, _ = NewAEADCodec(CipherAESGCM, "secret")
+		r := bytes.NewReader(bytes.Join(frames, nil))
+		receiver := NewStream(codec.Server())
+		for range frames {
+			if _, err := receiver.ReadFrame(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	frames := newFrames()
+	assert.NoError(read(frames...))
+	// 重放、调换顺序、丢弃以及从中间开始的帧都会被拒绝
+	assert.ErrorIs(read(frames[0], frames[0]), ErrFrameOrder)
+	assert.ErrorIs(read(frames[0], frames[2], frames[1]), ErrFrameOrder)
+	assert.ErrorIs(read(frames[0], frames[2]), ErrFrameOrder)
+	assert.ErrorIs(read(frames[1]), ErrFrameOrder)
+	// 另一串帧的第一帧也不能插入
+	assert.ErrorIs(read(frames[0], newFrames()[0]), ErrFrameOrder)
+	_, err := codec.Server().ReadFrame(bytes.NewReader(frames[1]))
+	assert.ErrorIs(err, ErrFrameOrder)
+
+	// 单独编码的帧可以作为一串帧的第一帧
+	assert.NoError(read(newFrames()[0]))
+	// 未加密时原样返回
+	assert.Equal(XORCodec, NewStream(XORCodec))
+}
@@ -7,10 +7,14 @@ import (
 	"io"
 )
 
+const maxFrameLength = 1024 * 1024 * 32
+
 type DataFrame struct {
 	Length uint32
 	Obs    byte
 	Data   []byte
+	// Sealed 表示该帧是否经过 AEAD 加密
+	Sealed bool
 }
 
 func NewDataFrame(data []byte) *DataFrame {
@@ -41,10 +45,15 @@ func ReadFrame(r io.Reader) (*DataFrame, error) {
 	if err != nil {
 		return nil, err
 	}
+	return readPlainFrame(r, binary.BigEndian.Uint32(bs[:]))
+}
+
+func readPlainFrame(r io.Reader, length uint32) (*DataFrame, error) {
+	var bs [1]byte
 	fr := &DataFrame{}
 
-	fr.Length = binary.BigEndian.Uint32(bs[:])
-	if fr.Length > 1024*1024*32 {
+	fr.Length = length
+	if fr.Length > maxFrameLength {
 		return nil, fmt.Errorf("frame is too big, %d", fr.Length)
 	}
 	n, err := r.Read(bs[:1])
@@ -0,0 +1,227 @@
+package route
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/PurpleNewNew/bs5/internal/proxyclient"
+	"github.com/gobwas/glob"
+	"github.com/pkg/errors"
+)
+
+// 内置的动作，其他名字表示 upstreams 中配置的上游代理链
+const (
+	ActionTunnel = "tunnel"
+	ActionDirect = "direct"
+	ActionReject = "reject"
+)
+
+// 规则的类型
+const (
+	TypeDomain        = "domain"
+	TypeDomainSuffix  = "domain-suffix"
+	TypeDomainKeyword = "domain-keyword"
+	TypeIPCIDR        = "ip-cidr"
+	TypePort          = "port"
+)
+
+var ErrRejected = errors.New("rejected by route rule")
+
+// Rule 一条路由规则，格式为 type,value,action，例如 domain-suffix,corp.local,tunnel
+type Rule struct {
+	Type   string
+	Value  string
+	Action string
+
+	match func(host string, ip net.IP, port int) bool
+}
+
+func (r *Rule) String() string {
+	return r.Type + "," + r.Value + "," + r.Action
+}
+
+// ParseRule 解析一条规则，类型和动作不区分大小写。ip-cidr 只匹配 IP 形式的地址，不会在本地解析域名
+func ParseRule(s string) (*Rule, error) {
+	// value 可能是带有逗号的 glob，例如 domain,*.{a,b}.com,direct
+	first, last := strings.Index(s, ","), strings.LastIndex(s, ",")
+	if first == -1 || first == last {
+		return nil, fmt.Errorf("invalid rule %q, expected type,value,action", s)
+	}
+	r := &Rule{
+		Type:   strings.ToLower(strings.TrimSpace(s[:first])),
+		Value:  strings.TrimSpace(s[first+1 : last]),
+		Action: strings.ToLower(strings.TrimSpace(s[last+1:])),
+	}
+	if r.Value == "" || r.Action == "" {
+		return nil, fmt.Errorf("invalid rule %q, expected type,value,action", s)
+	}
+
+	switch r.Type {
+	case TypeDomain:
+		g, err := glob.Compile(strings.ToLower(r.Value))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid rule %q", s)
+		}
+		r.match = func(host string, _ net.IP, _ int) bool {
+			return g.Match(host)
+		}
+	case TypeDomainSuffix:
+		suffix := strings.ToLower(strings.TrimPrefix(r.Value, "."))
+		r.match = func(host string, _ net.IP, _ int) bool {
+			return host == suffix || strings.HasSuffix(host, "."+suffix)
+		}
+	case TypeDomainKeyword, "keyword":
+		r.Type = TypeDomainKeyword
+		keyword := strings.ToLower(r.Value)
+		r.match = func(host string, _ net.IP, _ int) bool {
+			return strings.Contains(host, keyword)
+		}
+	case TypeIPCIDR:
+		_, ipNet, err := net.ParseCIDR(r.Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid rule %q", s)
+		}
+		r.match = func(_ string, ip net.IP, _ int) bool {
+			return ip != nil && ipNet.Contains(ip)
+		}
+	case TypePort:
+		low, high, err := parsePortRange(r.Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid rule %q", s)
+		}
+		r.match = func(_ string, _ net.IP, port int) bool {
+			return port >= low && port <= high
+		}
+	default:
+		return nil, fmt.Errorf("invalid rule %q, unknown type %s", s, r.Type)
+	}
+	return r, nil
+}
+
+// parsePortRange 解析单个端口或者 1000-2000 形式的端口范围
+func parsePortRange(s string) (int, int, error) {
+	lowStr, highStr, isRange := strings.Cut(s, "-")
+	low, err := strconv.ParseUint(strings.TrimSpace(lowStr), 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	high := low
+	if isRange {
+		if high, err = strconv.ParseUint(strings.TrimSpace(highStr), 10, 16); err != nil {
+			return 0, 0, err
+		}
+	}
+	if low > high {
+		return 0, 0, fmt.Errorf("invalid port range %s", s)
+	}
+	return int(low), int(high), nil
+}
+
+// Router 按顺序匹配规则，第一条命中的规则决定连接方式，都没有命中时使用默认动作
+type Router struct {
+	rules     []*Rule
+	final     string
+	upstreams map[string]proxyclient.Dial
+	direct    proxyclient.Dial
+}
+
+// New 创建路由，upstreams 为上游代理链的名字到代理地址的映射，final 为空时默认走隧道
+func New(rules []string, upstreams map[string][]string, final string) (*Router, error) {
+	r := &Router{
+		final:     strings.ToLower(strings.TrimSpace(final)),
+		upstreams: make(map[string]proxyclient.Dial),
+		direct:    (&net.Dialer{}).DialContext,
+	}
+	if r.final == "" {
+		r.final = ActionTunnel
+	}
+	for name, proxies := range upstreams {
+		name = strings.ToLower(name)
+		if name == ActionTunnel || name == ActionDirect || name == ActionReject {
+			return nil, fmt.Errorf("upstream name %s is reserved", name)
+		}
+		urls := make([]*url.URL, 0, len(proxies))
+		for _, p := range proxies {
+			u, err := url.Parse(p)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid proxy of upstream %s", name)
+			}
+			urls = append(urls, u)
+		}
+		dial, err := proxyclient.NewClientChain(urls)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid upstream %s", name)
+		}
+		r.upstreams[name] = dial
+	}
+	for _, s := range rules {
+		rule, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.checkAction(rule.Action); err != nil {
+			return nil, errors.Wrapf(err, "invalid rule %q", s)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	if err := r.checkAction(r.final); err != nil {
+		return nil, errors.Wrap(err, "invalid default route")
+	}
+	return r, nil
+}
+
+func (r *Router) checkAction(action string) error {
+	switch action {
+	case ActionTunnel, ActionDirect, ActionReject:
+		return nil
+	}
+	if _, ok := r.upstreams[action]; !ok {
+		return fmt.Errorf("unknown action or upstream %s", action)
+	}
+	return nil
+}
+
+// Match 返回 host:port 对应的动作以及命中的规则，没有命中时规则为 nil
+func (r *Router) Match(host string, port int) (string, *Rule) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	for _, rule := range r.rules {
+		if rule.match(host, ip, port) {
+			return rule.Action, rule
+		}
+	}
+	return r.final, nil
+}
+
+// MatchAddress 与 Match 相同，参数为 host:port 形式的地址
+func (r *Router) MatchAddress(address string) (string, *Rule, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", nil, err
+	}
+	action, rule := r.Match(host, port)
+	return action, rule, nil
+}
+
+// Dial 使用 direct 或上游代理链连接目标，tunnel 需要由调用方处理
+func (r *Router) Dial(ctx context.Context, action, network, address string) (net.Conn, error) {
+	switch action {
+	case ActionDirect:
+		return r.direct(ctx, network, address)
+	case ActionReject:
+		return nil, ErrRejected
+	}
+	dial, ok := r.upstreams[action]
+	if !ok {
+		return nil, fmt.Errorf("unknown upstream %s", action)
+	}
+	return dial(ctx, network, address)
+}
@@ -0,0 +1,64 @@
+package route
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouterMatch(t *testing.T) {
+	r, err := New([]string{
+		"domain,*.{google,facebook}.com,direct",
+		"domain-suffix,corp.local,tunnel",
+		"keyword,ads,reject",
+		"ip-cidr,10.0.0.0/8,tunnel",
+		"ip-cidr,fd00::/8,tunnel",
+		"port,25,reject",
+		"port,8000-8100,up",
+	}, map[string][]string{"up": {"socks5://127.0.0.1:1080"}}, "direct")
+	require.NoError(t, err)
+
+	cases := []struct {
+		host   string
+		port   int
+		action string
+	}{
+		{"www.google.com", 443, ActionDirect},
+		{"corp.local", 80, ActionTunnel},
+		{"git.CORP.local.", 22, ActionTunnel},
+		{"notcorp.local", 80, ActionDirect},
+		{"myads.example.com", 80, ActionReject},
+		{"10.1.2.3", 80, ActionTunnel},
+		{"fd00::1", 80, ActionTunnel},
+		{"11.1.2.3", 25, ActionReject},
+		{"example.com", 8080, "up"},
+		{"example.com", 8101, ActionDirect},
+	}
+	for _, c := range cases {
+		action, _ := r.Match(c.host, c.port)
+		require.Equal(t, c.action, action, "%s:%d", c.host, c.port)
+	}
+
+	action, rule, err := r.MatchAddress("[fd00::2]:443")
+	require.NoError(t, err)
+	require.Equal(t, ActionTunnel, action)
+	require.Equal(t, "ip-cidr,fd00::/8,tunnel", rule.String())
+}
+
+func TestRouterInvalid(t *testing.T) {
+	for _, rules := range [][]string{
+		{"domain,example.com"},
+		{"unknown,example.com,direct"},
+		{"ip-cidr,10.0.0.0/33,tunnel"},
+		{"port,100-10,direct"},
+		{"port,70000,direct"},
+		{"domain,example.com,missing"},
+	} {
+		_, err := New(rules, nil, "")
+		require.Error(t, err, "%v", rules)
+	}
+	_, err := New(nil, map[string][]string{"direct": {"socks5://127.0.0.1:1080"}}, "")
+	require.Error(t, err)
+	_, err = New(nil, nil, "nowhere")
+	require.Error(t, err)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/PurpleNewNew/bs5/pkg/core"
+	log "github.com/kataras/golog"
+)
+
+// serveFull 全双工模式，一个请求的请求体和响应体分别承载上行与下行数据
+func (h *Handler) serveFull(w http.ResponseWriter, r *http.Request) {
+	m, action, err := readBodyFrame(r)
+	if err == nil && action == core.ActionMux {
+		h.serveMux(w, r, core.IsFlowControl(m))
+		return
+	}
+	if err == nil && action == core.ActionListen {
+		h.serveListen(w, r, m, true)
+		return
+	}
+	if err == nil && action == core.ActionResume && h.ResumeTimeout > 0 {
+		h.serveResume(w, r, m)
+		return
+	}
+	if err != nil || action != core.ActionCreate {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	_ = rc.EnableFullDuplex()
+	w.Header().Set("X-Accel-Buffering", "no")
+	fw := h.newFrameWriter(w)
+	if len(m["u"]) != 0 {
+		h.serveFullUDP(r, fw)
+		return
+	}
+
+	conn, err := h.dialTarget(r, m)
+	if err != nil {
+		log.Debugf("dial target error, %s", err)
+		_ = fw.WriteFrame(newStatus(0x01))
+		_ = rc.SetReadDeadline(time.Now())
+		return
+	}
+	if len(m["rs"]) != 0 && h.ResumeTimeout > 0 {
+		s := h.newResumableSession(string(m["id"]), conn)
+		gen, _ := s.attach(0)
+		status := newStatus(0x00)
+		status["rs"] = []byte{0x01}
+		h.serveResumable(w, r, s, gen, status)
+		return
+	}
+	defer conn.Close()
+	if err := fw.WriteFrame(newStatus(0x00)); err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer conn.Close()
+		h.readFullRequest(r, rc, conn)
+	}()
+
+	pipeSocket(conn, fw, "")
+	_ = fw.WriteFrame(newDel())
+
+	// 目标连接已经断开，打断仍在阻塞的请求体读取，避免 handler 返回后还在读 Body。
+	// 客户端收到 del 后会结束请求体，留出一段时间读完，连接才可以被复用
+	_ = rc.SetReadDeadline(time.Now().Add(drainTimeout))
+	wg.Wait()
+}
+
+func (h *Handler) readFullRequest(r *http.Request, rc *http.ResponseController, conn net.Conn) {
+	for {
+		m, action, err := readBodyFrame(r)
+		if err != nil {
+			return
+		}
+		switch action {
+		case core.ActionData:
+			if data := m["dt"]; len(data) != 0 {
+				if _, err := conn.Write(data); err != nil {
+					return
+				}
+			}
+			if core.IsCloseWrite(m) {
+				closeWrite(conn)
+			}
+		case core.ActionDelete:
+			_ = conn.Close()
+			drainRequest(r, rc)
+			return
+		case core.ActionHeartbeat:
+			continue
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+
+	"github.com/PurpleNewNew/bs5/pkg/core"
+	log "github.com/kataras/golog"
+)
+
+// serveHalf 半双工模式，创建连接的请求持续返回下行数据，上行数据通过额外的请求发送
+func (h *Handler) serveHalf(w http.ResponseWriter, r *http.Request) {
+	m, action, err := readBodyFrame(r)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if redirect := h.nextHop(r, m); redirect != "" {
+		h.serveRedirect(w, r, m, action, redirect)
+		return
+	}
+
+	id := string(m["id"])
+	switch action {
+	case core.ActionCreate:
+		h.serveHalfCreate(w, r, id, m)
+	case core.ActionListen:
+		h.serveListen(w, r, m, false)
+	case core.ActionData:
+		if err := h.writeSession(id, m); errors.Is(err, errNoSession) {
+			_ = h.newFrameWriter(w).WriteFrame(newDel())
+		}
+	case core.ActionDatagram:
+		if err := h.writeDatagram(id, m); errors.Is(err, errNoSession) {
+			_ = h.newFrameWriter(w).WriteFrame(newDel())
+		}
+	case core.ActionDelete:
+		h.closeSession(id)
+	case core.ActionBatch:
+		h.serveHalfBatch(w, m["dt"])
+	case core.ActionHeartbeat:
+	default:
+		w.WriteHeader(http.StatusForbidden)
+	}
+}
+
+var errNoSession = errors.New("no such session")
+
+func (h *Handler) writeSession(id string, m map[string][]byte) error {
+	s, ok := h.sessions.Load(id)
+	if !ok {
+		return errNoSession
+	}
+	data, cw := m["dt"], core.IsCloseWrite(m)
+	if len(data) == 0 && !cw {
+		return nil
+	}
+	if s.(*session).udp != nil {
+		return errInvalidAction
+	}
+	if len(data) != 0 {
+		if _, err := s.(*session).Write(data); err != nil {
+			log.Debugf("write to target error, %s", err)
+			return err
+		}
+	}
+	if cw {
+		s.(*session).CloseWrite()
+	}
+	return nil
+}
+
+func (h *Handler) closeSession(id string) {
+	if s, ok := h.sessions.Load(id); ok {
+		_ = s.(*session).Close()
+	}
+}
+
+// serveHalfBatch 依次处理批量请求中的每一帧，按顺序在 s 字段中返回每一帧的结果，0 表示成功
+func (h *Handler) serveHalfBatch(w http.ResponseWriter, data []byte) {
+	r := bytes.NewReader(data)
+	var status []byte
+	for r.Len() != 0 {
+		m, action, err := readRequestFrame(h.codec(), r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		id := string(m["id"])
+		result := byte(0x00)
+		switch action {
+		case core.ActionData:
+			if h.writeSession(id, m) != nil {
+				result = 0x01
+			}
+		case core.ActionDatagram:
+			if h.writeDatagram(id, m) != nil {
+				result = 0x01
+			}
+		case core.ActionDelete:
+			h.closeSession(id)
+		case core.ActionHeartbeat:
+		default:
+			result = 0x01
+		}
+		status = append(status, result)
+	}
+	_ = h.newFrameWriter(w).WriteFrame(map[string][]byte{"ac": {core.ActionBatch}, "s": status})
+}
+
+func (h *Handler) serveHalfCreate(w http.ResponseWriter, r *http.Request, id string, m map[string][]byte) {
+	w.Header().Set("X-Accel-Buffering", "no")
+	fw := h.newFrameWriter(w)
+	if len(m["u"]) != 0 {
+		h.serveHalfUDP(r, id, fw)
+		return
+	}
+
+	conn, err := h.dialTarget(r, m)
+	if err != nil {
+		log.Debugf("dial target error, %s", err)
+		_ = fw.WriteFrame(newStatus(0x01))
+		return
+	}
+	h.sessions.Store(id, &session{conn: conn})
+	defer func() {
+		h.sessions.Delete(id)
+		_ = conn.Close()
+	}()
+
+	if err := fw.WriteFrame(newStatus(0x00)); err != nil {
+		return
+	}
+
+	// 客户端断开时关闭目标连接，结束下面的读取
+	go func() {
+		<-r.Context().Done()
+		_ = conn.Close()
+	}()
+
+	pipeSocket(conn, fw, "")
+	_ = fw.WriteFrame(newDel())
+}
@@ -0,0 +1,329 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/PurpleNewNew/bs5/pkg/camouflage"
+	"github.com/PurpleNewNew/bs5/pkg/core"
+	"github.com/PurpleNewNew/bs5/pkg/netrans"
+	log "github.com/kataras/golog"
+)
+
+// Handler 是 suo5 协议的 Go 服务端实现，行为与 assets/webshell 中的脚本保持一致，
+// 可以直接挂载到任意的 http.ServeMux 上使用
+type Handler struct {
+	// UserAgent 非空时只处理 User-Agent 完全一致的请求，与脚本中的校验逻辑相同
+	UserAgent string
+	// DialTimeout 连接目标地址的超时时间
+	DialTimeout time.Duration
+	// Dial 用于连接目标地址，为空时使用 net.Dialer
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+	// Listen 用于反向转发时在服务端监听，为空时使用 net.Listen
+	Listen func(network, address string) (net.Listener, error)
+	// ListenPacket 用于转发 UDP 数据报，为空时使用 net.ListenPacket
+	ListenPacket func(network, address string) (net.PacketConn, error)
+	// RedirectClient 用于将请求转发到 r 字段指定的地址
+	RedirectClient *http.Client
+	// AEAD 非空时只接受加密的数据帧，探测请求中会附带一个加密帧供客户端协商
+	AEAD *netrans.AEADCodec
+	// ResumeTimeout 全双工的承载请求断开后保留连接的时间，客户端可以在此期间恢复，为 0 时不支持恢复
+	ResumeTimeout time.Duration
+	// Profile 请求的伪装方式，需要与客户端一致，为空时使用与脚本相同的 raw
+	Profile camouflage.Profile
+	// Padding 为返回的每个数据帧加入随机长度的填充，客户端会忽略这个字段
+	Padding *core.Padding
+
+	sessions   sync.Map // id -> *session, 半双工模式下的连接
+	resumables sync.Map // id -> *resumableSession, 可恢复的全双工连接
+	accepted   sync.Map // id -> net.Conn, 反向监听接受后等待客户端接管的连接
+	offsets    sync.Map // url -> int64, 转发地址响应的偏移
+
+	tokenOnce  sync.Once
+	probeToken []byte
+	probeLimit probeLimiter
+}
+
+// NewHandler 创建一个使用默认配置的 Handler
+func NewHandler() *Handler {
+	return &Handler{
+		DialTimeout:   5 * time.Second,
+		ResumeTimeout: 90 * time.Second,
+	}
+}
+
+var errInvalidAction = errors.New("invalid action")
+
+type session struct {
+	mu   sync.Mutex
+	conn net.Conn
+	// udp 非空时这是一个 UDP 关联，conn 为空
+	udp *udpRelay
+}
+
+func (s *session) Close() error {
+	if s.udp != nil {
+		return s.udp.Close()
+	}
+	return s.conn.Close()
+}
+
+func (s *session) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn.Write(p)
+}
+
+func (s *session) CloseWrite() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	closeWrite(s.conn)
+}
+
+// drainTimeout 会话结束后等待客户端结束请求体的时间
+const drainTimeout = time.Second
+
+// drainRequest 在 drainTimeout 内读完全双工请求体剩余的部分，这样 handler 返回后客户端可以复用这个连接。
+// 调用前需要先关闭目标连接，客户端迟迟不结束请求体时不会一直占着目标
+func drainRequest(r *http.Request, rc *http.ResponseController) {
+	_ = rc.SetReadDeadline(time.Now().Add(drainTimeout))
+	_, _ = io.Copy(io.Discard, r.Body)
+}
+
+// closeWrite 客户端半关闭后关闭到目标连接的写入端，连接不支持时忽略
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.UserAgent != "" && r.UserAgent() != h.UserAgent {
+		return
+	}
+	if isWebSocket(r) {
+		h.serveWebSocket(w, r)
+		return
+	}
+	mode, body, ok := h.profile().Decode(r)
+	if !ok {
+		return
+	}
+	r.Body = h.newRequestBody(body, r.Body)
+
+	switch mode {
+	case camouflage.ModeCheck:
+		h.serveChecking(w, r)
+	case camouflage.ModeFull:
+		h.serveFull(w, r)
+	default:
+		h.serveHalf(w, r)
+	}
+}
+
+func (h *Handler) profile() camouflage.Profile {
+	if h.Profile != nil {
+		return h.Profile
+	}
+	profile, _ := camouflage.New(camouflage.Raw, "")
+	return profile
+}
+
+// requestBody 解码后的请求体，codec 按顺序校验其中连续的帧
+type requestBody struct {
+	io.Reader
+	io.Closer
+	codec netrans.Codec
+}
+
+func (h *Handler) newRequestBody(r io.Reader, c io.Closer) *requestBody {
+	return &requestBody{Reader: r, Closer: c, codec: netrans.NewStream(h.codec())}
+}
+
+// serveChecking 原样返回请求体的前 32 字节，客户端据此判断是否支持全双工以及响应的偏移
+func (h *Handler) serveChecking(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	_ = rc.EnableFullDuplex()
+
+	data := make([]byte, 32)
+	n, _ := io.ReadFull(r.Body, data)
+	_, _ = w.Write(data[:n])
+	// 探测请求没有经过认证，加密的是服务端自己生成的内容，并且限制速度
+	if h.AEAD != nil && n == len(data) && h.probeLimit.wait(r.Context()) == nil {
+		h.tokenOnce.Do(func() {
+			h.probeToken = []byte(core.RandString(32))
+		})
+		_, _ = w.Write(h.AEAD.Server().Encode(h.probeToken))
+	}
+	_ = rc.Flush()
+}
+
+const (
+	// probeInterval probeBurst 探测请求中生成加密帧的平均间隔和允许的突发数量
+	probeInterval = 50 * time.Millisecond
+	probeBurst    = 20
+)
+
+// probeLimiter 限制探测请求生成加密帧的速度，超出时等待
+type probeLimiter struct {
+	mu   sync.Mutex
+	next time.Time
+}
+
+func (l *probeLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	if earliest := now.Add(-probeBurst * probeInterval); l.next.Before(earliest) {
+		l.next = earliest
+	}
+	at := l.next
+	l.next = l.next.Add(probeInterval)
+	l.mu.Unlock()
+
+	delay := at.Sub(now)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *Handler) codec() netrans.Codec {
+	if h.AEAD != nil {
+		return core.NewPaddingCodec(h.AEAD.Server(), h.Padding)
+	}
+	return core.NewPaddingCodec(netrans.XORCodec, h.Padding)
+}
+
+func (h *Handler) dialTarget(r *http.Request, m map[string][]byte) (net.Conn, error) {
+	if id := string(m["a"]); id != "" {
+		return h.takeAccepted(id)
+	}
+	host := string(m["h"])
+	port := string(m["p"])
+	if port == "0" {
+		// 连接自身，客户端用这种方式测试隧道是否可用
+		port = localPort(r)
+	}
+	dial := h.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	timeout := h.DialTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	return dial(ctx, "tcp", net.JoinHostPort(host, port))
+}
+
+func localPort(r *http.Request) string {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			return port
+		}
+	}
+	if _, port, err := net.SplitHostPort(r.Host); err == nil {
+		return port
+	}
+	if r.TLS != nil {
+		return "443"
+	}
+	return "80"
+}
+
+// readBodyFrame 读取请求体中的下一帧
+func readBodyFrame(r *http.Request) (map[string][]byte, byte, error) {
+	body, ok := r.Body.(*requestBody)
+	if !ok {
+		return nil, 0, errInvalidAction
+	}
+	return readRequestFrame(body.codec, body)
+}
+
+func readRequestFrame(codec netrans.Codec, r io.Reader) (map[string][]byte, byte, error) {
+	fr, err := codec.ReadFrame(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	m, err := core.Unmarshal(fr.Data)
+	if err != nil {
+		return nil, 0, err
+	}
+	action := m["ac"]
+	if len(action) != 1 {
+		return nil, 0, errInvalidAction
+	}
+	return m, action[0], nil
+}
+
+// frameWriter 保证多个 goroutine 写响应时每一帧都是完整的，并在写完后立即刷新
+type frameWriter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	rc    *http.ResponseController
+	codec netrans.Codec
+}
+
+func (h *Handler) newFrameWriter(w http.ResponseWriter) *frameWriter {
+	return &frameWriter{w: w, rc: http.NewResponseController(w), codec: netrans.NewStream(h.codec())}
+}
+
+func (f *frameWriter) WriteFrame(m map[string][]byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.w.Write(core.BuildBodyWith(f.codec, m)); err != nil {
+		return err
+	}
+	return f.rc.Flush()
+}
+
+// pipeSocket 将目标连接的数据封装为数据帧写入响应，直到连接关闭，id 非空时每一帧都带上流的 id
+func pipeSocket(conn net.Conn, fw *frameWriter, id string) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			if werr := fw.WriteFrame(withID(newData(data), id)); werr != nil {
+				log.Debugf("write response error, %s", werr)
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func withID(m map[string][]byte, id string) map[string][]byte {
+	if id != "" {
+		m["id"] = []byte(id)
+	}
+	return m
+}
+
+func newStatus(b byte) map[string][]byte {
+	return map[string][]byte{"s": {b}}
+}
+
+func newData(data []byte) map[string][]byte {
+	return map[string][]byte{"ac": {core.ActionData}, "dt": data}
+}
+
+func newDel() map[string][]byte {
+	return map[string][]byte{"ac": {core.ActionDelete}}
+}
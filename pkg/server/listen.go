@@ -0,0 +1,115 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/PurpleNewNew/bs5/pkg/core"
+	log "github.com/kataras/golog"
+)
+
+const (
+	// acceptTimeout 接受的连接等待客户端接管的时间，超时后关闭
+	acceptTimeout = 30 * time.Second
+	// listenHeartbeatInterval 监听请求上没有新连接时定期发送心跳，避免响应被中间的代理超时断开
+	listenHeartbeatInterval = 10 * time.Second
+)
+
+var errNotAccepted = errors.New("no such accepted connection")
+
+// serveListen 反向转发，在服务端监听 h:p，每接受一个连接就在响应中发送一个 ActionListen 帧通知客户端，
+// 客户端用带有 a 字段的 ActionCreate 接管连接。请求断开时关闭监听，全双工时请求体结束也会关闭监听
+func (h *Handler) serveListen(w http.ResponseWriter, r *http.Request, m map[string][]byte, full bool) {
+	rc := http.NewResponseController(w)
+	_ = rc.EnableFullDuplex()
+	w.Header().Set("X-Accel-Buffering", "no")
+	fw := h.newFrameWriter(w)
+
+	listen := h.Listen
+	if listen == nil {
+		listen = net.Listen
+	}
+	lis, err := listen("tcp", net.JoinHostPort(string(m["h"]), string(m["p"])))
+	if err != nil {
+		log.Debugf("listen error, %s", err)
+		_ = fw.WriteFrame(newStatus(0x01))
+		return
+	}
+	defer lis.Close()
+	if err := fw.WriteFrame(newStatus(0x00)); err != nil {
+		return
+	}
+	log.Debugf("listening on %s", lis.Addr())
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+		_ = lis.Close()
+	}()
+	if full {
+		go func() {
+			defer lis.Close()
+			for {
+				if _, action, err := readBodyFrame(r); err != nil || action == core.ActionDelete {
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		t := time.NewTicker(listenHeartbeatInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := fw.WriteFrame(map[string][]byte{"ac": {core.ActionHeartbeat}}); err != nil {
+					_ = lis.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		id := core.RandString(8)
+		h.accepted.Store(id, conn)
+		time.AfterFunc(acceptTimeout, func() {
+			if h.accepted.CompareAndDelete(id, conn) {
+				log.Debugf("accepted connection %s expired", id)
+				_ = conn.Close()
+			}
+		})
+
+		host, port, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		notify := map[string][]byte{
+			"ac": {core.ActionListen},
+			"id": []byte(id),
+			"h":  []byte(host),
+			"p":  []byte(port),
+		}
+		if err := fw.WriteFrame(notify); err != nil {
+			return
+		}
+	}
+}
+
+// takeAccepted 取出等待接管的连接，每个连接只能被接管一次
+func (h *Handler) takeAccepted(id string) (net.Conn, error) {
+	v, ok := h.accepted.LoadAndDelete(id)
+	if !ok {
+		return nil, errNotAccepted
+	}
+	return v.(net.Conn), nil
+}
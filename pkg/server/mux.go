@@ -0,0 +1,323 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/PurpleNewNew/bs5/pkg/core"
+	log "github.com/kataras/golog"
+)
+
+// serveMux 多路复用模式，一个全双工请求承载多个流，每一帧通过 id 区分所属的流。
+// 流的创建与关闭不影响承载请求本身，请求结束时关闭其上所有的连接。
+// 读取请求的循环从不等待某一个流，flow 为 true 时双方按照 core.MuxWindow 控制每个流在途的数据
+func (h *Handler) serveMux(w http.ResponseWriter, r *http.Request, flow bool) {
+	rc := http.NewResponseController(w)
+	_ = rc.EnableFullDuplex()
+	w.Header().Set("X-Accel-Buffering", "no")
+	fw := h.newFrameWriter(w)
+	status := newStatus(0x00)
+	if flow {
+		status["fc"] = []byte{0x01}
+	}
+	if err := fw.WriteFrame(status); err != nil {
+		return
+	}
+
+	// streams 由读取循环维护，流结束时由各自的协程移除
+	var mu sync.Mutex
+	streams := make(map[string]*muxStream)
+	get := func(id string) (*muxStream, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		s, ok := streams[id]
+		return s, ok
+	}
+	remove := func(id string, s *muxStream) {
+		mu.Lock()
+		defer mu.Unlock()
+		if streams[id] == s {
+			delete(streams, id)
+		}
+	}
+	var wg sync.WaitGroup
+	defer func() {
+		mu.Lock()
+		for _, s := range streams {
+			s.close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	}()
+
+	for {
+		m, action, err := readBodyFrame(r)
+		if err != nil {
+			return
+		}
+		id := string(m["id"])
+		switch action {
+		case core.ActionCreate:
+			s := newMuxStream(flow)
+			mu.Lock()
+			if old, ok := streams[id]; ok {
+				old.close()
+			}
+			streams[id] = s
+			mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				h.serveMuxStream(r, fw, id, m, s)
+				// 返回时两个方向都已经结束，不需要等客户端的 ActionDelete
+				remove(id, s)
+			}()
+		case core.ActionData:
+			s, ok := get(id)
+			if ok && !s.push(m["dt"], core.IsCloseWrite(m)) {
+				// 客户端发送了超出窗口的数据，只重置这一个流
+				log.Debugf("mux stream %s write buffer overflow", id)
+				s.close()
+				remove(id, s)
+				ok = false
+			}
+			if !ok {
+				_ = fw.WriteFrame(withID(newDel(), id))
+			}
+		case core.ActionWindow:
+			if s, ok := get(id); ok {
+				if n, ok := core.WindowSize(m); ok {
+					s.grant(n)
+				}
+			}
+		case core.ActionDelete:
+			if s, ok := get(id); ok {
+				s.close()
+				remove(id, s)
+			}
+		case core.ActionHeartbeat:
+		default:
+			return
+		}
+	}
+}
+
+func (h *Handler) serveMuxStream(r *http.Request, fw *frameWriter, id string, m map[string][]byte, s *muxStream) {
+	conn, err := h.dialTarget(r, m)
+	if err != nil {
+		log.Debugf("dial target error, %s", err)
+		_ = fw.WriteFrame(withID(newStatus(0x01), id))
+		return
+	}
+	if !s.attach(conn) {
+		_ = conn.Close()
+		return
+	}
+	defer s.close()
+	if err := fw.WriteFrame(withID(newStatus(0x00), id)); err != nil {
+		return
+	}
+
+	go func() {
+		for {
+			data, cw, ok := s.pop()
+			if !ok {
+				return
+			}
+			if len(data) != 0 {
+				_ = conn.SetWriteDeadline(time.Now().Add(muxWriteTimeout))
+				if _, err := conn.Write(data); err != nil {
+					s.close()
+					return
+				}
+				if n := s.consume(len(data)); n != 0 {
+					_ = fw.WriteFrame(core.NewActionWindow(id, n))
+				}
+			}
+			if cw {
+				closeWrite(conn)
+			}
+		}
+	}()
+
+	if s.flow {
+		pipeMuxSocket(conn, fw, id, s)
+	} else {
+		pipeSocket(conn, fw, id)
+	}
+	_ = fw.WriteFrame(withID(newDel(), id))
+}
+
+// pipeMuxSocket 与 pipeSocket 相同，但是每次最多读取客户端窗口允许的长度
+func pipeMuxSocket(conn net.Conn, fw *frameWriter, id string, s *muxStream) {
+	buf := make([]byte, 32*1024)
+	for {
+		credit := s.waitCredit()
+		if credit == 0 {
+			return
+		}
+		n, err := conn.Read(buf[:min(credit, len(buf))])
+		if n > 0 {
+			s.spend(n)
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			if werr := fw.WriteFrame(withID(newData(data), id)); werr != nil {
+				log.Debugf("write response error, %s", werr)
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// muxWriteTimeout 写目标连接的超时时间，避免一个卡住的连接长期阻塞整个承载请求
+const muxWriteTimeout = 30 * time.Second
+
+// muxStream 承载请求上的一个流，上行数据先进入队列，由单独的协程写入目标连接，
+// 队列最多缓存 core.MuxWindow 字节，目标连接较慢时不会阻塞其他流
+type muxStream struct {
+	flow bool
+	done chan struct{}
+	once sync.Once
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	conn     net.Conn
+	queue    [][]byte
+	size     int
+	cw       bool
+	consumed int
+	credit   int
+}
+
+func newMuxStream(flow bool) *muxStream {
+	s := &muxStream{
+		flow:   flow,
+		done:   make(chan struct{}),
+		credit: core.MuxWindow,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// push 将数据加入队列，cw 表示数据写完后关闭目标连接的写入端。启用了流控时缓存的数据超过窗口返回 false，
+// 不支持流控的客户端不知道窗口的存在，这时等待队列腾出空间，和没有流控之前一样阻塞读取循环
+func (s *muxStream) push(data []byte, cw bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.flow && s.size != 0 && s.size+len(data) > core.MuxWindow && !s.closed() {
+		s.cond.Wait()
+	}
+	if s.flow && s.size+len(data) > core.MuxWindow {
+		return false
+	}
+	if len(data) != 0 {
+		s.queue = append(s.queue, data)
+		s.size += len(data)
+	}
+	s.cw = s.cw || cw
+	s.cond.Broadcast()
+	return true
+}
+
+// pop 等待队列中的下一段数据，队列为空且需要半关闭时返回 cw，流关闭后返回 false
+func (s *muxStream) pop() ([]byte, bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.queue) == 0 && !s.cw && !s.closed() {
+		s.cond.Wait()
+	}
+	if s.closed() {
+		return nil, false, false
+	}
+	if len(s.queue) == 0 {
+		s.cw = false
+		return nil, true, true
+	}
+	data := s.queue[0]
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+	return data, false, true
+}
+
+// consume 数据写入目标连接后释放队列空间，累计达到半个窗口时返回需要通知客户端的增量
+func (s *muxStream) consume(n int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.size -= n
+	s.cond.Broadcast()
+	if !s.flow {
+		return 0
+	}
+	s.consumed += n
+	if s.consumed < core.MuxWindow/2 {
+		return 0
+	}
+	n, s.consumed = s.consumed, 0
+	return n
+}
+
+func (s *muxStream) grant(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credit += n
+	s.cond.Broadcast()
+}
+
+// waitCredit 等待客户端的窗口，流关闭后返回 0
+func (s *muxStream) waitCredit() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.credit == 0 && !s.closed() {
+		s.cond.Wait()
+	}
+	if s.closed() {
+		return 0
+	}
+	return s.credit
+}
+
+func (s *muxStream) spend(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credit -= n
+}
+
+// closed 调用时需要持有 s.mu
+func (s *muxStream) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// attach 在连接建立后关联到流上，流已经被关闭时返回 false
+func (s *muxStream) attach(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	s.conn = conn
+	return true
+}
+
+func (s *muxStream) close() {
+	s.once.Do(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		close(s.done)
+		if s.conn != nil {
+			_ = s.conn.Close()
+		}
+		s.cond.Broadcast()
+	})
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/PurpleNewNew/bs5/pkg/camouflage"
+	"github.com/PurpleNewNew/bs5/pkg/core"
+	"github.com/PurpleNewNew/bs5/pkg/netrans"
+	log "github.com/kataras/golog"
+)
+
+var defaultRedirectClient = &http.Client{
+	Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// isLocalURL 判断 r 字段指向的是否就是当前服务，用于负载均衡场景下只转发打到其他节点上的请求。
+// 与脚本只比较 IP 不同，这里同时比较端口，这样同一台机器上的多个实例也能互相转发
+func (h *Handler) isLocalURL(r *http.Request, redirect string) bool {
+	u, err := url.Parse(redirect)
+	if err != nil {
+		return true
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if port != localPort(r) {
+		return false
+	}
+	ip := net.ParseIP(u.Hostname())
+	if ip == nil {
+		return false
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextHop 取出帧中的转发地址，跳过指向当前服务的部分，剩下的地址留在帧中交给下一跳处理。
+// 返回空字符串时由当前服务处理
+func (h *Handler) nextHop(r *http.Request, m map[string][]byte) string {
+	hops := core.RedirectHops(m)
+	for len(hops) != 0 && h.isLocalURL(r, hops[0]) {
+		hops = hops[1:]
+	}
+	if len(hops) == 0 {
+		core.SetRedirectHops(m, nil)
+		return ""
+	}
+	core.SetRedirectHops(m, hops[1:])
+	return hops[0]
+}
+
+// newRedirectRequest 使用与当前请求相同的请求头和伪装方式，将 body 包装为发往 redirect 的请求
+func (h *Handler) newRedirectRequest(r *http.Request, redirect string, mode camouflage.Mode, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, redirect, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range r.Header {
+		switch http.CanonicalHeaderKey(k) {
+		case "Content-Length", "Host", "Connection", "Content-Encoding", "Transfer-Encoding":
+			continue
+		}
+		req.Header[k] = v
+	}
+	if err := h.profile().Encode(req, mode, bytes.NewReader(body)); err != nil {
+		return nil, err
+	}
+	req.Close = true
+	return req, nil
+}
+
+// redirectCodec 对下一跳来说当前服务是客户端，加密时使用客户端方向的密钥，下一跳的响应原样回传给客户端
+func (h *Handler) redirectCodec() netrans.Codec {
+	if h.AEAD != nil {
+		return core.NewPaddingCodec(h.AEAD, h.Padding)
+	}
+	return h.codec()
+}
+
+// hopOffset 下一跳的响应之前可能也有页面自身的输出，第一次转发时像客户端一样发送探测请求确定偏移并缓存
+func (h *Handler) hopOffset(r *http.Request, client *http.Client, redirect string) (int64, error) {
+	if v, ok := h.offsets.Load(redirect); ok {
+		return v.(int64), nil
+	}
+	data := []byte(core.RandString(64))
+	req, err := h.newRedirectRequest(r, redirect, camouflage.ModeCheck, data)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	offset := bytes.Index(body, data[:32])
+	if offset == -1 {
+		return 0, fmt.Errorf("unexpected response of %s", redirect)
+	}
+	h.offsets.Store(redirect, int64(offset))
+	return int64(offset), nil
+}
+
+// serveRedirect 将去掉当前这一跳后的数据帧转发到指定地址，创建连接的请求需要把对方的响应持续回传
+func (h *Handler) serveRedirect(w http.ResponseWriter, r *http.Request, m map[string][]byte, action byte, redirect string) {
+	client := h.RedirectClient
+	if client == nil {
+		client = defaultRedirectClient
+	}
+	offset, err := h.hopOffset(r, client, redirect)
+	if err != nil {
+		log.Debugf("check redirect url %s error, %s", redirect, err)
+		return
+	}
+	// 重定向只在半双工模式下使用，按照相同的伪装方式重新包装数据帧
+	req, err := h.newRedirectRequest(r, redirect, camouflage.ModeHalf, core.BuildBodyWith(h.redirectCodec(), m))
+	if err != nil {
+		log.Debugf("build redirect request to %s error, %s", redirect, err)
+		return
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Debugf("redirect to %s error, %s", redirect, err)
+		return
+	}
+	defer resp.Body.Close()
+	// 去掉下一跳页面自身的输出，客户端只按第一跳的偏移处理
+	if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+		return
+	}
+
+	if action != core.ActionCreate {
+		// 批量请求需要把每一帧的处理结果带回给客户端
+		_, _ = io.Copy(w, resp.Body)
+		return
+	}
+	w.Header().Set("X-Accel-Buffering", "no")
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			_ = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/PurpleNewNew/bs5/pkg/core"
+	log "github.com/kataras/golog"
+)
+
+const (
+	// maxUnacked 未被客户端确认的下行数据上限，超过后暂停读取目标连接
+	maxUnacked = 4 * 1024 * 1024
+	// ackThreshold 收到的上行数据超过该值还没有确认时主动发送一次确认
+	ackThreshold = 64 * 1024
+	// resumeFrameSize 单个下行数据帧的最大长度
+	resumeFrameSize = 32 * 1024
+)
+
+// resumableSession 可恢复的全双工连接。目标连接与承载请求解耦，请求断开后连接保留 ResumeTimeout，
+// 客户端可以用 ActionResume 重新接上，未被确认的下行数据会从客户端已收到的位置开始重放
+type resumableSession struct {
+	h    *Handler
+	id   string
+	conn net.Conn
+
+	// connMu 保证上行数据按序号顺序写入目标连接
+	connMu sync.Mutex
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	sendBuf  []byte
+	sendBase uint64
+	sent     uint64
+	eof      bool
+	recvNext uint64
+	lastAck  uint64
+	gen      uint64
+	active   bool
+	closed   bool
+	timer    *time.Timer
+}
+
+func (h *Handler) newResumableSession(id string, conn net.Conn) *resumableSession {
+	s := &resumableSession{h: h, id: id, conn: conn}
+	s.cond = sync.NewCond(&s.mu)
+	if old, loaded := h.resumables.Swap(id, s); loaded {
+		old.(*resumableSession).close()
+	}
+	go s.pump()
+	return s
+}
+
+// pump 持续读取目标连接，数据保留到客户端确认为止
+func (s *resumableSession) pump() {
+	buf := make([]byte, 32*1024)
+	for {
+		s.mu.Lock()
+		for len(s.sendBuf) >= maxUnacked && !s.closed {
+			s.cond.Wait()
+		}
+		closed := s.closed
+		s.mu.Unlock()
+		if closed {
+			return
+		}
+
+		n, err := s.conn.Read(buf)
+		s.mu.Lock()
+		s.sendBuf = append(s.sendBuf, buf[:n]...)
+		if err != nil {
+			s.eof = true
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// attach 将会话接到新的承载请求上，旧的请求随之失效，ack 为客户端已经收到的字节数
+func (s *resumableSession) attach(ack uint64) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || ack < s.sendBase || ack > s.sendBase+uint64(len(s.sendBuf)) {
+		return 0, false
+	}
+	s.trim(ack)
+	s.sent = ack
+	s.gen++
+	s.active = true
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.cond.Broadcast()
+	return s.gen, true
+}
+
+// detach 承载请求结束，超过 ResumeTimeout 仍没有重新接上时关闭会话
+func (s *resumableSession) detach(gen uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gen != gen || !s.active {
+		return
+	}
+	s.active = false
+	s.cond.Broadcast()
+	if !s.closed {
+		s.timer = time.AfterFunc(s.h.ResumeTimeout, func() {
+			s.mu.Lock()
+			expired := !s.active
+			s.mu.Unlock()
+			if expired {
+				log.Debugf("session %s expired", s.id)
+				s.close()
+			}
+		})
+	}
+}
+
+func (s *resumableSession) close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.h.resumables.CompareAndDelete(s.id, s)
+	_ = s.conn.Close()
+}
+
+// trim 调用时需要持有 s.mu
+func (s *resumableSession) trim(ack uint64) {
+	if ack <= s.sendBase || ack > s.sendBase+uint64(len(s.sendBuf)) {
+		return
+	}
+	s.sendBuf = s.sendBuf[ack-s.sendBase:]
+	s.sendBase = ack
+	s.cond.Broadcast()
+}
+
+// writeLoop 将目标连接的数据写入当前的承载请求，请求被替换、会话关闭或写入失败时返回
+func (s *resumableSession) writeLoop(gen uint64, fw *frameWriter) {
+	for {
+		s.mu.Lock()
+		for {
+			if s.gen != gen || !s.active || s.closed {
+				s.mu.Unlock()
+				return
+			}
+			end := s.sendBase + uint64(len(s.sendBuf))
+			if s.sent < end || s.eof || s.recvNext-s.lastAck >= ackThreshold {
+				break
+			}
+			s.cond.Wait()
+		}
+
+		var m map[string][]byte
+		end := s.sendBase + uint64(len(s.sendBuf))
+		switch {
+		case s.sent < end:
+			start := s.sent - s.sendBase
+			n := uint64(len(s.sendBuf)) - start
+			if n > resumeFrameSize {
+				n = resumeFrameSize
+			}
+			data := make([]byte, n)
+			copy(data, s.sendBuf[start:start+n])
+			m = withID(newData(data), s.id)
+			core.SetUint64(m, "sq", s.sent)
+			s.sent += n
+		case s.eof:
+			m = withID(newDel(), s.id)
+		default:
+			m = map[string][]byte{"ac": {core.ActionHeartbeat}, "id": []byte(s.id)}
+		}
+		core.SetUint64(m, "ak", s.recvNext)
+		s.lastAck = s.recvNext
+		s.mu.Unlock()
+
+		if err := fw.WriteFrame(m); err != nil {
+			return
+		}
+		if m["ac"][0] == core.ActionDelete {
+			return
+		}
+	}
+}
+
+// readLoop 处理承载请求上的上行数据，按序号去掉客户端重放的重复部分
+func (s *resumableSession) readLoop(r *http.Request, rc *http.ResponseController) {
+	for {
+		m, action, err := readBodyFrame(r)
+		if err != nil {
+			return
+		}
+		if ack, ok := core.GetUint64(m, "ak"); ok {
+			s.mu.Lock()
+			s.trim(ack)
+			s.mu.Unlock()
+		}
+		switch action {
+		case core.ActionData:
+			if err := s.write(m); err != nil {
+				log.Debugf("write to target error, %s", err)
+				s.close()
+				return
+			}
+		case core.ActionDelete:
+			s.close()
+			drainRequest(r, rc)
+			return
+		case core.ActionHeartbeat:
+		default:
+			return
+		}
+	}
+}
+
+func (s *resumableSession) write(m map[string][]byte) error {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	data := m["dt"]
+	s.mu.Lock()
+	seq, ok := core.GetUint64(m, "sq")
+	if !ok {
+		seq = s.recvNext
+	}
+	if seq > s.recvNext {
+		s.mu.Unlock()
+		return errInvalidAction
+	}
+	if skip := s.recvNext - seq; skip < uint64(len(data)) {
+		data = data[skip:]
+	} else {
+		data = nil
+	}
+	s.recvNext += uint64(len(data))
+	if s.recvNext-s.lastAck >= ackThreshold {
+		s.cond.Broadcast()
+	}
+	s.mu.Unlock()
+	if len(data) != 0 {
+		if _, err := s.conn.Write(data); err != nil {
+			return err
+		}
+	}
+	if core.IsCloseWrite(m) {
+		closeWrite(s.conn)
+	}
+	return nil
+}
+
+// serveResumable 在承载请求上运行会话，直到请求断开或会话结束
+func (h *Handler) serveResumable(w http.ResponseWriter, r *http.Request, s *resumableSession, gen uint64, status map[string][]byte) {
+	rc := http.NewResponseController(w)
+	fw := h.newFrameWriter(w)
+	if err := fw.WriteFrame(status); err != nil {
+		s.detach(gen)
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer s.detach(gen)
+		s.readLoop(r, rc)
+	}()
+
+	s.writeLoop(gen, fw)
+	s.detach(gen)
+	_ = rc.SetReadDeadline(time.Now().Add(drainTimeout))
+	wg.Wait()
+}
+
+// serveResume 客户端用 ActionResume 重新接上之前的会话
+func (h *Handler) serveResume(w http.ResponseWriter, r *http.Request, m map[string][]byte) {
+	rc := http.NewResponseController(w)
+	_ = rc.EnableFullDuplex()
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	id := string(m["id"])
+	ack, _ := core.GetUint64(m, "ak")
+	v, ok := h.resumables.Load(id)
+	var gen uint64
+	if ok {
+		gen, ok = v.(*resumableSession).attach(ack)
+	}
+	if !ok {
+		log.Debugf("resume session %s failed", id)
+		_ = h.newFrameWriter(w).WriteFrame(newStatus(0x01))
+		_ = rc.SetReadDeadline(time.Now())
+		return
+	}
+	s := v.(*resumableSession)
+	s.mu.Lock()
+	status := newStatus(0x00)
+	core.SetUint64(status, "ak", s.recvNext)
+	s.mu.Unlock()
+	h.serveResumable(w, r, s, gen, status)
+}
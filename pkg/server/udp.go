@@ -0,0 +1,165 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/PurpleNewNew/bs5/pkg/core"
+	log "github.com/kataras/golog"
+)
+
+// udpRelay UDP 关联在服务端对应的 socket，客户端发来的数据报按 h、p 转发，收到的数据报带上来源地址返回
+type udpRelay struct {
+	conn net.PacketConn
+	once sync.Once
+}
+
+func (h *Handler) listenUDP() (*udpRelay, error) {
+	listen := h.ListenPacket
+	if listen == nil {
+		listen = net.ListenPacket
+	}
+	conn, err := listen("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	return &udpRelay{conn: conn}, nil
+}
+
+// writeTo 发送一个数据报，单个数据报发送失败不影响整个关联
+func (u *udpRelay) writeTo(m map[string][]byte) error {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(string(m["h"]), string(m["p"])))
+	if err != nil {
+		log.Debugf("resolve udp address error, %s", err)
+		return nil
+	}
+	if _, err := u.conn.WriteTo(m["dt"], addr); err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		log.Debugf("write udp datagram error, %s", err)
+	}
+	return nil
+}
+
+// pipe 将收到的数据报写入响应，直到 socket 关闭
+func (u *udpRelay) pipe(fw *frameWriter, id string) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := u.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		m := withID(newDatagram(udpAddr.IP.String(), udpAddr.Port, data), id)
+		if err := fw.WriteFrame(m); err != nil {
+			log.Debugf("write response error, %s", err)
+			return
+		}
+	}
+}
+
+func (u *udpRelay) Close() error {
+	var err error
+	u.once.Do(func() { err = u.conn.Close() })
+	return err
+}
+
+func newDatagram(host string, port int, data []byte) map[string][]byte {
+	return map[string][]byte{
+		"ac": {core.ActionDatagram},
+		"h":  []byte(host),
+		"p":  []byte(strconv.Itoa(port)),
+		"dt": data,
+	}
+}
+
+// serveFullUDP 全双工模式下的 UDP 关联，请求体承载上行的数据报，响应体承载下行的数据报
+func (h *Handler) serveFullUDP(r *http.Request, fw *frameWriter) {
+	relay, err := h.listenUDP()
+	if err != nil {
+		log.Debugf("listen udp error, %s", err)
+		_ = fw.WriteFrame(newStatus(0x01))
+		_ = fw.rc.SetReadDeadline(time.Now())
+		return
+	}
+	defer relay.Close()
+	if err := fw.WriteFrame(newStatus(0x00)); err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer relay.Close()
+		for {
+			m, action, err := readBodyFrame(r)
+			if err != nil {
+				return
+			}
+			switch action {
+			case core.ActionDatagram:
+				if err := relay.writeTo(m); err != nil {
+					return
+				}
+			case core.ActionHeartbeat:
+				continue
+			default:
+				return
+			}
+		}
+	}()
+
+	relay.pipe(fw, "")
+	_ = fw.WriteFrame(newDel())
+	_ = fw.rc.SetReadDeadline(time.Now())
+	wg.Wait()
+}
+
+// serveHalfUDP 半双工模式下的 UDP 关联，上行的数据报通过额外的请求发送
+func (h *Handler) serveHalfUDP(r *http.Request, id string, fw *frameWriter) {
+	relay, err := h.listenUDP()
+	if err != nil {
+		log.Debugf("listen udp error, %s", err)
+		_ = fw.WriteFrame(newStatus(0x01))
+		return
+	}
+	h.sessions.Store(id, &session{udp: relay})
+	defer func() {
+		h.sessions.Delete(id)
+		_ = relay.Close()
+	}()
+
+	if err := fw.WriteFrame(newStatus(0x00)); err != nil {
+		return
+	}
+
+	go func() {
+		<-r.Context().Done()
+		_ = relay.Close()
+	}()
+
+	relay.pipe(fw, "")
+	_ = fw.WriteFrame(newDel())
+}
+
+func (h *Handler) writeDatagram(id string, m map[string][]byte) error {
+	s, ok := h.sessions.Load(id)
+	if !ok {
+		return errNoSession
+	}
+	if s.(*session).udp == nil {
+		return errInvalidAction
+	}
+	return s.(*session).udp.writeTo(m)
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/PurpleNewNew/bs5/pkg/camouflage"
+	"golang.org/x/net/websocket"
+)
+
+// isWebSocket 请求是否为 WebSocket 的升级请求
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// serveWebSocket 升级为 WebSocket 后，第一个字节为请求的类型，之后的数据与全双工请求的请求体相同，
+// 每个返回的数据帧作为一个二进制消息发送
+func (h *Handler) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	s := websocket.Server{
+		// 不检查 Origin
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			mode := make([]byte, 1)
+			if _, err := io.ReadFull(ws, mode); err != nil {
+				return
+			}
+			body := io.NopCloser(ws)
+			r.Body = h.newRequestBody(body, body)
+			ww := &wsResponseWriter{ws: ws, header: make(http.Header)}
+			switch camouflage.Mode(mode[0]) {
+			case camouflage.ModeCheck:
+				h.serveChecking(ww, r)
+			case camouflage.ModeFull:
+				h.serveFull(ww, r)
+			}
+		},
+	}
+	s.ServeHTTP(w, r)
+}
+
+// wsResponseWriter 让全双工的处理逻辑把 WebSocket 连接当作响应使用
+type wsResponseWriter struct {
+	ws     *websocket.Conn
+	header http.Header
+}
+
+func (w *wsResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *wsResponseWriter) Write(p []byte) (int, error) {
+	return w.ws.Write(p)
+}
+
+// WriteHeader 升级后无法再返回状态码，忽略
+func (w *wsResponseWriter) WriteHeader(int) {}
+
+// FlushError 每次写入都是一个完整的消息，不需要刷新
+func (w *wsResponseWriter) FlushError() error {
+	return nil
+}
+
+func (w *wsResponseWriter) SetReadDeadline(t time.Time) error {
+	return w.ws.SetReadDeadline(t)
+}
+
+func (w *wsResponseWriter) EnableFullDuplex() error {
+	return nil
+}